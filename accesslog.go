@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Access log formats
+const (
+	LOG_TEXT = "text" // One human-readable line per request; the default
+	LOG_JSON = "json" // One JSON object per request, for log aggregators
+)
+
+// Keys under which request details are stored in the gin.Context
+const (
+	requestIDKey = "request_id"
+	clientIDKey  = "client_id"
+)
+
+// accessLogEntry is the JSON form of an access log line.
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	ClientID  string  `json:"client_id,omitempty"`
+	ClientIP  string  `json:"client_ip"`
+	Scheme    string  `json:"scheme"`
+}
+
+// accessLog creates a middleware which gives each request a unique id, echoes
+// it in an X-Request-ID header, and logs the request to out once it has been
+// handled. Handlers can find the id under requestIDKey, and may record the
+// client under clientIDKey.
+func accessLog(out io.Writer, format string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id, err := newUUID()
+		if err != nil {
+			respondError(c, 500, "Unknown Error", err.Error())
+			c.Abort()
+			return
+		}
+		c.Set(requestIDKey, id)
+		c.Header("X-Request-ID", id)
+
+		c.Next()
+
+		entry := accessLogEntry{
+			Time:      start.UTC().Format(time.RFC3339),
+			RequestID: id,
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Status:    c.Writer.Status(),
+			LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+			ClientID:  c.GetString(clientIDKey),
+			ClientIP:  clientIP(c),
+			Scheme:    requestScheme(c),
+		}
+
+		var line bytes.Buffer
+		if format == LOG_JSON {
+			json.NewEncoder(&line).Encode(entry)
+		} else {
+			fmt.Fprintf(&line, "%s | %3d | %8.3fms | %-7s %s | ip=%s client_id=%q request_id=%s\n",
+				entry.Time, entry.Status, entry.LatencyMS, entry.Method, entry.Path, entry.ClientIP, entry.ClientID, entry.RequestID)
+		}
+		out.Write(line.Bytes())
+	}
+}
+
+// newUUID generates a random (version 4) UUID, as per RFC 4122.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
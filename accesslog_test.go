@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var uuidRE = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestAccessLogJSON(t *testing.T) {
+	var out bytes.Buffer
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(accessLog(&out, LOG_JSON))
+	router.GET("/hello", func(c *gin.Context) {
+		c.Set(clientIDKey, "https://client.example")
+		c.String(201, "Hello")
+	})
+
+	w := get(router, "/hello?secret=1")
+	id := w.Header().Get("X-Request-ID")
+	if !uuidRE.MatchString(id) {
+		t.Errorf("response has X-Request-ID %q, which is not a UUID", id)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("access log line is not valid JSON: %s\n%s", err, out.String())
+	}
+
+	expected := map[string]interface{}{
+		"request_id": id,
+		"method":     "GET",
+		"path":       "/hello",
+		"status":     float64(201),
+		"client_id":  "https://client.example",
+		"client_ip":  "192.0.2.1",
+		"scheme":     "http",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("access log has %s=%v instead of %v", k, entry[k], v)
+		}
+	}
+
+	if _, ok := entry["latency_ms"].(float64); !ok {
+		t.Errorf("access log has no latency_ms: %s", out.String())
+	}
+
+	// Every request gets a new id
+	if get(router, "/hello").Header().Get("X-Request-ID") == id {
+		t.Error("two requests were given the same X-Request-ID")
+	}
+
+	if lines := strings.Count(out.String(), "\n"); lines != 2 {
+		t.Errorf("expected 2 access log lines, got %d", lines)
+	}
+}
+
+func TestAccessLogText(t *testing.T) {
+	var out bytes.Buffer
+	router := gin.New()
+	router.Use(accessLog(&out, LOG_TEXT))
+	router.GET("/hello", func(c *gin.Context) { c.String(200, "Hello") })
+
+	w := get(router, "/hello")
+	line := out.String()
+	for _, s := range []string{"200", "GET", "/hello", "request_id=" + w.Header().Get("X-Request-ID")} {
+		if !strings.Contains(line, s) {
+			t.Errorf("access log line does not contain %q: %s", s, line)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Results of sending a confirmation email, as recorded in an AuditRecord
+const (
+	auditSent   = "sent"
+	auditFailed = "failed"
+)
+
+// AuditConfig describes where to keep the audit log of confirmation emails.
+type AuditConfig struct {
+	// A file which records are appended to. If empty, nothing is recorded.
+	Path string `json:"path" env:"AUTHDAEMON_AUDIT_PATH"`
+
+	// Record a SHA-256 hash of each address, rather than the address itself
+	HashEmails bool `json:"hash_emails" env:"AUTHDAEMON_AUDIT_HASH_EMAILS"`
+}
+
+// AuditRecord describes an attempt to send a confirmation email.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Email     string    `json:"email"`
+	ClientID  string    `json:"client_id"`
+	RequestID string    `json:"request_id"`
+	Result    string    `json:"result"` // auditSent or auditFailed
+	Error     string    `json:"error,omitempty"`
+}
+
+// AuditLogger keeps a trail of the confirmation emails which were sent, and
+// which failed, apart from the access log.
+type AuditLogger interface {
+	Record(AuditRecord)
+}
+
+// mailRequest identifies the login a message is sent for, so that it can be
+// audited and logged alongside the request which asked for it, even once the
+// message is being sent in the background.
+type mailRequest struct {
+	RequestID string
+	ClientID  string
+}
+
+type mailRequestKey struct{}
+
+// withMailRequest returns a copy of ctx carrying req.
+func withMailRequest(ctx context.Context, req mailRequest) context.Context {
+	return context.WithValue(ctx, mailRequestKey{}, req)
+}
+
+// mailRequestFrom returns the mailRequest ctx carries, if any.
+func mailRequestFrom(ctx context.Context) mailRequest {
+	req, _ := ctx.Value(mailRequestKey{}).(mailRequest)
+	return req
+}
+
+// auditMailer is a Mailer which records each message it sends, or fails to,
+// once the underlying Mailer is done with it. A MailQueue should send through
+// one, rather than being wrapped by it, so that what's recorded is whether the
+// message was delivered, not just whether it was queued.
+type auditMailer struct {
+	mailer Mailer
+	audit  AuditLogger
+	clock  Clock
+}
+
+// newAuditMailer creates an auditMailer which sends through mailer, and
+// records to audit, with times told by clock.
+func newAuditMailer(mailer Mailer, audit AuditLogger, clock Clock) *auditMailer {
+	return &auditMailer{mailer: mailer, audit: audit, clock: clock}
+}
+
+// Send sends a message, and records whether it was sent for the request ctx
+// carries.
+func (m *auditMailer) Send(ctx context.Context, to, subject, textBody, htmlBody string) error {
+	err := m.mailer.Send(ctx, to, subject, textBody, htmlBody)
+
+	req := mailRequestFrom(ctx)
+	record := AuditRecord{
+		Time:      m.clock.Now(),
+		Email:     to,
+		ClientID:  req.ClientID,
+		RequestID: req.RequestID,
+		Result:    auditSent,
+	}
+	if err != nil {
+		record.Result, record.Error = auditFailed, err.Error()
+	}
+	m.audit.Record(record)
+
+	return err
+}
+
+// fileAuditLogger is an AuditLogger which writes each record as a line of
+// JSON.
+type fileAuditLogger struct {
+	hashEmails bool
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// newAuditLogger creates a fileAuditLogger appending to the file at
+// config.Path, which is created readable only by the current user if it
+// doesn't exist. If config.Path is empty, it returns nil.
+func newAuditLogger(config AuditConfig) (*fileAuditLogger, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileAuditLogger{hashEmails: config.HashEmails, out: f}, nil
+}
+
+// Record writes record as one line. An address is hashed after lowercasing,
+// so that each user has one hash, however they typed it.
+func (l *fileAuditLogger) Record(record AuditRecord) {
+	if l.hashEmails {
+		record.Email = hashEmail(record.Email)
+	}
+	record.Time = record.Time.UTC()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// hashEmail returns the hex SHA-256 of an email address, lowercased.
+func hashEmail(email string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(h[:])
+}
+
+// Close closes the file being written to.
+func (l *fileAuditLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if closer, ok := l.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
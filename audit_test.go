@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeAuditLogger keeps records in memory.
+type fakeAuditLogger struct {
+	records []AuditRecord
+}
+
+func (l *fakeAuditLogger) Record(record AuditRecord) {
+	l.records = append(l.records, record)
+}
+
+func TestEmailAudit(t *testing.T) {
+	tests := []struct {
+		description string
+		err         error
+		result      string
+	}{
+		{"a successful send", nil, auditSent},
+		{"a failed send", errors.New("connection refused"), auditFailed},
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	for _, test := range tests {
+		audit := &fakeAuditLogger{}
+		auth := newEmailAuthenticator("https://issuer.example", newAuditMailer(&fakeMailer{err: test.err}, audit, clock), newMemorySessionStore(SESSION_LIFETIME))
+
+		router := gin.New()
+		router.Use(accessLog(io.Discard, LOG_TEXT))
+		oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, auth)
+
+		w := postForm(router, "/authorize", validAuthForm())
+
+		if len(audit.records) != 1 {
+			t.Fatalf("%s produced %d audit records instead of 1", test.description, len(audit.records))
+		}
+
+		record := audit.records[0]
+		if record.Email != "foo@example.com" || record.ClientID != "https://client.example" || record.Result != test.result {
+			t.Errorf("%s produced the audit record %+v", test.description, record)
+		}
+		if record.RequestID == "" || record.RequestID != w.Header().Get("X-Request-ID") {
+			t.Errorf("%s was audited with request_id %q instead of %q", test.description, record.RequestID, w.Header().Get("X-Request-ID"))
+		}
+		if !record.Time.Equal(clock.Now()) {
+			t.Errorf("%s was audited at %s instead of %s", test.description, record.Time, clock.Now())
+		}
+		if (test.err == nil) != (record.Error == "") {
+			t.Errorf("%s was audited with error %q", test.description, record.Error)
+		}
+	}
+}
+
+func TestQueuedEmailAudit(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The login succeeds once the message is queued
+	audit := &fakeAuditLogger{}
+	queue := newMailQueue(newAuditMailer(&fakeMailer{err: errors.New("connection refused")}, audit, realClock{}), 1, 1)
+	router := gin.New()
+	router.Use(accessLog(io.Discard, LOG_TEXT))
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, newEmailAuthenticator("https://issuer.example", queue, newMemorySessionStore(SESSION_LIFETIME)))
+
+	w := postForm(router, "/authorize", validAuthForm())
+	if w.Code != 200 {
+		t.Fatalf("POST /authorize with room in the mail queue returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// But it's audited as failed once the worker fails to send it
+	queue.Close(context.Background())
+	if len(audit.records) != 1 {
+		t.Fatalf("a queued message produced %d audit records instead of 1", len(audit.records))
+	}
+	if record := audit.records[0]; record.Result != auditFailed || record.RequestID != w.Header().Get("X-Request-ID") || record.ClientID != "https://client.example" {
+		t.Errorf("a queued message which couldn't be sent produced the audit record %+v", record)
+	}
+}
+
+func TestFileAuditLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for _, hash := range []bool{false, true} {
+		audit, err := newAuditLogger(AuditConfig{Path: path, HashEmails: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		audit.Record(AuditRecord{Email: "Foo@example.com", ClientID: "https://client.example", Result: auditSent})
+		if err := audit.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Each logger appends to the file, rather than replacing it
+	var emails []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("audit log has a line which isn't JSON: %s", scanner.Text())
+		}
+		emails = append(emails, record.Email)
+	}
+
+	expected := []string{"Foo@example.com", hashEmail("foo@example.com")}
+	if len(emails) != 2 || emails[0] != expected[0] || emails[1] != expected[1] {
+		t.Errorf("audit log has emails %q instead of %q", emails, expected)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("audit log was created with mode %v instead of 0600", info.Mode().Perm())
+	}
+
+	if audit, err := newAuditLogger(AuditConfig{}); audit != nil || err != nil {
+		t.Errorf("newAuditLogger without a path returned %v, %v instead of nil", audit, err)
+	}
+}
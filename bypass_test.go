@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authorizeRun submits validAuthForm to a server started by startRun, and
+// returns the response body.
+func authorizeRun(t *testing.T, cfg Config) string {
+	startRun(t, cfg, http.DefaultClient, "http")
+
+	resp, err := http.PostForm(fmt.Sprintf("http://127.0.0.1:%d/authorize", cfg.Port), validAuthForm())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /authorize returned %d: %s", resp.StatusCode, body)
+	}
+
+	return string(body)
+}
+
+func TestRunBypass(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Address = "127.0.0.1"
+	cfg.Port = freePort(t)
+	cfg.AuthMode = AUTH_BYPASS
+	cfg.InsecureAllowBypass = true
+
+	action, params := parseFormPost(t, authorizeRun(t, cfg))
+	if action != "https://client.example/callback" {
+		t.Errorf("bypass login posts to %q instead of the redirect_uri", action)
+	}
+
+	// The signature is checked elsewhere; here only the claims matter
+	parts := strings.Split(params.Get("id_token"), ".")
+	if len(parts) != 3 {
+		t.Fatalf("bypass login did not return an id_token: %v", params)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var claims IDToken
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Email != "foo@example.com" || claims.Nonce != "n-0S6_WzA2Mj" {
+		t.Errorf("bypass login issued unexpected claims: %+v", claims)
+	}
+}
+
+func TestBypassOffByDefault(t *testing.T) {
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.AuthMode != AUTH_EMAIL || cfg.InsecureAllowBypass {
+		t.Fatalf("default config has auth_mode %q and insecure_allow_bypass %t", cfg.AuthMode, cfg.InsecureAllowBypass)
+	}
+
+	cfg.Address = "127.0.0.1"
+	cfg.Port = freePort(t)
+
+	if body := authorizeRun(t, cfg); !strings.Contains(body, "Check your email") || strings.Contains(body, "id_token") {
+		t.Errorf("POST /authorize did not ask the user to check their email: %s", body)
+	}
+}
+
+func TestBypassPKCE(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, newBypassAuthenticator())
+
+	// Bypassed logins finish in the authorization request, so that's where
+	// the verifier is checked
+	verifier := "dBjftJeZ4CVP-mJ92K9ZVqNhn0gtLVQTo2NKJpRjdV0"
+	tests := []struct {
+		description string
+		verifier    string
+		ok          bool
+	}{
+		{"the matching verifier", verifier, true},
+		{"a different verifier", strings.ToUpper(verifier), false},
+		{"no verifier", "", false},
+	}
+
+	for _, test := range tests {
+		form := validAuthForm()
+		form.Set("code_challenge", "lJhBIgJzn9ty8k15Z3ssytxRJ7rUIpGYGJeNVq7mM08")
+		form.Set("code_challenge_method", "S256")
+		if test.verifier != "" {
+			form.Set("code_verifier", test.verifier)
+		}
+
+		w := postForm(router, "/authorize", form)
+		if !test.ok {
+			if w.Code != 400 || !strings.Contains(w.Body.String(), "code_verifier") {
+				t.Errorf("POST /authorize with %s returned %d: %s", test.description, w.Code, w.Body.String())
+			}
+			continue
+		}
+
+		if w.Code != 200 {
+			t.Fatalf("POST /authorize with %s returned %d: %s", test.description, w.Code, w.Body.String())
+		}
+		_, params := parseFormPost(t, w.Body.String())
+		verifiedClaims(t, params.Get("id_token"), &key.PublicKey)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/callahad/authdaemon/internal/validation"
+	"github.com/square/go-jose"
+)
+
+// ClientRegistry restricts which clients may log users in. Each entry is an
+// exact origin like https://client.example, or a wildcard like
+// https://*.example.com which matches any subdomain of example.com, but not
+// example.com itself.
+//
+// Clients may also have redirect URIs registered, in which case their
+// authorization requests must use one of them exactly, rather than any url
+// within their origin, or path prefixes, in which case they may use any url
+// at or beneath one of those paths. Those with a secret may authenticate to endpoints like
+// token introspection, which aren't for browsers, and those with public keys
+// may sign their authorization requests as request objects.
+type ClientRegistry struct {
+	allowAll  bool // No origins were listed, only redirect URIs, secrets, or keys
+	origins   []string
+	wildcards []wildcardOrigin
+	redirects map[string][]string           // Registered redirect URIs, by origin
+	prefixes  map[string][]string           // Registered redirect URI prefixes, by origin
+	secrets   map[string]string             // Client secrets, by origin
+	keys      map[string]jose.JsonWebKeySet // Public keys, by origin
+}
+
+// wildcardOrigin is the parsed form of an entry like https://*.example.com:8443.
+type wildcardOrigin struct {
+	scheme string
+	suffix string // Like ".example.com"
+	port   string
+}
+
+// newClientRegistry creates a ClientRegistry from a list of allowed origins,
+// a list of redirect URIs and a list of redirect URI prefixes, each
+// registered for the client whose origin it's in, a list of secrets like
+// https://client.example=secret, and a list of key files like
+// https://client.example=/path/to/client.jwks. If the first list is empty,
+// every client is allowed, and if all are, it returns nil.
+func newClientRegistry(allowed []string, redirectURIs []string, redirectPrefixes []string, secrets []string, keys []string) (*ClientRegistry, error) {
+	if len(allowed) == 0 && len(redirectURIs) == 0 && len(redirectPrefixes) == 0 && len(secrets) == 0 && len(keys) == 0 {
+		return nil, nil
+	}
+
+	registry := &ClientRegistry{allowAll: len(allowed) == 0}
+	for _, entry := range allowed {
+		wildcard := strings.Contains(entry, "://*.")
+
+		// Check the entry's syntax with a stand-in for the wildcard
+		if !validation.OnlyOrigin(strings.Replace(entry, "://*.", "://x.", 1)) {
+			return nil, fmt.Errorf("Client %q must be an origin like https://client.example or https://*.example.com", entry)
+		}
+
+		if !wildcard {
+			registry.origins = append(registry.origins, strings.ToLower(entry))
+			continue
+		}
+
+		u, _ := url.Parse(strings.Replace(entry, "://*.", "://x.", 1))
+		registry.wildcards = append(registry.wildcards, wildcardOrigin{
+			scheme: u.Scheme,
+			suffix: strings.ToLower(strings.TrimPrefix(u.Hostname(), "x")),
+			port:   u.Port(),
+		})
+	}
+
+	for _, uri := range redirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !validation.ValidURI(uri) || u.Fragment != "" {
+			return nil, fmt.Errorf("Redirect URI %q must be an absolute url without a fragment", uri)
+		}
+
+		origin := originKey(uri)
+		if !registry.Allowed(origin) {
+			return nil, fmt.Errorf("Redirect URI %q is not within any allowed client's origin", uri)
+		}
+
+		if registry.redirects == nil {
+			registry.redirects = map[string][]string{}
+		}
+		registry.redirects[origin] = append(registry.redirects[origin], uri)
+	}
+
+	for _, prefix := range redirectPrefixes {
+		u, err := url.Parse(prefix)
+		if err != nil || !validation.ValidURI(prefix) || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+			return nil, fmt.Errorf("Redirect URI prefix %q must be an absolute url without a query or fragment", prefix)
+		}
+
+		origin := originKey(prefix)
+		if !registry.Allowed(origin) {
+			return nil, fmt.Errorf("Redirect URI prefix %q is not within any allowed client's origin", prefix)
+		}
+
+		if registry.prefixes == nil {
+			registry.prefixes = map[string][]string{}
+		}
+		registry.prefixes[origin] = append(registry.prefixes[origin], prefix)
+	}
+
+	for _, entry := range secrets {
+		clientID, secret, _ := strings.Cut(entry, "=")
+		if !registry.Allowed(clientID) {
+			return nil, fmt.Errorf("Client secret for %q must be for an allowed client's origin", clientID)
+		}
+
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("Client secret for %q must be at least 16 characters", clientID)
+		}
+
+		if registry.secrets == nil {
+			registry.secrets = map[string]string{}
+		}
+		registry.secrets[strings.ToLower(clientID)] = secret
+	}
+
+	for _, entry := range keys {
+		clientID, path, _ := strings.Cut(entry, "=")
+		if !registry.Allowed(clientID) {
+			return nil, fmt.Errorf("Client keys for %q must be for an allowed client's origin", clientID)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read client keys for %q: %s", clientID, err)
+		}
+
+		set, err := parseClientKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse client keys for %q from %s: %s", clientID, path, err)
+		}
+
+		if registry.keys == nil {
+			registry.keys = map[string]jose.JsonWebKeySet{}
+		}
+		clientID = strings.ToLower(clientID)
+		registry.keys[clientID] = jose.JsonWebKeySet{Keys: append(registry.keys[clientID].Keys, set.Keys...)}
+	}
+
+	return registry, nil
+}
+
+// parseClientKeys reads a JWK Set, or a single PEM public key, which has no
+// kid. Only public keys are accepted, so that clients' private keys aren't
+// left lying around.
+func parseClientKeys(data []byte) (jose.JsonWebKeySet, error) {
+	var set jose.JsonWebKeySet
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if err := json.Unmarshal(data, &set); err != nil {
+			return set, err
+		}
+	} else {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			return set, errors.New("neither a JWK Set nor a PEM public key")
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return set, err
+		}
+		set.Keys = []jose.JsonWebKey{{Key: key}}
+	}
+
+	if len(set.Keys) == 0 {
+		return set, errors.New("no keys found")
+	}
+	for _, key := range set.Keys {
+		if !key.IsPublic() {
+			return set, errors.New("only public keys may be given")
+		}
+	}
+
+	return set, nil
+}
+
+// Allowed reports whether clientID may log users in. A nil ClientRegistry
+// allows every client.
+func (r *ClientRegistry) Allowed(clientID string) bool {
+	if r == nil {
+		return true
+	}
+
+	if !validation.OnlyOrigin(clientID) {
+		return false
+	}
+
+	if r.allowAll {
+		return true
+	}
+
+	if contains(r.origins, strings.ToLower(clientID)) {
+		return true
+	}
+
+	u, err := url.Parse(clientID)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, w := range r.wildcards {
+		if u.Scheme == w.scheme && u.Port() == w.port && strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RedirectAllowed reports whether clientID may receive responses at
+// redirectURI. If it has any redirect URIs registered, redirectURI must be
+// exactly one of them, or else be within one of its prefixes, as
+// validation.ContainedByPath checks. Otherwise, it need only be within
+// clientID's origin.
+func (r *ClientRegistry) RedirectAllowed(clientID string, redirectURI string) bool {
+	if registered := r.redirectURIs(clientID); registered != nil {
+		return contains(registered, redirectURI)
+	}
+
+	if prefixes := r.redirectPrefixes(clientID); prefixes != nil {
+		for _, prefix := range prefixes {
+			if validation.ContainedByPath(redirectURI, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return validation.ContainedBy(redirectURI, clientID)
+}
+
+// redirectURIs returns the redirect URIs registered for clientID, if any.
+func (r *ClientRegistry) redirectURIs(clientID string) []string {
+	if r == nil {
+		return nil
+	}
+
+	return r.redirects[originKey(clientID)]
+}
+
+// redirectPrefixes returns the redirect URI prefixes registered for clientID,
+// if any.
+func (r *ClientRegistry) redirectPrefixes(clientID string) []string {
+	if r == nil {
+		return nil
+	}
+
+	return r.prefixes[originKey(clientID)]
+}
+
+// originKey returns the origin of uri as the registry keys it: with the scheme
+// lowercased, and the host normalized as validation.SameHost compares it, so
+// that https://CLIENT.example. and https://client.example are the same client.
+func originKey(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	host := validation.NormalizeHost(u.Hostname())
+	if ip := net.ParseIP(host); ip != nil && strings.Contains(host, ":") {
+		host = "[" + ip.String() + "]"
+	}
+	if u.Port() != "" {
+		host += ":" + u.Port()
+	}
+
+	return strings.ToLower(u.Scheme) + "://" + host
+}
+
+// Authenticate reports whether secret is clientID's registered secret.
+// Clients without one, including every client of a nil ClientRegistry, can't
+// authenticate.
+func (r *ClientRegistry) Authenticate(clientID string, secret string) bool {
+	if r == nil {
+		return false
+	}
+
+	expected, ok := r.secrets[strings.ToLower(clientID)]
+	return ok && secretsEqual(secret, expected)
+}
+
+// hasSecrets reports whether any client can authenticate.
+func (r *ClientRegistry) hasSecrets() bool {
+	return r != nil && len(r.secrets) > 0
+}
+
+// Keys returns the public keys registered for clientID whose kid is kid, as
+// well as any without a kid.
+func (r *ClientRegistry) Keys(clientID string, kid string) []jose.JsonWebKey {
+	if r == nil {
+		return nil
+	}
+
+	var matches []jose.JsonWebKey
+	for _, key := range r.keys[strings.ToLower(clientID)].Keys {
+		if key.KeyID == kid || key.KeyID == "" {
+			matches = append(matches, key)
+		}
+	}
+	return matches
+}
+
+// hasKeys reports whether any client can sign request objects.
+func (r *ClientRegistry) hasKeys() bool {
+	return r != nil && len(r.keys) > 0
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestClientRegistry(t *testing.T) {
+	registry, err := newClientRegistry([]string{
+		"https://client.example",
+		"http://localhost:8080",
+		"https://*.example.com",
+		"https://*.apps.example.org:8443",
+	}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := []string{
+		// Exact matches
+		"https://client.example",
+		"https://CLIENT.example",
+		"http://localhost:8080",
+
+		// Subdomain wildcards
+		"https://app.example.com",
+		"https://deep.app.example.com",
+		"https://app.apps.example.org:8443",
+	}
+
+	rejected := []string{
+		// Not in the list
+		"https://evil.example",
+		"https://client.example.evil.example",
+
+		// Scheme or port mismatches
+		"http://client.example",
+		"https://client.example:8443",
+		"http://localhost",
+		"http://app.example.com",
+		"https://app.apps.example.org",
+
+		// Wildcards only match subdomains
+		"https://example.com",
+		"https://evilexample.com",
+		"https://apps.example.org:8443",
+
+		// Not origins
+		"https://client.example/path",
+		"not a url",
+	}
+
+	for _, clientID := range allowed {
+		if !registry.Allowed(clientID) {
+			t.Errorf("ClientRegistry.Allowed(%q) unexpectedly returned false", clientID)
+		}
+	}
+
+	for _, clientID := range rejected {
+		if registry.Allowed(clientID) {
+			t.Errorf("ClientRegistry.Allowed(%q) unexpectedly returned true", clientID)
+		}
+	}
+}
+
+func TestClientRegistryUnconfigured(t *testing.T) {
+	registry, err := newClientRegistry(nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !registry.Allowed("https://anyone.example") {
+		t.Error("an unconfigured ClientRegistry rejected a client")
+	}
+}
+
+func TestClientRegistryErrors(t *testing.T) {
+	for _, entry := range []string{"client.example", "https://client.example/path", "https://*", "https://foo.*.example.com", "ftp://client.example"} {
+		if _, err := newClientRegistry([]string{entry}, nil, nil, nil, nil); err == nil {
+			t.Errorf("newClientRegistry(%q) unexpectedly succeeded", entry)
+		}
+	}
+}
+
+func TestClientRegistryRedirectURIs(t *testing.T) {
+	registry, err := newClientRegistry([]string{"https://client.example", "https://*.example.com"}, []string{
+		"https://client.example/callback",
+		"https://client.example/other?via=login",
+		"https://app.example.com/callback",
+	}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		clientID    string
+		redirectURI string
+		expected    bool
+	}{
+		// Exact matches
+		{"https://client.example", "https://client.example/callback", true},
+		{"https://client.example", "https://client.example/other?via=login", true},
+		{"https://APP.example.com", "https://app.example.com/callback", true},
+
+		// Anything else, even within the origin
+		{"https://client.example", "https://client.example/", false},
+		{"https://client.example", "https://client.example/callback/", false},
+		{"https://client.example", "https://client.example/Callback", false},
+		{"https://client.example", "https://client.example/callback?next=evil", false},
+		{"https://client.example", "https://client.example/other", false},
+		{"https://app.example.com", "https://app.example.com/", false},
+
+		// Clients without any registered fall back to their origin
+		{"https://other.example.com", "https://other.example.com/anywhere", true},
+		{"https://other.example.com", "https://evil.example/anywhere", false},
+	}
+
+	for _, test := range tests {
+		if actual := registry.RedirectAllowed(test.clientID, test.redirectURI); actual != test.expected {
+			t.Errorf("ClientRegistry.RedirectAllowed(%q, %q) returned %t instead of %t", test.clientID, test.redirectURI, actual, test.expected)
+		}
+	}
+
+	// Redirect URIs alone don't restrict which clients are allowed
+	registry, err = newClientRegistry(nil, []string{"https://client.example/callback"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !registry.Allowed("https://anyone.example") || !registry.RedirectAllowed("https://anyone.example", "https://anyone.example/cb") {
+		t.Error("a ClientRegistry with only redirect URIs rejected another client")
+	}
+	if registry.RedirectAllowed("https://client.example", "https://client.example/elsewhere") {
+		t.Error("a ClientRegistry with only redirect URIs allowed an unregistered one")
+	}
+
+	// Other spellings of the same origin are held to the same redirect URIs
+	for _, clientID := range []string{"https://client.example.", "https://CLIENT.example", "HTTPS://client.example."} {
+		if registry.RedirectAllowed(clientID, "https://client.example./elsewhere") || registry.RedirectAllowed(clientID, clientID+"/elsewhere") {
+			t.Errorf("a ClientRegistry allowed an unregistered redirect URI for %s", clientID)
+		}
+		if !registry.RedirectAllowed(clientID, "https://client.example/callback") {
+			t.Errorf("a ClientRegistry rejected the registered redirect URI for %s", clientID)
+		}
+	}
+}
+
+func TestClientRegistryRedirectURIErrors(t *testing.T) {
+	for _, uri := range []string{"/callback", "https://client.example/#fragment", "https://other.example/callback", "ftp://client.example/"} {
+		if _, err := newClientRegistry([]string{"https://client.example"}, []string{uri}, nil, nil, nil); err == nil {
+			t.Errorf("newClientRegistry with redirect URI %q unexpectedly succeeded", uri)
+		}
+	}
+}
+
+func TestClientRegistryRedirectPrefixes(t *testing.T) {
+	registry, err := newClientRegistry(nil, []string{"https://exact.example/callback"}, []string{
+		"https://client.example/callback",
+		"https://client.example/oauth/",
+		"https://exact.example/anything",
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		clientID    string
+		redirectURI string
+		expected    bool
+	}{
+		// Within a prefix
+		{"https://client.example", "https://client.example/callback", true},
+		{"https://client.example", "https://client.example/callback/google?via=login", true},
+		{"https://client.example", "https://client.example/oauth/return", true},
+		{"https://client.example.", "https://client.example/callback", true},
+
+		// Outside them, if only just
+		{"https://client.example", "https://client.example/callbackevil", false},
+		{"https://client.example", "https://client.example/callback/../admin", false},
+		{"https://client.example", "https://client.example/callback/%2e%2e/admin", false},
+		{"https://client.example", "https://client.example/admin", false},
+		{"https://client.example.", "https://client.example./admin", false},
+
+		// Exact redirect URIs take precedence
+		{"https://exact.example", "https://exact.example/callback", true},
+		{"https://exact.example", "https://exact.example/anything", false},
+
+		// Other clients may use their whole origin
+		{"https://other.example", "https://other.example/anywhere", true},
+	}
+
+	for _, test := range tests {
+		if actual := registry.RedirectAllowed(test.clientID, test.redirectURI); actual != test.expected {
+			t.Errorf("ClientRegistry.RedirectAllowed(%q, %q) returned %t instead of %t", test.clientID, test.redirectURI, actual, test.expected)
+		}
+	}
+
+	for _, prefix := range []string{"/callback", "https://client.example/callback?x=1", "https://client.example/#fragment", "https://other.example/callback"} {
+		if _, err := newClientRegistry([]string{"https://client.example"}, nil, []string{prefix}, nil, nil); err == nil {
+			t.Errorf("newClientRegistry with redirect URI prefix %q unexpectedly succeeded", prefix)
+		}
+	}
+}
+
+func TestAuthorizeRegisteredRedirect(t *testing.T) {
+	router, key := newEmailTestRouter(t, &fakeMailer{})
+	clients, err := newClientRegistry(nil, []string{"https://client.example/callback"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oidcAddRoutes(router.Group("/restricted"), ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Clients: clients}, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME)))
+
+	form := validAuthForm()
+	form.Set("redirect_uri", "https://client.example/callback")
+	if w := postForm(router, "/restricted/authorize", form); w.Code != 200 {
+		t.Errorf("POST /authorize with a registered redirect_uri returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// Errors aren't redirected to unregistered urls either
+	for _, scope := range []string{"openid email", "email"} {
+		form.Set("redirect_uri", "https://client.example/elsewhere")
+		form.Set("scope", scope)
+		w := postForm(router, "/restricted/authorize", form)
+		if w.Code != 400 || w.Header().Get("Location") != "" {
+			t.Errorf("POST /authorize with an unregistered redirect_uri and scope %q returned %d with Location %q, instead of 400", scope, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	other := validAuthForm()
+	other.Set("client_id", "https://other.example")
+	other.Set("redirect_uri", "https://other.example/anywhere")
+	if w := postForm(router, "/restricted/authorize", other); w.Code != 200 {
+		t.Errorf("POST /authorize for a client without registered redirect URIs returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthorizeUnauthorizedClient(t *testing.T) {
+	router, key := newEmailTestRouter(t, &fakeMailer{})
+	clients, _ := newClientRegistry([]string{"https://client.example"}, nil, nil, nil, nil)
+	oidcAddRoutes(router.Group("/restricted"), ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Clients: clients}, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME)))
+
+	if w := postForm(router, "/restricted/authorize", validAuthForm()); w.Code != 200 {
+		t.Errorf("POST /authorize for an allowed client returned %d: %s", w.Code, w.Body.String())
+	}
+
+	form := validAuthForm()
+	form.Set("client_id", "https://other.example")
+	form.Set("redirect_uri", "https://other.example/callback")
+	w := postForm(router, "/restricted/authorize", form)
+	if w.Code != 302 {
+		t.Fatalf("POST /authorize for a disallowed client returned %d instead of 302", w.Code)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := location.Query().Get("error"); code != "unauthorized_client" {
+		t.Errorf("POST /authorize for a disallowed client returned error=%q instead of unauthorized_client", code)
+	}
+}
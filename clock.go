@@ -0,0 +1,16 @@
+package main
+
+import "time"
+
+// Clock tells the current time. Anything which checks expiry or stamps a time
+// takes one, rather than calling time.Now, so that tests can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the Clock used outside of tests.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/callahad/authdaemon/internal/validation"
+)
+
+// Config holds the daemon's settings. Each field may be set in a JSON config
+// file under its `json` key, and overridden by the first environment variable
+// listed in its `env` tag which is present.
+type Config struct {
+	Origin  string `json:"origin" env:"AUTHDAEMON_ORIGIN"`
+	Address string `json:"address" env:"AUTHDAEMON_ADDRESS"`
+	Port    int    `json:"port" env:"AUTHDAEMON_PORT,PORT"`
+
+	// Either "https" or, for developing locally without TLS, "http". The
+	// issuer and every endpoint url use it.
+	Scheme string `json:"scheme" env:"AUTHDAEMON_SCHEME"`
+
+	// A path to listen on as a Unix domain socket instead of address and
+	// port, for a reverse proxy on the same machine. Any stale socket left
+	// there is replaced.
+	Socket string `json:"socket" env:"AUTHDAEMON_SOCKET"`
+
+	// A path like /auth which every endpoint is under, and which is part of
+	// the issuer, for serving behind a reverse proxy alongside other things.
+	// Empty serves them at the root.
+	BasePath string `json:"base_path" env:"AUTHDAEMON_BASE_PATH"`
+
+	// IP addresses or CIDR ranges of reverse proxies whose X-Forwarded-For
+	// and X-Forwarded-Proto headers are believed. Empty believes no one.
+	TrustedProxies []string `json:"trusted_proxies" env:"AUTHDAEMON_TRUSTED_PROXIES"`
+
+	// Either "text" or "json"
+	LogFormat string `json:"log_format" env:"AUTHDAEMON_LOG_FORMAT"`
+
+	// A directory of HTML templates to use instead of the built-in pages,
+	// named like those in templates/. Any not found there are built-in.
+	PagesDir string `json:"pages_dir" env:"AUTHDAEMON_PAGES_DIR"`
+
+	// What to serve at the base path: "page" for index.html, "none" for a
+	// 404, or a URL, like the site's home page, to redirect to
+	Index string `json:"index" env:"AUTHDAEMON_INDEX"`
+
+	// Where to keep the signing key, such as a mounted secret. If empty, and
+	// so is key_pem, a new key is generated on every start, invalidating
+	// previously issued tokens.
+	KeyPath string `json:"key_path" env:"AUTHDAEMON_KEY_PATH"`
+
+	// The PEM-encoded signing key itself, for platforms where files are
+	// awkward, unless key_path is set. Newlines may be escaped as \n.
+	KeyPEM string `json:"key_pem" env:"AUTHDAEMON_KEY_PEM"`
+
+	// Refuse to start without a key_path or key_pem, rather than generating
+	// a key which is lost on restart
+	RequirePersistentKey bool `json:"require_persistent_key" env:"AUTHDAEMON_REQUIRE_PERSISTENT_KEY"`
+
+	// Either "RS256" or "ES256"; must match the key at KeyPath or KeyPEM, if any
+	SigningAlg string `json:"signing_alg" env:"AUTHDAEMON_SIGNING_ALG"`
+
+	// The size in bits of RSA keys we generate: 2048, 3072, or 4096
+	KeySize int `json:"key_size" env:"AUTHDAEMON_KEY_SIZE"`
+
+	// How long each signing key is used for before a new one takes over, or
+	// zero to never rotate. Rotated keys aren't saved to KeyPath, so this is
+	// only for single instances which can live with restarts reverting to it.
+	KeyRotationInterval Duration `json:"key_rotation_interval" env:"AUTHDAEMON_KEY_ROTATION_INTERVAL"`
+
+	// How long new keys are published before they sign, and old keys after,
+	// which must cover both keyset_max_age and token_lifetime
+	KeyRotationGrace Duration `json:"key_rotation_grace" env:"AUTHDAEMON_KEY_ROTATION_GRACE"`
+
+	TokenLifetime   Duration `json:"token_lifetime" env:"AUTHDAEMON_TOKEN_LIFETIME"`
+	SessionLifetime Duration `json:"session_lifetime" env:"AUTHDAEMON_SESSION_LIFETIME"`
+
+	// How long confirmation links work for after they're emailed, which may
+	// be longer than session_lifetime for users slow to check their email
+	LinkLifetime Duration `json:"link_lifetime" env:"AUTHDAEMON_LINK_LIFETIME"`
+
+	ShutdownTimeout Duration `json:"shutdown_timeout" env:"AUTHDAEMON_SHUTDOWN_TIMEOUT"`
+
+	// The most sessions kept in memory, after which saving a new one evicts
+	// the oldest. Redis sessions are left to Redis's own maxmemory policy.
+	MaxSessions int `json:"max_sessions" env:"AUTHDAEMON_MAX_SESSIONS"`
+
+	// Limits on each connection and request
+	ReadTimeout  Duration `json:"read_timeout" env:"AUTHDAEMON_READ_TIMEOUT"`
+	WriteTimeout Duration `json:"write_timeout" env:"AUTHDAEMON_WRITE_TIMEOUT"`
+	IdleTimeout  Duration `json:"idle_timeout" env:"AUTHDAEMON_IDLE_TIMEOUT"`
+	MaxBodyBytes int      `json:"max_body_bytes" env:"AUTHDAEMON_MAX_BODY_BYTES"`
+
+	// How long starting a login may wait on upstream providers or the SMTP
+	// server before giving up
+	LoginTimeout Duration `json:"login_timeout" env:"AUTHDAEMON_LOGIN_TIMEOUT"`
+
+	// The longest state parameter accepted, in bytes
+	MaxStateLength int `json:"max_state_length" env:"AUTHDAEMON_MAX_STATE_LENGTH"`
+
+	// The longest nonce parameter accepted, in bytes
+	MaxNonceLength int `json:"max_nonce_length" env:"AUTHDAEMON_MAX_NONCE_LENGTH"`
+
+	// How long relying parties may cache the discovery document and JWK Set
+	// for. Zero makes them check for changes on every use.
+	DiscoveryMaxAge Duration `json:"discovery_max_age" env:"AUTHDAEMON_DISCOVERY_MAX_AGE"`
+	KeysetMaxAge    Duration `json:"keyset_max_age" env:"AUTHDAEMON_KEYSET_MAX_AGE"`
+
+	// How far to backdate the iat and nbf claims of id_tokens, to allow for
+	// clients whose clocks are behind ours
+	TokenLeeway Duration `json:"token_leeway" env:"AUTHDAEMON_TOKEN_LEEWAY"`
+
+	// Limits on starting logins, per client_id and per email address
+	RateLimitBurst    int      `json:"rate_limit_burst" env:"AUTHDAEMON_RATE_LIMIT_BURST"`
+	RateLimitInterval Duration `json:"rate_limit_interval" env:"AUTHDAEMON_RATE_LIMIT_INTERVAL"`
+
+	GoogleClientID string `json:"google_client_id" env:"AUTHDAEMON_GOOGLE_CLIENT_ID"`
+
+	// Delegate to the OpenID Connect provider of any email domain which
+	// publishes a discovery document, rather than sending it an email
+	DelegateDiscovery bool `json:"delegate_discovery" env:"AUTHDAEMON_DELEGATE_DISCOVERY"`
+
+	// How long to keep upstream discovery documents and keys, unless their
+	// Cache-Control headers say otherwise
+	UpstreamCacheTTL Duration `json:"upstream_cache_ttl" env:"AUTHDAEMON_UPSTREAM_CACHE_TTL"`
+
+	// The longest to keep upstream documents, whatever their Cache-Control
+	// headers say, and the most to keep at once
+	UpstreamMaxAge    Duration `json:"upstream_max_age" env:"AUTHDAEMON_UPSTREAM_MAX_AGE"`
+	UpstreamCacheSize int      `json:"upstream_cache_size" env:"AUTHDAEMON_UPSTREAM_CACHE_SIZE"`
+
+	// The signing algorithms accepted in id_tokens from Google and other
+	// providers, like RS256, ES256, or PS256. Only asymmetric ones may be used.
+	UpstreamAlgs []string `json:"upstream_algs" env:"AUTHDAEMON_UPSTREAM_ALGS"`
+
+	// Either "email" or "bypass". Bypass logs anyone in as any address they
+	// claim, so it also requires InsecureAllowBypass, to avoid turning it on
+	// by accident.
+	AuthMode            string `json:"auth_mode" env:"AUTHDAEMON_AUTH_MODE"`
+	InsecureAllowBypass bool   `json:"insecure_allow_bypass" env:"AUTHDAEMON_INSECURE_ALLOW_BYPASS"`
+
+	// Only accept confirmation links opened in the browser which started
+	// logging in, so nobody can log a victim in as themselves by sending them
+	// a link. Users then can't use a different device to open the link.
+	RequireSameBrowser bool `json:"require_same_browser" env:"AUTHDAEMON_REQUIRE_SAME_BROWSER"`
+
+	// Signs the cookies for require_same_browser, and must be the same on
+	// every instance. If empty, a new one is generated on every start.
+	CSRFSecret string `json:"csrf_secret" env:"AUTHDAEMON_CSRF_SECRET"`
+
+	// Sign confirmation links with the signing key instead of keeping them in
+	// the session store, valid for link_lifetime. Links then work more
+	// than once until they expire, and only on instances sharing the key.
+	StatelessLinks bool `json:"stateless_links" env:"AUTHDAEMON_STATELESS_LINKS"`
+
+	// Origins of the clients allowed to log users in, like
+	// https://client.example or https://*.example.com. Empty allows all.
+	Clients []string `json:"clients" env:"AUTHDAEMON_CLIENTS"`
+
+	// Exact redirect URIs, like https://client.example/callback. A client
+	// with any listed here may only use those; others may use any url within
+	// their origin.
+	RedirectURIs []string `json:"redirect_uris" env:"AUTHDAEMON_REDIRECT_URIS"`
+
+	// Paths like https://client.example/callback, at or beneath which a
+	// client without redirect_uris must receive responses. A client with
+	// any listed here may use any url under them, but nowhere else within
+	// its origin.
+	RedirectPrefixes []string `json:"redirect_prefixes" env:"AUTHDAEMON_REDIRECT_PREFIXES"`
+
+	// Secrets like https://rs.example=secret, with which clients such as
+	// resource servers authenticate to /introspect
+	ClientSecrets []string `json:"client_secrets" env:"AUTHDAEMON_CLIENT_SECRETS"`
+
+	// The most id_tokens /introspect remembers having verified, so that
+	// checking the same one again is cheap. 0 turns the cache off.
+	IntrospectCache int `json:"introspect_cache" env:"AUTHDAEMON_INTROSPECT_CACHE"`
+
+	// Public keys like https://client.example=/etc/authdaemon/client.jwks,
+	// each a file holding a JWK Set or a PEM public key, which verify the
+	// client's signed request objects. Without any, request objects aren't
+	// supported.
+	ClientKeys []string `json:"client_keys" env:"AUTHDAEMON_CLIENT_KEYS"`
+
+	// Reject authorization requests whose Origin and Referer headers are
+	// both missing, rather than trusting their client_id
+	RequireOrigin bool `json:"require_origin" env:"AUTHDAEMON_REQUIRE_ORIGIN"`
+
+	// Reject authorization requests with scopes other than openid, email, and
+	// profile, rather than ignoring them
+	StrictScopes bool `json:"strict_scopes" env:"AUTHDAEMON_STRICT_SCOPES"`
+
+	// Reject authorization requests with an id_token_hint that we didn't
+	// issue to the client, rather than ignoring it
+	StrictIDTokenHints bool `json:"strict_id_token_hints" env:"AUTHDAEMON_STRICT_ID_TOKEN_HINTS"`
+
+	// Treat the local part of email addresses as case-insensitive, like the
+	// domain. Most mail servers do, but RFC 5321 doesn't require it.
+	LowercaseEmails bool `json:"lowercase_emails" env:"AUTHDAEMON_LOWERCASE_EMAILS"`
+
+	// Domains, like example.com, whose users alone may log in. Empty allows
+	// all, except those in blocked_domains.
+	AllowedDomains []string `json:"allowed_domains" env:"AUTHDAEMON_ALLOWED_DOMAINS"`
+	BlockedDomains []string `json:"blocked_domains" env:"AUTHDAEMON_BLOCKED_DOMAINS"`
+
+	// Let clients revoke id_tokens at /revoke before they expire. Revocations
+	// are kept in memory, so only apply to the instance which received them.
+	Revocation bool `json:"revocation" env:"AUTHDAEMON_REVOCATION"`
+
+	// Serve /userinfo, which returns the sub and email of an id_token sent
+	// as a Bearer token
+	UserInfo bool `json:"userinfo" env:"AUTHDAEMON_USERINFO"`
+
+	// Serve /.well-known/webfinger, which tells clients which issuer, ours
+	// or an upstream one, verifies an email address
+	WebFinger bool `json:"webfinger" env:"AUTHDAEMON_WEBFINGER"`
+
+	// Either "public", where the sub claim is the user's email address, or
+	// "pairwise", where it's an opaque value that differs between clients
+	SubjectType string `json:"subject_type" env:"AUTHDAEMON_SUBJECT_TYPE"`
+
+	// Keeps pairwise subs from being linked across clients. Changing it
+	// changes every user's sub.
+	PairwiseSecret string `json:"pairwise_secret" env:"AUTHDAEMON_PAIRWISE_SECRET"`
+
+	// Claims added to every id_token, like {"tenant": "acme"}. In the
+	// environment, they're given as a JSON object.
+	ExtraClaims map[string]interface{} `json:"extra_claims" env:"AUTHDAEMON_EXTRA_CLAIMS"`
+
+	// The claims each scope adds to id_tokens, like {"openid": ["sub",
+	// "email"]}, replacing the defaults entirely. The openid scope must
+	// always add sub. In the environment, it's given as a JSON object.
+	ScopeClaims map[string][]string `json:"scope_claims" env:"AUTHDAEMON_SCOPE_CLAIMS"`
+
+	// The response_types authorization requests may use, and discovery
+	// advertises, like "id_token" or "id_token token". Each must include
+	// id_token. Empty means just "id_token".
+	ResponseTypes []string `json:"response_types" env:"AUTHDAEMON_RESPONSE_TYPES"`
+
+	SMTP SMTPConfig `json:"smtp"`
+
+	// If empty, keep sessions in memory, which only works for one instance
+	Redis RedisConfig `json:"redis"`
+
+	// If empty, serve plain HTTP and leave TLS to a reverse proxy
+	TLS TLSConfig `json:"tls"`
+
+	// If empty, confirmation emails aren't audited, beyond the access log
+	Audit AuditConfig `json:"audit"`
+
+	// If empty, issued id_tokens aren't recorded, beyond the access log
+	TokenLog TokenLogConfig `json:"token_log"`
+}
+
+// defaultConfig returns the configuration used when nothing is overridden.
+func defaultConfig() Config {
+	return Config{
+		Origin:            ORIGIN,
+		Scheme:            SCHEME_HTTPS,
+		Address:           ADDRESS,
+		Port:              int(PORT),
+		LogFormat:         LOG_TEXT,
+		Index:             INDEX_PAGE,
+		SigningAlg:        ALG_RS256,
+		KeySize:           RSA_KEY_SIZE,
+		KeyRotationGrace:  Duration{KEY_ROTATION_GRACE},
+		SubjectType:       SUBJECT_PUBLIC,
+		AuthMode:          AUTH_EMAIL,
+		TokenLifetime:     Duration{TOKEN_LIFETIME},
+		SessionLifetime:   Duration{SESSION_LIFETIME},
+		LinkLifetime:      Duration{LINK_LIFETIME},
+		MaxSessions:       MAX_SESSIONS,
+		IntrospectCache:   INTROSPECT_CACHE_SIZE,
+		ShutdownTimeout:   Duration{SHUTDOWN_TIMEOUT},
+		ReadTimeout:       Duration{READ_TIMEOUT},
+		WriteTimeout:      Duration{WRITE_TIMEOUT},
+		IdleTimeout:       Duration{IDLE_TIMEOUT},
+		MaxBodyBytes:      MAX_BODY_BYTES,
+		LoginTimeout:      Duration{LOGIN_TIMEOUT},
+		MaxStateLength:    MAX_STATE_LENGTH,
+		MaxNonceLength:    MAX_NONCE_LENGTH,
+		DiscoveryMaxAge:   Duration{DISCOVERY_MAX_AGE},
+		KeysetMaxAge:      Duration{KEYSET_MAX_AGE},
+		RateLimitBurst:    RATE_LIMIT_BURST,
+		RateLimitInterval: Duration{RATE_LIMIT_INTERVAL},
+		UpstreamCacheTTL:  Duration{DISCOVERY_TTL},
+		UpstreamMaxAge:    Duration{UPSTREAM_MAX_AGE},
+		UpstreamCacheSize: DISCOVERY_CACHE_SIZE,
+		UpstreamAlgs:      []string{ALG_RS256, ALG_ES256},
+		TokenLog: TokenLogConfig{
+			Retention: Duration{TOKEN_LOG_RETENTION},
+		},
+		SMTP: SMTPConfig{
+			Port:        587,
+			Security:    SMTP_STARTTLS,
+			MaxAttempts: SMTP_MAX_ATTEMPTS,
+			Workers:     SMTP_WORKERS,
+			QueueDepth:  SMTP_QUEUE_DEPTH,
+		},
+	}
+}
+
+// LoadConfig reads configuration from the JSON file at path, if path is not
+// empty, and then applies any overrides from the environment.
+func LoadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return Config{}, err
+		}
+		defer f.Close()
+
+		decoder := json.NewDecoder(f)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return Config{}, fmt.Errorf("Could not parse %s: %s", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+
+	if err := cfg.valid(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// valid verifies that all settings are usable.
+func (cfg *Config) valid() error {
+	_, clientsErr := newClientRegistry(cfg.Clients, cfg.RedirectURIs, cfg.RedirectPrefixes, cfg.ClientSecrets, cfg.ClientKeys)
+	_, proxiesErr := parseProxies(cfg.TrustedProxies)
+
+	tests := []struct {
+		description string
+		ok          bool
+	}{
+		{"origin must be a host name with an optional port", validation.ValidHost(cfg.Origin)},
+		{"scheme must be 'https' or 'http'", contains([]string{SCHEME_HTTPS, SCHEME_HTTP}, cfg.Scheme)},
+		{"port must be between 1 and 65535", cfg.Port > 0 && cfg.Port <= 65535},
+		{"base_path must be empty or a path like /auth, without a trailing slash", validBasePath(cfg.BasePath)},
+		{"trusted_proxies must be IP addresses or CIDR ranges, like 10.0.0.0/8", proxiesErr == nil},
+		{"log_format must be 'text' or 'json'", contains([]string{LOG_TEXT, LOG_JSON}, cfg.LogFormat)},
+		{
+			"index must be 'page', 'none', or an http or https URL",
+			contains([]string{INDEX_PAGE, INDEX_NONE}, cfg.Index) || validation.ValidURI(cfg.Index),
+		},
+		{"signing_alg must be 'RS256' or 'ES256'", contains([]string{ALG_RS256, ALG_ES256}, cfg.SigningAlg)},
+		{"key_size must be 2048, 3072, or 4096", validKeySize(cfg.KeySize)},
+		{"key_rotation_interval must not be negative", cfg.KeyRotationInterval.Duration >= 0},
+		{
+			"key_rotation_grace must be at least keyset_max_age and token_lifetime, and less than key_rotation_interval",
+			cfg.KeyRotationInterval.Duration == 0 || (cfg.KeyRotationGrace.Duration >= cfg.KeysetMaxAge.Duration &&
+				cfg.KeyRotationGrace.Duration >= cfg.TokenLifetime.Duration &&
+				cfg.KeyRotationGrace.Duration < cfg.KeyRotationInterval.Duration),
+		},
+		{"token_lifetime must be positive", cfg.TokenLifetime.Duration > 0},
+		{"token_leeway must not be negative", cfg.TokenLeeway.Duration >= 0},
+		{"session_lifetime must be positive", cfg.SessionLifetime.Duration > 0},
+		{"link_lifetime must be positive", cfg.LinkLifetime.Duration > 0},
+		{"max_sessions must be positive", cfg.MaxSessions > 0},
+		{"introspect_cache must not be negative", cfg.IntrospectCache >= 0},
+		{"shutdown_timeout must be positive", cfg.ShutdownTimeout.Duration > 0},
+		{"read_timeout must be positive", cfg.ReadTimeout.Duration > 0},
+		{"write_timeout must be positive", cfg.WriteTimeout.Duration > 0},
+		{"idle_timeout must be positive", cfg.IdleTimeout.Duration > 0},
+		{"max_body_bytes must be positive", cfg.MaxBodyBytes > 0},
+		{"login_timeout must be positive", cfg.LoginTimeout.Duration > 0},
+		{"max_state_length must be positive", cfg.MaxStateLength > 0},
+		{"max_nonce_length must be positive", cfg.MaxNonceLength > 0},
+		{"discovery_max_age must not be negative", cfg.DiscoveryMaxAge.Duration >= 0},
+		{"keyset_max_age must not be negative", cfg.KeysetMaxAge.Duration >= 0},
+		{"rate_limit_burst must be positive", cfg.RateLimitBurst > 0},
+		{"rate_limit_interval must be positive", cfg.RateLimitInterval.Duration > 0},
+		{"upstream_cache_ttl must be positive", cfg.UpstreamCacheTTL.Duration > 0},
+		{"upstream_max_age must be at least upstream_cache_ttl", cfg.UpstreamMaxAge.Duration >= cfg.UpstreamCacheTTL.Duration},
+		{"upstream_cache_size must be positive", cfg.UpstreamCacheSize > 0},
+		{"upstream_algs must only list asymmetric algorithms, like RS256, ES256, or PS256", validUpstreamAlgs(cfg.UpstreamAlgs)},
+		{"subject_type must be 'public' or 'pairwise'", contains([]string{SUBJECT_PUBLIC, SUBJECT_PAIRWISE}, cfg.SubjectType)},
+		{
+			"pairwise_secret must be at least 16 characters when subject_type is 'pairwise'",
+			cfg.SubjectType != SUBJECT_PAIRWISE || len(cfg.PairwiseSecret) >= 16,
+		},
+		{"extra_claims must not include claims we set, like " + strings.Join(reservedClaims, ", "), validExtraClaims(cfg.ExtraClaims)},
+		{"response_types must each be 'id_token', optionally with 'token'", validResponseTypes(cfg.ResponseTypes)},
+		{"scope_claims must map openid, email, and profile to " + strings.Join(scopedClaims, ", ") + ", with openid including sub", validScopeClaims(cfg.ScopeClaims)},
+		{"auth_mode must be 'email' or 'bypass'", contains([]string{AUTH_EMAIL, AUTH_BYPASS}, cfg.AuthMode)},
+		{
+			"auth_mode 'bypass' lets anyone log in as anyone, and requires insecure_allow_bypass",
+			cfg.AuthMode != AUTH_BYPASS || cfg.InsecureAllowBypass,
+		},
+		{"csrf_secret must be at least 16 characters if set", cfg.CSRFSecret == "" || len(cfg.CSRFSecret) >= 16},
+		{"allowed_domains must be domain names, like example.com", validDomains(cfg.AllowedDomains)},
+		{"blocked_domains must be domain names, like example.com", validDomains(cfg.BlockedDomains)},
+		{"smtp.port must be between 1 and 65535", cfg.SMTP.Port > 0 && cfg.SMTP.Port <= 65535},
+		{
+			"smtp.security must be 'starttls', 'tls', or 'none'",
+			contains([]string{SMTP_STARTTLS, SMTP_TLS, SMTP_NONE}, cfg.SMTP.Security),
+		},
+		{"smtp.from is required when smtp.host is set", cfg.SMTP.Host == "" || cfg.SMTP.From != ""},
+		{"smtp.from must be an email address, without a display name", cfg.SMTP.From == "" || validMailbox(cfg.SMTP.From)},
+		{"smtp.reply_to must be an email address if set", cfg.SMTP.ReplyTo == "" || validMailbox(cfg.SMTP.ReplyTo)},
+		{"smtp.max_attempts must be positive", cfg.SMTP.MaxAttempts > 0},
+		{"smtp.workers must be positive", cfg.SMTP.Workers > 0},
+		{"smtp.queue_depth must not be negative", cfg.SMTP.QueueDepth >= 0},
+		{"smtp.probe must be 'warn', 'require', or empty", contains([]string{"", SMTP_PROBE_WARN, SMTP_PROBE_REQUIRE}, cfg.SMTP.Probe)},
+		{"token_log.store must be 'memory', 'sqlite', or empty", contains([]string{"", TOKEN_LOG_MEMORY, TOKEN_LOG_SQLITE}, cfg.TokenLog.Store)},
+		{"token_log.path is required when token_log.store is 'sqlite'", cfg.TokenLog.Store != TOKEN_LOG_SQLITE || cfg.TokenLog.Path != ""},
+		{"token_log.retention must be positive", cfg.TokenLog.Retention.Duration > 0},
+		{"redis.address must be a host and port", cfg.Redis.Address == "" || validRedisAddress(cfg.Redis.Address)},
+		{"redis.db must not be negative", cfg.Redis.DB >= 0},
+		{
+			"clients must be origins like https://client.example or https://*.example.com, redirect_uris and redirect_prefixes absolute urls within them, client_secrets at least 16 characters, and client_keys files of public keys",
+			clientsErr == nil,
+		},
+		{"tls.cert_path and tls.key_path must be set together", (cfg.TLS.CertPath == "") == (cfg.TLS.KeyPath == "")},
+		{"tls.autocert cannot be used with tls.cert_path", !cfg.TLS.Autocert || cfg.TLS.CertPath == ""},
+		{"tls.cache_dir is required when tls.autocert is set", !cfg.TLS.Autocert || cfg.TLS.CacheDir != ""},
+	}
+
+	for _, v := range tests {
+		if !v.ok {
+			return errors.New("Invalid configuration: " + v.description)
+		}
+	}
+
+	return nil
+}
+
+// selfCheck returns warnings about settings which work, but are weak enough
+// that operators should know they're in use, for logging at startup. Key IDs
+// are SHA-256 thumbprints, so unlike the rest aren't worth checking.
+func selfCheck(cfg Config) []string {
+	tests := []struct {
+		description string
+		ok          bool
+	}{
+		{"auth_mode is 'bypass', so anyone can log in as any email address without verification. Never use this in production!", cfg.AuthMode != AUTH_BYPASS},
+		{"Neither key_path nor key_pem is set, so a new signing key is generated on every start, and id_tokens stop verifying after restarts", cfg.KeyPath != "" || cfg.KeyPEM != ""},
+		{"clients is empty, so any site may log users in", len(cfg.Clients) > 0},
+		{"scheme is 'http', so id_tokens and confirmation links can be intercepted", cfg.Scheme != SCHEME_HTTP},
+		{"smtp.host is empty, so confirmation links are logged instead of sent, and anyone who can read the logs can log in", cfg.SMTP.Host != "" || cfg.AuthMode == AUTH_BYPASS},
+	}
+
+	var warnings []string
+	for _, v := range tests {
+		if !v.ok {
+			warnings = append(warnings, v.description)
+		}
+	}
+	return warnings
+}
+
+// basePathRE matches paths made of one or more plain segments, like /auth or
+// /services/auth.
+var basePathRE = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+// validBasePath checks that path is empty, or a path which can be put in
+// front of our endpoints' paths.
+func validBasePath(path string) bool {
+	if path == "" {
+		return true
+	}
+
+	for _, segment := range strings.Split(path, "/")[1:] {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	return basePathRE.MatchString(path)
+}
+
+// validDomains checks that each of domains is a host name, without a port.
+func validDomains(domains []string) bool {
+	for _, domain := range domains {
+		if strings.ContainsAny(domain, ":[") || !validation.ValidHost(domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyEnv overrides the fields of a struct from the environment variables
+// named in their `env` tags, recursing into nested structs.
+func applyEnv(v reflect.Value, lookup func(string) (string, bool)) error {
+	structure := v.Type()
+	for i := 0; i < structure.NumField(); i++ {
+		field := structure.Field(i)
+		value := v.Field(i)
+
+		if value.Kind() == reflect.Struct && value.Type() != reflect.TypeOf(Duration{}) {
+			if err := applyEnv(value, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, name := range strings.Split(field.Tag.Get("env"), ",") {
+			raw, ok := lookup(name)
+			if name == "" || !ok {
+				continue
+			}
+
+			if err := setFromString(value, raw); err != nil {
+				return fmt.Errorf("Invalid value for %s: %s", name, err)
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// setFromString parses raw into a config field of any supported type.
+func setFromString(value reflect.Value, raw string) error {
+	if d, ok := value.Addr().Interface().(*Duration); ok {
+		parsed, err := time.ParseDuration(raw)
+		d.Duration = parsed
+		return err
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", value.Type())
+		}
+
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		// Replacing, rather than adding to, any map from the file
+		value.Set(reflect.Zero(value.Type()))
+		return json.Unmarshal([]byte(raw), value.Addr().Interface())
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+
+	return nil
+}
+
+// Duration is a time.Duration which is written in config files as a string
+// like "10m" or "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("durations must be strings like \"10m\"")
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = parsed
+	return nil
+}
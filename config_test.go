@@ -0,0 +1,248 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes contents to a temporary config file and returns its path.
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		description string
+		file        string
+		env         map[string]string
+		check       func(Config) bool
+	}{
+		{
+			"defaults",
+			"",
+			nil,
+			func(c Config) bool {
+				return c.Origin == ORIGIN && c.Port == int(PORT) && c.TokenLifetime.Duration == TOKEN_LIFETIME && c.TokenLeeway.Duration == 0
+			},
+		},
+		{
+			"file values",
+			`{"origin": "example.com", "port": 8080, "token_lifetime": "5m", "token_leeway": "30s", "smtp": {"host": "smtp.example.com", "from": "login@example.com"}}`,
+			nil,
+			func(c Config) bool {
+				return c.Origin == "example.com" && c.Port == 8080 && c.TokenLifetime.Duration == 5*time.Minute && c.TokenLeeway.Duration == 30*time.Second &&
+					c.SMTP.Host == "smtp.example.com" && c.SMTP.Port == 587 && c.Address == ADDRESS
+			},
+		},
+		{
+			"env overrides file",
+			`{"origin": "example.com", "port": 8080}`,
+			map[string]string{"AUTHDAEMON_ORIGIN": "example.org", "AUTHDAEMON_SESSION_LIFETIME": "1h"},
+			func(c Config) bool {
+				return c.Origin == "example.org" && c.Port == 8080 && c.SessionLifetime.Duration == time.Hour
+			},
+		},
+		{
+			"PORT env override",
+			`{"port": 8080}`,
+			map[string]string{"PORT": "5000"},
+			func(c Config) bool { return c.Port == 5000 },
+		},
+		{
+			"AUTHDAEMON_PORT takes precedence over PORT",
+			"",
+			map[string]string{"PORT": "5000", "AUTHDAEMON_PORT": "6000"},
+			func(c Config) bool { return c.Port == 6000 },
+		},
+		{
+			"nested env overrides",
+			"",
+			map[string]string{"AUTHDAEMON_SMTP_HOST": "mail.example.com", "AUTHDAEMON_SMTP_FROM": "a@example.com", "AUTHDAEMON_SMTP_PORT": "465"},
+			func(c Config) bool { return c.SMTP.Host == "mail.example.com" && c.SMTP.Port == 465 },
+		},
+		{
+			"extra claims from the env",
+			`{"extra_claims": {"tenant": "acme"}}`,
+			map[string]string{"AUTHDAEMON_EXTRA_CLAIMS": `{"env": "staging", "groups": ["admins"]}`},
+			func(c Config) bool { return len(c.ExtraClaims) == 2 && c.ExtraClaims["env"] == "staging" },
+		},
+		{
+			"response types from the env",
+			"",
+			map[string]string{"AUTHDAEMON_RESPONSE_TYPES": "id_token,id_token token"},
+			func(c Config) bool {
+				return len(c.ResponseTypes) == 2 && c.ResponseTypes[1] == "id_token token"
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+
+			path := ""
+			if test.file != "" {
+				path = writeConfig(t, test.file)
+			}
+
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig returned an error: %s", err)
+			}
+
+			if !test.check(cfg) {
+				t.Errorf("LoadConfig returned unexpected values: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		description string
+		file        string
+		env         map[string]string
+		message     string
+	}{
+		{"bad port", `{"port": 0}`, nil, "port"},
+		{"trailing slash in base path", `{"base_path": "/auth/"}`, nil, "base_path"},
+		{"relative base path", "", map[string]string{"AUTHDAEMON_BASE_PATH": "auth"}, "base_path"},
+		{"base path with dot segments", `{"base_path": "/auth/.."}`, nil, "base_path"},
+		{"port too large", `{"port": 65536}`, nil, "port"},
+		{"bad env port", "", map[string]string{"AUTHDAEMON_PORT": "99999"}, "port"},
+		{"non-numeric env port", "", map[string]string{"PORT": "http"}, "PORT"},
+		{"empty origin", `{"origin": ""}`, nil, "origin"},
+		{"origin with a scheme", `{"origin": "https://example.com"}`, nil, "origin"},
+		{"bad duration", `{"token_lifetime": "ten minutes"}`, nil, "config.json"},
+		{"numeric duration", `{"token_lifetime": 600}`, nil, "config.json"},
+		{"negative leeway", "", map[string]string{"AUTHDAEMON_TOKEN_LEEWAY": "-30s"}, "token_leeway"},
+		{"no read timeout", `{"read_timeout": "0s"}`, nil, "read_timeout"},
+		{"no body limit", "", map[string]string{"AUTHDAEMON_MAX_BODY_BYTES": "0"}, "max_body_bytes"},
+		{"no login timeout", "", map[string]string{"AUTHDAEMON_LOGIN_TIMEOUT": "0s"}, "login_timeout"},
+		{"negative keyset max age", `{"keyset_max_age": "-5m"}`, nil, "keyset_max_age"},
+		{"no rate limit burst", `{"rate_limit_burst": 0}`, nil, "rate_limit_burst"},
+		{"no rate limit interval", "", map[string]string{"AUTHDAEMON_RATE_LIMIT_INTERVAL": "0s"}, "rate_limit_interval"},
+		{"bad log format", `{"log_format": "xml"}`, nil, "log_format"},
+		{"TLS cert without a key", `{"tls": {"cert_path": "cert.pem"}}`, nil, "tls.key_path"},
+		{"autocert and a cert", `{"tls": {"autocert": true, "cache_dir": "certs", "cert_path": "cert.pem", "key_path": "key.pem"}}`, nil, "tls.autocert"},
+		{"autocert without a cache", "", map[string]string{"AUTHDAEMON_TLS_AUTOCERT": "true"}, "tls.cache_dir"},
+		{"short csrf secret", "", map[string]string{"AUTHDAEMON_CSRF_SECRET": "hunter2"}, "csrf_secret"},
+		{"bad client", "", map[string]string{"AUTHDAEMON_CLIENTS": "https://client.example, client.example"}, "clients"},
+		{"unlisted redirect uri", "", map[string]string{"AUTHDAEMON_CLIENTS": "https://client.example", "AUTHDAEMON_REDIRECT_URIS": "https://other.example/callback"}, "redirect_uris"},
+		{"missing client keys", `{"client_keys": ["https://client.example=/nonexistent/client.jwks"]}`, nil, "client_keys"},
+		{"short client secret", "", map[string]string{"AUTHDAEMON_CLIENT_SECRETS": "https://rs.example=hunter2"}, "client_secrets"},
+		{"bad signing alg", `{"signing_alg": "HS256"}`, nil, "signing_alg"},
+		{"small key size", `{"key_size": 1024}`, nil, "key_size"},
+		{"symmetric upstream alg", "", map[string]string{"AUTHDAEMON_UPSTREAM_ALGS": "RS256,HS256"}, "upstream_algs"},
+		{"no upstream algs", `{"upstream_algs": []}`, nil, "upstream_algs"},
+		{"bad token log store", `{"token_log": {"store": "postgres"}}`, nil, "token_log.store"},
+		{"sqlite token log without a path", "", map[string]string{"AUTHDAEMON_TOKEN_LOG_STORE": "sqlite"}, "token_log.path"},
+		{"short key rotation grace", `{"key_rotation_interval": "24h", "key_rotation_grace": "1m"}`, nil, "key_rotation_grace"},
+		{"key rotation grace longer than the interval", "", map[string]string{"AUTHDAEMON_KEY_ROTATION_INTERVAL": "30m"}, "key_rotation_grace"},
+		{"bad trusted proxy", "", map[string]string{"AUTHDAEMON_TRUSTED_PROXIES": "10.0.0.0/8,proxy.example"}, "trusted_proxies"},
+		{"bad trusted proxy range", `{"trusted_proxies": ["10.0.0.0/33"]}`, nil, "trusted_proxies"},
+		{"odd key size", "", map[string]string{"AUTHDAEMON_KEY_SIZE": "2049"}, "key_size"},
+		{"bad auth mode", `{"auth_mode": "none"}`, nil, "auth_mode"},
+		{"bypass without the insecure flag", "", map[string]string{"AUTHDAEMON_AUTH_MODE": "bypass"}, "insecure_allow_bypass"},
+		{"bad subject type", `{"subject_type": "private"}`, nil, "subject_type"},
+		{"pairwise without a secret", "", map[string]string{"AUTHDAEMON_SUBJECT_TYPE": "pairwise"}, "pairwise_secret"},
+		{"short pairwise secret", `{"subject_type": "pairwise", "pairwise_secret": "hunter2"}`, nil, "pairwise_secret"},
+		{"unknown field", `{"orign": "example.com"}`, nil, "orign"},
+		{"malformed JSON", `{"origin": `, nil, "config.json"},
+		{"Redis without a port", `{"redis": {"address": "localhost"}}`, nil, "redis.address"},
+		{"negative Redis db", "", map[string]string{"AUTHDAEMON_REDIS_ADDRESS": "localhost:6379", "AUTHDAEMON_REDIS_DB": "-1"}, "redis.db"},
+		{"bad SMTP security", `{"smtp": {"security": "ssl"}}`, nil, "smtp.security"},
+		{"bad SMTP probe", `{"smtp": {"probe": "always"}}`, nil, "smtp.probe"},
+		{"no state length", `{"max_state_length": 0}`, nil, "max_state_length"},
+		{"no nonce length", "", map[string]string{"AUTHDAEMON_MAX_NONCE_LENGTH": "0"}, "max_nonce_length"},
+		{"reserved extra claim", `{"extra_claims": {"tenant": "acme", "email": "admin@example.com"}}`, nil, "extra_claims"},
+		{"response type without id_token", `{"response_types": ["id_token", "token"]}`, nil, "response_types"},
+		{"unknown response type", "", map[string]string{"AUTHDAEMON_RESPONSE_TYPES": "id_token,code id_token"}, "response_types"},
+		{"scope claims without sub", `{"scope_claims": {"openid": ["email"]}}`, nil, "scope_claims"},
+		{"scope claims for an unknown claim", "", map[string]string{"AUTHDAEMON_SCOPE_CLAIMS": `{"openid": ["sub"], "email": ["phone_number"]}`}, "scope_claims"},
+		{"malformed extra claims", "", map[string]string{"AUTHDAEMON_EXTRA_CLAIMS": "tenant=acme"}, "AUTHDAEMON_EXTRA_CLAIMS"},
+		{"bad index", `{"index": "hello"}`, nil, "index"},
+		{"index redirect without a scheme", "", map[string]string{"AUTHDAEMON_INDEX": "example.com/home"}, "index"},
+		{"no sessions", "", map[string]string{"AUTHDAEMON_MAX_SESSIONS": "0"}, "max_sessions"},
+		{"negative introspect cache", `{"introspect_cache": -1}`, nil, "introspect_cache"},
+		{"upstream max age below the ttl", `{"upstream_cache_ttl": "2h", "upstream_max_age": "1h"}`, nil, "upstream_max_age"},
+		{"no upstream cache", "", map[string]string{"AUTHDAEMON_UPSTREAM_CACHE_SIZE": "0"}, "upstream_cache_size"},
+		{"bad scheme", "", map[string]string{"AUTHDAEMON_SCHEME": "ftp"}, "scheme"},
+		{"links which never work", `{"link_lifetime": "0s"}`, nil, "link_lifetime"},
+		{"allowed domain with a port", `{"allowed_domains": ["example.com:443"]}`, nil, "allowed_domains"},
+		{"blocked domain which isn't a domain", "", map[string]string{"AUTHDAEMON_BLOCKED_DOMAINS": "example.com,not a domain"}, "blocked_domains"},
+		{"SMTP without a sender", `{"smtp": {"host": "smtp.example.com"}}`, nil, "smtp.from"},
+		{"SMTP sender with a display name", `{"smtp": {"from": "Login <login@example.com>"}}`, nil, "smtp.from"},
+		{"bad SMTP reply-to", "", map[string]string{"AUTHDAEMON_SMTP_REPLY_TO": "not an address"}, "smtp.reply_to"},
+		{"no SMTP workers", `{"smtp": {"workers": 0}}`, nil, "smtp.workers"},
+		{"negative SMTP queue depth", "", map[string]string{"AUTHDAEMON_SMTP_QUEUE_DEPTH": "-1"}, "smtp.queue_depth"},
+		{"no SMTP attempts", "", map[string]string{"AUTHDAEMON_SMTP_MAX_ATTEMPTS": "0"}, "smtp.max_attempts"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+
+			path := ""
+			if test.file != "" {
+				path = writeConfig(t, test.file)
+			}
+
+			_, err := LoadConfig(path)
+			if err == nil {
+				t.Fatal("LoadConfig unexpectedly succeeded")
+			}
+
+			if !strings.Contains(err.Error(), test.message) {
+				t.Errorf("LoadConfig error %q does not mention %q", err, test.message)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if !os.IsNotExist(err) {
+		t.Errorf("LoadConfig of a missing file returned %v instead of a not-exist error", err)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	// The defaults are fine for trying things out, but not much else
+	cfg := defaultConfig()
+	cfg.AuthMode, cfg.InsecureAllowBypass = AUTH_BYPASS, true
+	cfg.Scheme = SCHEME_HTTP
+
+	warnings := strings.Join(selfCheck(cfg), "\n")
+	for _, setting := range []string{"auth_mode", "key_path", "clients", "scheme"} {
+		if !strings.Contains(warnings, setting) {
+			t.Errorf("selfCheck of an insecure config did not warn about %s:\n%s", setting, warnings)
+		}
+	}
+
+	// Confirmation links are only logged if there are any
+	cfg.AuthMode = AUTH_EMAIL
+	if warnings := strings.Join(selfCheck(cfg), "\n"); !strings.Contains(warnings, "smtp.host") {
+		t.Errorf("selfCheck without an SMTP server did not warn about smtp.host:\n%s", warnings)
+	}
+
+	cfg.Scheme = SCHEME_HTTPS
+	cfg.KeyPath = "/etc/authdaemon/key.pem"
+	cfg.Clients = []string{"https://client.example"}
+	cfg.SMTP.Host = "smtp.example.com"
+	if warnings := selfCheck(cfg); len(warnings) != 0 {
+		t.Errorf("selfCheck of a hardened config returned %q", warnings)
+	}
+}
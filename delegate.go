@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/callahad/authdaemon/internal/validation"
+	"github.com/gin-gonic/gin"
+	"github.com/square/go-jose"
+)
+
+// How long to keep upstream documents which don't say, the longest to keep
+// any whatever they say, and how long to wait for them.
+const (
+	DISCOVERY_TTL     = 1 * time.Hour
+	UPSTREAM_MAX_AGE  = 24 * time.Hour
+	DISCOVERY_TIMEOUT = 10 * time.Second
+)
+
+// DISCOVERY_CACHE_SIZE is the most upstream documents kept at once.
+const DISCOVERY_CACHE_SIZE = 1000
+
+// maxDiscoveryBytes caps how much of an upstream document is read.
+const maxDiscoveryBytes = 1 << 20
+
+// asymmetricAlgs are the signing algorithms which upstream id_tokens may be
+// allowed to use. Others are never accepted, whatever is configured: with
+// "none", anyone could forge a token, and with symmetric algorithms like
+// HS256, anyone who knows the provider's public key could.
+var asymmetricAlgs = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "PS384", "PS512"}
+
+// validUpstreamAlgs checks that algs is a non-empty list of asymmetricAlgs.
+func validUpstreamAlgs(algs []string) bool {
+	for _, alg := range algs {
+		if !contains(asymmetricAlgs, alg) {
+			return false
+		}
+	}
+	return len(algs) > 0
+}
+
+// upstream is an OpenID Connect provider which we delegate authentication to.
+type upstream struct {
+	name         string   // For error messages, like "Google"
+	issuers      []string // Accepted values of the iss claim
+	authEndpoint string
+	jwksURI      string
+}
+
+// upstreamClaims holds the id_token claims we check from upstream providers.
+type upstreamClaims struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Expiry        int64  `json:"exp"`
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// upstreamNonce derives the nonce we expect an upstream to echo back for a
+// given state. Both are single-use, since the session is deleted by the
+// callback.
+func upstreamNonce(state string) string {
+	h := sha256.Sum256([]byte("nonce:" + state))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// emailDomain returns the part of email after the last "@".
+func emailDomain(email string) string {
+	return email[strings.LastIndex(email, "@")+1:]
+}
+
+// Delegate authenticates users by delegating to their email domain's own
+// OpenID Connect provider, if it publishes a discovery document at
+// https://<domain>/.well-known/openid-configuration.
+//
+// Like GoogleDelegate, it uses the implicit flow with form_post. Our origin is
+// the client_id, as providers which accept unregistered clients, like this
+// daemon, expect.
+type Delegate struct {
+	clientID    string // Our origin
+	redirectURI string // Our callback
+	algs        []string
+	docs        *documentCache
+	store       SessionStore
+
+	// issuer returns the issuer whose discovery document we look for, for a
+	// domain
+	issuer func(domain string) string
+}
+
+// newDelegate creates a Delegate with callbacks under issuer, which fetches
+// upstream documents through docs, and accepts id_tokens signed with any of
+// algs. Pending requests are kept in store.
+func newDelegate(issuer string, store SessionStore, docs *documentCache, algs []string) *Delegate {
+	var clientID string
+	if u, err := url.Parse(issuer); err == nil {
+		clientID = u.Scheme + "://" + u.Host
+	}
+
+	return &Delegate{
+		clientID:    clientID,
+		redirectURI: issuer + delegateCallbackPath,
+		algs:        algs,
+		docs:        docs,
+		store:       store,
+		issuer: func(domain string) string {
+			return "https://" + domain
+		},
+	}
+}
+
+const delegateCallbackPath = "/callback/delegate"
+
+// delegateSessionPrefix namespaces our sessions in the SessionStore.
+const delegateSessionPrefix = "delegate:"
+
+// AddRoutes registers the endpoint upstream providers post their responses to.
+func (d *Delegate) AddRoutes(router gin.IRouter, done CompleteFunc) {
+	router.POST(delegateCallbackPath, d.callback(done))
+}
+
+// Accepts reports whether email's domain has a provider we can delegate to.
+// This may fetch its discovery document, so logins for domains which aren't
+// cached can take up to DISCOVERY_TIMEOUT.
+func (d *Delegate) Accepts(ctx context.Context, email string) bool {
+	up, _ := d.resolve(ctx, emailDomain(email))
+	return up != nil
+}
+
+// Start redirects the user to their domain's provider to log in.
+func (d *Delegate) Start(c *gin.Context, req AuthRequest) {
+	up, err := d.resolve(c.Request.Context(), emailDomain(req.LoginHint))
+	if up == nil {
+		respondError(c, 502, "Upstream Error", fmt.Sprintf("No provider for %s: %s", req.LoginHint, err))
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		respondError(c, 500, "Unknown Error", err.Error())
+		return
+	}
+
+	if err := d.store.Save(delegateSessionPrefix+state, req); err != nil {
+		respondError(c, 500, "Session Error", err.Error())
+		return
+	}
+
+	params := url.Values{
+		"client_id":     {d.clientID},
+		"response_type": {"id_token"},
+		"response_mode": {"form_post"},
+		"scope":         {"openid email"},
+		"redirect_uri":  {d.redirectURI},
+		"login_hint":    {req.LoginHint},
+		"state":         {state},
+		"nonce":         {upstreamNonce(state)},
+	}
+
+	c.Redirect(302, up.authEndpoint+"?"+params.Encode())
+}
+
+// callback creates a handler for the id_tokens upstream providers post back
+// to us. The user is only verified if their domain's provider vouches for the
+// same address they gave us.
+func (d *Delegate) callback(done CompleteFunc) func(*gin.Context) {
+	return func(c *gin.Context) {
+		state := c.PostForm("state")
+
+		req, err := d.store.Consume(delegateSessionPrefix + state)
+		if state == "" || err != nil {
+			fail(c, "unknown_state", "Bad State", "Unknown or expired login attempt")
+			return
+		}
+
+		if errCode := c.PostForm("error"); errCode != "" {
+			fail(c, "upstream_error", "Upstream Error", "The provider for "+req.LoginHint+" returned an error: "+errCode)
+			return
+		}
+
+		up, err := d.resolve(c.Request.Context(), emailDomain(req.LoginHint))
+		if up == nil {
+			respondError(c, 502, "Upstream Error", fmt.Sprintf("No provider for %s: %s", req.LoginHint, err))
+			return
+		}
+
+		email, err := verifyUpstreamToken(c.Request.Context(), d.docs, *up, d.clientID, c.PostForm("id_token"), upstreamNonce(state), d.algs)
+		if err != nil {
+			fail(c, "invalid_upstream_token", "Bad Token", err.Error())
+			return
+		}
+
+		// The login_hint was normalized by authorize, so compare like with like
+		if normalized, err := validation.NormalizeEmail(email); err != nil || !strings.EqualFold(normalized, req.LoginHint) {
+			fail(c, "email_mismatch", "Email Mismatch", fmt.Sprintf("Logged in to %s as %s instead of %s", up.name, email, req.LoginHint))
+			return
+		}
+
+		done(c, req, req.LoginHint, AMR_DELEGATED)
+	}
+}
+
+// IssuerFor returns the issuer of the provider for email's domain, for
+// resolveIssuer.
+func (d *Delegate) IssuerFor(ctx context.Context, email string) (string, error) {
+	up, err := d.resolve(ctx, emailDomain(email))
+	if err != nil {
+		return "", err
+	}
+	return up.issuers[0], nil
+}
+
+// resolve returns the provider for domain, if its discovery document says it
+// supports the flow we use. Domains which are IP addresses, as in
+// foo@[127.0.0.1], are never looked up.
+func (d *Delegate) resolve(ctx context.Context, domain string) (*upstream, error) {
+	if net.ParseIP(strings.Trim(domain, "[]")) != nil {
+		return nil, errors.New("Email addresses at IP addresses have no provider")
+	}
+
+	issuer := d.issuer(strings.ToLower(domain))
+	document, err := d.docs.fetchDiscovery(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	tests := []struct {
+		description string
+		ok          bool
+	}{
+		{"authorization_endpoint must be an https url", validHTTPS(document.AuthorizationEndpoint)},
+		{"jwks_uri must be an https url", validHTTPS(document.JwksURI)},
+		{"response_types_supported must include 'id_token'", contains(document.ResponseTypesSupported, "id_token")},
+		{"response_modes_supported must include 'form_post'", contains(document.ResponseModesSupported, "form_post")},
+	}
+
+	for _, v := range tests {
+		if !v.ok {
+			return nil, errors.New("Unusable discovery document: " + v.description)
+		}
+	}
+
+	return &upstream{
+		name:         domain,
+		issuers:      []string{issuer},
+		authEndpoint: document.AuthorizationEndpoint,
+		jwksURI:      document.JwksURI,
+	}, nil
+}
+
+// validHTTPS checks that uri is a valid url using https.
+func validHTTPS(uri string) bool {
+	return validation.ValidURI(uri) && strings.HasPrefix(uri, "https://")
+}
+
+// verifyUpstreamToken checks the signature and claims of an id_token issued
+// by up to clientID, returning the verified email address it contains. Its
+// keys are fetched through docs, until ctx is done, and fetched anew if none
+// match in case the provider rotated them.
+//
+// The token must be signed with one of allowedAlgs, which only count if
+// they're asymmetricAlgs, and with the same algorithm as its key is for, if
+// the key says.
+func verifyUpstreamToken(ctx context.Context, docs *documentCache, up upstream, clientID string, token string, nonce string, allowedAlgs []string) (string, error) {
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return "", errors.New("Malformed id_token")
+	}
+
+	alg := jws.Signatures[0].Header.Algorithm
+	if !contains(asymmetricAlgs, alg) || !contains(allowedAlgs, alg) {
+		return "", fmt.Errorf("id_token is signed with %q, which is not allowed", alg)
+	}
+
+	kid := jws.Signatures[0].Header.KeyID
+	keys, err := docs.fetchJWKS(ctx, up.jwksURI)
+	if err == nil && len(keys.Key(kid)) == 0 {
+		docs.forget(up.jwksURI)
+		keys, err = docs.fetchJWKS(ctx, up.jwksURI)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Could not get %s's keys: %s", up.name, err)
+	}
+
+	matches := keys.Key(kid)
+	if len(matches) == 0 {
+		return "", errors.New("id_token signed by an unknown key")
+	}
+
+	if matches[0].Algorithm != "" && matches[0].Algorithm != alg {
+		return "", fmt.Errorf("id_token is signed with %s, but its key is for %s", alg, matches[0].Algorithm)
+	}
+
+	payload, err := jws.Verify(&matches[0])
+	if err != nil {
+		return "", errors.New("id_token signature is invalid")
+	}
+
+	var claims upstreamClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.New("Malformed id_token claims")
+	}
+
+	tests := []struct {
+		description string
+		ok          bool
+	}{
+		{"id_token was not issued by " + up.name, contains(up.issuers, claims.Issuer)},
+		{"id_token was issued to another client", claims.Audience == clientID},
+		{"id_token has expired", docs.clock.Now().Unix() < claims.Expiry},
+		{"id_token nonce does not match", secretsEqual(claims.Nonce, nonce)},
+		{"id_token email is not verified", claims.Email != "" && claims.EmailVerified},
+	}
+
+	for _, v := range tests {
+		if !v.ok {
+			return "", errors.New(v.description)
+		}
+	}
+
+	return claims.Email, nil
+}
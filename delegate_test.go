@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeUpstream is a Delegate wired to a local provider for upstream.example,
+// along with the key for signing its id_tokens.
+type fakeUpstream struct {
+	*Delegate
+	server      *httptest.Server
+	key         *rsa.PrivateKey
+	ourKey      *rsa.PrivateKey // For verifying the id_tokens we issue
+	router      *gin.Engine
+	discoveries int32 // How many times a discovery document was fetched
+}
+
+func newFakeUpstream(t *testing.T, responseModes ...string) *fakeUpstream {
+	upstreamKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ourKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(responseModes) == 0 {
+		responseModes = []string{"form_post"}
+	}
+
+	u := &fakeUpstream{key: upstreamKey, ourKey: ourKey}
+
+	gin.SetMode(gin.TestMode)
+	provider := gin.New()
+	provider.GET("/:domain/.well-known/openid-configuration", func(c *gin.Context) {
+		atomic.AddInt32(&u.discoveries, 1)
+		if c.Param("domain") != "upstream.example" {
+			c.Status(404)
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"issuer":                   u.server.URL + "/upstream.example",
+			"authorization_endpoint":   u.server.URL + "/auth",
+			"jwks_uri":                 u.server.URL + "/certs",
+			"response_types_supported": []string{"id_token"},
+			"response_modes_supported": responseModes,
+		})
+	})
+	provider.GET("/certs", func(c *gin.Context) {
+		keyset(u.key, 0)(c)
+	})
+	u.server = httptest.NewTLSServer(provider)
+	t.Cleanup(u.server.Close)
+
+	store := newMemorySessionStore(SESSION_LIFETIME)
+	docs := newDocumentCache(DISCOVERY_TTL, UPSTREAM_MAX_AGE, DISCOVERY_CACHE_SIZE)
+	docs.client = u.server.Client()
+	u.Delegate = newDelegate("https://issuer.example", store, docs, []string{ALG_RS256, "PS256"})
+	u.issuer = func(domain string) string {
+		return u.server.URL + "/" + domain
+	}
+
+	u.router = gin.New()
+	oidcAddRoutes(u.router, ProviderConfig{Origin: "issuer.example", Key: ourKey, Lifetime: TOKEN_LIFETIME}, u.Delegate, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, store))
+
+	return u
+}
+
+// login starts an authorization request for email, and returns the state and
+// nonce sent upstream.
+func (u *fakeUpstream) login(t *testing.T, email string) (string, string) {
+	form := validAuthForm()
+	form.Set("login_hint", email)
+
+	nonce, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("nonce", nonce)
+
+	w := postForm(u.router, "/authorize", form)
+	if w.Code != 302 {
+		t.Fatalf("POST /authorize for %s returned %d instead of redirecting: %s", email, w.Code, w.Body.String())
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(location.String(), u.server.URL+"/auth?") {
+		t.Fatalf("POST /authorize redirected to %s instead of upstream", location)
+	}
+
+	params := location.Query()
+	expected := map[string]string{
+		"client_id":     "https://issuer.example",
+		"response_type": "id_token",
+		"response_mode": "form_post",
+		"redirect_uri":  "https://issuer.example/callback/delegate",
+		"login_hint":    email,
+	}
+	for k, v := range expected {
+		if params.Get(k) != v {
+			t.Errorf("upstream redirect has %s=%q instead of %q", k, params.Get(k), v)
+		}
+	}
+
+	return params.Get("state"), params.Get("nonce")
+}
+
+// respond posts an id_token with the given claims to our Delegate callback.
+func (u *fakeUpstream) respond(t *testing.T, state string, claims upstreamClaims) *httptest.ResponseRecorder {
+	token, err := signToken(u.key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return postForm(u.router, "/callback/delegate", url.Values{
+		"state":    {state},
+		"id_token": {token},
+	})
+}
+
+// validClaims returns the claims upstream.example would issue.
+func (u *fakeUpstream) validClaims(nonce string) upstreamClaims {
+	return upstreamClaims{
+		Issuer:        u.server.URL + "/upstream.example",
+		Audience:      "https://issuer.example",
+		Expiry:        time.Now().Add(time.Minute).Unix(),
+		Nonce:         nonce,
+		Email:         "foo@upstream.example",
+		EmailVerified: true,
+	}
+}
+
+func TestDelegateAccepts(t *testing.T) {
+	u := newFakeUpstream(t)
+
+	if !u.Accepts(context.Background(), "foo@upstream.example") || !u.Accepts(context.Background(), "foo@UPSTREAM.example") {
+		t.Error("Delegate.Accepts rejected a domain with a provider")
+	}
+
+	if u.Accepts(context.Background(), "foo@other.example") {
+		t.Error("Delegate.Accepts accepted a domain without a provider")
+	}
+
+	// Each domain's discovery document is only fetched once
+	u.Accepts(context.Background(), "foo@other.example")
+	if n := atomic.LoadInt32(&u.discoveries); n != 2 {
+		t.Errorf("fetched discovery documents %d times instead of once per domain", n)
+	}
+}
+
+func TestDelegateIPAddresses(t *testing.T) {
+	u := newFakeUpstream(t)
+
+	for _, email := range []string{"foo@[127.0.0.1]", "foo@127.0.0.1", "foo@[::1]", "foo@[169.254.169.254]"} {
+		if u.Accepts(context.Background(), email) {
+			t.Errorf("Delegate.Accepts accepted %s", email)
+		}
+	}
+	if n := atomic.LoadInt32(&u.discoveries); n != 0 {
+		t.Errorf("looked for providers at IP addresses %d times", n)
+	}
+}
+
+func TestDelegateUnsupportedProvider(t *testing.T) {
+	u := newFakeUpstream(t, "query", "fragment")
+
+	if u.Accepts(context.Background(), "foo@upstream.example") {
+		t.Error("Delegate.Accepts accepted a provider without form_post")
+	}
+
+	// Those users get a confirmation link instead
+	form := validAuthForm()
+	form.Set("login_hint", "foo@upstream.example")
+	if w := postForm(u.router, "/authorize", form); w.Code != 200 || !strings.Contains(w.Body.String(), "Check your email") {
+		t.Errorf("POST /authorize for a domain with an unusable provider returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDelegateRoundTrip(t *testing.T) {
+	u := newFakeUpstream(t)
+	state, nonce := u.login(t, "foo@upstream.example")
+
+	w := u.respond(t, state, u.validClaims(nonce))
+	if w.Code != 200 {
+		t.Fatalf("Delegate callback returned %d: %s", w.Code, w.Body.String())
+	}
+
+	action, params := parseFormPost(t, w.Body.String())
+	if action != "https://client.example/callback" {
+		t.Errorf("Delegate callback posts to %q instead of the redirect_uri", action)
+	}
+
+	claims := verifiedClaims(t, params.Get("id_token"), &u.ourKey.PublicKey)
+	if len(claims.AuthMethods) != 1 || claims.AuthMethods[0] != AMR_DELEGATED {
+		t.Errorf("Delegate callback issued an id_token with amr %q instead of [%q]", claims.AuthMethods, AMR_DELEGATED)
+	}
+
+	// The state can only be used once
+	if w = u.respond(t, state, u.validClaims(nonce)); w.Code != 400 {
+		t.Errorf("reusing a Delegate state returned %d instead of 400", w.Code)
+	}
+}
+
+func TestDelegateRejectsBadTokens(t *testing.T) {
+	u := newFakeUpstream(t)
+
+	tests := []struct {
+		description string
+		modify      func(*upstreamClaims)
+	}{
+		{"email mismatch", func(c *upstreamClaims) { c.Email = "bar@upstream.example" }},
+		{"another domain's email", func(c *upstreamClaims) { c.Email = "foo@other.example" }},
+		{"unverified email", func(c *upstreamClaims) { c.EmailVerified = false }},
+		{"wrong audience", func(c *upstreamClaims) { c.Audience = "https://someone-else.example" }},
+		{"wrong issuer", func(c *upstreamClaims) { c.Issuer = "https://upstream.example" }},
+		{"wrong nonce", func(c *upstreamClaims) { c.Nonce = "bogus" }},
+		{"expired", func(c *upstreamClaims) { c.Expiry = time.Now().Add(-time.Minute).Unix() }},
+	}
+
+	for _, test := range tests {
+		state, nonce := u.login(t, "foo@upstream.example")
+		claims := u.validClaims(nonce)
+		test.modify(&claims)
+
+		if w := u.respond(t, state, claims); w.Code != 400 {
+			t.Errorf("Delegate callback with %s returned %d instead of 400", test.description, w.Code)
+		}
+	}
+}
+
+func TestDelegateKeyRotation(t *testing.T) {
+	u := newFakeUpstream(t)
+
+	state, nonce := u.login(t, "foo@upstream.example")
+	if w := u.respond(t, state, u.validClaims(nonce)); w.Code != 200 {
+		t.Fatalf("Delegate callback returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// The cached keys are replaced when a token is signed by a new one
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.key = rotated
+
+	state, nonce = u.login(t, "foo@upstream.example")
+	if w := u.respond(t, state, u.validClaims(nonce)); w.Code != 200 {
+		t.Errorf("Delegate callback after the provider rotated its keys returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// craftToken builds a compact JWS with the given header and claims, signed by
+// sign, for algorithms signToken won't use.
+func craftToken(t *testing.T, header map[string]string, claims upstreamClaims, sign func(input []byte) []byte) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	input := encode(header) + "." + encode(claims)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func TestVerifyUpstreamTokenAlgorithms(t *testing.T) {
+	u := newFakeUpstream(t)
+
+	up, err := u.resolve(context.Background(), "upstream.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kid := generateKid(u.key.Public())
+	claims := u.validClaims("n-0S6_WzA2Mj")
+	verify := func(token string, allowedAlgs ...string) error {
+		_, err := verifyUpstreamToken(context.Background(), u.docs, *up, "https://issuer.example", token, "n-0S6_WzA2Mj", allowedAlgs)
+		return err
+	}
+
+	valid, err := signToken(u.key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(valid, ALG_RS256); err != nil {
+		t.Fatalf("verifyUpstreamToken rejected a valid RS256 token: %s", err)
+	}
+	if err := verify(valid, ALG_ES256); err == nil {
+		t.Error("verifyUpstreamToken accepted an RS256 token when only ES256 is allowed")
+	}
+
+	// Even when configured, "none" and symmetric algorithms are refused
+	unsigned := craftToken(t, map[string]string{"alg": "none", "kid": kid}, claims, func([]byte) []byte { return nil })
+	if err := verify(unsigned, ALG_RS256, "none"); err == nil {
+		t.Error("verifyUpstreamToken accepted an unsigned token")
+	}
+
+	// Signed with the public key as an HMAC secret, which anyone can get
+	publicKey, err := x509.MarshalPKIXPublicKey(u.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	symmetric := craftToken(t, map[string]string{"alg": "HS256", "kid": kid}, claims, func(input []byte) []byte {
+		mac := hmac.New(sha256.New, publicKey)
+		mac.Write(input)
+		return mac.Sum(nil)
+	})
+	if err := verify(symmetric, ALG_RS256, "HS256"); err == nil {
+		t.Error("verifyUpstreamToken accepted a token signed with HS256")
+	}
+
+	// The key's own algorithm must match, if it has one
+	pss := craftToken(t, map[string]string{"alg": "PS256", "kid": kid}, claims, func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		sig, err := rsa.SignPSS(rand.Reader, u.key, crypto.SHA256, digest[:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	})
+	if err := verify(pss, ALG_RS256, "PS256"); err == nil {
+		t.Error("verifyUpstreamToken accepted a PS256 token signed with an RS256 key")
+	}
+}
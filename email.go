@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	html "html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	text "text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/square/go-jose"
+)
+
+// EmailAuthenticator verifies email addresses by sending a one-time
+// confirmation link which the user must open to finish logging in.
+type EmailAuthenticator struct {
+	issuer string
+	mailer Mailer
+	store  SessionStore
+
+	// If set, confirmation links only work in the browser which asked for
+	// them, which gets a cookie signed with this key
+	csrfKey []byte
+
+	// If set, confirmation tokens are signed with this key and carry the
+	// request themselves, instead of being kept in store
+	linkKey crypto.Signer
+
+	// How long confirmation links work for
+	linkLifetime time.Duration
+	clock        Clock
+}
+
+// newEmailAuthenticator creates an EmailAuthenticator which sends links back
+// to issuer, the url its routes are under, using mailer, and keeps pending
+// requests in store. Links work for LINK_LIFETIME.
+func newEmailAuthenticator(issuer string, mailer Mailer, store SessionStore) *EmailAuthenticator {
+	return &EmailAuthenticator{
+		issuer:       issuer,
+		mailer:       mailer,
+		store:        store,
+		linkLifetime: LINK_LIFETIME,
+		clock:        realClock{},
+	}
+}
+
+// ErrLinkExpired is returned when redeeming a confirmation token which has
+// outlived the link's lifetime.
+var ErrLinkExpired = errors.New("This confirmation link has expired")
+
+const confirmPath = "/confirm"
+
+// csrfCookie holds the signature of the pending confirmation token, when
+// links must be opened in the same browser. Starting another login in the
+// same browser replaces it.
+const csrfCookie = "authdaemon_csrf"
+
+// emailSessionPrefix namespaces our sessions, so that ids handed out by other
+// Authenticators can't be used as confirmation tokens.
+const emailSessionPrefix = "email:"
+
+// requireSameBrowser makes confirmation links only work in the browser which
+// started logging in, using key to sign a cookie bound to the link's token.
+// Otherwise, someone could start logging in as themselves, then trick a victim
+// into opening the link, logging the victim in to the client as them.
+//
+// Users can then no longer start logging in on one device and open the link
+// on another, such as their phone.
+func (auth *EmailAuthenticator) requireSameBrowser(key []byte) {
+	auth.csrfKey = key
+}
+
+// statelessLinks makes confirmation tokens signed values which carry the
+// pending request, so that any instance with key can check them without a
+// shared SessionStore.
+//
+// As nothing records their use, links then work until they expire rather than
+// only once, and a client's nonce is no longer kept from completing two logins.
+func (auth *EmailAuthenticator) statelessLinks(key crypto.Signer) {
+	auth.linkKey = key
+}
+
+// expireLinks makes confirmation links work for lifetime, rather than
+// LINK_LIFETIME. Unless links are stateless, the SessionStore must keep
+// sessions for at least as long.
+func (auth *EmailAuthenticator) expireLinks(lifetime time.Duration) {
+	auth.linkLifetime = lifetime
+}
+
+// confirmUse marks signed tokens as confirmation tokens, so that no other
+// token we sign, like an id_token, can be passed off as one.
+const confirmUse = "email_confirmation"
+
+// confirmClaims are the contents of a signed confirmation token.
+type confirmClaims struct {
+	Use     string      `json:"use"`
+	Request AuthRequest `json:"req"`
+	Expiry  int64       `json:"exp"`
+}
+
+// issueToken returns a confirmation token for req: a signed one if links are
+// stateless, or else a random one which req is saved under.
+//
+// Random tokens end with their expiry, like abc.1500000000, which as it's
+// part of the session id can't be changed without the token no longer
+// matching one.
+func (auth *EmailAuthenticator) issueToken(req AuthRequest) (string, error) {
+	expiry := auth.clock.Now().Add(auth.linkLifetime).Unix()
+	if auth.linkKey != nil {
+		return signToken(auth.linkKey, confirmClaims{
+			Use:     confirmUse,
+			Request: req,
+			Expiry:  expiry,
+		})
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	token += "." + strconv.FormatInt(expiry, 10)
+	return token, auth.store.Save(emailSessionPrefix+token, req)
+}
+
+// redeemToken returns the request a confirmation token was issued for, or
+// ErrLinkExpired if it has expired. Unless links are stateless, the token
+// can't be redeemed again.
+func (auth *EmailAuthenticator) redeemToken(token string) (AuthRequest, error) {
+	if auth.linkKey == nil {
+		_, suffix, _ := strings.Cut(token, ".")
+		expiry, err := strconv.ParseInt(suffix, 10, 64)
+		if err != nil {
+			return AuthRequest{}, ErrNoSession
+		}
+		if auth.clock.Now().Unix() >= expiry {
+			return AuthRequest{}, ErrLinkExpired
+		}
+		return auth.store.Consume(emailSessionPrefix + token)
+	}
+
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return AuthRequest{}, errors.New("Malformed confirmation token")
+	}
+
+	payload, err := jws.Verify(auth.linkKey.Public())
+	if err != nil {
+		return AuthRequest{}, errors.New("Confirmation token signature is invalid")
+	}
+
+	var claims confirmClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Use != confirmUse {
+		return AuthRequest{}, errors.New("Not a confirmation token")
+	}
+
+	if auth.clock.Now().Unix() >= claims.Expiry {
+		return AuthRequest{}, ErrLinkExpired
+	}
+
+	return claims.Request, nil
+}
+
+// forgetToken stops an unused confirmation token from being redeemed, if it's
+// kept in the store.
+func (auth *EmailAuthenticator) forgetToken(token string) {
+	if auth.linkKey == nil {
+		auth.store.Delete(emailSessionPrefix + token)
+	}
+}
+
+// csrfKey returns the key for signing csrfCookies, which is secret if set.
+// Otherwise, a random key is generated, which other instances won't share.
+func csrfKey(secret string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// csrfToken signs token, binding it to the browser which is given the result.
+func (auth *EmailAuthenticator) csrfToken(token string) string {
+	mac := hmac.New(sha256.New, auth.csrfKey)
+	mac.Write([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setCSRFCookie sets or, with an empty value, clears the csrfCookie. It's
+// only sent with requests for confirmation links, including when they're
+// opened from an email, which SameSite=Lax allows.
+func (auth *EmailAuthenticator) setCSRFCookie(c *gin.Context, value string) {
+	maxAge := 0
+	if value == "" {
+		maxAge = -1
+	}
+
+	// Confirmation links are under the issuer's path, if it has one. The
+	// cookie can only be kept from plain HTTP if the issuer doesn't use it.
+	base, secure := "", true
+	if u, err := url.Parse(auth.issuer); err == nil {
+		base, secure = u.Path, u.Scheme != SCHEME_HTTP
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     base + confirmPath,
+		MaxAge:   maxAge,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearBrowser clears the csrfCookie when the user logs out, so that no login
+// they started in this browser can be finished in it.
+func (auth *EmailAuthenticator) clearBrowser(c *gin.Context) {
+	auth.setCSRFCookie(c, "")
+}
+
+// AddRoutes registers the endpoint that confirmation links point to.
+func (auth *EmailAuthenticator) AddRoutes(router gin.IRouter, done CompleteFunc) {
+	router.GET(confirmPath, auth.confirm(done))
+}
+
+// Accepts reports that any email address can receive a confirmation link.
+func (auth *EmailAuthenticator) Accepts(ctx context.Context, email string) bool {
+	return true
+}
+
+// Start emails a confirmation link to req.LoginHint and tells the user to
+// go check their inbox.
+func (auth *EmailAuthenticator) Start(c *gin.Context, req AuthRequest) {
+	token, err := auth.issueToken(req)
+	if err != nil {
+		respondError(c, 500, "Session Error", err.Error())
+		return
+	}
+
+	data := emailData{
+		Email:  req.LoginHint,
+		Client: req.ClientID,
+		Link:   auth.issuer + confirmPath + "?token=" + url.QueryEscape(token),
+	}
+
+	var textBody, htmlBody bytes.Buffer
+	if err := emailTextTemplate.Execute(&textBody, data); err != nil {
+		respondError(c, 500, "Unknown Error", err.Error())
+		return
+	}
+	if err := emailHTMLTemplate.Execute(&htmlBody, data); err != nil {
+		respondError(c, 500, "Unknown Error", err.Error())
+		return
+	}
+
+	ctx := withMailRequest(c.Request.Context(), mailRequest{RequestID: c.GetString(requestIDKey), ClientID: req.ClientID})
+	if err := auth.mailer.Send(ctx, req.LoginHint, "Finish logging in to "+req.ClientID, textBody.String(), htmlBody.String()); err != nil {
+		auth.forgetToken(token)
+		log.Printf("[mail] request_id=%s Could not send to %s: %s", c.GetString(requestIDKey), req.LoginHint, err)
+		status := 500
+		if errors.Is(err, ErrMailQueueFull) || errors.Is(err, ErrMailQueueClosed) {
+			status = 503
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			status = 504
+		}
+		respondError(c, status, "Mail Error", "Could not send confirmation email: "+err.Error())
+		return
+	}
+
+	if auth.csrfKey != nil {
+		auth.setCSRFCookie(c, auth.csrfToken(token))
+	}
+
+	recordOutcome(c, outcomeEmailSent)
+	renderPage(c, 200, "check_email.html", checkEmailPage{Client: req.ClientID, Email: req.LoginHint})
+}
+
+// confirm creates a handler which finishes authentication for users who open
+// a confirmation link. Each link may only be used once.
+//
+// If links must be opened in the same browser, the csrfCookie is checked
+// before the link is used, so that opening it elsewhere doesn't use it up.
+func (auth *EmailAuthenticator) confirm(done CompleteFunc) func(*gin.Context) {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+
+		if auth.csrfKey != nil {
+			cookie, _ := c.Cookie(csrfCookie)
+			if token == "" || !secretsEqual(cookie, auth.csrfToken(token)) {
+				failPage(c, 403, "Wrong Browser", "Open this confirmation link in the same browser you used to log in")
+				return
+			}
+		}
+
+		req, err := auth.redeemToken(token)
+		if err == ErrSessionUsed {
+			failPage(c, 400, "Bad Token", "This confirmation link has already been used")
+			return
+		}
+		if err == ErrLinkExpired {
+			failPage(c, 410, "Link Expired", "This confirmation link has expired. Please go back and try logging in again.")
+			return
+		}
+		if token == "" || err != nil {
+			failPage(c, 400, "Bad Token", "This confirmation link is invalid or has expired")
+			return
+		}
+
+		if auth.csrfKey != nil {
+			auth.setCSRFCookie(c, "")
+		}
+
+		done(c, req, req.LoginHint, AMR_EMAIL)
+	}
+}
+
+// --- TEMPLATES ---
+
+// emailData holds the values interpolated into confirmation emails.
+type emailData struct {
+	Email  string
+	Client string
+	Link   string
+}
+
+var emailTextTemplate = text.Must(text.New("email.txt").Parse(
+	`Hello,
+
+To finish logging in to {{.Client}} as {{.Email}}, open this link:
+
+{{.Link}}
+
+If you did not try to log in, you can safely ignore this email.
+`))
+
+var emailHTMLTemplate = html.Must(html.New("email.html").Parse(
+	`<p>Hello,</p>
+<p>To finish logging in to {{.Client}} as {{.Email}}, <a href="{{.Link}}">click here</a>.</p>
+<p>If you did not try to log in, you can safely ignore this email.</p>
+`))
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/square/go-jose"
+)
+
+// fakeMessage is an email captured by fakeMailer.
+type fakeMessage struct {
+	to, subject, textBody, htmlBody string
+}
+
+// fakeMailer records messages instead of sending them.
+type fakeMailer struct {
+	sent []fakeMessage
+	err  error
+}
+
+func (m *fakeMailer) Send(ctx context.Context, to, subject, textBody, htmlBody string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, fakeMessage{to, subject, textBody, htmlBody})
+	return nil
+}
+
+// validAuthForm returns the body of a well-formed authorization request.
+func validAuthForm() url.Values {
+	return url.Values{
+		"scope":         {"openid email"},
+		"response_type": {"id_token"},
+		"client_id":     {"https://client.example"},
+		"redirect_uri":  {"https://client.example/callback"},
+		"login_hint":    {"foo@example.com"},
+		"state":         {"xyzzy"},
+		"nonce":         {"n-0S6_WzA2Mj"},
+	}
+}
+
+// newEmailTestRouter returns a router with OpenID Connect routes backed by an
+// EmailAuthenticator that delivers to mailer.
+func newEmailTestRouter(t *testing.T, mailer Mailer) (*gin.Engine, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	store := newMemorySessionStore(SESSION_LIFETIME)
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, newEmailAuthenticator("https://issuer.example", mailer, store))
+
+	return router, key
+}
+
+func postForm(router http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func get(router http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+var linkRE = regexp.MustCompile(`https://issuer\.example(/confirm\?token=[-_.a-zA-Z0-9%]+)`)
+
+// emailLogin submits an authorization request, follows the confirmation link
+// emailed to mailer, and returns the claims of the resulting id_token.
+func emailLogin(t *testing.T, router http.Handler, mailer *fakeMailer, key crypto.PublicKey, form url.Values) IDToken {
+	t.Helper()
+
+	if w := postForm(router, "/authorize", form); w.Code != 200 {
+		t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+	}
+
+	msg := mailer.sent[len(mailer.sent)-1]
+	match := linkRE.FindStringSubmatch(msg.textBody)
+	if match == nil {
+		t.Fatalf("email does not contain a confirmation link: %s", msg.textBody)
+	}
+
+	w := get(router, match[1])
+	if w.Code != 200 {
+		t.Fatalf("GET %s returned %d: %s", match[1], w.Code, w.Body.String())
+	}
+
+	_, params := parseFormPost(t, w.Body.String())
+	return verifiedClaims(t, params.Get("id_token"), key)
+}
+
+func TestEmailRoundTrip(t *testing.T) {
+	mailer := &fakeMailer{}
+	router, key := newEmailTestRouter(t, mailer)
+
+	w := postForm(router, "/authorize", validAuthForm())
+	if w.Code != 200 {
+		t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+	}
+
+	if !strings.Contains(w.Body.String(), "Check your email") {
+		t.Errorf("POST /authorize did not render the check your email page: %s", w.Body.String())
+	}
+
+	if len(mailer.sent) != 1 {
+		t.Fatalf("expected 1 email to be sent, got %d", len(mailer.sent))
+	}
+
+	msg := mailer.sent[0]
+	if msg.to != "foo@example.com" {
+		t.Errorf("email sent to %q instead of foo@example.com", msg.to)
+	}
+
+	match := linkRE.FindStringSubmatch(msg.textBody)
+	if match == nil {
+		t.Fatalf("email does not contain a confirmation link: %s", msg.textBody)
+	}
+
+	if !strings.Contains(msg.htmlBody, match[0]) {
+		t.Errorf("email HTML part does not contain the confirmation link %q", match[0])
+	}
+
+	w = get(router, match[1])
+	if w.Code != 200 {
+		t.Fatalf("GET %s returned %d: %s", match[1], w.Code, w.Body.String())
+	}
+
+	action, params := parseFormPost(t, w.Body.String())
+	if action != "https://client.example/callback" {
+		t.Errorf("confirmation posts to %q instead of the redirect_uri", action)
+	}
+
+	if state := params.Get("state"); state != "xyzzy" {
+		t.Errorf("response has state %q instead of xyzzy", state)
+	}
+
+	jws, err := jose.ParseSigned(params.Get("id_token"))
+	if err != nil {
+		t.Fatalf("response does not contain a valid id_token: %s", err)
+	}
+
+	payload, err := jws.Verify(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("id_token signature did not verify: %s", err)
+	}
+
+	var claims IDToken
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Email != "foo@example.com" || !claims.EmailVerified {
+		t.Errorf("id_token does not assert foo@example.com is verified: %+v", claims)
+	}
+
+	if claims.Nonce != "n-0S6_WzA2Mj" {
+		t.Errorf("id_token has nonce %q instead of n-0S6_WzA2Mj", claims.Nonce)
+	}
+
+	if len(claims.AuthMethods) != 1 || claims.AuthMethods[0] != AMR_EMAIL {
+		t.Errorf("id_token has amr %q instead of [%q]", claims.AuthMethods, AMR_EMAIL)
+	}
+
+	// Links can only be used once
+	if w = get(router, match[1]); w.Code != 400 || !strings.Contains(w.Body.String(), "already been used") {
+		t.Errorf("reusing a confirmation link returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestEmailPKCE(t *testing.T) {
+	mailer := &fakeMailer{}
+	router, _ := newEmailTestRouter(t, mailer)
+
+	form := validAuthForm()
+	form.Set("code_challenge", "lJhBIgJzn9ty8k15Z3ssytxRJ7rUIpGYGJeNVq7mM08")
+	form.Set("code_challenge_method", "S256")
+
+	// Confirmation links are opened by the user, never the client, so no
+	// code_verifier could reach them. The request is refused before any link
+	// is sent.
+	w := postForm(router, "/authorize", form)
+	if w.Code != 302 {
+		t.Fatalf("POST /authorize with a code_challenge returned %d: %s", w.Code, w.Body.String())
+	}
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := u.Query().Get("error"); code != "invalid_request" || !strings.Contains(u.Query().Get("error_description"), "code_challenge") {
+		t.Errorf("POST /authorize with a code_challenge redirected to %s", u)
+	}
+	if len(mailer.sent) != 0 {
+		t.Errorf("POST /authorize with a code_challenge sent %d emails", len(mailer.sent))
+	}
+}
+
+func TestEmailNonceReplay(t *testing.T) {
+	mailer := &fakeMailer{}
+	router, _ := newEmailTestRouter(t, mailer)
+
+	// Start two logins with the same nonce
+	for i := 0; i < 2; i++ {
+		if w := postForm(router, "/authorize", validAuthForm()); w.Code != 200 {
+			t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	var links []string
+	for _, msg := range mailer.sent {
+		links = append(links, linkRE.FindStringSubmatch(msg.textBody)[1])
+	}
+
+	if w := get(router, links[0]); w.Code != 200 {
+		t.Fatalf("GET %s returned %d: %s", links[0], w.Code, w.Body.String())
+	}
+
+	// Only one of them may finish, or the client could be sent two id_tokens
+	// for the same nonce
+	if w := get(router, links[1]); w.Code != 400 {
+		t.Errorf("confirming a second login with a used nonce returned %d instead of 400", w.Code)
+	}
+}
+
+func TestEmailBadToken(t *testing.T) {
+	router, _ := newEmailTestRouter(t, &fakeMailer{})
+
+	for _, path := range []string{"/confirm", "/confirm?token=", "/confirm?token=bogus"} {
+		if w := get(router, path); w.Code != 400 {
+			t.Errorf("GET %s returned %d instead of 400", path, w.Code)
+		}
+	}
+}
+
+func TestEmailLinkExpiry(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Links outlive the session lifetime, which the store must cover too
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	store := newMemorySessionStore(time.Hour)
+	store.clock = clock
+	mailer := &fakeMailer{}
+	auth := newEmailAuthenticator("https://issuer.example", mailer, store)
+	auth.expireLinks(time.Hour)
+	auth.clock = clock
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Clock: clock}, auth)
+
+	var links []string
+	for i := 0; i < 2; i++ {
+		if w := postForm(router, "/authorize", validAuthForm()); w.Code != 200 {
+			t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+		}
+		match := linkRE.FindStringSubmatch(mailer.sent[i].textBody)
+		if match == nil {
+			t.Fatal("email does not contain a confirmation link")
+		}
+		links = append(links, match[1])
+	}
+
+	clock.Advance(time.Hour - time.Second)
+	if w := get(router, links[0]); w.Code != 200 {
+		t.Errorf("confirming in the last second of the link's lifetime returned %d: %s", w.Code, w.Body.String())
+	}
+
+	clock.Advance(time.Second)
+	w := get(router, links[1])
+	if w.Code != 410 || !strings.Contains(w.Body.String(), "This confirmation link has expired") {
+		t.Errorf("confirming an expired link returned %d instead of the expiry page: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestEmailSameBrowser(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &fakeMailer{}
+	auth := newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME))
+	auth.requireSameBrowser([]byte("0123456789abcdef"))
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, auth)
+
+	// start logs in, returning the confirmation link and the browser's cookie
+	start := func(nonce string) (string, *http.Cookie) {
+		form := validAuthForm()
+		form.Set("nonce", nonce)
+		w := postForm(router, "/authorize", form)
+		if w.Code != 200 {
+			t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+		}
+
+		var cookie *http.Cookie
+		for _, v := range w.Result().Cookies() {
+			if v.Name == csrfCookie {
+				cookie = v
+			}
+		}
+		if cookie == nil || !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != confirmPath {
+			t.Fatalf("POST /authorize set cookie %v instead of a secure, HttpOnly, SameSite=Lax one for %s", cookie, confirmPath)
+		}
+
+		match := linkRE.FindStringSubmatch(mailer.sent[len(mailer.sent)-1].textBody)
+		if match == nil {
+			t.Fatal("email does not contain a confirmation link")
+		}
+		return match[1], cookie
+	}
+
+	confirm := func(link string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", link, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	link, cookie := start("nonce-1")
+	_, other := start("nonce-2")
+
+	if w := confirm(link, nil); w.Code != 403 {
+		t.Errorf("GET %s without a cookie returned %d instead of 403", link, w.Code)
+	}
+	if w := confirm(link, other); w.Code != 403 {
+		t.Errorf("GET %s with another login's cookie returned %d instead of 403", link, w.Code)
+	}
+	if w := confirm(link, &http.Cookie{Name: csrfCookie, Value: "bogus"}); w.Code != 403 {
+		t.Errorf("GET %s with a bogus cookie returned %d instead of 403", link, w.Code)
+	}
+
+	// The rejected attempts didn't use up the link
+	w := confirm(link, cookie)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "id_token") {
+		t.Fatalf("GET %s with its cookie returned %d: %s", link, w.Code, w.Body.String())
+	}
+
+	cleared := false
+	for _, v := range w.Result().Cookies() {
+		cleared = cleared || (v.Name == csrfCookie && v.MaxAge < 0)
+	}
+	if !cleared {
+		t.Errorf("GET %s did not clear the %s cookie", link, csrfCookie)
+	}
+}
+
+func TestEmailNoCookieByDefault(t *testing.T) {
+	router, _ := newEmailTestRouter(t, &fakeMailer{})
+
+	w := postForm(router, "/authorize", validAuthForm())
+	if cookies := w.Result().Cookies(); len(cookies) > 0 {
+		t.Errorf("POST /authorize set cookies %v without require_same_browser", cookies)
+	}
+}
+
+func TestEmailStatelessLinks(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a SessionStore, as none should be needed
+	mailer := &fakeMailer{}
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	auth := newEmailAuthenticator("https://issuer.example", mailer, nil)
+	auth.statelessLinks(key)
+	auth.clock = clock
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, auth)
+
+	claims := emailLogin(t, router, mailer, &key.PublicKey, validAuthForm())
+	if claims.Email != "foo@example.com" || claims.Nonce != "n-0S6_WzA2Mj" {
+		t.Errorf("stateless confirmation link issued an id_token for %q with nonce %q", claims.Email, claims.Nonce)
+	}
+
+	req := AuthRequest{
+		Scope:        "openid email",
+		ResponseType: "id_token",
+		ClientID:     "https://client.example",
+		RedirectURI:  "https://client.example/callback",
+		LoginHint:    "foo@example.com",
+		State:        "xyzzy",
+		Nonce:        "n-0S6_WzA2Mj",
+	}
+	token, err := auth.issueToken(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if redeemed, err := auth.redeemToken(token); err != nil || redeemed != req {
+		t.Errorf("redeemToken returned %+v (%v) instead of the original request", redeemed, err)
+	}
+
+	// Swapping in another address keeps the signature, which no longer matches
+	parts := strings.Split(token, ".")
+	forged := req
+	forged.LoginHint = "victim@example.com"
+	payload, err := json.Marshal(confirmClaims{Use: confirmUse, Request: forged, Expiry: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigned, err := signToken(otherKey, confirmClaims{Use: confirmUse, Request: req, Expiry: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken, err := signToken(key, newIDToken(ProviderConfig{Origin: "issuer.example", Lifetime: TOKEN_LIFETIME}, req, req.LoginHint, AMR_EMAIL, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		token       string
+	}{
+		{"a tampered token", tampered},
+		{"a token signed by another key", otherSigned},
+		{"an id_token", idToken},
+		{"a random token", "bogus"},
+	}
+
+	for _, test := range tests {
+		if _, err := auth.redeemToken(test.token); err == nil {
+			t.Errorf("redeemToken accepted %s", test.description)
+		}
+		if w := get(router, confirmPath+"?token="+url.QueryEscape(test.token)); w.Code != 400 {
+			t.Errorf("GET /confirm with %s returned %d instead of 400", test.description, w.Code)
+		}
+	}
+
+	// Links work until the very end of their lifetime
+	clock.Advance(LINK_LIFETIME - time.Second)
+	if _, err := auth.redeemToken(token); err != nil {
+		t.Errorf("redeemToken rejected a token in the last second of its lifetime: %s", err)
+	}
+
+	clock.Advance(time.Second)
+	if _, err := auth.redeemToken(token); err != ErrLinkExpired {
+		t.Errorf("redeemToken returned %v for an expired token instead of ErrLinkExpired", err)
+	}
+
+	// Failing to send leaves nothing to clean up
+	mailer.err = errors.New("connection refused")
+	if w := postForm(router, "/authorize", validAuthForm()); w.Code != 500 {
+		t.Errorf("POST /authorize with a broken mailer returned %d instead of 500", w.Code)
+	}
+}
+
+func TestEmailSendFailure(t *testing.T) {
+	router, _ := newEmailTestRouter(t, &fakeMailer{err: errors.New("connection refused")})
+
+	if w := postForm(router, "/authorize", validAuthForm()); w.Code != 500 {
+		t.Errorf("POST /authorize with a broken mailer returned %d instead of 500", w.Code)
+	}
+}
+
+func TestEmailOverSMTP(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	router, _ := newEmailTestRouter(t, newSMTPMailer(server.config()))
+
+	if w := postForm(router, "/authorize", validAuthForm()); w.Code != 200 {
+		t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+	}
+
+	delivered := server.delivered()
+	if len(delivered) != 1 {
+		t.Fatalf("expected 1 message to be delivered, got %d", len(delivered))
+	}
+
+	_, parts := parseMessage(t, delivered[0])
+	for _, part := range []string{"text/plain", "text/html"} {
+		if !linkRE.MatchString(parts[part]) {
+			t.Errorf("message %s part does not contain a confirmation link: %s", part, parts[part])
+		}
+	}
+}
+
+func TestEmailLoginTimeout(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, _ := stallingSMTPServer(t)
+	router := gin.New()
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, LoginTimeout: 50 * time.Millisecond}
+	oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", newSMTPMailer(server.config()), newMemorySessionStore(SESSION_LIFETIME)))
+
+	start := time.Now()
+	if w := postForm(router, "/authorize", validAuthForm()); w.Code != 504 {
+		t.Errorf("POST /authorize with a stalled SMTP server returned %d instead of 504: %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("POST /authorize with a stalled SMTP server took %s", elapsed)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/callahad/authdaemon/internal/validation"
+	"github.com/gin-gonic/gin"
+)
+
+// googleDomains lists the email domains hosted by Google.
+var googleDomains = []string{"gmail.com", "googlemail.com"}
+
+// GoogleDelegate authenticates Google-hosted email addresses by delegating to
+// Google's own OpenID Connect provider, as documented at
+// https://developers.google.com/identity/protocols/OpenIDConnect.
+//
+// The implicit flow is used, so only a client_id is required: Google posts a
+// signed id_token straight back to our callback, and we verify it ourselves.
+type GoogleDelegate struct {
+	ClientID string
+
+	issuer   string
+	algs     []string
+	upstream upstream
+	docs     *documentCache
+	store    SessionStore
+}
+
+// newGoogleDelegate creates a GoogleDelegate for the OAuth client registered
+// with Google as clientID, with callbacks under issuer, which fetches Google's
+// keys through docs, and accepts id_tokens signed with any of algs. Pending
+// requests are kept in store.
+func newGoogleDelegate(issuer string, clientID string, store SessionStore, docs *documentCache, algs []string) *GoogleDelegate {
+	return &GoogleDelegate{
+		ClientID: clientID,
+		issuer:   issuer,
+		algs:     algs,
+		upstream: upstream{
+			name:         "Google",
+			issuers:      []string{"https://accounts.google.com", "accounts.google.com"},
+			authEndpoint: "https://accounts.google.com/o/oauth2/v2/auth",
+			jwksURI:      "https://www.googleapis.com/oauth2/v3/certs",
+		},
+		docs:  docs,
+		store: store,
+	}
+}
+
+const googleCallbackPath = "/callback/google"
+
+// googleSessionPrefix namespaces our sessions in the SessionStore.
+const googleSessionPrefix = "google:"
+
+// AddRoutes registers the endpoint Google posts its responses to.
+func (g *GoogleDelegate) AddRoutes(router gin.IRouter, done CompleteFunc) {
+	router.POST(googleCallbackPath, g.callback(done))
+}
+
+// Accepts reports whether email belongs to a Google-hosted domain.
+func (g *GoogleDelegate) Accepts(ctx context.Context, email string) bool {
+	return contains(googleDomains, strings.ToLower(emailDomain(email)))
+}
+
+// IssuerFor returns Google's issuer, for resolveIssuer.
+func (g *GoogleDelegate) IssuerFor(ctx context.Context, email string) (string, error) {
+	return g.upstream.issuers[0], nil
+}
+
+// Start redirects the user to Google to log in.
+func (g *GoogleDelegate) Start(c *gin.Context, req AuthRequest) {
+	state, err := randomToken()
+	if err != nil {
+		respondError(c, 500, "Unknown Error", err.Error())
+		return
+	}
+
+	if err := g.store.Save(googleSessionPrefix+state, req); err != nil {
+		respondError(c, 500, "Session Error", err.Error())
+		return
+	}
+
+	params := url.Values{
+		"client_id":     {g.ClientID},
+		"response_type": {"id_token"},
+		"response_mode": {"form_post"},
+		"scope":         {"openid email"},
+		"redirect_uri":  {g.issuer + googleCallbackPath},
+		"login_hint":    {req.LoginHint},
+		"state":         {state},
+		"nonce":         {upstreamNonce(state)},
+	}
+
+	c.Redirect(302, g.upstream.authEndpoint+"?"+params.Encode())
+}
+
+// callback creates a handler for the id_tokens Google posts back to us. The
+// user is only verified if Google vouches for the same address they gave us.
+func (g *GoogleDelegate) callback(done CompleteFunc) func(*gin.Context) {
+	return func(c *gin.Context) {
+		state := c.PostForm("state")
+
+		req, err := g.store.Consume(googleSessionPrefix + state)
+		if state == "" || err != nil {
+			fail(c, "unknown_state", "Bad State", "Unknown or expired login attempt")
+			return
+		}
+
+		if errCode := c.PostForm("error"); errCode != "" {
+			fail(c, "upstream_error", "Upstream Error", "Google returned an error: "+errCode)
+			return
+		}
+
+		email, err := verifyUpstreamToken(c.Request.Context(), g.docs, g.upstream, g.ClientID, c.PostForm("id_token"), upstreamNonce(state), g.algs)
+		if err != nil {
+			fail(c, "invalid_upstream_token", "Bad Token", err.Error())
+			return
+		}
+
+		// The login_hint was normalized by authorize, so compare like with like
+		if normalized, err := validation.NormalizeEmail(email); err != nil || !strings.EqualFold(normalized, req.LoginHint) {
+			fail(c, "email_mismatch", "Email Mismatch", fmt.Sprintf("Logged in to Google as %s instead of %s", email, req.LoginHint))
+			return
+		}
+
+		done(c, req, req.LoginHint, AMR_GOOGLE)
+	}
+}
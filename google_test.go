@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeGoogle is a GoogleDelegate wired to a local JWKS endpoint, along with
+// the key for signing upstream id_tokens.
+type fakeGoogle struct {
+	*GoogleDelegate
+	key    *rsa.PrivateKey
+	ourKey *rsa.PrivateKey // For verifying the id_tokens we issue
+	router *gin.Engine
+}
+
+func newFakeGoogle(t *testing.T) *fakeGoogle {
+	googleKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ourKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	jwks := gin.New()
+	jwks.GET("/certs", keyset(googleKey, 0))
+	server := httptest.NewServer(jwks)
+	t.Cleanup(server.Close)
+
+	store := newMemorySessionStore(SESSION_LIFETIME)
+	docs := newDocumentCache(DISCOVERY_TTL, UPSTREAM_MAX_AGE, DISCOVERY_CACHE_SIZE)
+	docs.client = server.Client()
+	g := newGoogleDelegate("https://issuer.example", "our-client-id", store, docs, []string{ALG_RS256})
+	g.upstream.jwksURI = server.URL + "/certs"
+
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: ourKey, Lifetime: TOKEN_LIFETIME}, g, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, store))
+
+	return &fakeGoogle{g, googleKey, ourKey, router}
+}
+
+// login starts an authorization request for email, and returns the state and
+// nonce sent to Google.
+func (g *fakeGoogle) login(t *testing.T, email string) (string, string) {
+	form := validAuthForm()
+	form.Set("login_hint", email)
+
+	// Each login needs its own nonce, or it will be rejected as a replay
+	nonce, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("nonce", nonce)
+
+	w := postForm(g.router, "/authorize", form)
+	if w.Code != 302 {
+		t.Fatalf("POST /authorize for %s returned %d instead of redirecting: %s", email, w.Code, w.Body.String())
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(location.String(), g.upstream.authEndpoint+"?") {
+		t.Fatalf("POST /authorize redirected to %s instead of Google", location)
+	}
+
+	params := location.Query()
+	expected := map[string]string{
+		"client_id":     "our-client-id",
+		"response_type": "id_token",
+		"response_mode": "form_post",
+		"redirect_uri":  "https://issuer.example/callback/google",
+		"login_hint":    email,
+	}
+	for k, v := range expected {
+		if params.Get(k) != v {
+			t.Errorf("Google redirect has %s=%q instead of %q", k, params.Get(k), v)
+		}
+	}
+
+	return params.Get("state"), params.Get("nonce")
+}
+
+// respond posts an id_token with the given claims to our Google callback.
+func (g *fakeGoogle) respond(t *testing.T, state string, claims upstreamClaims) *httptest.ResponseRecorder {
+	token, err := signToken(g.key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return postForm(g.router, "/callback/google", url.Values{
+		"state":    {state},
+		"id_token": {token},
+	})
+}
+
+func TestGoogleAccepts(t *testing.T) {
+	g := newGoogleDelegate("https://issuer.example", "our-client-id", newMemorySessionStore(SESSION_LIFETIME), newDocumentCache(DISCOVERY_TTL, UPSTREAM_MAX_AGE, DISCOVERY_CACHE_SIZE), []string{ALG_RS256})
+
+	for _, email := range []string{"foo@gmail.com", "foo@googlemail.com", "foo@GMail.com"} {
+		if !g.Accepts(context.Background(), email) {
+			t.Errorf("GoogleDelegate.Accepts(%q) unexpectedly returned false", email)
+		}
+	}
+
+	for _, email := range []string{"foo@example.com", "foo@gmail.com.evil.com", "gmail.com@example.com"} {
+		if g.Accepts(context.Background(), email) {
+			t.Errorf("GoogleDelegate.Accepts(%q) unexpectedly returned true", email)
+		}
+	}
+}
+
+func TestGoogleRoundTrip(t *testing.T) {
+	g := newFakeGoogle(t)
+	state, nonce := g.login(t, "foo@gmail.com")
+
+	w := g.respond(t, state, upstreamClaims{
+		Issuer:        "https://accounts.google.com",
+		Audience:      "our-client-id",
+		Expiry:        time.Now().Add(time.Minute).Unix(),
+		Nonce:         nonce,
+		Email:         "foo@gmail.com",
+		EmailVerified: true,
+	})
+
+	if w.Code != 200 {
+		t.Fatalf("Google callback returned %d: %s", w.Code, w.Body.String())
+	}
+
+	action, params := parseFormPost(t, w.Body.String())
+	if action != "https://client.example/callback" {
+		t.Errorf("Google callback posts to %q instead of the redirect_uri", action)
+	}
+
+	claims := verifiedClaims(t, params.Get("id_token"), &g.ourKey.PublicKey)
+	if len(claims.AuthMethods) != 1 || claims.AuthMethods[0] != AMR_GOOGLE {
+		t.Errorf("Google callback issued an id_token with amr %q instead of [%q]", claims.AuthMethods, AMR_GOOGLE)
+	}
+
+	// The state can only be used once
+	if w = g.respond(t, state, upstreamClaims{}); w.Code != 400 {
+		t.Errorf("reusing a Google state returned %d instead of 400", w.Code)
+	}
+}
+
+func TestGoogleRejectsBadTokens(t *testing.T) {
+	g := newFakeGoogle(t)
+
+	valid := func(nonce string) upstreamClaims {
+		return upstreamClaims{
+			Issuer:        "https://accounts.google.com",
+			Audience:      "our-client-id",
+			Expiry:        time.Now().Add(time.Minute).Unix(),
+			Nonce:         nonce,
+			Email:         "foo@gmail.com",
+			EmailVerified: true,
+		}
+	}
+
+	tests := []struct {
+		description string
+		modify      func(*upstreamClaims)
+	}{
+		{"email mismatch", func(c *upstreamClaims) { c.Email = "bar@gmail.com" }},
+		{"unverified email", func(c *upstreamClaims) { c.EmailVerified = false }},
+		{"wrong audience", func(c *upstreamClaims) { c.Audience = "someone-else" }},
+		{"wrong issuer", func(c *upstreamClaims) { c.Issuer = "https://evil.example" }},
+		{"wrong nonce", func(c *upstreamClaims) { c.Nonce = "bogus" }},
+		{"expired", func(c *upstreamClaims) { c.Expiry = time.Now().Add(-time.Minute).Unix() }},
+	}
+
+	for _, test := range tests {
+		state, nonce := g.login(t, "foo@gmail.com")
+		claims := valid(nonce)
+		test.modify(&claims)
+
+		if w := g.respond(t, state, claims); w.Code != 400 {
+			t.Errorf("Google callback with %s returned %d instead of 400", test.description, w.Code)
+		}
+	}
+}
+
+func TestGoogleStateIsNotAConfirmationToken(t *testing.T) {
+	g := newFakeGoogle(t)
+	state, _ := g.login(t, "foo@gmail.com")
+
+	if w := get(g.router, "/confirm?token="+url.QueryEscape(state)); w.Code != 400 {
+		t.Errorf("confirming with a Google state returned %d instead of 400", w.Code)
+	}
+}
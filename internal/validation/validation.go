@@ -0,0 +1,321 @@
+// Package validation checks the email addresses, urls, and hosts which arrive
+// in requests and configuration, before anything trusts them.
+package validation
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// EmailRE is a quick sanity check for email addresses. It excludes some
+// legitimate addresses, so use ValidEmail to actually validate them.
+var EmailRE = regexp.MustCompile(`^[a-zA-Z0-9][+-_.a-zA-Z0-9]*@[-_.a-zA-Z0-9]+$`)
+
+// ValidEmail checks that s is a bare email address, as per RFC 5322 with
+// RFC 6532 UTF-8 extensions, whose domain has at least two labels and can be
+// converted to ASCII for lookup, as per UTS #46. Display names and angle
+// brackets, like "Foo <foo@example.com>", are not allowed.
+func ValidEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || strings.ContainsAny(s, "<>") || strings.TrimSpace(s) != s {
+		return false
+	}
+
+	domain := addr.Address[strings.LastIndex(addr.Address, "@")+1:]
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" {
+			return false
+		}
+	}
+
+	if _, err := idna.Lookup.ToASCII(domain); err != nil {
+		return false
+	}
+
+	return strings.Contains(domain, ".")
+}
+
+// NormalizeEmail puts an email address into a canonical form, so that the same
+// user always gets the same claims. It strips surrounding whitespace, applies
+// Unicode NFC normalization, and converts the domain to lowercase ASCII, with
+// international domains in their punycode form, so that domains can be matched
+// and looked up however they were written. The local part is left alone, as
+// it may be case-sensitive.
+func NormalizeEmail(s string) (string, error) {
+	email := norm.NFC.String(strings.TrimSpace(s))
+	if !ValidEmail(email) {
+		return "", fmt.Errorf("%q is not a valid email address", s)
+	}
+
+	at := strings.LastIndex(email, "@")
+	domain, err := idna.Lookup.ToASCII(email[at+1:])
+	if err != nil {
+		return "", fmt.Errorf("%q does not have a valid domain: %s", s, err)
+	}
+
+	return email[:at] + "@" + domain, nil
+}
+
+// hostnameRE is used for basic sanity-checking of host names, without ports.
+var hostnameRE = regexp.MustCompile(`^[\-.a-zA-Z0-9]+$`)
+
+// ValidURI ensures that URIs are valid and conform to our expectations.
+func ValidURI(uri string) bool {
+	if !safeChars(uri) {
+		return false
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+
+	tests := []bool{
+		// The URL must parse as a host, port, etc. not just as opaque data.
+		u.Opaque == "",
+
+		// The scheme must be HTTP or HTTPS.
+		u.Scheme == "http" || u.Scheme == "https",
+
+		// The host must not redundantly specify default port numbers.
+		!(u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")),
+		!(u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")),
+
+		// The hostname must be specified.
+		ValidHost(u.Host),
+
+		// The URL must not have a user:password prefix
+		u.User == nil,
+
+		// The URL struct also has Path, RawPath, RawQuery, and Fragment fields.
+		// We don't care about these when assessing the basic validity of a URL.
+	}
+
+	for _, ok := range tests {
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ValidHost checks a host component with an optional port, like example.com,
+// 127.0.0.1:8080, or [::1]:8080. IPv6 literals must be in brackets.
+func ValidHost(hostport string) bool {
+	bracketed := strings.HasPrefix(hostport, "[")
+
+	host, port := hostport, ""
+	if bracketed && strings.HasSuffix(hostport, "]") {
+		host = hostport[1 : len(hostport)-1]
+	} else if strings.Contains(hostport, ":") {
+		var err error
+		if host, port, err = net.SplitHostPort(hostport); err != nil || port == "" {
+			return false
+		}
+	}
+
+	if !ValidPort(port) {
+		return false
+	}
+
+	// Brackets are required around IPv6 addresses, and only allowed there.
+	if bracketed {
+		return strings.Contains(host, ":") && net.ParseIP(host) != nil
+	}
+
+	return hostnameRE.MatchString(host)
+}
+
+// SameHost checks that two URLs have the same host and port, treating
+// different spellings of the same IPv6 address as equal. Host names are
+// case-insensitive, and a single trailing dot, as in the fully qualified
+// "example.com.", is ignored.
+func SameHost(a, b *url.URL) bool {
+	if a.Port() != b.Port() {
+		return false
+	}
+
+	if strings.Contains(a.Hostname(), ":") && strings.Contains(b.Hostname(), ":") {
+		ipA, ipB := net.ParseIP(a.Hostname()), net.ParseIP(b.Hostname())
+		return ipA != nil && ipA.Equal(ipB)
+	}
+
+	return NormalizeHost(a.Hostname()) == NormalizeHost(b.Hostname())
+}
+
+// NormalizeHost lowercases a host name and strips one trailing dot.
+func NormalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// ValidPort checks that a port is either omitted or between 1 and 65535.
+func ValidPort(port string) bool {
+	if port == "" {
+		return true
+	}
+
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// OnlyOrigin checks that a URL is valid and only has a scheme, host, and port.
+//
+// A "?" or "#" with nothing after it, as in http://example.com? or
+// http://example.com#, still counts as a query or fragment. url.Parse leaves
+// both empty, but the URL differs from the origin's serialization, which has
+// neither, so it would never match an Origin header.
+func OnlyOrigin(uri string) bool {
+	u, err := url.Parse(uri)
+
+	if err != nil || !ValidURI(uri) || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+
+	return !strings.ContainsAny(uri, "?#")
+}
+
+// OriginMatches checks that the origin from a request's Origin header is the
+// same as a client_id, including its scheme and port.
+func OriginMatches(headerOrigin string, clientID string) bool {
+	return OnlyOrigin(headerOrigin) && ContainedBy(headerOrigin, clientID)
+}
+
+// RefererOrigin returns the origin of a Referer header.
+func RefererOrigin(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// safeChars checks that s has no control characters, which browsers strip or
+// mishandle, or backslashes, which they treat as slashes in http(s) urls.
+// Either could make a browser see a different host than we did.
+func safeChars(s string) bool {
+	return !strings.ContainsAny(s, "\\\x7f") && !strings.ContainsFunc(s, func(r rune) bool {
+		return r < 0x20
+	})
+}
+
+// maxDecodes is how many layers of percent-encoding ContainedBy unwraps.
+// Nothing legitimate needs more than a couple.
+const maxDecodes = 3
+
+// stillContained checks that uri stays within origin however many times it's
+// percent-decoded, as a sloppy client or proxy might before redirecting. Each
+// decoded form must still be free of unsafe characters and have the same
+// scheme and host.
+func stillContained(uri string, origin *url.URL) bool {
+	for i := 0; i < maxDecodes; i++ {
+		decoded, err := url.PathUnescape(uri)
+		if err != nil || !safeChars(decoded) {
+			return false
+		}
+		if decoded == uri {
+			return true
+		}
+
+		u, err := url.Parse(decoded)
+		if err != nil || u.Scheme != origin.Scheme || u.User != nil || !SameHost(u, origin) {
+			return false
+		}
+		uri = decoded
+	}
+
+	// Still encoded after that many layers, which is only done to hide something
+	return false
+}
+
+// ContainedBy checks that a given URL is within a given origin.
+func ContainedBy(uri string, origin string) bool {
+	// Parse both URLs
+	a, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+
+	b, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	// They must have the same scheme and host:port
+	if a.Scheme != b.Scheme {
+		return false
+	}
+
+	if !SameHost(a, b) {
+		return false
+	}
+
+	// They must both be valid URIs
+	if !ValidURI(origin) || !ValidURI(uri) {
+		return false
+	}
+
+	// The origin URL must only include a scheme, host, and optional port.
+	if !OnlyOrigin(origin) {
+		return false
+	}
+
+	// Encoding mustn't hide a different host
+	return stillContained(uri, b)
+}
+
+// ContainedByPath checks that a given URL is within a given prefix, like
+// https://client.example/callback, which means within its origin, as for
+// ContainedBy, and at or beneath its path. A prefix with no path is just an
+// origin.
+//
+// Paths are compared segment by segment, so /callback doesn't contain
+// /callbackevil, once dot segments are resolved, so /callback/../admin isn't
+// contained either. That holds however many times the path is
+// percent-decoded, in case something decodes it before resolving it.
+func ContainedByPath(uri string, prefix string) bool {
+	p, err := url.Parse(prefix)
+	if err != nil || p.User != nil || p.RawQuery != "" || p.ForceQuery || p.Fragment != "" {
+		return false
+	}
+
+	if !ContainedBy(uri, p.Scheme+"://"+p.Host) {
+		return false
+	}
+
+	allowed := path.Clean("/" + p.Path)
+	if allowed == "/" {
+		return true
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+
+	// ContainedBy has checked that this many layers are enough
+	within := u.Path
+	for i := 0; i < maxDecodes; i++ {
+		if cleaned := path.Clean("/" + within); cleaned != allowed && !strings.HasPrefix(cleaned, allowed+"/") {
+			return false
+		}
+
+		decoded, err := url.PathUnescape(within)
+		if err != nil || decoded == within {
+			return err == nil
+		}
+		within = decoded
+	}
+
+	return false
+}
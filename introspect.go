@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// introspection is the response to a token introspection request, as per
+// https://tools.ietf.org/html/rfc7662#section-2.2. Inactive tokens get no
+// claims at all.
+type introspection struct {
+	Active   bool   `json:"active"`
+	Subject  string `json:"sub,omitempty"`
+	Audience string `json:"aud,omitempty"`
+	Expiry   int64  `json:"exp,omitempty"`
+	IssuedAt int64  `json:"iat,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// introspect creates a handler for token introspection requests, as per RFC
+// 7662, so that resource servers can check our id_tokens without verifying
+// them themselves.
+//
+// Callers must authenticate with HTTP Basic as a client with a secret in
+// p.Clients. Tokens which are malformed, forged, expired, or revoked are all
+// reported the same way, as inactive. Active tokens are kept in p.TokenCache,
+// if there is one, so asking about them again is cheap.
+func introspect(p ProviderConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		clientID, secret, ok := clientCredentials(c.Request)
+		if !ok || !p.Clients.Authenticate(clientID, secret) {
+			c.Header("WWW-Authenticate", `Basic realm="`+p.Origin+`"`)
+			oauthError(c, 401, "invalid_client", "invalid_client", "Client authentication failed")
+			return
+		}
+
+		token := c.PostForm("token")
+		if token == "" {
+			oauthError(c, 400, "invalid_request", "missing_token", "token is required")
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+
+		claims, err := cachedIDToken(p, token)
+		if err != nil {
+			c.JSON(200, introspection{Active: false})
+			return
+		}
+
+		c.JSON(200, introspection{
+			Active:   true,
+			Subject:  claims.Subject,
+			Audience: claims.Audience,
+			Expiry:   claims.Expiry,
+			IssuedAt: claims.IssuedAt,
+			Email:    claims.Email,
+		})
+	}
+}
+
+// clientCredentials returns the client_id and secret from a request's HTTP
+// Basic credentials. As per https://tools.ietf.org/html/rfc6749#section-2.3.1,
+// both are form-encoded first, which keeps the colon in a client_id like
+// https://rs.example from being taken for the separator.
+func clientCredentials(r *http.Request) (string, string, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", "", false
+	}
+
+	clientID, err := url.QueryUnescape(username)
+	if err != nil {
+		return "", "", false
+	}
+
+	secret, err := url.QueryUnescape(password)
+	if err != nil {
+		return "", "", false
+	}
+
+	return clientID, secret, true
+}
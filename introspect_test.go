@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testClientSecret = "correct horse battery staple"
+
+func newIntrospectTestRouter(t *testing.T) (*gin.Engine, ProviderConfig) {
+	clients, err := newClientRegistry(nil, nil, nil, []string{"https://rs.example=" + testClientSecret}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newTestProvider(t, ProviderConfig{Clients: clients})
+}
+
+// postIntrospect asks router about token, authenticating as clientID with
+// secret unless clientID is empty.
+func postIntrospect(router *gin.Engine, clientID string, secret string, token string) *httptest.ResponseRecorder {
+	form := url.Values{"token": {token}}
+	req := httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIntrospectActive(t *testing.T) {
+	router, p := newIntrospectTestRouter(t)
+
+	token, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example", Scope: "openid email"}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := postIntrospect(router, "https://rs.example", testClientSecret, token)
+	if w.Code != 200 {
+		t.Fatalf("POST /introspect returned %d: %s", w.Code, w.Body.String())
+	}
+
+	var response introspection
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if !response.Active || response.Subject != "foo@example.com" || response.Email != "foo@example.com" || response.Audience != "https://client.example" {
+		t.Errorf("POST /introspect for a valid token returned %+v", response)
+	}
+	if response.Expiry <= time.Now().Unix() || response.IssuedAt > time.Now().Unix() {
+		t.Errorf("POST /introspect returned exp %d and iat %d", response.Expiry, response.IssuedAt)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("POST /introspect returned Cache-Control %q instead of no-store", cc)
+	}
+}
+
+func TestIntrospectInactive(t *testing.T) {
+	router, p := newIntrospectTestRouter(t)
+
+	expired, err := signToken(p.Key, newIDToken(p, AuthRequest{ClientID: "https://client.example"}, "foo@example.com", AMR_EMAIL, time.Now().Add(-2*TOKEN_LIFETIME)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for description, token := range map[string]string{"an expired token": expired, "a malformed token": "bogus"} {
+		w := postIntrospect(router, "https://rs.example", testClientSecret, token)
+		if w.Code != 200 {
+			t.Errorf("POST /introspect for %s returned %d instead of 200", description, w.Code)
+			continue
+		}
+
+		// Inactive tokens don't reveal any of their claims
+		if body := strings.TrimSpace(w.Body.String()); body != `{"active":false}` {
+			t.Errorf("POST /introspect for %s returned %s", description, body)
+		}
+	}
+
+	// Without a token, there's nothing to introspect
+	w := postIntrospect(router, "https://rs.example", testClientSecret, "")
+	if body := w.Body.String(); w.Code != 400 || !strings.Contains(body, `"error":"invalid_request"`) || !strings.Contains(body, `"code":"missing_token"`) {
+		t.Errorf("POST /introspect without a token returned %d: %s", w.Code, body)
+	}
+}
+
+func TestIntrospectUnauthenticated(t *testing.T) {
+	router, p := newIntrospectTestRouter(t)
+
+	token, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example"}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		clientID    string
+		secret      string
+	}{
+		{"no credentials", "", ""},
+		{"the wrong secret", "https://rs.example", "hunter2"},
+		{"a client without a secret", "https://client.example", testClientSecret},
+	}
+
+	for _, test := range tests {
+		w := postIntrospect(router, test.clientID, test.secret, token)
+		if w.Code != 401 || !strings.Contains(w.Body.String(), `"error":"invalid_client"`) {
+			t.Errorf("POST /introspect with %s returned %d instead of 401: %s", test.description, w.Code, w.Body.String())
+		}
+		if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic") {
+			t.Errorf("POST /introspect with %s didn't ask for Basic credentials", test.description)
+		}
+	}
+
+	// Without any client secrets, there's nothing to authenticate as
+	disabled, _ := newEmailTestRouter(t, &fakeMailer{})
+	if w := postIntrospect(disabled, "https://rs.example", testClientSecret, token); w.Code != 404 {
+		t.Errorf("POST /introspect without client secrets returned %d instead of 404", w.Code)
+	}
+}
+
+func TestIntrospectCached(t *testing.T) {
+	router, p := newIntrospectTestRouter(t)
+	p.TokenCache = newTokenCache(10)
+	p.Revoked = newBlocklist()
+	router, _ = newTestProvider(t, p)
+
+	token, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example", Scope: "openid email"}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	introspect := func(token string) introspection {
+		var response introspection
+		if err := json.Unmarshal(postIntrospect(router, "https://rs.example", testClientSecret, token).Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	if !introspect(token).Active || p.TokenCache.Len() != 1 {
+		t.Fatalf("introspecting a valid token left %d tokens cached", p.TokenCache.Len())
+	}
+
+	// Cached tokens aren't verified again, so a cached forgery would pass
+	claims, _ := p.TokenCache.Get(token)
+	claims.Subject = "cached@example.com"
+	p.TokenCache.Put("not-a-jwt", claims)
+	if response := introspect("not-a-jwt"); !response.Active || response.Subject != "cached@example.com" {
+		t.Errorf("POST /introspect for a cached token returned %+v", response)
+	}
+
+	// But revocation is still checked
+	p.Revoked.Revoke(claims.JWTID, time.Unix(claims.Expiry, 0))
+	if introspect(token).Active {
+		t.Error("POST /introspect reported a cached token active after it was revoked")
+	}
+
+	// And inactive tokens aren't cached
+	if introspect("bogus").Active || p.TokenCache.Len() != 2 {
+		t.Errorf("introspecting a bogus token left %d tokens cached", p.TokenCache.Len())
+	}
+}
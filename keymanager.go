@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"log"
+	"sync"
+	"time"
+)
+
+// How often a KeyManager checks whether it's time for the next stage of a
+// rollover.
+const KEY_ROTATION_CHECK = 1 * time.Minute
+
+// KeyManager rotates signing keys on a schedule, so that relying parties pick
+// up each new key before it's used:
+//
+//  1. A new key is generated and published grace before it's due, while the
+//     current key goes on signing, so that cached JWK Sets have time to
+//     refresh.
+//  2. Once the current key has signed for interval, and the new key has been
+//     published for grace, the new key takes over signing.
+//  3. The old key stays published for another grace, so that tokens it
+//     signed can still be verified, and is then retired.
+//
+// Rotated keys are only kept in memory, so each instance rotates its own, and
+// a restart goes back to the key it started with.
+type KeyManager struct {
+	interval time.Duration
+	grace    time.Duration
+	clock    Clock
+	generate func() (crypto.Signer, error)
+
+	mu        sync.RWMutex
+	current   crypto.Signer
+	since     time.Time     // When current started signing
+	next      crypto.Signer // Published, but not signing yet
+	published time.Time     // When next was published
+	previous  crypto.Signer // No longer signing, but still published
+}
+
+// newKeyManager creates a KeyManager which starts off signing with key, and
+// generates new keys for alg, of bits if they're RSA keys, every interval.
+func newKeyManager(key crypto.Signer, alg string, bits int, interval time.Duration, grace time.Duration) *KeyManager {
+	m := &KeyManager{
+		interval: interval,
+		grace:    grace,
+		clock:    realClock{},
+		generate: func() (crypto.Signer, error) { return generateKey(alg, bits) },
+		current:  key,
+	}
+	m.since = m.clock.Now()
+	return m
+}
+
+// Current returns the key to sign id_tokens with.
+func (m *KeyManager) Current() crypto.Signer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.current
+}
+
+// All returns every key which should be published: the current key, followed
+// by the next and previous keys, if there are any.
+func (m *KeyManager) All() []crypto.Signer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := []crypto.Signer{m.current}
+	for _, key := range []crypto.Signer{m.next, m.previous} {
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// rotate advances to whichever stage of the rollover is due.
+func (m *KeyManager) rotate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+
+	if m.previous != nil && !now.Before(m.since.Add(m.grace)) {
+		m.previous = nil
+	}
+
+	if m.next == nil && !now.Before(m.since.Add(m.interval-m.grace)) {
+		key, err := m.generate()
+		if err != nil {
+			return err
+		}
+		m.next, m.published = key, now
+	}
+
+	// However late we are, the next key must have been published for grace
+	if m.next != nil && !now.Before(m.since.Add(m.interval)) && !now.Before(m.published.Add(m.grace)) {
+		m.previous, m.current, m.next = m.current, m.next, nil
+		m.since = now
+	}
+
+	return nil
+}
+
+// run rotates keys as they're due until ctx is canceled.
+func (m *KeyManager) run(ctx context.Context) {
+	ticker := time.NewTicker(KEY_ROTATION_CHECK)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.rotate(); err != nil {
+				log.Printf("[keys] Could not generate the next signing key: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/square/go-jose"
+)
+
+// newTestKeyManager creates a KeyManager which rotates ES256 keys, which are
+// quick to generate, every day, on a clock which only moves when told to.
+func newTestKeyManager(t *testing.T) (*KeyManager, *fakeClock) {
+	key, err := generateKey(ALG_ES256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	m := newKeyManager(key, ALG_ES256, 0, 24*time.Hour, time.Hour)
+	m.clock = clock
+	m.since = clock.Now()
+
+	return m, clock
+}
+
+// kids returns the Key IDs of keys, in order.
+func kids(keys []crypto.Signer) []string {
+	var ids []string
+	for _, key := range keys {
+		ids = append(ids, generateKid(key.Public()))
+	}
+	return ids
+}
+
+func TestKeyManagerRollover(t *testing.T) {
+	m, clock := newTestKeyManager(t)
+	p := ProviderConfig{Origin: "issuer.example", Lifetime: TOKEN_LIFETIME, Keys: m}
+	first := m.Current()
+
+	// signedBy checks which key signs id_tokens, and that they still verify
+	signedBy := func(stage string, expected crypto.Signer) {
+		token, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example"}, "foo@example.com", AMR_EMAIL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jws, err := jose.ParseSigned(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kid := jws.Signatures[0].Header.KeyID; kid != generateKid(expected.Public()) {
+			t.Errorf("%s, an id_token was signed by %s instead of %s", stage, kid, generateKid(expected.Public()))
+		}
+		if _, err := parseIDToken(p, token); err != nil {
+			t.Errorf("%s, an id_token we signed did not verify: %s", stage, err)
+		}
+	}
+
+	// advance moves the clock on and runs the rotation, which should then
+	// publish expected
+	advance := func(stage string, d time.Duration, expected ...crypto.Signer) {
+		clock.Advance(d)
+		if err := m.rotate(); err != nil {
+			t.Fatal(err)
+		}
+
+		published, want := kids(m.All()), kids(expected)
+		if len(published) != len(want) {
+			t.Fatalf("%s, published %d keys instead of %d", stage, len(published), len(want))
+		}
+		for i := range want {
+			if published[i] != want[i] {
+				t.Errorf("%s, published key %d is %s instead of %s", stage, i, published[i], want[i])
+			}
+		}
+	}
+
+	advance("at first", 0, first)
+	signedBy("at first", first)
+
+	advance("before the grace period", 22*time.Hour, first)
+	signedBy("before the grace period", first)
+
+	// The next key is published a grace period ahead of signing
+	clock.Advance(time.Hour)
+	if err := m.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	keys := m.All()
+	if len(keys) != 2 || keys[0] != first {
+		t.Fatalf("during the grace period, published %q instead of the current and next keys", kids(keys))
+	}
+	second := keys[1]
+	signedBy("during the grace period", first)
+
+	// Then takes over, while the old key still verifies what it signed
+	advance("after the rollover", time.Hour, second, first)
+	signedBy("after the rollover", second)
+
+	// Until it's retired a grace period later
+	advance("after retirement", time.Hour, second)
+	signedBy("after retirement", second)
+}
+
+func TestKeyManagerLateRotation(t *testing.T) {
+	m, clock := newTestKeyManager(t)
+	first := m.Current()
+
+	// If the ticker is late, the new key is still published for a whole
+	// grace period before it signs
+	clock.Advance(30 * time.Hour)
+	if err := m.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Current() != first || len(m.All()) != 2 {
+		t.Errorf("a late rotation switched keys without publishing the next one first")
+	}
+
+	clock.Advance(time.Hour)
+	if err := m.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Current() == first {
+		t.Errorf("the next key did not take over after its grace period")
+	}
+}
+
+func TestRotatingKeyset(t *testing.T) {
+	m, clock := newTestKeyManager(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/jwks.json", rotatingKeyset(m, 0))
+
+	published := func() []string {
+		w := get(router, "/jwks.json")
+		var set jose.JsonWebKeySet
+		if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for _, key := range set.Keys {
+			ids = append(ids, key.KeyID)
+		}
+		return ids
+	}
+
+	if ids := published(); len(ids) != 1 || ids[0] != generateKid(m.Current().Public()) {
+		t.Errorf("JWK Set has %q instead of the current key", ids)
+	}
+
+	clock.Advance(23 * time.Hour)
+	if err := m.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := published(); len(ids) != 2 {
+		t.Errorf("JWK Set has %q instead of the current and next keys", ids)
+	}
+}
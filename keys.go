@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Supported id_token signing algorithms
+const (
+	ALG_RS256 = "RS256" // RSA, the default and most widely supported
+	ALG_ES256 = "ES256" // ECDSA using P-256, for smaller keys and tokens
+)
+
+// RSA_KEY_SIZE is the default size of generated RSA keys, in bits, and the
+// smallest we accept.
+const RSA_KEY_SIZE = 2048
+
+// rsaKeySizes are the sizes of RSA key which may be generated, in bits.
+var rsaKeySizes = []int{2048, 3072, 4096}
+
+// validKeySize checks that bits is one of the rsaKeySizes.
+func validKeySize(bits int) bool {
+	for _, size := range rsaKeySizes {
+		if bits == size {
+			return true
+		}
+	}
+	return false
+}
+
+// loadOrCreateKey reads a PEM-encoded RSA or ECDSA private key from path, in
+// PKCS#1, SEC 1, or PKCS#8 form. If there is no file at path, a new key for
+// alg is generated and saved there, readable only by the current user, with
+// bits giving the size of RSA keys. An existing key must be of the kind alg
+// calls for, but may be of any size we accept.
+func loadOrCreateKey(path string, alg string, bits int) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createKey(path, alg, bits)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return loadKey(data, path, alg)
+}
+
+// loadKey parses a PEM-encoded private key from source, like a file or
+// environment variable, which must be of the kind alg calls for.
+func loadKey(data []byte, source string, alg string) (crypto.Signer, error) {
+	key, err := parseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load key from %s: %s", source, err)
+	}
+
+	if keyAlg := signingAlg(key); keyAlg != alg {
+		return nil, fmt.Errorf("The key in %s is for %s, not %s", source, keyAlg, alg)
+	}
+
+	return key, nil
+}
+
+// parseKey decodes a PEM-encoded RSA or ECDSA P-256 private key.
+func parseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok || signingAlg(signer) == "" {
+		return nil, errors.New("not an RSA or ECDSA P-256 key")
+	}
+
+	if k, ok := signer.(*rsa.PrivateKey); ok && k.N.BitLen() < RSA_KEY_SIZE {
+		return nil, fmt.Errorf("RSA keys must be at least %d bits, not %d", RSA_KEY_SIZE, k.N.BitLen())
+	}
+
+	return signer, nil
+}
+
+// generateKey creates a new private key for alg. RSA keys are bits long,
+// which must be one of the rsaKeySizes; ECDSA keys are always 256 bits.
+func generateKey(alg string, bits int) (crypto.Signer, error) {
+	switch alg {
+	case ALG_RS256:
+		if !validKeySize(bits) {
+			return nil, fmt.Errorf("unsupported RSA key size %d", bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case ALG_ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+
+	return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+// checkKey reports why key can't sign id_tokens, if it can't: there may be no
+// key at all, or one of a kind we don't support, or one which is malformed.
+func checkKey(key crypto.Signer) error {
+	switch k := key.(type) {
+	case nil:
+		return errors.New("no signing key loaded")
+	case *rsa.PrivateKey:
+		if k == nil || k.N == nil {
+			return errors.New("the RSA signing key is empty")
+		}
+		if err := k.Validate(); err != nil {
+			return fmt.Errorf("the RSA signing key is invalid: %s", err)
+		}
+	case *ecdsa.PrivateKey:
+		if k == nil || k.D == nil || k.Curve != elliptic.P256() {
+			return errors.New("the ECDSA signing key is empty or not on P-256")
+		}
+	default:
+		return fmt.Errorf("unsupported kind of signing key %T", key)
+	}
+
+	return nil
+}
+
+// signingAlg returns the JWS algorithm which key signs with, or an empty
+// string if it isn't a supported kind of key.
+func signingAlg(key crypto.Signer) string {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return ALG_RS256
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P256() {
+			return ALG_ES256
+		}
+	}
+
+	return ""
+}
+
+// createKey generates a new key for alg, of bits if it's an RSA key, and
+// writes it to path in PKCS#8 form. It will not overwrite an existing file.
+func createKey(path string, alg string, bits int) (crypto.Signer, error) {
+	key, err := generateKey(alg, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/callahad/authdaemon/internal/validation"
+	"github.com/gin-gonic/gin"
+)
+
+// LogoutRequest is an RP-Initiated Logout request, as per the spec at
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html.
+type LogoutRequest struct {
+	ClientID              string `form:"client_id"`
+	PostLogoutRedirectURI string `form:"post_logout_redirect_uri"`
+	State                 string `form:"state"`
+}
+
+// loggedOutPage is shown after logging out, if the client didn't ask to have
+// the user sent back.
+type loggedOutPage struct {
+	Client string
+}
+
+// browserAuthenticator is an Authenticator which keeps state in the user's
+// browser while they log in, such as the EmailAuthenticator's csrfCookie.
+type browserAuthenticator interface {
+	Authenticator
+	clearBrowser(c *gin.Context)
+}
+
+// endSession creates a handler for logout requests.
+//
+// We don't keep a login session with the user's browser, as every id_token is
+// issued after verifying their email address afresh. All there is to end
+// locally is any login still in progress, whose state auths have kept in the
+// browser. Otherwise, the endpoint exists so clients have somewhere standard
+// to send users after logging them out of the client itself.
+func endSession(p ProviderConfig, auths []Authenticator) func(*gin.Context) {
+	return func(c *gin.Context) {
+		var req LogoutRequest
+		if err := c.ShouldBind(&req); err != nil {
+			failPage(c, 400, "Bad Value", err.Error())
+			return
+		}
+
+		if err := req.valid(p.Clients); err != nil {
+			failPage(c, 400, "Bad Value", err.Error())
+			return
+		}
+
+		for _, auth := range auths {
+			if auth, ok := auth.(browserAuthenticator); ok {
+				auth.clearBrowser(c)
+			}
+		}
+
+		if req.PostLogoutRedirectURI == "" {
+			renderPage(c, 200, "logged_out.html", loggedOutPage{req.ClientID})
+			return
+		}
+
+		u, _ := url.Parse(req.PostLogoutRedirectURI)
+		if req.State != "" {
+			params := u.Query()
+			params.Set("state", req.State)
+			u.RawQuery = params.Encode()
+		}
+
+		c.Redirect(302, u.String())
+	}
+}
+
+// valid checks that a post_logout_redirect_uri, if present, is one which
+// clients allows for a client_id it allows, as for authorization requests.
+// Otherwise, anyone could use the endpoint to redirect users to an arbitrary
+// site, or a client to a path it isn't allowed.
+func (params *LogoutRequest) valid(clients *ClientRegistry) error {
+	if params.PostLogoutRedirectURI == "" {
+		return nil
+	}
+
+	type testCase struct {
+		description string
+		ok          bool
+	}
+
+	tests := []testCase{
+		{
+			"client_id is required with post_logout_redirect_uri",
+			params.ClientID != "",
+		},
+		{
+			"client_id must not include paths, query values, or fragments",
+			validation.OnlyOrigin(params.ClientID),
+		},
+		{
+			"client_id is not allowed to log users in",
+			clients.Allowed(params.ClientID),
+		},
+		{
+			"post_logout_redirect_uri must be a valid url. " + urlNote,
+			validation.ValidURI(params.PostLogoutRedirectURI),
+		},
+		{
+			"post_logout_redirect_uri must be an absolute url that falls within client_id's origin",
+			validation.ContainedBy(params.PostLogoutRedirectURI, params.ClientID),
+		},
+		{
+			"post_logout_redirect_uri is not registered for client_id",
+			clients.RedirectAllowed(params.ClientID, params.PostLogoutRedirectURI),
+		},
+	}
+
+	for _, v := range tests {
+		if !v.ok {
+			return requestError{"invalid_request", v.description, "invalid_request"}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newLogoutTestRouter(t *testing.T, allowed ...string) *gin.Engine {
+	clients, err := newClientRegistry(allowed, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router, _ := newTestProvider(t, ProviderConfig{Clients: clients})
+	return router
+}
+
+func TestEndSession(t *testing.T) {
+	router := newLogoutTestRouter(t, "https://client.example")
+
+	form := url.Values{
+		"client_id":                {"https://client.example"},
+		"post_logout_redirect_uri": {"https://client.example/goodbye?lang=en"},
+		"state":                    {"abc"},
+	}
+
+	for method, w := range map[string]interface{ Header() http.Header }{
+		"GET":  get(router, "/end_session?"+form.Encode()),
+		"POST": postForm(router, "/end_session", form),
+	} {
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || location.Host != "client.example" || location.Path != "/goodbye" {
+			t.Errorf("%s /end_session redirected to %q instead of the post_logout_redirect_uri", method, w.Header().Get("Location"))
+			continue
+		}
+		if q := location.Query(); q.Get("state") != "abc" || q.Get("lang") != "en" {
+			t.Errorf("%s /end_session redirected with query %q, not the original query and state", method, location.RawQuery)
+		}
+	}
+}
+
+func TestEndSessionWithoutRedirect(t *testing.T) {
+	router := newLogoutTestRouter(t)
+
+	w := get(router, "/end_session")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Logged out") {
+		t.Errorf("GET /end_session returned %d instead of a logged out page:\n%s", w.Code, w.Body.String())
+	}
+}
+
+func TestEndSessionErrors(t *testing.T) {
+	tests := []struct {
+		description string
+		allowed     []string
+		form        url.Values
+	}{
+		{
+			"no client_id",
+			nil,
+			url.Values{"post_logout_redirect_uri": {"https://client.example/"}},
+		},
+		{
+			"another origin",
+			nil,
+			url.Values{"client_id": {"https://client.example"}, "post_logout_redirect_uri": {"https://evil.example/"}},
+		},
+		{
+			"another scheme",
+			nil,
+			url.Values{"client_id": {"https://client.example"}, "post_logout_redirect_uri": {"http://client.example/"}},
+		},
+		{
+			"client_id with a path",
+			nil,
+			url.Values{"client_id": {"https://client.example/foo"}, "post_logout_redirect_uri": {"https://client.example/foo"}},
+		},
+		{
+			"unregistered client",
+			[]string{"https://client.example"},
+			url.Values{"client_id": {"https://evil.example"}, "post_logout_redirect_uri": {"https://evil.example/"}},
+		},
+		{
+			"relative url",
+			nil,
+			url.Values{"client_id": {"https://client.example"}, "post_logout_redirect_uri": {"/goodbye"}},
+		},
+	}
+
+	for _, test := range tests {
+		router := newLogoutTestRouter(t, test.allowed...)
+
+		w := postForm(router, "/end_session", test.form)
+		if w.Code != 400 {
+			t.Errorf("/end_session with %s returned %d instead of 400", test.description, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != "" {
+			t.Errorf("/end_session with %s redirected to %s", test.description, location)
+		}
+	}
+}
+
+func TestEndSessionRegisteredRedirects(t *testing.T) {
+	clients, err := newClientRegistry(nil, []string{"https://exact.example/goodbye"}, []string{"https://client.example/callback"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router, _ := newTestProvider(t, ProviderConfig{Clients: clients})
+
+	tests := []struct {
+		clientID string
+		uri      string
+		ok       bool
+	}{
+		{"https://client.example", "https://client.example/callback/goodbye", true},
+		{"https://client.example", "https://client.example/goodbye", false},
+		{"https://exact.example", "https://exact.example/goodbye", true},
+		{"https://exact.example", "https://exact.example/goodbye/again", false},
+	}
+
+	for _, test := range tests {
+		w := postForm(router, "/end_session", url.Values{"client_id": {test.clientID}, "post_logout_redirect_uri": {test.uri}})
+		if redirected := w.Code == 302 && w.Header().Get("Location") == test.uri; redirected != test.ok {
+			t.Errorf("/end_session to %s for %s returned %d with Location %q", test.uri, test.clientID, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestEndSessionClearsCSRFCookie(t *testing.T) {
+	router, _ := newTestProvider(t, ProviderConfig{}, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME)))
+
+	w := get(router, "/end_session")
+	cleared := false
+	for _, v := range w.Result().Cookies() {
+		cleared = cleared || (v.Name == csrfCookie && v.MaxAge < 0)
+	}
+	if w.Code != 200 || !cleared {
+		t.Errorf("GET /end_session returned %d without clearing the %s cookie", w.Code, csrfCookie)
+	}
+}
+
+func TestEndSessionMalformedBody(t *testing.T) {
+	router := newLogoutTestRouter(t)
+
+	req := httptest.NewRequest("POST", "/end_session", strings.NewReader("client_id=%zz"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != 400 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "Bad Value") {
+		t.Errorf("POST /end_session with a malformed body returned %d, not our error page: %s", w.Code, w.Body.String())
+	}
+}
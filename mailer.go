@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// Mailer sends email messages with both plaintext and HTML bodies, giving up
+// once ctx is done.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, textBody, htmlBody string) error
+}
+
+// newMailer creates an SMTPMailer if an SMTP host is configured, or else a
+// Mailer which only logs messages, for development.
+func newMailer(config SMTPConfig) Mailer {
+	if config.Host == "" {
+		return logMailer{}
+	}
+	return newSMTPMailer(config)
+}
+
+// logMailer is a Mailer for development which logs messages instead of
+// delivering them.
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, to, subject, textBody, htmlBody string) error {
+	log.Printf("[mail] To: %s\nSubject: %s\n\n%s", to, subject, textBody)
+	return nil
+}
+
+// SMTP connection security modes
+const (
+	SMTP_STARTTLS = "starttls" // Upgrade a plaintext connection; the default
+	SMTP_TLS      = "tls"      // Implicit TLS from the start, usually port 465
+	SMTP_NONE     = "none"     // No encryption, only for trusted local relays
+)
+
+// What to do if the SMTP server can't be logged in to at startup
+const (
+	SMTP_PROBE_WARN    = "warn"    // Log a warning, and start anyway
+	SMTP_PROBE_REQUIRE = "require" // Refuse to start
+)
+
+// How many times to try sending a message, and how long to wait before trying
+// again the first time. Each wait after that is twice as long.
+const (
+	SMTP_MAX_ATTEMPTS = 3
+	SMTP_RETRY_DELAY  = 500 * time.Millisecond
+)
+
+// SMTPConfig describes how to connect to an SMTP server.
+type SMTPConfig struct {
+	Host     string `json:"host" env:"AUTHDAEMON_SMTP_HOST"`
+	Port     int    `json:"port" env:"AUTHDAEMON_SMTP_PORT"`
+	Username string `json:"username" env:"AUTHDAEMON_SMTP_USERNAME"`
+	Password string `json:"password" env:"AUTHDAEMON_SMTP_PASSWORD"`
+	From     string `json:"from" env:"AUTHDAEMON_SMTP_FROM"`
+	Security string `json:"security" env:"AUTHDAEMON_SMTP_SECURITY"`
+
+	// The display name shown alongside From, like "Example Login". It may
+	// contain non-ASCII characters.
+	FromName string `json:"from_name" env:"AUTHDAEMON_SMTP_FROM_NAME"`
+
+	// Where replies go, if not to From
+	ReplyTo string `json:"reply_to" env:"AUTHDAEMON_SMTP_REPLY_TO"`
+
+	// How many times to try sending each message, if the server fails
+	// temporarily
+	MaxAttempts int `json:"max_attempts" env:"AUTHDAEMON_SMTP_MAX_ATTEMPTS"`
+
+	// How many messages to send at once, and how many more may wait before
+	// logins are refused with a 503
+	Workers    int `json:"workers" env:"AUTHDAEMON_SMTP_WORKERS"`
+	QueueDepth int `json:"queue_depth" env:"AUTHDAEMON_SMTP_QUEUE_DEPTH"`
+
+	// Whether to log in to the server at startup, to find problems before
+	// the first login does: "warn", "require", or empty not to
+	Probe string `json:"probe" env:"AUTHDAEMON_SMTP_PROBE"`
+}
+
+// validMailbox checks that address is a bare email address, like
+// login@example.com, without a display name or angle brackets.
+func validMailbox(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	return err == nil && parsed.Name == "" && parsed.Address == address
+}
+
+// SMTPMailer is a Mailer which delivers messages through an SMTP server.
+type SMTPMailer struct {
+	config     SMTPConfig
+	retryDelay time.Duration
+	sleep      func(time.Duration)
+	clock      Clock
+}
+
+// newSMTPMailer creates an SMTPMailer. An empty Security mode means STARTTLS,
+// and a MaxAttempts of 0 means SMTP_MAX_ATTEMPTS.
+func newSMTPMailer(config SMTPConfig) *SMTPMailer {
+	if config.Security == "" {
+		config.Security = SMTP_STARTTLS
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = SMTP_MAX_ATTEMPTS
+	}
+	return &SMTPMailer{config, SMTP_RETRY_DELAY, time.Sleep, realClock{}}
+}
+
+// Send delivers a multipart/alternative message to a single recipient.
+//
+// Temporary failures, like 4xx replies and network errors, are retried until
+// config.MaxAttempts have been made, backing off exponentially. Each wait is
+// jittered, so that instances which failed together don't retry together.
+// Permanent failures, like 5xx replies, are returned straight away, as is
+// ctx's error once it's done, which closes any connection in progress.
+func (m *SMTPMailer) Send(ctx context.Context, to, subject, textBody, htmlBody string) error {
+	from := mail.Address{Name: m.config.FromName, Address: m.config.From}
+	msg, err := buildMessage(from, m.config.ReplyTo, to, subject, textBody, htmlBody, m.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	delay := m.retryDelay
+	for attempt := 1; ; attempt++ {
+		err = m.send(ctx, to, msg)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || attempt >= m.config.MaxAttempts || !temporarySMTPError(err) {
+			return err
+		}
+
+		// Wait between half and all of the delay
+		m.sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+		delay *= 2
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// temporarySMTPError reports whether sending may succeed if tried again: the
+// server replied with a 4xx code, or couldn't be reached.
+func temporarySMTPError(err error) bool {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code >= 400 && reply.Code < 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// send makes a single attempt at delivering msg to a single recipient.
+func (m *SMTPMailer) send(ctx context.Context, to string, msg []byte) error {
+	client, err := m.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := m.authenticate(client); err != nil {
+		return err
+	}
+
+	if err := client.Mail(m.config.From); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// Ping checks that the SMTP server can be reached, and that TLS can be
+// negotiated with it as configured.
+func (m *SMTPMailer) Ping() error {
+	client, err := m.dial(context.Background())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Quit()
+}
+
+// Probe checks that the SMTP server can be reached and logged in to, as
+// sending would, without sending anything.
+func (m *SMTPMailer) Probe() error {
+	client, err := m.dial(context.Background())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := m.authenticate(client); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// authenticate logs in to the SMTP server, if there's a username to log in
+// with.
+func (m *SMTPMailer) authenticate(client *smtp.Client) error {
+	if m.config.Username == "" {
+		return nil
+	}
+
+	auth := smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+	return client.Auth(auth)
+}
+
+// probeMailer probes mailer's SMTP server at startup, as probe asks. Failures
+// are returned if probe is SMTP_PROBE_REQUIRE, and otherwise logged. Mailers
+// without a server, like logMailer, have nothing to probe.
+func probeMailer(mailer Mailer, probe string) error {
+	prober, ok := mailer.(interface{ Probe() error })
+	if probe == "" || !ok {
+		return nil
+	}
+
+	err := prober.Probe()
+	if err == nil {
+		return nil
+	}
+	if probe == SMTP_PROBE_REQUIRE {
+		return fmt.Errorf("Could not log in to the SMTP server: %s", err)
+	}
+	log.Printf("WARNING: Could not log in to the SMTP server, so confirmation emails may not be sent: %s", err)
+	return nil
+}
+
+// dial connects to the SMTP server, negotiating TLS as configured. The
+// connection is closed once ctx is done, interrupting whatever it's doing.
+func (m *SMTPMailer) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.config.Host, fmt.Sprintf("%d", m.config.Port))
+	tlsConfig := &tls.Config{ServerName: m.config.Host}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	switch m.config.Security {
+	case SMTP_TLS:
+		conn, err := (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		context.AfterFunc(ctx, func() { conn.Close() })
+		return smtp.NewClient(conn, m.config.Host)
+
+	case SMTP_STARTTLS, SMTP_NONE:
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		context.AfterFunc(ctx, func() { conn.Close() })
+
+		client, err := smtp.NewClient(conn, m.config.Host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if m.config.Security == SMTP_STARTTLS {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+
+		return client, nil
+	}
+
+	return nil, fmt.Errorf("Unknown SMTP security mode: %q", m.config.Security)
+}
+
+// buildMessage formats an RFC 5322 message with plaintext and HTML parts,
+// dated date. A non-ASCII display name in from is encoded per RFC 2047, and
+// the Reply-To header is left out if replyTo is empty.
+func buildMessage(from mail.Address, replyTo, to, subject, textBody, htmlBody string, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+
+	headers := []struct{ name, value string }{
+		{"From", from.String()},
+		{"Reply-To", replyTo},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + body.Boundary()},
+	}
+
+	var msg bytes.Buffer
+	for _, h := range headers {
+		if h.value == "" {
+			continue
+		}
+		fmt.Fprintf(&msg, "%s: %s\r\n", h.name, h.value)
+	}
+	msg.WriteString("\r\n")
+
+	parts := []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", textBody},
+		{"text/html; charset=utf-8", htmlBody},
+	}
+
+	for _, p := range parts {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(p.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	msg.Write(buf.Bytes())
+	return msg.Bytes(), nil
+}
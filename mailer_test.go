@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer is a minimal SMTP server which records delivered messages.
+type fakeSMTPServer struct {
+	listener net.Listener
+	username string
+	password string
+
+	// hook may override the reply to an SMTP command verb, like "RCPT".
+	// Returning an empty string gives the normal reply.
+	hook func(verb string) string
+
+	mu       sync.Mutex
+	messages []string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMTPServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+// config returns an SMTPConfig for connecting to the server without TLS.
+func (s *fakeSMTPServer) config() SMTPConfig {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return SMTPConfig{
+		Host:     host,
+		Port:     p,
+		Username: s.username,
+		Password: s.password,
+		From:     "login@issuer.example",
+		Security: SMTP_NONE,
+	}
+}
+
+func (s *fakeSMTPServer) delivered() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb := strings.ToUpper(strings.Fields(line + " ")[0])
+		if s.hook != nil {
+			if reply := s.hook(verb); reply != "" {
+				tp.PrintfLine("%s", reply)
+				continue
+			}
+		}
+
+		switch verb {
+		case "EHLO":
+			tp.PrintfLine("250-fake")
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "AUTH":
+			creds, _ := base64.StdEncoding.DecodeString(line[strings.LastIndex(line, " ")+1:])
+			if string(creds) == "\x00"+s.username+"\x00"+s.password {
+				tp.PrintfLine("235 Authenticated")
+			} else {
+				tp.PrintfLine("535 Authentication failed")
+			}
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			tp.PrintfLine("250 Queued")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Unknown command")
+		}
+	}
+}
+
+// parseMessage decodes a message built by buildMessage into its headers and
+// the content of its plaintext and HTML parts.
+func parseMessage(t *testing.T, raw string) (*mail.Message, map[string]string) {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("message could not be parsed: %s", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("message has Content-Type %q", msg.Header.Get("Content-Type"))
+	}
+
+	parts := map[string]string{}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(part)
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[partType] = string(content)
+	}
+
+	return msg, parts
+}
+
+func TestBuildMessage(t *testing.T) {
+	long := strings.Repeat("a", 100) + " https://issuer.example/confirm?token=abc=="
+	raw, err := buildMessage(mail.Address{Address: "login@issuer.example"}, "", "foo@example.com", "Héllo", long, "<p>"+long+"</p>", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(raw, []byte("\r\n\r\n")) {
+		t.Error("message headers are not terminated by CRLF")
+	}
+
+	msg, parts := parseMessage(t, string(raw))
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Héllo" {
+		t.Errorf("message has subject %q instead of Héllo", subject)
+	}
+
+	if to := msg.Header.Get("To"); to != "foo@example.com" {
+		t.Errorf("message is addressed to %q instead of foo@example.com", to)
+	}
+
+	if from := msg.Header.Get("From"); from != "<login@issuer.example>" {
+		t.Errorf("message is from %q instead of <login@issuer.example>", from)
+	}
+
+	if _, ok := msg.Header["Reply-To"]; ok {
+		t.Error("message has a Reply-To header when none was configured")
+	}
+
+	if parts["text/plain"] != long {
+		t.Errorf("message text part is %q instead of %q", parts["text/plain"], long)
+	}
+
+	if parts["text/html"] != "<p>"+long+"</p>" {
+		t.Errorf("message HTML part is %q", parts["text/html"])
+	}
+}
+
+func TestBuildMessageSender(t *testing.T) {
+	tests := []struct {
+		description string
+		name        string
+		header      string // The From header as it should be sent
+	}{
+		{"ASCII display name", "Issuer Login", `"Issuer Login" <login@issuer.example>`},
+		{"UTF-8 display name", "Connexion Émetteur", "=?utf-8?q?Connexion_=C3=89metteur?= <login@issuer.example>"},
+	}
+
+	for _, test := range tests {
+		from := mail.Address{Name: test.name, Address: "login@issuer.example"}
+		raw, err := buildMessage(from, "help@issuer.example", "foo@example.com", "Hello", "text", "<p>html</p>", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, _ := parseMessage(t, string(raw))
+
+		if header := msg.Header.Get("From"); header != test.header {
+			t.Errorf("message with an %s has From %q instead of %q", test.description, header, test.header)
+		}
+
+		addresses, err := msg.Header.AddressList("From")
+		if err != nil || len(addresses) != 1 || *addresses[0] != from {
+			t.Errorf("message with an %s has From %v (%v) instead of %v", test.description, addresses, err, from)
+		}
+
+		if replyTo := msg.Header.Get("Reply-To"); replyTo != "help@issuer.example" {
+			t.Errorf("message with an %s has Reply-To %q instead of help@issuer.example", test.description, replyTo)
+		}
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.username, server.password = "user", "secret"
+	mailer := newSMTPMailer(server.config())
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	mailer.clock = clock
+
+	if err := mailer.Send(context.Background(), "foo@example.com", "Hello", "text body", "<p>html body</p>"); err != nil {
+		t.Fatalf("SMTPMailer.Send returned an error: %s", err)
+	}
+
+	delivered := server.delivered()
+	if len(delivered) != 1 {
+		t.Fatalf("expected 1 message to be delivered, got %d", len(delivered))
+	}
+
+	msg, parts := parseMessage(t, delivered[0])
+	if parts["text/plain"] != "text body" || parts["text/html"] != "<p>html body</p>" {
+		t.Errorf("delivered message has unexpected parts: %v", parts)
+	}
+
+	// It's dated by the mailer's clock
+	if date, err := msg.Header.Date(); err != nil || !date.Equal(clock.Now()) {
+		t.Errorf("delivered message has Date %q instead of %s", msg.Header.Get("Date"), clock.Now().Format(time.RFC1123Z))
+	}
+}
+
+func TestSMTPMailerErrors(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.username, server.password = "user", "secret"
+
+	config := server.config()
+	config.Password = "wrong"
+	if err := newSMTPMailer(config).Send(context.Background(), "foo@example.com", "Hello", "text", "html"); err == nil {
+		t.Error("SMTPMailer.Send with bad credentials unexpectedly succeeded")
+	}
+
+	config = server.config()
+	server.hook = func(verb string) string {
+		if verb == "RCPT" {
+			return "550 No such user"
+		}
+		return ""
+	}
+	if err := newSMTPMailer(config).Send(context.Background(), "foo@example.com", "Hello", "text", "html"); err == nil {
+		t.Error("SMTPMailer.Send to a rejected recipient unexpectedly succeeded")
+	}
+
+	// The fake server doesn't offer STARTTLS, so this must fail rather than
+	// silently sending in the clear.
+	server.hook = nil
+	config.Security = SMTP_STARTTLS
+	if err := newSMTPMailer(config).Send(context.Background(), "foo@example.com", "Hello", "text", "html"); err == nil {
+		t.Error("SMTPMailer.Send without STARTTLS support unexpectedly succeeded")
+	}
+
+	if len(server.delivered()) != 0 {
+		t.Errorf("expected no messages to be delivered, got %d", len(server.delivered()))
+	}
+}
+
+func TestSMTPMailerPing(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	mailer := newSMTPMailer(server.config())
+
+	if err := mailer.Ping(); err != nil {
+		t.Errorf("SMTPMailer.Ping returned an error: %s", err)
+	}
+
+	server.listener.Close()
+	if err := mailer.Ping(); err == nil {
+		t.Error("SMTPMailer.Ping of a stopped server unexpectedly succeeded")
+	}
+}
+
+func TestProbeMailer(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.username, server.password = "user", "secret"
+
+	for _, probe := range []string{SMTP_PROBE_WARN, SMTP_PROBE_REQUIRE} {
+		if err := probeMailer(newSMTPMailer(server.config()), probe); err != nil {
+			t.Errorf("probeMailer(%q) with the right credentials returned an error: %s", probe, err)
+		}
+	}
+
+	config := server.config()
+	config.Password = "wrong"
+	if err := probeMailer(newSMTPMailer(config), SMTP_PROBE_REQUIRE); err == nil || !strings.Contains(err.Error(), "535") {
+		t.Errorf("probeMailer(require) with bad credentials returned %v", err)
+	}
+
+	// Warnings are only logged
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	if err := probeMailer(newSMTPMailer(config), SMTP_PROBE_WARN); err != nil || !strings.Contains(logged.String(), "WARNING") {
+		t.Errorf("probeMailer(warn) with bad credentials returned %v, and logged %q", err, logged.String())
+	}
+
+	// And nothing happens unless asked
+	if err := probeMailer(newSMTPMailer(config), ""); err != nil {
+		t.Errorf("probeMailer without a probe returned %s", err)
+	}
+
+	if len(server.delivered()) != 0 {
+		t.Errorf("probing delivered %d messages", len(server.delivered()))
+	}
+}
+
+// failingSMTPServer returns a fake server which replies to the first failures
+// MAIL commands with reply, and counts how many it gets.
+func failingSMTPServer(t *testing.T, failures int32, reply string) (*fakeSMTPServer, *int32) {
+	server := newFakeSMTPServer(t)
+
+	var attempts int32
+	server.hook = func(verb string) string {
+		if verb == "MAIL" && atomic.AddInt32(&attempts, 1) <= failures {
+			return reply
+		}
+		return ""
+	}
+
+	return server, &attempts
+}
+
+// newTestSMTPMailer creates an SMTPMailer which records how long it waits
+// between attempts, instead of waiting.
+func newTestSMTPMailer(config SMTPConfig, waits *[]time.Duration) *SMTPMailer {
+	mailer := newSMTPMailer(config)
+	mailer.sleep = func(d time.Duration) { *waits = append(*waits, d) }
+	return mailer
+}
+
+func TestSMTPMailerRetriesTemporaryErrors(t *testing.T) {
+	server, attempts := failingSMTPServer(t, 2, "451 Try again later")
+
+	var waits []time.Duration
+	if err := newTestSMTPMailer(server.config(), &waits).Send(context.Background(), "foo@example.com", "Hello", "text", "html"); err != nil {
+		t.Fatalf("SMTPMailer.Send after two temporary failures returned an error: %s", err)
+	}
+
+	if n := atomic.LoadInt32(attempts); n != 3 {
+		t.Errorf("SMTPMailer.Send made %d attempts instead of 3", n)
+	}
+	if len(server.delivered()) != 1 {
+		t.Errorf("expected 1 message to be delivered, got %d", len(server.delivered()))
+	}
+
+	// Each wait is jittered within the delay, which doubles each time
+	if len(waits) != 2 {
+		t.Fatalf("SMTPMailer.Send waited %d times instead of 2", len(waits))
+	}
+	for i, wait := range waits {
+		delay := SMTP_RETRY_DELAY << i
+		if wait < delay/2 || wait > delay {
+			t.Errorf("wait %d was %s, which isn't between %s and %s", i+1, wait, delay/2, delay)
+		}
+	}
+}
+
+func TestSMTPMailerGivesUp(t *testing.T) {
+	server, attempts := failingSMTPServer(t, 100, "421 Service not available")
+
+	config := server.config()
+	config.MaxAttempts = 4
+
+	var waits []time.Duration
+	if err := newTestSMTPMailer(config, &waits).Send(context.Background(), "foo@example.com", "Hello", "text", "html"); err == nil {
+		t.Error("SMTPMailer.Send to a server which keeps failing unexpectedly succeeded")
+	}
+
+	if n := atomic.LoadInt32(attempts); n != 4 {
+		t.Errorf("SMTPMailer.Send made %d attempts instead of max_attempts", n)
+	}
+}
+
+func TestSMTPMailerPermanentErrors(t *testing.T) {
+	server, attempts := failingSMTPServer(t, 1, "550 Sender rejected")
+
+	var waits []time.Duration
+	if err := newTestSMTPMailer(server.config(), &waits).Send(context.Background(), "foo@example.com", "Hello", "text", "html"); err == nil {
+		t.Error("SMTPMailer.Send after a permanent failure unexpectedly succeeded")
+	}
+
+	if n := atomic.LoadInt32(attempts); n != 1 || len(waits) != 0 {
+		t.Errorf("SMTPMailer.Send retried a permanent failure, making %d attempts", n)
+	}
+	if len(server.delivered()) != 0 {
+		t.Errorf("expected no messages to be delivered, got %d", len(server.delivered()))
+	}
+}
+
+// stallingSMTPServer returns a fake server which stops responding when it's
+// sent DATA, and the channel its stall is signalled on.
+func stallingSMTPServer(t *testing.T) (*fakeSMTPServer, chan struct{}) {
+	server := newFakeSMTPServer(t)
+
+	stalled, release := make(chan struct{}, 1), make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	server.hook = func(verb string) string {
+		if verb == "DATA" {
+			stalled <- struct{}{}
+			<-release
+		}
+		return ""
+	}
+
+	return server, stalled
+}
+
+func TestSMTPMailerCanceled(t *testing.T) {
+	server, stalled := stallingSMTPServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		var waits []time.Duration
+		result <- newTestSMTPMailer(server.config(), &waits).Send(ctx, "foo@example.com", "Hello", "text", "html")
+	}()
+
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SMTPMailer.Send never reached DATA")
+	}
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("SMTPMailer.Send returned %v after being canceled, instead of context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SMTPMailer.Send didn't return after being canceled")
+	}
+
+	if len(server.delivered()) != 0 {
+		t.Errorf("expected no messages to be delivered, got %d", len(server.delivered()))
+	}
+
+	// Nor is anything sent once the context is done
+	if err := newSMTPMailer(server.config()).Send(ctx, "foo@example.com", "Hello", "text", "html"); err != context.Canceled {
+		t.Errorf("SMTPMailer.Send with a canceled context returned %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// How many messages are sent at once by default, and how many more may wait
+// for a worker before new ones are refused.
+const (
+	SMTP_WORKERS     = 4
+	SMTP_QUEUE_DEPTH = 100
+)
+
+// SMTP_SEND_TIMEOUT is how long a worker may spend sending each message,
+// including any retries, before giving up on it.
+const SMTP_SEND_TIMEOUT = 1 * time.Minute
+
+// ErrMailQueueFull is returned by MailQueue.Send when every worker is busy and
+// no more messages can wait.
+var ErrMailQueueFull = errors.New("Too many messages are waiting to be sent")
+
+// ErrMailQueueClosed is returned by MailQueue.Send once the queue is closed,
+// as requests still in flight at shutdown may yet try to send.
+var ErrMailQueueClosed = errors.New("No more messages are being sent")
+
+// mailJob is a message waiting in a MailQueue, and the request it's for.
+type mailJob struct {
+	to, subject, textBody, htmlBody string
+	request                         mailRequest
+}
+
+// MailQueue is a Mailer which hands messages to a fixed number of workers
+// sending through another Mailer, so that a burst of logins can't open more
+// connections to the SMTP server than that, or keep requests waiting on it.
+//
+// Send only reports whether a message was queued. Failures to deliver it,
+// after any retries by the underlying Mailer, are logged with the request which
+// queued it, and can be audited by sending through an auditMailer. Once
+// queued, it's sent whatever happens to that request, within
+// SMTP_SEND_TIMEOUT.
+type MailQueue struct {
+	mailer Mailer
+	jobs   chan mailJob
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex // Guards closed, so jobs is never sent to once closed
+	closed bool
+}
+
+// newMailQueue starts workers which send messages through mailer, with room
+// for depth more to wait.
+func newMailQueue(mailer Mailer, workers int, depth int) *MailQueue {
+	q := &MailQueue{mailer: mailer, jobs: make(chan mailJob, depth)}
+
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Send queues a message, or returns ErrMailQueueFull if there's no room,
+// ErrMailQueueClosed if the queue is closed, or ctx's error if it's already
+// done.
+func (q *MailQueue) Send(ctx context.Context, to, subject, textBody, htmlBody string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrMailQueueClosed
+	}
+
+	select {
+	case q.jobs <- mailJob{to, subject, textBody, htmlBody, mailRequestFrom(ctx)}:
+		return nil
+	default:
+		return ErrMailQueueFull
+	}
+}
+
+// work sends queued messages until the queue is closed.
+func (q *MailQueue) work() {
+	defer q.wg.Done()
+
+	for job := range q.jobs {
+		ctx, cancel := context.WithTimeout(withMailRequest(context.Background(), job.request), SMTP_SEND_TIMEOUT)
+		if err := q.mailer.Send(ctx, job.to, job.subject, job.textBody, job.htmlBody); err != nil {
+			log.Printf("[mail] request_id=%s Could not send to %s: %s", job.request.RequestID, job.to, err)
+		}
+		cancel()
+	}
+}
+
+// Close stops accepting messages, and waits for those already queued to be
+// sent, or for ctx to be done, in which case it returns ctx's error and any
+// messages still queued are sent, or not, in the background.
+func (q *MailQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
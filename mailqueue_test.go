@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// blockingMailer is a Mailer whose sends wait until release is closed, and
+// which keeps track of how many are in progress at once.
+type blockingMailer struct {
+	release chan struct{}
+	started chan string // Receives each recipient as sending starts
+
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+	sent    []string
+}
+
+func newBlockingMailer() *blockingMailer {
+	return &blockingMailer{release: make(chan struct{}), started: make(chan string, 100)}
+}
+
+func (m *blockingMailer) Send(ctx context.Context, to, subject, textBody, htmlBody string) error {
+	m.mu.Lock()
+	m.active++
+	if m.active > m.maxSeen {
+		m.maxSeen = m.active
+	}
+	m.mu.Unlock()
+
+	m.started <- to
+	<-m.release
+
+	m.mu.Lock()
+	m.active--
+	m.sent = append(m.sent, to)
+	m.mu.Unlock()
+	return nil
+}
+
+// waitStarted waits for n sends to start.
+func (m *blockingMailer) waitStarted(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-m.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d sends started", i, n)
+		}
+	}
+}
+
+func TestMailQueueConcurrency(t *testing.T) {
+	mailer := newBlockingMailer()
+	queue := newMailQueue(mailer, 2, 10)
+
+	for i := 0; i < 10; i++ {
+		if err := queue.Send(context.Background(), fmt.Sprintf("user%d@example.com", i), "Hello", "text", "<p>html</p>"); err != nil {
+			t.Fatalf("MailQueue.Send returned an error with room in the queue: %s", err)
+		}
+	}
+
+	// Only as many messages as there are workers are sent at once
+	mailer.waitStarted(t, 2)
+	select {
+	case to := <-mailer.started:
+		t.Errorf("a third message, to %s, started sending with only 2 workers", to)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(mailer.release)
+	queue.Close(context.Background())
+
+	if mailer.maxSeen != 2 {
+		t.Errorf("sent %d messages at once instead of 2", mailer.maxSeen)
+	}
+	if len(mailer.sent) != 10 {
+		t.Errorf("Close returned after %d of 10 queued messages were sent", len(mailer.sent))
+	}
+}
+
+func TestMailQueueClose(t *testing.T) {
+	mailer := newBlockingMailer()
+	queue := newMailQueue(mailer, 1, 1)
+	defer close(mailer.release)
+
+	if err := queue.Send(context.Background(), "foo@example.com", "Hello", "text", "<p>html</p>"); err != nil {
+		t.Fatal(err)
+	}
+	mailer.waitStarted(t, 1)
+
+	// Close only waits as long as it's given for the message being sent
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := queue.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("MailQueue.Close with a send still in progress returned %v instead of context.DeadlineExceeded", err)
+	}
+
+	// Requests still in flight can't queue more, rather than panicking
+	if err := queue.Send(context.Background(), "bar@example.com", "Hello", "text", "<p>html</p>"); err != ErrMailQueueClosed {
+		t.Errorf("MailQueue.Send after Close returned %v instead of ErrMailQueueClosed", err)
+	}
+
+	// And closing again is harmless
+	if err := queue.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("MailQueue.Close a second time returned %v", err)
+	}
+}
+
+func TestMailQueueFull(t *testing.T) {
+	mailer := newBlockingMailer()
+	queue := newMailQueue(mailer, 1, 1)
+	defer queue.Close(context.Background())
+	defer close(mailer.release)
+
+	// One message is being sent, and another waits
+	if err := queue.Send(context.Background(), "foo@example.com", "Hello", "text", "<p>html</p>"); err != nil {
+		t.Fatal(err)
+	}
+	mailer.waitStarted(t, 1)
+	if err := queue.Send(context.Background(), "bar@example.com", "Hello", "text", "<p>html</p>"); err != nil {
+		t.Fatalf("MailQueue.Send returned an error with room in the queue: %s", err)
+	}
+
+	if err := queue.Send(context.Background(), "baz@example.com", "Hello", "text", "<p>html</p>"); err != ErrMailQueueFull {
+		t.Errorf("MailQueue.Send returned %v instead of ErrMailQueueFull", err)
+	}
+
+	// Logins which can't be queued are refused straight away
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, newEmailAuthenticator("https://issuer.example", queue, newMemorySessionStore(SESSION_LIFETIME)))
+
+	if w := postForm(router, "/authorize", validAuthForm()); w.Code != 503 {
+		t.Errorf("POST /authorize with a full mail queue returned %d instead of 503: %s", w.Code, w.Body.String())
+	}
+}
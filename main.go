@@ -1,48 +1,444 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/square/go-jose"
+	"io"
+	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-// Program metadata and configuration
+// Program metadata and default configuration
 const (
 	VERSION        = "0.1.0"
 	REPO           = "https://github.com/callahad/authdaemon"
 	ORIGIN         = "laoidc.herokuapp.com"
 	ADDRESS        = "0.0.0.0"
 	PORT    uint16 = 3333
+
+	// How the origin is reached: always https, except in local development
+	SCHEME_HTTPS = "https"
+	SCHEME_HTTP  = "http"
+
+	// Who may connect to a Unix domain socket we listen on: our user and
+	// group, which a reverse proxy on the same machine can be added to
+	SOCKET_MODE os.FileMode = 0660
+
+	// How long issued id_tokens remain valid
+	TOKEN_LIFETIME time.Duration = 10 * time.Minute
+
+	// How long users have to finish logging in, and to open the link in a
+	// confirmation email
+	SESSION_LIFETIME time.Duration = 15 * time.Minute
+	LINK_LIFETIME    time.Duration = 15 * time.Minute
+
+	// The most sessions kept in memory at once, after which the oldest are
+	// evicted
+	MAX_SESSIONS = 10000
+
+	// The most verified id_tokens introspection remembers at once
+	INTROSPECT_CACHE_SIZE = 1000
+
+	// How many logins each client_id or email address may start at once,
+	// and how quickly that allowance recovers
+	RATE_LIMIT_BURST                  = 10
+	RATE_LIMIT_INTERVAL time.Duration = 6 * time.Second
+
+	// How long to wait for requests in flight when shutting down
+	SHUTDOWN_TIMEOUT time.Duration = 10 * time.Second
+
+	// Limits on connections, so slow or oversized requests can't tie up the
+	// server. Writing covers sending confirmation emails, so allows longer.
+	READ_TIMEOUT  time.Duration = 10 * time.Second
+	WRITE_TIMEOUT time.Duration = 30 * time.Second
+	IDLE_TIMEOUT  time.Duration = 2 * time.Minute
+
+	// How long starting a login may wait on upstream providers or the SMTP
+	// server, which must leave time to write the response
+	LOGIN_TIMEOUT time.Duration = 20 * time.Second
+
+	// The largest authorization request body accepted, in bytes
+	MAX_BODY_BYTES = 64 << 10
+
+	// The longest state accepted, in bytes, as it's echoed back to the client
+	MAX_STATE_LENGTH = 1024
+
+	// The longest nonce accepted, in bytes, as it's copied into id_tokens
+	MAX_NONCE_LENGTH = 256
+
+	// How long relying parties may cache our discovery document and keys.
+	// Keys are cached for less, so that new ones are picked up soon.
+	DISCOVERY_MAX_AGE time.Duration = 1 * time.Hour
+	KEYSET_MAX_AGE    time.Duration = 5 * time.Minute
+
+	// How long rotated keys are published before and after they sign
+	KEY_ROTATION_GRACE time.Duration = 1 * time.Hour
 )
 
 func main() {
-	// TODO: Set up a config parser
+	configPath := flag.String("config", "", "path to a JSON configuration file")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	showDocs := flag.Bool("dump", false, "print the discovery document and JWK Set as JSON and exit")
+	flag.Parse()
 
-	// Let the PORT environment variable override the configuration.
-	// This is necessary for tools like https://github.com/codegangsta/gin
-	// (Not to be confused with gin-gonic/gin, the web framework this uses.)
-	port := os.Getenv("PORT")
-	if len(port) <= 0 {
-		port = fmt.Sprintf("%d", PORT)
+	if *showVersion {
+		fmt.Println(buildInfo())
+		return
 	}
 
-	// Generate an ephemeral RSA key for this instance
-	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	// Settings come from the config file, if any, then the environment.
+	// The PORT environment variable is honored for tools like
+	// https://github.com/codegangsta/gin (Not to be confused with
+	// gin-gonic/gin, the web framework this uses.)
+	cfg, err := LoadConfig(*configPath)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+
+	if *showDocs {
+		if err := dump(os.Stdout, cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Stop gracefully on Ctrl-C, or when asked to by a process manager
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadSigningKey loads the signing key from cfg.KeyPath, which may be a
+// mounted secret, or else from cfg.KeyPEM. Without either, it generates an
+// ephemeral one for this instance, if cfg.RequirePersistentKey allows it.
+func loadSigningKey(cfg Config) (crypto.Signer, error) {
+	if len(cfg.KeyPath) > 0 {
+		return loadOrCreateKey(cfg.KeyPath, cfg.SigningAlg, cfg.KeySize)
+	}
+	if len(cfg.KeyPEM) > 0 {
+		// Some platforms can't hold newlines in environment variables
+		return loadKey([]byte(strings.ReplaceAll(cfg.KeyPEM, `\n`, "\n")), "key_pem", cfg.SigningAlg)
+	}
+	if cfg.RequirePersistentKey {
+		return nil, errors.New("require_persistent_key is set, but there is no key_path or key_pem, so a throwaway key would be generated and every restart would invalidate issued tokens")
+	}
+	return generateKey(cfg.SigningAlg, cfg.KeySize)
+}
+
+// dump writes the discovery document and JWK Set which run would serve for
+// cfg to out, as a single JSON object.
+func dump(out io.Writer, cfg Config) error {
+	key, err := loadSigningKey(cfg)
+	if err != nil {
+		return err
+	}
+
+	clients, err := newClientRegistry(cfg.Clients, cfg.RedirectURIs, cfg.RedirectPrefixes, cfg.ClientSecrets, cfg.ClientKeys)
+	if err != nil {
+		return err
+	}
+
+	// Only whether these are set changes the documents
+	p := ProviderConfig{Origin: cfg.Origin, Scheme: cfg.Scheme, BasePath: cfg.BasePath, Key: key, Clients: clients, UserInfo: cfg.UserInfo, ResponseTypes: cfg.ResponseTypes}
+	if cfg.Revocation {
+		p.Revoked = newBlocklist()
+	}
+	if cfg.SubjectType == SUBJECT_PAIRWISE {
+		p.PairwiseSecret = cfg.PairwiseSecret
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Discovery interface{}        `json:"discovery"`
+		Keyset    jose.JsonWebKeySet `json:"jwks"`
+	}{providerMetadata(p.issuer(), p.paths(), signingAlg(key), p.subjectType(), p.responseTypes(), supportedClaims(p.scopeClaims()), clients.hasKeys()), jwkSet(key)})
+}
+
+// run serves requests as configured until ctx is canceled, then stops
+// accepting connections and waits up to cfg.ShutdownTimeout for requests in
+// flight to finish.
+func run(ctx context.Context, cfg Config) error {
+	key, err := loadSigningKey(cfg)
+	if err != nil {
+		return err
+	}
+
+	var keys *KeyManager
+	if cfg.KeyRotationInterval.Duration > 0 {
+		keys = newKeyManager(key, cfg.SigningAlg, cfg.KeySize, cfg.KeyRotationInterval.Duration, cfg.KeyRotationGrace.Duration)
+		go keys.run(ctx)
 	}
 
 	// Set up routes and start server
 
-	router := gin.Default()
+	// Sessions are kept for as long as confirmation links work, if that's
+	// longer, as links which aren't stateless are sessions too
+	sessionLifetime := cfg.SessionLifetime.Duration
+	if cfg.LinkLifetime.Duration > sessionLifetime {
+		sessionLifetime = cfg.LinkLifetime.Duration
+	}
+
+	var store SessionStore
+	if cfg.Redis.Address != "" {
+		store = newRedisSessionStore(cfg.Redis, sessionLifetime)
+	} else {
+		memory := newMemorySessionStore(sessionLifetime)
+		memory.limit(cfg.MaxSessions)
+		store = memory
+	}
+	metrics := newMetrics(store)
+
+	warnings := selfCheck(cfg)
+	for _, warning := range warnings {
+		log.Print("WARNING: " + warning)
+	}
+	metrics.countWarnings(len(warnings))
+
+	pages, err := loadPages(cfg.PagesDir)
+	if err != nil {
+		return err
+	}
+
+	router := gin.New()
+	allowMethods(router)
+	if err := trustProxies(router, cfg.TrustedProxies); err != nil {
+		return err
+	}
+	router.Use(gin.Recovery(), accessLog(os.Stdout, cfg.LogFormat), metrics.middleware(), usePages(pages))
+
+	// Everything is served under the base path, which is part of the issuer
+	base := router.Group(cfg.BasePath)
+	issuer := cfg.Scheme + "://" + cfg.Origin + cfg.BasePath
+
+	indexAddRoutes(base, cfg.Index, issuer)
+
+	var auths []Authenticator
+	var queue *MailQueue
+	mailer := newMailer(cfg.SMTP)
+	if err := probeMailer(mailer, cfg.SMTP.Probe); err != nil {
+		return err
+	}
+	if cfg.AuthMode == AUTH_BYPASS {
+		auths = append(auths, newBypassAuthenticator())
+	} else {
+		docs := newDocumentCache(cfg.UpstreamCacheTTL.Duration, cfg.UpstreamMaxAge.Duration, cfg.UpstreamCacheSize)
+
+		// Delegate Google-hosted addresses to Google, if we have a client_id for it
+		if len(cfg.GoogleClientID) > 0 {
+			auths = append(auths, newGoogleDelegate(issuer, cfg.GoogleClientID, store, docs, cfg.UpstreamAlgs))
+		}
+
+		// And other domains to their own providers, if they have one
+		if cfg.DelegateDiscovery {
+			auths = append(auths, newDelegate(issuer, store, docs, cfg.UpstreamAlgs))
+		}
+
+		// Confirmation emails are audited once they're actually sent, or fail
+		sender := mailer
+		audit, err := newAuditLogger(cfg.Audit)
+		if err != nil {
+			return err
+		}
+		if audit != nil {
+			defer audit.Close()
+			sender = newAuditMailer(mailer, audit, realClock{})
+		}
+
+		// And sent in the background, by a few workers
+		queue = newMailQueue(sender, cfg.SMTP.Workers, cfg.SMTP.QueueDepth)
+
+		emailAuth := newEmailAuthenticator(issuer, queue, store)
+		if cfg.RequireSameBrowser {
+			key, err := csrfKey(cfg.CSRFSecret)
+			if err != nil {
+				return err
+			}
+			emailAuth.requireSameBrowser(key)
+		}
+		if cfg.StatelessLinks {
+			emailAuth.statelessLinks(key)
+		}
+		emailAuth.expireLinks(cfg.LinkLifetime.Duration)
+		auths = append(auths, emailAuth)
+	}
+
+	limiter := newRateLimiter(cfg.RateLimitInterval.Duration, cfg.RateLimitBurst)
+
+	clients, err := newClientRegistry(cfg.Clients, cfg.RedirectURIs, cfg.RedirectPrefixes, cfg.ClientSecrets, cfg.ClientKeys)
+	if err != nil {
+		return err
+	}
 
-	router.GET("/", func(c *gin.Context) {
-		c.String(200, "Hello, World!")
-	})
+	tokens, err := newTokenLog(cfg.TokenLog)
+	if err != nil {
+		return err
+	}
+	if closer, ok := tokens.(io.Closer); ok {
+		defer closer.Close()
+	}
 
-	oidcAddRoutes(router, ORIGIN, rsakey)
+	var revoked *Blocklist
+	if cfg.Revocation {
+		revoked = newBlocklist()
+	}
 
-	router.Run(fmt.Sprintf("%s:%s", ADDRESS, port))
+	var tokenCache *TokenCache
+	if cfg.IntrospectCache > 0 {
+		tokenCache = newTokenCache(cfg.IntrospectCache)
+	}
+
+	// A pairwise_secret left over from an earlier subject_type is ignored
+	var pairwiseSecret string
+	if cfg.SubjectType == SUBJECT_PAIRWISE {
+		pairwiseSecret = cfg.PairwiseSecret
+	}
+
+	oidcAddRoutes(router, ProviderConfig{
+		Origin:             cfg.Origin,
+		Scheme:             cfg.Scheme,
+		BasePath:           cfg.BasePath,
+		Key:                key,
+		Lifetime:           cfg.TokenLifetime.Duration,
+		Leeway:             cfg.TokenLeeway.Duration,
+		MaxBodyBytes:       int64(cfg.MaxBodyBytes),
+		LoginTimeout:       cfg.LoginTimeout.Duration,
+		MaxStateLength:     cfg.MaxStateLength,
+		MaxNonceLength:     cfg.MaxNonceLength,
+		DiscoveryMaxAge:    cfg.DiscoveryMaxAge.Duration,
+		KeysetMaxAge:       cfg.KeysetMaxAge.Duration,
+		Limiter:            limiter,
+		Clients:            clients,
+		RequireOrigin:      cfg.RequireOrigin,
+		StrictScopes:       cfg.StrictScopes,
+		StrictIDTokenHints: cfg.StrictIDTokenHints,
+		LowercaseEmails:    cfg.LowercaseEmails,
+		Revoked:            revoked,
+		UserInfo:           cfg.UserInfo,
+		WebFinger:          cfg.WebFinger,
+		PairwiseSecret:     pairwiseSecret,
+		Keys:               keys,
+		Tokens:             tokens,
+		TokenCache:         tokenCache,
+		AllowedDomains:     cfg.AllowedDomains,
+		BlockedDomains:     cfg.BlockedDomains,
+		ExtraClaims:        cfg.ExtraClaims,
+		ScopeClaims:        cfg.ScopeClaims,
+		ResponseTypes:      cfg.ResponseTypes,
+	}, auths...)
+	opsAddRoutes(base, keyCheck(key), pingCheck("smtp", mailer), pingCheck("session_store", store))
+	metrics.AddRoutes(base)
+
+	tlsConfig, err := serverTLS(cfg.Origin, cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	listener, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Serve HTTPS directly if configured, otherwise plain HTTP
+	server := &http.Server{
+		Handler:           router,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: cfg.ReadTimeout.Duration,
+		ReadTimeout:       cfg.ReadTimeout.Duration,
+		WriteTimeout:      cfg.WriteTimeout.Duration,
+		IdleTimeout:       cfg.IdleTimeout.Duration,
+	}
+	served := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			served <- server.ServeTLS(listener, "", "")
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+
+	// Queued confirmation emails get whatever's left of the timeout. Any
+	// requests still in flight can't queue more once it's closed.
+	if queue != nil {
+		if err := queue.Close(shutdownCtx); err != nil {
+			log.Printf("Stopped waiting for queued emails to be sent: %s", err)
+		}
+	}
+
+	// Persistent stores keep pending logins across restarts; memory can't.
+	if memory, ok := store.(*MemorySessionStore); ok && memory.Pending() > 0 {
+		log.Printf("Discarding %d pending logins held in memory", memory.Pending())
+	}
+	closeStore(store)
+
+	return err
+}
+
+// listen opens a Unix domain socket at cfg.Socket if it's set, or else a TCP
+// port on cfg.Address.
+func listen(cfg Config) (net.Listener, error) {
+	if cfg.Socket == "" {
+		return net.Listen("tcp", net.JoinHostPort(cfg.Address, fmt.Sprintf("%d", cfg.Port)))
+	}
+
+	// A socket left behind by a server which didn't shut down cleanly would
+	// stop us listening, but one still in use, or anything that isn't a
+	// socket, is left alone
+	if info, err := os.Lstat(cfg.Socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", cfg.Socket)
+		}
+		if conn, err := net.Dial("unix", cfg.Socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", cfg.Socket)
+		}
+		if err := os.Remove(cfg.Socket); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", cfg.Socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(cfg.Socket, SOCKET_MODE); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// closeStore releases any resources held by a SessionStore, such as database
+// connections, if it needs closing.
+func closeStore(store SessionStore) {
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Could not close session store: %s", err)
+		}
+	}
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose"
+)
+
+// freePort finds a local TCP port which nothing is listening on.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startRun calls run in the background, and waits until client can fetch the
+// discovery document from it. Canceling the returned context stops the
+// server, after which run's result is sent on the returned channel.
+func startRun(t *testing.T, cfg Config, client *http.Client, scheme string) (context.CancelFunc, <-chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- run(ctx, cfg) }()
+
+	url := fmt.Sprintf("%s://127.0.0.1:%d/.well-known/openid-configuration", scheme, cfg.Port)
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err = client.Get(url); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("server did not start: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+
+	return cancel, stopped
+}
+
+func TestRun(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Address = "127.0.0.1"
+	cfg.Port = freePort(t)
+
+	cancel, stopped := startRun(t, cfg, http.DefaultClient, "http")
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("run returned an error after a clean shutdown: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after its context was canceled")
+	}
+
+	if _, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", cfg.Port)); err == nil {
+		t.Error("server still accepts requests after shutting down")
+	}
+}
+
+func TestRunListenError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	cfg := defaultConfig()
+	cfg.Address = "127.0.0.1"
+	cfg.Port = listener.Addr().(*net.TCPAddr).Port
+
+	if err := run(context.Background(), cfg); err == nil {
+		t.Error("run on a port already in use unexpectedly succeeded")
+	}
+}
+
+func TestRunUnixSocket(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Socket = filepath.Join(t.TempDir(), "authdaemon.sock")
+
+	// Left behind by a server which didn't shut down cleanly
+	stale, err := net.Listen("unix", cfg.Socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", cfg.Socket)
+		},
+	}}
+	cancel, stopped := startRun(t, cfg, client, "http")
+
+	if info, err := os.Stat(cfg.Socket); err != nil || info.Mode().Perm() != SOCKET_MODE {
+		t.Errorf("socket has mode %v (%v) instead of %v", info.Mode().Perm(), err, SOCKET_MODE)
+	}
+
+	// Another server can't take the socket over while it's in use
+	if _, err := listen(cfg); err == nil {
+		t.Error("listen on a socket in use unexpectedly succeeded")
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("run returned an error after a clean shutdown: %s", err)
+	}
+	if _, err := os.Stat(cfg.Socket); !os.IsNotExist(err) {
+		t.Errorf("socket was left behind after shutting down: %v", err)
+	}
+
+	// Nor is anything else at the path replaced
+	if err := ioutil.WriteFile(cfg.Socket, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("run with a file at the socket path returned %v", err)
+	}
+}
+
+func TestRunSMTPProbe(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.username, server.password = "user", "secret"
+
+	cfg := defaultConfig()
+	cfg.Address = "127.0.0.1"
+	cfg.Port = freePort(t)
+	cfg.SMTP = server.config()
+	cfg.SMTP.Password = "wrong"
+	cfg.SMTP.Probe = SMTP_PROBE_REQUIRE
+
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "SMTP") {
+		t.Fatalf("run with bad SMTP credentials returned %v instead of refusing to start", err)
+	}
+
+	cfg.SMTP.Password = "secret"
+	cancel, stopped := startRun(t, cfg, http.DefaultClient, "http")
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("run with good SMTP credentials returned an error: %s", err)
+	}
+}
+
+func TestRunRequirePersistentKey(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Address = "127.0.0.1"
+	cfg.Port = freePort(t)
+	cfg.RequirePersistentKey = true
+
+	err := run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "require_persistent_key") {
+		t.Fatalf("run without a key_path returned %v instead of refusing to start", err)
+	}
+
+	// With one, it starts
+	cfg.KeyPath = filepath.Join(t.TempDir(), "key.pem")
+	cancel, stopped := startRun(t, cfg, http.DefaultClient, "http")
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("run with a key_path returned an error: %s", err)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	generatePEM := func() (*ecdsa.PrivateKey, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	}
+	envKey, envPEM := generatePEM()
+	fileKey, filePEM := generatePEM()
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := ioutil.WriteFile(path, []byte(filePEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AUTHDAEMON_SIGNING_ALG", ALG_ES256)
+	t.Setenv("AUTHDAEMON_KEY_PEM", envPEM)
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The PEM is used without a key_path
+	if key, err := loadSigningKey(cfg); err != nil || !envKey.Equal(key) {
+		t.Errorf("loadSigningKey with AUTHDAEMON_KEY_PEM returned a different key (%v)", err)
+	}
+
+	// Even with its newlines escaped
+	cfg.KeyPEM = strings.ReplaceAll(envPEM, "\n", `\n`)
+	if key, err := loadSigningKey(cfg); err != nil || !envKey.Equal(key) {
+		t.Errorf("loadSigningKey with escaped newlines returned a different key (%v)", err)
+	}
+
+	// But the key_path takes precedence
+	cfg.KeyPath = path
+	if key, err := loadSigningKey(cfg); err != nil || !fileKey.Equal(key) {
+		t.Errorf("loadSigningKey with a key_path and key_pem didn't use the key_path (%v)", err)
+	}
+
+	// A PEM for another algorithm is refused, rather than ignored
+	cfg.KeyPath, cfg.SigningAlg = "", ALG_RS256
+	if _, err := loadSigningKey(cfg); err == nil || !strings.Contains(err.Error(), "key_pem") {
+		t.Errorf("loadSigningKey with an ES256 key_pem for RS256 returned %v", err)
+	}
+
+	// And the PEM is persistent, as far as require_persistent_key goes
+	cfg.SigningAlg, cfg.RequirePersistentKey = ALG_ES256, true
+	if key, err := loadSigningKey(cfg); err != nil || !envKey.Equal(key) {
+		t.Errorf("loadSigningKey with key_pem and require_persistent_key returned %v", err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Origin = "issuer.example"
+	cfg.BasePath = "/auth"
+	cfg.SigningAlg = ALG_ES256
+
+	var out bytes.Buffer
+	if err := dump(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var docs struct {
+		Discovery struct {
+			Issuer  string `json:"issuer"`
+			JwksURI string `json:"jwks_uri"`
+		} `json:"discovery"`
+		Keyset jose.JsonWebKeySet `json:"jwks"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &docs); err != nil {
+		t.Fatalf("dump did not print valid JSON: %s\n%s", err, out.String())
+	}
+
+	if docs.Discovery.Issuer != "https://issuer.example/auth" {
+		t.Errorf("dumped discovery document has issuer %q", docs.Discovery.Issuer)
+	}
+	if docs.Discovery.JwksURI != "https://issuer.example/auth"+oidcPaths.Keyset {
+		t.Errorf("dumped discovery document has jwks_uri %q", docs.Discovery.JwksURI)
+	}
+	if len(docs.Keyset.Keys) != 1 || docs.Keyset.Keys[0].Algorithm != ALG_ES256 {
+		t.Errorf("dumped JWK Set has %d keys instead of one ES256 key: %s", len(docs.Keyset.Keys), out.String())
+	}
+}
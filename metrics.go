@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of steps in the login flow, as counted by Metrics
+const (
+	outcomeValidationError = "validation_error" // A malformed authorization request
+	outcomeEmailSent       = "email_sent"       // A confirmation link was sent
+	outcomeTokenIssued     = "token_issued"     // A login finished with an id_token
+)
+
+// outcomeKey is where handlers record the outcome of a request in the
+// gin.Context, for Metrics to count once the request is finished.
+const outcomeKey = "outcome"
+
+// Metrics collects Prometheus metrics about HTTP requests and login flows.
+type Metrics struct {
+	registry *prometheus.Registry
+	flows    *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// newMetrics creates a Metrics with its own registry. If store can report how
+// many sessions are pending, that is exposed as a gauge, and if it can report
+// how many it has evicted, that is exposed as a counter.
+func newMetrics(store SessionStore) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		flows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "authdaemon",
+			Name:      "auth_flow_total",
+			Help:      "Steps of the login flow, by outcome.",
+		}, []string{"outcome"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "authdaemon",
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+	}
+	m.registry.MustRegister(m.flows, m.latency)
+
+	// Start every outcome at zero, so that rates can be computed from the first scrape
+	for _, outcome := range []string{outcomeValidationError, outcomeEmailSent, outcomeTokenIssued} {
+		m.flows.WithLabelValues(outcome)
+	}
+
+	if counted, ok := store.(interface{ Pending() int }); ok {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "authdaemon",
+			Name:      "pending_sessions",
+			Help:      "Logins which have been started but not yet finished or expired.",
+		}, func() float64 { return float64(counted.Pending()) }))
+	}
+
+	if evicting, ok := store.(interface{ Evictions() int }); ok {
+		m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "authdaemon",
+			Name:      "evicted_sessions_total",
+			Help:      "Sessions dropped before they expired to stay within max_sessions.",
+		}, func() float64 { return float64(evicting.Evictions()) }))
+	}
+
+	return m
+}
+
+// countWarnings exposes how many weak settings selfCheck found at startup, so
+// that they can be alerted on as well as logged.
+func (m *Metrics) countWarnings(n int) {
+	m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "authdaemon",
+		Name:      "config_warnings_total",
+		Help:      "Weak settings found by the startup self-check.",
+	}, func() float64 { return float64(n) }))
+}
+
+// AddRoutes registers the endpoint which Prometheus scrapes.
+func (m *Metrics) AddRoutes(router gin.IRouter) {
+	router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})))
+}
+
+// middleware creates a handler which times each request, and counts any
+// outcome it records.
+func (m *Metrics) middleware() func(*gin.Context) {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		// Label by route pattern rather than path, to keep cardinality bounded
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.latency.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+
+		if outcome := c.GetString(outcomeKey); outcome != "" {
+			m.flows.WithLabelValues(outcome).Inc()
+		}
+	}
+}
+
+// recordOutcome notes what a request accomplished, for Metrics.
+func recordOutcome(c *gin.Context, outcome string) {
+	c.Set(outcomeKey, outcome)
+}
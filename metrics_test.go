@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &fakeMailer{}
+	store := newMemorySessionStore(SESSION_LIFETIME)
+	metrics := newMetrics(store)
+
+	router := gin.New()
+	router.Use(metrics.middleware())
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, newEmailAuthenticator("https://issuer.example", mailer, store))
+	metrics.AddRoutes(router)
+	metrics.countWarnings(2)
+
+	count := func(outcome string) float64 {
+		return testutil.ToFloat64(metrics.flows.WithLabelValues(outcome))
+	}
+
+	bad := validAuthForm()
+	bad.Set("scope", "bogus")
+	postForm(router, "/authorize", bad)
+	bad.Del("client_id")
+	postForm(router, "/authorize", bad)
+
+	if n := count(outcomeValidationError); n != 2 {
+		t.Errorf("validation_error counter is %g after 2 bad requests", n)
+	}
+
+	postForm(router, "/authorize", validAuthForm())
+	if n := count(outcomeEmailSent); n != 1 {
+		t.Errorf("email_sent counter is %g after sending 1 email", n)
+	}
+
+	match := linkRE.FindStringSubmatch(mailer.sent[0].textBody)
+	if match == nil {
+		t.Fatal("email does not contain a confirmation link")
+	}
+	get(router, match[1])
+	if n := count(outcomeTokenIssued); n != 1 {
+		t.Errorf("token_issued counter is %g after confirming 1 email", n)
+	}
+
+	w := get(router, "/metrics")
+	if w.Code != 200 {
+		t.Fatalf("GET /metrics returned %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, s := range []string{
+		`authdaemon_auth_flow_total{outcome="validation_error"} 2`,
+		`authdaemon_http_request_duration_seconds_count{method="POST",route="/authorize",status="400"} 1`,
+		`authdaemon_pending_sessions 0`,
+		`authdaemon_evicted_sessions_total 0`,
+		`authdaemon_config_warnings_total 2`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("GET /metrics does not contain %s:\n%s", s, body)
+		}
+	}
+}
@@ -1,25 +1,329 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/callahad/authdaemon/internal/validation"
 	"github.com/gin-gonic/gin"
 	"github.com/square/go-jose"
 )
 
-// oidcAddRoutes adds OpenID Connect endpoints to an existing gin.IRouter.
-func oidcAddRoutes(router gin.IRouter, origin string, rsakey *rsa.PrivateKey) {
-	jwksPath := "/jwks.json"
-	authPath := "/authorize"
+// ProviderConfig holds the settings for the OpenID Connect endpoints.
+type ProviderConfig struct {
+	Origin   string        // Our host, and port if not 443
+	Scheme   string        // How Origin is reached: https, or http for local development. Empty means https.
+	BasePath string        // Where our endpoints are under Origin, like /auth, or empty for the root
+	Key      crypto.Signer // Signs id_tokens, unless Keys is set
+	Lifetime time.Duration // How long id_tokens are valid for
+	Leeway   time.Duration // How far to backdate id_tokens, for clients with slow clocks
 
-	router.GET("/.well-known/openid-configuration", discovery(origin, jwksPath, authPath))
-	router.GET(jwksPath, keyset(&rsakey.PublicKey))
-	router.POST(authPath, authorize(origin, rsakey))
+	// The largest authorization request body accepted, or 0 for no limit
+	MaxBodyBytes int64
+
+	// How long starting a login may take, or 0 for no limit
+	LoginTimeout time.Duration
+
+	// The longest state accepted, or 0 for no limit. It's HTML-escaped in
+	// form_post pages and URL-encoded in redirects, whatever its length.
+	MaxStateLength int
+
+	// The longest nonce accepted, or 0 for no limit, as it's copied into
+	// each id_token
+	MaxNonceLength int
+
+	// How long relying parties may cache the discovery document and JWK Set
+	// for, or 0 to have them check for changes every time
+	DiscoveryMaxAge time.Duration
+	KeysetMaxAge    time.Duration
+
+	// If not nil, caps how often each client_id and each email address may
+	// start logging in
+	Limiter *RateLimiter
+
+	// If not nil, only the client_ids it allows may log users in
+	Clients *ClientRegistry
+
+	// Require an Origin or Referer header on authorization requests
+	RequireOrigin bool
+
+	// Reject authorization requests with scopes we don't support, rather than
+	// ignoring them
+	StrictScopes bool
+
+	// Reject authorization requests with an id_token_hint we can't use,
+	// rather than ignoring it
+	StrictIDTokenHints bool
+
+	// Lowercase the local part of email addresses, not just the domain, so
+	// that Foo@example.com and foo@example.com are the same user
+	LowercaseEmails bool
+
+	// If not nil, id_tokens may be revoked at the revocation endpoint
+	Revoked *Blocklist
+
+	// Serve the UserInfo endpoint, where id_tokens are accepted as Bearer
+	// tokens
+	UserInfo bool
+
+	// Serve WebFinger, which tells clients the issuer for an email address
+	WebFinger bool
+
+	// If set, each client gets a different sub for the same user, derived
+	// from this secret, rather than their email address
+	PairwiseSecret string
+
+	// If not nil, rotates the keys which sign id_tokens, in place of Key
+	Keys *KeyManager
+
+	// If not nil, keeps a record of each id_token issued
+	Tokens TokenLog
+
+	// If not nil, remembers id_tokens which introspection has verified
+	TokenCache *TokenCache
+
+	// If not empty, only users with email addresses at these domains may log
+	// in, and never those at BlockedDomains
+	AllowedDomains []string
+	BlockedDomains []string
+
+	// If not nil, tells the time id_tokens are issued and checked at
+	Clock Clock
+
+	// Claims added to every id_token, none of which may be reservedClaims
+	ExtraClaims map[string]interface{}
+
+	// The response_types authorization requests may use, and discovery
+	// advertises. If empty, supportedResponseTypes.
+	ResponseTypes []string
+
+	// The claims each scope adds to id_tokens. If nil, defaultScopeClaims.
+	ScopeClaims map[string][]string
+}
+
+// now returns the current time, as told by p.Clock if it's set.
+func (p ProviderConfig) now() time.Time {
+	if p.Clock != nil {
+		return p.Clock.Now()
+	}
+	return time.Now()
+}
+
+// domainAllowed reports whether users with email may log in, as its domain is
+// allowed, if only some are, and isn't blocked. Domains are compared
+// case-insensitively.
+func (p ProviderConfig) domainAllowed(email string) bool {
+	domain := emailDomain(email)
+	listed := func(domains []string) bool {
+		for _, d := range domains {
+			if strings.EqualFold(d, domain) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(p.AllowedDomains) > 0 && !listed(p.AllowedDomains) {
+		return false
+	}
+	return !listed(p.BlockedDomains)
+}
+
+// signingKey returns the key to sign id_tokens with now.
+func (p ProviderConfig) signingKey() crypto.Signer {
+	if p.Keys != nil {
+		return p.Keys.Current()
+	}
+	return p.Key
+}
+
+// verificationKey returns the published key whose kid is kid, or the signing
+// key if there's no such key.
+func (p ProviderConfig) verificationKey(kid string) crypto.Signer {
+	if p.Keys != nil {
+		for _, key := range p.Keys.All() {
+			if generateKid(key.Public()) == kid {
+				return key
+			}
+		}
+	}
+	return p.signingKey()
+}
+
+// paths returns where each endpoint is served, with those which aren't
+// enabled left empty.
+func (p ProviderConfig) paths() providerPaths {
+	paths := oidcPaths
+	if p.Revoked == nil {
+		paths.Revoke = ""
+	}
+	if !p.Clients.hasSecrets() {
+		paths.Introspect = ""
+	}
+	if !p.UserInfo {
+		paths.UserInfo = ""
+	}
+	return paths
+}
+
+// issuer returns our issuer identifier, which every endpoint is under.
+func (p ProviderConfig) issuer() string {
+	return p.scheme() + "://" + p.Origin + p.BasePath
+}
+
+// scheme returns how our origin is reached.
+func (p ProviderConfig) scheme() string {
+	if p.Scheme == "" {
+		return SCHEME_HTTPS
+	}
+	return p.Scheme
+}
+
+// responseTypes returns the response_types authorization requests may use.
+func (p ProviderConfig) responseTypes() []string {
+	if len(p.ResponseTypes) == 0 {
+		return supportedResponseTypes
+	}
+	return p.ResponseTypes
+}
+
+// scopeClaims returns the claims each scope adds to id_tokens.
+func (p ProviderConfig) scopeClaims() map[string][]string {
+	if p.ScopeClaims == nil {
+		return defaultScopeClaims
+	}
+	return p.ScopeClaims
+}
+
+// subjectType returns which kind of sub claim is issued.
+func (p ProviderConfig) subjectType() string {
+	if p.PairwiseSecret != "" {
+		return SUBJECT_PAIRWISE
+	}
+	return SUBJECT_PUBLIC
+}
+
+// subject returns the sub claim for the user with the given email, when
+// logging in to clientID.
+func (p ProviderConfig) subject(email string, clientID string) string {
+	if p.PairwiseSecret != "" {
+		return pairwiseSubject(p.PairwiseSecret, email, clientID)
+	}
+	return email
+}
+
+// providerPaths are where the OpenID Connect endpoints are served, relative
+// to the issuer. They are declared once so that the routes and the discovery
+// document can't disagree.
+type providerPaths struct {
+	Discovery  string
+	Keyset     string
+	Authorize  string
+	EndSession string
+	Revoke     string // Only if the ProviderConfig has a Blocklist
+	Introspect string // Only if any of its Clients have secrets
+	UserInfo   string // Only if it enables UserInfo
+}
+
+// oidcPaths are the paths of the endpoints added by oidcAddRoutes.
+var oidcPaths = providerPaths{
+	Discovery:  "/.well-known/openid-configuration",
+	Keyset:     "/jwks.json",
+	Authorize:  "/authorize",
+	EndSession: "/end_session",
+	Revoke:     "/revoke",
+	Introspect: "/introspect",
+	UserInfo:   "/userinfo",
+}
+
+// oidcAddRoutes adds OpenID Connect endpoints to an existing gin.IRouter,
+// under p.BasePath, except for WebFinger, which is at its root.
+//
+// Each authorization request is handled by the first of auths which accepts
+// the user's email address.
+func oidcAddRoutes(router gin.IRouter, p ProviderConfig, auths ...Authenticator) {
+	if p.WebFinger {
+		router.GET(webfingerPath, allowAnyOrigin(), webfinger(p, auths))
+	}
+
+	if p.BasePath != "" {
+		router = router.Group(p.BasePath)
+	}
+
+	paths := p.paths()
+
+	// Browser-based clients may fetch these from any site, and monitoring
+	// tools may probe them with HEAD. The authorization endpoint is
+	// deliberately not among them.
+	public := []struct {
+		path    string
+		handler func(*gin.Context)
+	}{
+		{paths.Discovery, discovery(p.issuer(), paths, signingAlg(p.signingKey()), p.subjectType(), p.responseTypes(), supportedClaims(p.scopeClaims()), p.Clients.hasKeys(), p.DiscoveryMaxAge)},
+		{paths.Keyset, keyset(p.Key, p.KeysetMaxAge)},
+	}
+	if p.Keys != nil {
+		public[1].handler = rotatingKeyset(p.Keys, p.KeysetMaxAge)
+	}
+	cors := allowAnyOrigin()
+	for _, v := range public {
+		router.GET(v.path, cors, v.handler)
+		router.HEAD(v.path, cors, v.handler)
+		router.OPTIONS(v.path, cors)
+	}
+
+	// Authorization requests may arrive as query parameters or form bodies
+	authHandler := authorize(p, p.BasePath+paths.Authorize, auths)
+	router.GET(paths.Authorize, authHandler)
+	router.POST(paths.Authorize, authHandler)
+
+	// As are logout requests
+	logoutHandler := endSession(p, auths)
+	router.GET(paths.EndSession, logoutHandler)
+	router.POST(paths.EndSession, logoutHandler)
+
+	if paths.Revoke != "" {
+		router.POST(paths.Revoke, revoke(p))
+	}
+
+	if paths.Introspect != "" {
+		router.POST(paths.Introspect, introspect(p))
+	}
+
+	// The UserInfo spec requires both methods
+	if paths.UserInfo != "" {
+		userinfoHandler := userinfo(p)
+		router.GET(paths.UserInfo, userinfoHandler)
+		router.POST(paths.UserInfo, userinfoHandler)
+	}
+
+	done := complete(p)
+	for _, auth := range auths {
+		auth.AddRoutes(router, done)
+	}
 }
 
 // -- HTTP Handlers ---
@@ -29,105 +333,547 @@ func oidcAddRoutes(router gin.IRouter, origin string, rsakey *rsa.PrivateKey) {
 //
 // The `form_post` response type is from the OAuth 2.0 Form Post Response Mode
 // spec at http://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html.
-func discovery(origin string, jwksPath string, authPath string) func(*gin.Context) {
-	var document = struct {
-		Issuer                           string   `json:"issuer"`
-		AuthorizationEndpoint            string   `json:"authorization_endpoint"`
-		JwksURI                          string   `json:"jwks_uri"`
-		ScopesSupported                  []string `json:"scopes_supported"`
-		ClaimsSupported                  []string `json:"claims_supported"`
-		ResponseTypesSupported           []string `json:"response_types_supported"`
-		ResponseModesSupported           []string `json:"response_modes_supported"`
-		GrantTypesSupports               []string `json:"grant_types_supports"`
-		SubjectTypesSupported            []string `json:"subject_types_supported"`
-		IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+//
+// Endpoint URLs are built from paths, the same paths oidcAddRoutes serves
+// under the issuer. Clients may cache the document for maxAge.
+func discovery(issuer string, paths providerPaths, alg string, subjectType string, responseTypes []string, claims []string, requestObjects bool, maxAge time.Duration) func(*gin.Context) {
+	return cacheableJSON(providerMetadata(issuer, paths, alg, subjectType, responseTypes, claims, requestObjects), maxAge)
+}
+
+// providerMetadata builds the discovery document which discovery serves.
+// Support for the request parameter, when clients have keys to sign request
+// objects with, is always advertised, as is the lack of support for
+// request_uri, since the spec has that default to true.
+func providerMetadata(issuer string, paths providerPaths, alg string, subjectType string, responseTypes []string, claims []string, requestObjects bool) interface{} {
+	return struct {
+		Issuer                                 string   `json:"issuer"`
+		AuthorizationEndpoint                  string   `json:"authorization_endpoint"`
+		JwksURI                                string   `json:"jwks_uri"`
+		EndSessionEndpoint                     string   `json:"end_session_endpoint"`
+		RevocationEndpoint                     string   `json:"revocation_endpoint,omitempty"`
+		IntrospectionEndpoint                  string   `json:"introspection_endpoint,omitempty"`
+		UserinfoEndpoint                       string   `json:"userinfo_endpoint,omitempty"`
+		ScopesSupported                        []string `json:"scopes_supported"`
+		ClaimsSupported                        []string `json:"claims_supported"`
+		ResponseTypesSupported                 []string `json:"response_types_supported"`
+		ResponseModesSupported                 []string `json:"response_modes_supported"`
+		GrantTypesSupports                     []string `json:"grant_types_supports"`
+		SubjectTypesSupported                  []string `json:"subject_types_supported"`
+		IDTokenSigningAlgValuesSupported       []string `json:"id_token_signing_alg_values_supported"`
+		CodeChallengeMethodsSupported          []string `json:"code_challenge_methods_supported"`
+		RequestParameterSupported              bool     `json:"request_parameter_supported"`
+		RequestURIParameterSupported           bool     `json:"request_uri_parameter_supported"`
+		RequestObjectSigningAlgValuesSupported []string `json:"request_object_signing_alg_values_supported,omitempty"`
 	}{
-		Issuer:                           "https://" + origin,
-		AuthorizationEndpoint:            "https://" + origin + authPath,
-		JwksURI:                          "https://" + origin + jwksPath,
-		ScopesSupported:                  []string{"openid", "email"},
-		ClaimsSupported:                  []string{"aud", "email", "email_verified", "exp", "iat", "iss", "sub"},
-		ResponseTypesSupported:           []string{"id_token"},
-		ResponseModesSupported:           []string{"form_post"},
-		GrantTypesSupports:               []string{"implicit"},
-		SubjectTypesSupported:            []string{"public"},
-		IDTokenSigningAlgValuesSupported: []string{"RS256"},
+		Issuer:                                 issuer,
+		AuthorizationEndpoint:                  endpoint(issuer, paths.Authorize),
+		JwksURI:                                endpoint(issuer, paths.Keyset),
+		EndSessionEndpoint:                     endpoint(issuer, paths.EndSession),
+		RevocationEndpoint:                     endpoint(issuer, paths.Revoke),
+		IntrospectionEndpoint:                  endpoint(issuer, paths.Introspect),
+		UserinfoEndpoint:                       endpoint(issuer, paths.UserInfo),
+		ScopesSupported:                        supportedScopes,
+		ClaimsSupported:                        claims,
+		ResponseTypesSupported:                 responseTypes,
+		ResponseModesSupported:                 []string{RESPONSE_MODE_FORM_POST},
+		GrantTypesSupports:                     []string{"implicit"},
+		SubjectTypesSupported:                  []string{subjectType},
+		IDTokenSigningAlgValuesSupported:       []string{alg},
+		CodeChallengeMethodsSupported:          []string{PKCE_S256},
+		RequestParameterSupported:              requestObjects,
+		RequestURIParameterSupported:           false,
+		RequestObjectSigningAlgValuesSupported: requestObjectAlgs(requestObjects),
+	}
+}
+
+// requestObjectAlgs returns the algorithms request objects may be signed
+// with, if they're supported.
+func requestObjectAlgs(supported bool) []string {
+	if !supported {
+		return nil
+	}
+	return asymmetricAlgs
+}
+
+// endpoint returns the url of the endpoint at path under issuer, or an empty
+// string if path is, as for endpoints which aren't enabled.
+func endpoint(issuer string, path string) string {
+	if path == "" {
+		return ""
+	}
+	return issuer + path
+}
+
+// allowAnyOrigin creates a handler which lets scripts on any site read the
+// response, as per the Fetch spec's CORS protocol. It answers preflight
+// OPTIONS requests itself.
+func allowAnyOrigin() func(*gin.Context) {
+	return func(c *gin.Context) {
+		c.Header("Access-Control-Allow-Origin", "*")
+
+		if c.Request.Method == "OPTIONS" {
+			c.Header("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Accept, Content-Type")
+			c.Header("Access-Control-Max-Age", "86400")
+			c.AbortWithStatus(204)
+		}
 	}
+}
+
+// keyset creates a handler that publishes the host's public keys as a JWK Set,
+// which clients may cache for maxAge.
+func keyset(key crypto.Signer, maxAge time.Duration) func(*gin.Context) {
+	return cacheableJSON(jwkSet(key), maxAge)
+}
 
+// rotatingKeyset creates a handler like keyset's, which publishes whichever
+// keys are current, next, or previous for keys.
+func rotatingKeyset(keys *KeyManager, maxAge time.Duration) func(*gin.Context) {
 	return func(c *gin.Context) {
-		c.JSON(200, document)
+		cacheableJSON(jwkSet(keys.All()...), maxAge)(c)
 	}
 }
 
-// keyset creates a handler that publishes the host's public keys as a JWK Set.
-func keyset(pubkey *rsa.PublicKey) func(*gin.Context) {
-	jwkSet := jose.JsonWebKeySet{
-		Keys: []jose.JsonWebKey{
-			jose.JsonWebKey{
-				Key:       pubkey,
-				KeyID:     generateKid(pubkey),
-				Algorithm: "RS256",
-				Use:       "sig",
-			},
-		},
+// jwkSet builds a JWK Set of the public halves of keys.
+func jwkSet(keys ...crypto.Signer) jose.JsonWebKeySet {
+	set := jose.JsonWebKeySet{Keys: []jose.JsonWebKey{}}
+	for _, key := range keys {
+		// Without a usable key there's nothing to publish, and authorize says why
+		if checkKey(key) != nil {
+			continue
+		}
+
+		set.Keys = append(set.Keys, jose.JsonWebKey{
+			Key:       key.Public(),
+			KeyID:     generateKid(key.Public()),
+			Algorithm: signingAlg(key),
+			Use:       "sig",
+		})
+	}
+	return set
+}
+
+// cacheableJSON creates a handler which serves a document that never changes
+// as JSON. Clients may cache it for maxAge, or must check it's unchanged each
+// time if that's 0, which its ETag lets them do with conditional requests.
+func cacheableJSON(document interface{}, maxAge time.Duration) func(*gin.Context) {
+	body, err := json.Marshal(document)
+	if err != nil {
+		return func(c *gin.Context) {
+			respondError(c, 500, "Unknown Error", err.Error())
+		}
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+
+	cacheControl := "no-cache"
+	if maxAge > 0 {
+		cacheControl = fmt.Sprintf("public, max-age=%d", int64(maxAge/time.Second))
 	}
 
 	return func(c *gin.Context) {
-		c.JSON(200, jwkSet)
+		c.Header("Cache-Control", cacheControl)
+		c.Header("ETag", etag)
+
+		if etagMatches(c.GetHeader("If-None-Match"), etag) {
+			c.Status(304)
+			return
+		}
+
+		// HEAD requests, from monitoring tools, get the same headers
+		if c.Request.Method == "HEAD" {
+			c.Header("Content-Type", "application/json; charset=utf-8")
+			c.Header("Content-Length", strconv.Itoa(len(body)))
+			c.Status(200)
+			return
+		}
+
+		c.Data(200, "application/json; charset=utf-8", body)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, or is "*".
+// As RFC 7232 requires, weak validators match too.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
 	}
+	return false
 }
 
-// authorize creates a handler for OpenID Connect authorization requests.
-func authorize(origin string, key *rsa.PrivateKey) func(*gin.Context) {
+// authorize creates a handler for OpenID Connect authorization requests. For
+// GET requests, gin binds the AuthRequest from the query string; for POST, from
+// the form body, or from a JSON body if that's its Content-Type.
+//
+// Requests without a login_hint get a page asking for the user's email, which
+// resubmits the request to authPath with the login_hint filled in. The
+// login_hint is normalized, so that it's the same for every request by the
+// same user.
+//
+// Browsers say which site a request came from in the Origin header, or at
+// least the Referer, and it must be the client_id or our own origin. Else a
+// site could use another client's client_id to log users in to it without
+// their knowledge. Requests with neither header are only allowed if
+// p.RequireOrigin is false.
+func authorize(p ProviderConfig, authPath string, auths []Authenticator) func(*gin.Context) {
+	origin, limiter, clients, requireOrigin := p.scheme()+"://"+p.Origin, p.Limiter, p.Clients, p.RequireOrigin
+	keyErr := checkKey(p.signingKey())
+
 	return func(c *gin.Context) {
+		// Don't start logins which could never finish
+		if keyErr != nil {
+			keyFailure(c, keyErr)
+			return
+		}
+
 		var form AuthRequest
 
-		bindErr := c.Bind(&form)
+		// The body is read up front, whatever its size limit, so that every
+		// parameter in it can be checked for repeats. Is it too big? This
+		// must be checked before binding, which would otherwise only fail
+		// with a generic error.
+		var jsonParams url.Values
+		if c.Request.Body != nil {
+			if p.MaxBodyBytes > 0 {
+				c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, p.MaxBodyBytes)
+			}
+
+			// ParseForm doesn't read JSON bodies, so read them up front
+			err := c.Request.ParseForm()
+			if c.ContentType() == "application/json" {
+				var body []byte
+				body, err = io.ReadAll(c.Request.Body)
+				c.Request.Body = io.NopCloser(bytes.NewReader(body))
+				jsonParams = withJSONParams(c.Request.Form, body)
+			}
+
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				recordOutcome(c, outcomeValidationError)
+				respondError(c, 413, "Request Too Large", fmt.Sprintf("Request bodies must be at most %d bytes", tooLarge.Limit))
+				return
+			}
+		}
+
+		// Binding errors are left for us to report in order, unlike c.Bind's,
+		// which respond with a bare 400 straight away
+		bindErr := c.ShouldBind(&form)
+		c.Set(clientIDKey, form.ClientID)
+
+		// A request object's signed parameters take precedence over the
+		// others. Errors are only reported once the redirect_uri is trusted.
+		var requestErr error
+		if form.RequestURI != "" {
+			requestErr = errRequestURI
+		} else if form.Request != "" {
+			if merged, err := mergeRequestObject(p, form); err != nil {
+				requestErr = err
+			} else {
+				// The request parsed, so binding can only have objected
+				// to required fields missing outside the request object,
+				// which complete() checks again
+				form, bindErr = merged, nil
+			}
+		}
+
+		// An id_token we issued says who the user is, if the login_hint
+		// doesn't. Errors are only reported once the redirect_uri is trusted.
+		var hintErr error
+		if form.IDTokenHint != "" {
+			var email string
+			if email, hintErr = idTokenHintEmail(p, form); hintErr == nil && form.LoginHint == "" {
+				form.LoginHint = email
+			}
+		}
+
+		// Malformed addresses are left as they are, for valid() to reject
+		if email, err := validation.NormalizeEmail(form.LoginHint); err == nil {
+			if p.LowercaseEmails {
+				email = strings.ToLower(email)
+			}
+			form.LoginHint = email
+		}
 
 		// Are any `binding:"required"` fields missing?
 		if fieldsErr := form.complete(); fieldsErr != nil {
-			fail(c, "Missing Field", fieldsErr.Error())
+			recordOutcome(c, outcomeValidationError)
+			fail(c, "missing_field", "Missing Field", fieldsErr.Error())
+			return
+		}
+
+		// Is the redirect_uri one the client registered, if it registered any?
+		// This comes before the other checks, as errors are redirected to any
+		// redirect_uri within the client's origin. Those outside it are left
+		// for valid() to reject.
+		if validation.ContainedBy(form.RedirectURI, form.ClientID) && !clients.RedirectAllowed(form.ClientID, form.RedirectURI) {
+			recordOutcome(c, outcomeValidationError)
+			fail(c, "unregistered_redirect_uri", "Bad Redirect", "redirect_uri "+form.RedirectURI+" is not registered for client_id "+form.ClientID)
+			return
+		}
+
+		// Were any parameters given more than once? Binding silently uses
+		// the first, while something upstream may have checked another. The
+		// error isn't redirected if the client_id or redirect_uri is in doubt.
+		// A JSON body's parameters aren't in the form, so are counted apart.
+		params := c.Request.Form
+		if jsonParams != nil {
+			params = jsonParams
+		}
+		if repeated := repeatedParams(params); len(repeated) > 0 {
+			recordOutcome(c, outcomeValidationError)
+			repeatErr := requestError{"invalid_request", "Parameters must not be repeated: " + strings.Join(repeated, " "), "repeated_parameter"}
+			if contains(repeated, "client_id") || contains(repeated, "redirect_uri") {
+				fail(c, repeatErr.reason, "Bad Value", repeatErr.Error())
+			} else {
+				reject(c, &form, "Bad Value", repeatErr)
+			}
 			return
 		}
 
-		// Are any field values invalid?
-		if validErr := form.valid(); validErr != nil {
-			fail(c, "Bad Value", validErr.Error())
+		// Are any field values invalid? A bad state is left out of the
+		// error, rather than echoed back.
+		if validErr := form.valid(p.responseTypes(), p.MaxNonceLength); validErr != nil {
+			recordOutcome(c, outcomeValidationError)
+			if err, ok := validErr.(requestError); ok && err.reason == "invalid_state" {
+				form.State = ""
+			}
+			reject(c, &form, "Bad Value", validErr)
+			return
+		}
+
+		// Was the request object unusable?
+		if requestErr != nil {
+			recordOutcome(c, outcomeValidationError)
+			reject(c, &form, "Bad Request Object", requestErr)
+			return
+		}
+
+		// Was the id_token_hint unusable? It's ignored unless
+		// p.StrictIDTokenHints is set.
+		if hintErr != nil && p.StrictIDTokenHints {
+			recordOutcome(c, outcomeValidationError)
+			reject(c, &form, "Bad Hint", requestError{"invalid_request", "id_token_hint is unusable: " + hintErr.Error(), "invalid_id_token_hint"})
+			return
+		}
+
+		// Is the state too long to echo back? It's left out of the error,
+		// which would be just as long.
+		if p.MaxStateLength > 0 && len(form.State) > p.MaxStateLength {
+			recordOutcome(c, outcomeValidationError)
+			form.State = ""
+			reject(c, &form, "Bad Value", requestError{"invalid_request", fmt.Sprintf("state must be at most %d bytes", p.MaxStateLength), "state_too_long"})
+			return
+		}
+
+		// Clients may ask for scopes we don't support, which we ignore unless
+		// p.StrictScopes is set
+		if unsupported := form.unsupportedScopes(); p.StrictScopes && len(unsupported) > 0 {
+			recordOutcome(c, outcomeValidationError)
+			reject(c, &form, "Bad Value", requestError{"invalid_scope", "Unsupported scopes: " + strings.Join(unsupported, " "), "unsupported_scope"})
 			return
 		}
 
 		// Did something else go wrong?
 		if bindErr != nil {
-			fail(c, "Unknown Error", bindErr.Error())
+			recordOutcome(c, outcomeValidationError)
+			fail(c, "malformed_request", "Unknown Error", bindErr.Error())
+			return
+		}
+
+		// Is this client allowed to use us?
+		if !clients.Allowed(form.ClientID) {
+			recordOutcome(c, outcomeValidationError)
+			reject(c, &form, "Unauthorized Client", requestError{"unauthorized_client", "client_id " + form.ClientID + " is not allowed to log users in here", "unauthorized_client"})
+			return
+		}
+
+		// Did the request come from the client, or from us?
+		sender := c.GetHeader("Origin")
+		if sender == "" || sender == "null" {
+			sender = validation.RefererOrigin(c.GetHeader("Referer"))
+		}
+		if sender == "" && requireOrigin {
+			recordOutcome(c, outcomeValidationError)
+			fail(c, "missing_origin", "Bad Origin", "Requests must include an Origin or Referer header")
+			return
+		}
+		if sender != "" && !validation.OriginMatches(sender, form.ClientID) && sender != origin {
+			recordOutcome(c, outcomeValidationError)
+			fail(c, "wrong_origin", "Bad Origin", "Requests for client_id "+form.ClientID+" must come from that origin, not "+sender)
+			return
+		}
+
+		// We keep no login sessions, so every user must verify their email
+		// address afresh, as prompt=login asks. That can't be done without
+		// interacting with them, as prompt=none forbids.
+		if form.prompts()[PROMPT_NONE] {
+			recordOutcome(c, outcomeValidationError)
+			reject(c, &form, "Login Required", requestError{"login_required", "Users must verify their email address for every login", "login_required"})
+			return
+		}
+
+		if form.LoginHint == "" {
+			renderPage(c, 200, "enter_email.html", struct {
+				Client string
+				Action string
+				Fields url.Values
+			}{form.ClientID, authPath, form.values()})
+			return
+		}
+
+		// Is this user allowed to log in here? Checked before anything is sent
+		// to them.
+		if !p.domainAllowed(form.LoginHint) {
+			recordOutcome(c, outcomeValidationError)
+			reject(c, &form, "Domain Not Allowed", requestError{"access_denied", "Email addresses at " + emailDomain(form.LoginHint) + " may not log in here", "domain_not_allowed"})
+			return
+		}
+
+		// Starting a login may send an email, so don't let anyone do it too often
+		if !limiter.Allow("client:"+form.ClientID) || !limiter.Allow("email:"+strings.ToLower(form.LoginHint)) {
+			c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(limiter.RetryAfter().Seconds()))))
+			respondError(c, 429, "Rate Limited", "Too many login attempts, please try again later")
+			return
+		}
+
+		// Starting a login may wait on upstream providers or the SMTP
+		// server, but no longer than p.LoginTimeout
+		if p.LoginTimeout > 0 {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), p.LoginTimeout)
+			defer cancel()
+			c.Request = c.Request.WithContext(ctx)
+		}
+
+		// The chosen Authenticator saves the whole form in its SessionStore,
+		// so optional values like form.State and form.Nonce survive until
+		// the flow completes, then reach the client via complete().
+		for _, auth := range auths {
+			if auth.Accepts(c.Request.Context(), form.LoginHint) {
+				// A code_verifier can only be checked in a request the client
+				// makes, before anything one-time is used up, so PKCE is
+				// refused where logins finish anywhere else
+				if _, inline := auth.(inlineAuthenticator); form.CodeChallenge != "" && !inline {
+					recordOutcome(c, outcomeValidationError)
+					reject(c, &form, "Bad Value", requestError{"invalid_request", "code_challenge is not supported for " + form.LoginHint + ", whose login finishes where no code_verifier can be sent", "unsupported_code_challenge"})
+					return
+				}
+
+				auth.Start(c, form)
+				return
+			}
+		}
+
+		respondError(c, 500, "Unknown Error", "No authentication method available for "+form.LoginHint)
+	}
+}
+
+// idTokenHintEmail returns the email address in req's id_token_hint, which
+// must be an id_token we issued to the same client and haven't revoked. As per
+// the spec, it may have expired. If req also has a login_hint, they must be
+// for the same address.
+func idTokenHintEmail(p ProviderConfig, req AuthRequest) (string, error) {
+	claims, err := verifyIDToken(p, req.IDTokenHint)
+	if err != nil {
+		return "", err
+	}
+
+	tests := []struct {
+		description string
+		ok          bool
+	}{
+		{"Token was issued to another client", claims.Audience == req.ClientID},
+		{"Token has no email address", claims.Email != ""},
+		{"Token is for someone other than the login_hint", req.LoginHint == "" || strings.EqualFold(claims.Email, req.LoginHint)},
+	}
+
+	for _, v := range tests {
+		if !v.ok {
+			return "", errors.New(v.description)
+		}
+	}
+
+	return claims.Email, nil
+}
+
+// complete creates a CompleteFunc which issues an id_token for a verified email
+// address and posts it to the client's redirect_uri.
+//
+// If the request had a PKCE code_challenge, as per RFC 7636, the request which
+// finishes logging in must include the matching code_verifier. authorize only
+// allows that for inlineAuthenticators, whose logins finish in the
+// authorization request itself.
+func complete(p ProviderConfig) CompleteFunc {
+	keyErr := checkKey(p.signingKey())
+
+	return func(c *gin.Context, req AuthRequest, email string, method string) {
+		if keyErr != nil {
+			keyFailure(c, keyErr)
 			return
 		}
 
-		// TODO: If present, persist optional form.State and form.Nonce values.
-		// State is returned as a query parameter outside of the JWT itself.
-		// Nonce is returned as a member value of the JWT.
+		if req.CodeChallenge != "" {
+			verifier := c.Query("code_verifier")
+			if verifier == "" {
+				verifier = c.PostForm("code_verifier")
+			}
+
+			if !verifyCodeChallenge(req.CodeChallenge, verifier) {
+				fail(c, "invalid_code_verifier", "Bad Verifier", "The code_verifier is missing or does not match the code_challenge")
+				return
+			}
+		}
+
+		token, err := mintIDToken(p, req, email, method)
+		if err != nil {
+			respondError(c, 500, "Token Error", err.Error())
+			return
+		}
 
-		// TODO: Trigger an appropriate authentication method
-		c.String(500, "FIXME: Unimplemented")
+		recordOutcome(c, outcomeTokenIssued)
+		renderFormPost(c, req, email, token)
 	}
 }
 
+// keyFailure logs why the signing key is unusable, and responds with a 500
+// which doesn't go into detail.
+func keyFailure(c *gin.Context, err error) {
+	log.Printf("[token] request_id=%s Cannot sign id_tokens: %s", c.GetString(requestIDKey), err)
+	respondError(c, 500, "Key Error", "The server is not able to sign tokens")
+}
+
 // --- TYPES ---
 
-// AuthRequest represents an OpenID Connect / OAuth2 authorization request body.
+// AuthRequest represents an OpenID Connect / OAuth2 authorization request body,
+// which may be form-encoded or, for programmatic clients, JSON.
 type AuthRequest struct {
 	// Required
-	Scope        string `form:"scope" binding:"required"`
-	ResponseType string `form:"response_type" binding:"required"`
-	ClientID     string `form:"client_id" binding:"required"`
-	RedirectURI  string `form:"redirect_uri" binding:"required"`
-
-	// NOTE: Technically optional, but handling omission is not yet implemented
-	LoginHint string `form:"login_hint" binding:"required"`
+	Scope        string `form:"scope" json:"scope" binding:"required"`
+	ResponseType string `form:"response_type" json:"response_type" binding:"required"`
+	ClientID     string `form:"client_id" json:"client_id" binding:"required"`
+	RedirectURI  string `form:"redirect_uri" json:"redirect_uri" binding:"required"`
 
 	// Optional
-	ResponseMode string `form:"response_mode"`
-	State        string `form:"state"`
-	Nonce        string `form:"nonce"`
+	LoginHint    string `form:"login_hint" json:"login_hint"`
+	ResponseMode string `form:"response_mode" json:"response_mode"`
+	State        string `form:"state" json:"state"`
+	Nonce        string `form:"nonce" json:"nonce"`
+	Prompt       string `form:"prompt" json:"prompt"`
+	MaxAge       string `form:"max_age" json:"max_age"`
+	ACRValues    string `form:"acr_values" json:"acr_values"`
+	IDTokenHint  string `form:"id_token_hint" json:"id_token_hint"`
+
+	// A JWT signed by the client, whose claims replace the other parameters,
+	// and which is cleared once they have
+	Request    string `form:"request" json:"request"`
+	RequestURI string `form:"request_uri" json:"request_uri"`
+
+	// PKCE, as per RFC 7636
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
 }
 
 // complete verifies that all required fields are present.
@@ -148,84 +894,530 @@ func (params *AuthRequest) complete() error {
 	return nil
 }
 
-// valid verifies that all field values are valid.
-func (params *AuthRequest) valid() error {
-	urlNote := "Note: urls must be absolute, must use http or https, and must omit default ports"
+// urlNote explains validation.ValidURI, for errors about urls which it rejects.
+const urlNote = "Note: urls must be absolute, must use http or https, and must omit default ports"
 
+// valid verifies that all field values are valid, and that the response_type
+// is one of responseTypes.
+func (params *AuthRequest) valid(responseTypes []string, maxNonceLength int) error {
 	type testCase struct {
 		description string
 		ok          bool
+		code        string // OAuth 2.0 error code
+		reason      string // Our own error code, for fail
 	}
 
 	// Array of validation testCases to check.
 	tests := []testCase{
 		// scope
 		{
-			"scope must be exactly 'openid email'",
-			params.Scope == "openid email",
+			"scope must include 'openid'",
+			params.scopes()["openid"],
+			"invalid_scope",
+			"invalid_scope",
 		},
 
 		// response_type
 		{
-			"response_type must be exactly 'id_token'",
-			params.ResponseType == "id_token",
+			"response_type must be one of '" + strings.Join(responseTypes, "', '") + "'",
+			responseTypeAllowed(responseTypes, params.ResponseType),
+			"unsupported_response_type",
+			"unsupported_response_type",
 		},
 
-		// client_id (TODO: Validate against Origin or Referer headers?)
+		// client_id (authorize also checks it against the Origin header)
 		{
 			"client_id must be a valid url. " + urlNote,
-			validURI(params.ClientID),
+			validation.ValidURI(params.ClientID),
+			"invalid_request",
+			"invalid_client_id",
 		},
 		{
 			"client_id must not include paths, query values, or fragments",
-			onlyOrigin(params.ClientID),
+			validation.OnlyOrigin(params.ClientID),
+			"invalid_request",
+			"invalid_client_id",
 		},
 
 		// redirect_uri
 		{
 			"redirect_uri must be a valid url. " + urlNote,
-			validURI(params.RedirectURI),
+			validation.ValidURI(params.RedirectURI),
+			"invalid_request",
+			"invalid_redirect_uri",
 		},
 		{
 			"redirect_uri must be an absolute url that falls within client_id's origin",
-			containedBy(params.RedirectURI, params.ClientID),
+			validation.ContainedBy(params.RedirectURI, params.ClientID),
+			"invalid_request",
+			"invalid_redirect_uri",
 		},
 
 		// response_mode
 		{
-			"response_mode must be 'params_post' or empty",
-			params.ResponseMode == "params_post" || params.ResponseMode == "",
+			"response_mode must be 'form_post' or omitted, as id_tokens are never sent in the query or fragment",
+			params.ResponseMode == RESPONSE_MODE_FORM_POST || params.ResponseMode == "",
+			"invalid_request",
+			"unsupported_response_mode",
 		},
 
-		// login_hint (NOTE: This could be made optional in the future.)
+		// login_hint
 		{
 			"login_hint must look like a valid email address",
-			emailRE.MatchString(params.LoginHint),
+			params.LoginHint == "" || validation.ValidEmail(params.LoginHint),
+			"invalid_request",
+			"invalid_login_hint",
+		},
+
+		// state and nonce, which are echoed back verbatim, in redirects and
+		// id_tokens respectively, so mustn't trip up whatever parses them
+		{
+			"state must not contain control characters",
+			printable(params.State),
+			"invalid_request",
+			"invalid_state",
+		},
+		{
+			"nonce must not contain control characters",
+			printable(params.Nonce),
+			"invalid_request",
+			"invalid_nonce",
+		},
+		{
+			fmt.Sprintf("nonce must be at most %d bytes", maxNonceLength),
+			maxNonceLength <= 0 || len(params.Nonce) <= maxNonceLength,
+			"invalid_request",
+			"nonce_too_long",
+		},
+
+		// prompt
+		{
+			"prompt must be a space-separated list of 'none', 'login', 'consent', or 'select_account'",
+			params.unsupportedPrompts() == nil,
+			"invalid_request",
+			"invalid_prompt",
+		},
+		{
+			"prompt must not include 'none' with any other value",
+			!params.prompts()[PROMPT_NONE] || len(params.prompts()) == 1,
+			"invalid_request",
+			"invalid_prompt",
+		},
+
+		// max_age
+		{
+			"max_age must be a number of seconds",
+			params.MaxAge == "" || validMaxAge(params.MaxAge),
+			"invalid_request",
+			"invalid_max_age",
+		},
+
+		// code_challenge
+		{
+			"code_challenge must be 43 to 128 letters, digits, or '-._~'",
+			params.CodeChallenge == "" || pkceRE.MatchString(params.CodeChallenge),
+			"invalid_request",
+			"invalid_code_challenge",
+		},
+		{
+			"code_challenge_method must be 'S256' when code_challenge is present, and omitted otherwise",
+			(params.CodeChallenge == "" && params.CodeChallengeMethod == "") ||
+				(params.CodeChallenge != "" && params.CodeChallengeMethod == PKCE_S256),
+			"invalid_request",
+			"invalid_code_challenge_method",
 		},
 	}
 
 	for _, v := range tests {
 		if !v.ok {
-			return errors.New(v.description)
+			return requestError{v.code, v.description, v.reason}
 		}
 	}
 
 	return nil
 }
 
+// supportedResponseTypes are the response_types we accept by default. Only
+// id_tokens are issued, so far; others belong in ProviderConfig.ResponseTypes
+// once they can be served too.
+var supportedResponseTypes = []string{"id_token"}
+
+// responseTypeAllowed reports whether responseType is one of responseTypes.
+// Each is a space-separated list whose order is insignificant, as per RFC 6749
+// Section 3.1.1, so "id_token token" is the same as "token id_token".
+func responseTypeAllowed(responseTypes []string, responseType string) bool {
+	normalize := func(s string) string {
+		fields := strings.Fields(s)
+		sort.Strings(fields)
+		return strings.Join(fields, " ")
+	}
+
+	for _, allowed := range responseTypes {
+		if normalize(allowed) == normalize(responseType) && responseType != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// implicitResponseTypes are the values which configured response_types may
+// combine. Every id_token is posted to the client, so "token" asks for nothing
+// more, but some clients always include it.
+var implicitResponseTypes = []string{"id_token", "token"}
+
+// validResponseTypes checks that each of responseTypes is a space-separated
+// list of implicitResponseTypes, including id_token, without repeats.
+func validResponseTypes(responseTypes []string) bool {
+	for _, responseType := range responseTypes {
+		fields := strings.Fields(responseType)
+		if !contains(fields, "id_token") {
+			return false
+		}
+		for i, field := range fields {
+			if !contains(implicitResponseTypes, field) || contains(fields[:i], field) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// supportedScopes are the scopes which affect the id_tokens we issue.
+var supportedScopes = []string{"openid", "email", "profile"}
+
+// scopes returns the set of scopes requested. They are space-separated and
+// their order is insignificant, as per RFC 6749 Section 3.3.
+func (params *AuthRequest) scopes() map[string]bool {
+	set := map[string]bool{}
+	for _, scope := range strings.Fields(params.Scope) {
+		set[scope] = true
+	}
+	return set
+}
+
+// unsupportedScopes returns the requested scopes which aren't in
+// supportedScopes, in the order they were given.
+func (params *AuthRequest) unsupportedScopes() []string {
+	var unsupported []string
+	for _, scope := range strings.Fields(params.Scope) {
+		if !contains(supportedScopes, scope) && !contains(unsupported, scope) {
+			unsupported = append(unsupported, scope)
+		}
+	}
+	return unsupported
+}
+
+// Values of the prompt parameter, as per
+// http://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+const (
+	PROMPT_NONE           = "none"           // Fail rather than interact with the user
+	PROMPT_LOGIN          = "login"          // Authenticate the user even if they're logged in
+	PROMPT_CONSENT        = "consent"        // Ask before sharing details with the client
+	PROMPT_SELECT_ACCOUNT = "select_account" // Ask which account to log in with
+)
+
+// supportedPrompts are the prompt values we accept. We always authenticate
+// users and show no consent or account selection pages, so only "none"
+// changes anything.
+var supportedPrompts = []string{PROMPT_NONE, PROMPT_LOGIN, PROMPT_CONSENT, PROMPT_SELECT_ACCOUNT}
+
+// prompts returns the set of prompt values requested.
+func (params *AuthRequest) prompts() map[string]bool {
+	set := map[string]bool{}
+	for _, prompt := range strings.Fields(params.Prompt) {
+		set[prompt] = true
+	}
+	return set
+}
+
+// unsupportedPrompts returns the requested prompt values which aren't in
+// supportedPrompts.
+func (params *AuthRequest) unsupportedPrompts() []string {
+	var unsupported []string
+	for _, prompt := range strings.Fields(params.Prompt) {
+		if !contains(supportedPrompts, prompt) {
+			unsupported = append(unsupported, prompt)
+		}
+	}
+	return unsupported
+}
+
+// printable checks that s has no control characters, like newlines or NUL.
+func printable(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) < 0
+}
+
+// validMaxAge checks that a max_age is a non-negative whole number of seconds.
+func validMaxAge(maxAge string) bool {
+	n, err := strconv.ParseInt(maxAge, 10, 64)
+	return err == nil && n >= 0
+}
+
+// values returns the non-empty fields of the request, keyed by form name.
+func (params *AuthRequest) values() url.Values {
+	structure := reflect.TypeOf(*params)
+	values := reflect.ValueOf(*params)
+	result := url.Values{}
+	for i := 0; i < structure.NumField(); i++ {
+		name := structure.Field(i).Tag.Get("form")
+		if value := values.Field(i).String(); value != "" {
+			result.Set(name, value)
+		}
+	}
+
+	return result
+}
+
+// repeatedParams returns the names of AuthRequest fields which have more than
+// one value in values, whether from the query, the body, or both.
+func repeatedParams(values url.Values) []string {
+	var repeated []string
+	structure := reflect.TypeOf(AuthRequest{})
+	for i := 0; i < structure.NumField(); i++ {
+		name := structure.Field(i).Tag.Get("form")
+		if len(values[name]) > 1 {
+			repeated = append(repeated, name)
+		}
+	}
+
+	return repeated
+}
+
+// withJSONParams returns a copy of values with an entry added for each
+// parameter in the JSON object body, so that repeatedParams can count them.
+// Unlike json.Unmarshal, which keeps the last, it sees every repeat. Bodies
+// which aren't JSON objects are left for binding to reject.
+func withJSONParams(values url.Values, body []byte) url.Values {
+	result := url.Values{}
+	for name, value := range values {
+		result[name] = append([]string(nil), value...)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return result
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return result
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return result
+		}
+		name, _ := token.(string)
+		result.Add(name, string(value))
+	}
+
+	return result
+}
+
+// redirectable reports whether errors can safely be sent to the redirect_uri,
+// because it is a valid url within a valid client_id's origin.
+func (params *AuthRequest) redirectable() bool {
+	return validation.ContainedBy(params.RedirectURI, params.ClientID)
+}
+
+// requestError is a problem with an authorization request, along with the
+// OAuth 2.0 error code for reporting it to the client, and the more specific
+// code fail reports when it can't be.
+type requestError struct {
+	code        string
+	description string
+	reason      string
+}
+
+func (e requestError) Error() string {
+	return e.description
+}
+
+// Authenticator verifies that a user controls the email address given as the
+// login_hint of an AuthRequest.
+type Authenticator interface {
+	// AddRoutes registers any endpoints the Authenticator needs to finish
+	// verifying users, such as confirmation links or upstream callbacks. Once
+	// a user has been verified, the Authenticator must call done.
+	AddRoutes(router gin.IRouter, done CompleteFunc)
+
+	// Accepts reports whether the Authenticator can verify email, giving up
+	// once ctx is done if that takes a while.
+	Accepts(ctx context.Context, email string) bool
+
+	// Start begins authenticating the user who made req, and writes the
+	// response for the current request. Anything slow it does, like sending
+	// email or fetching upstream documents, must stop once the request's
+	// context is done.
+	Start(c *gin.Context, req AuthRequest)
+}
+
+// inlineAuthenticator is an Authenticator whose Start finishes logging users
+// in during the authorization request, which the client makes, and so can
+// carry a PKCE code_verifier. Others finish at confirmation links or upstream
+// callbacks, which the client never sees.
+type inlineAuthenticator interface {
+	Authenticator
+	finishesInline()
+}
+
+// CompleteFunc finishes an authorization request once email has been verified
+// by method, one of the AMR_ constants.
+type CompleteFunc func(c *gin.Context, req AuthRequest, email string, method string)
+
 // --- HELPERS ---
 
-// generateKid deterministically generates a JWK Key ID by hashing a public key.
-func generateKid(key *rsa.PublicKey) string {
-	h := sha1.New()
-	h.Write(key.N.Bytes())
-	return fmt.Sprintf("%x", h.Sum(nil))
+// generateKid deterministically generates a JWK Key ID for an RSA or ECDSA
+// public key, using its RFC 7638 JWK Thumbprint: the SHA-256 hash of just the
+// required members of its JWK, in lexicographic order with no whitespace.
+func generateKid(key crypto.PublicKey) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	var canonical string
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		e := big.NewInt(int64(k.E)).Bytes()
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, b64(e), b64(k.N.Bytes()))
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		x, y := make([]byte, size), make([]byte, size)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Curve.Params().Name, b64(x), b64(y))
+	default:
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:])
+}
+
+// RESPONSE_MODE_FORM_POST is the only supported response_mode, which is also
+// used when none is given. The query and fragment modes would put id_tokens in
+// urls, which end up in logs and browser history.
+const RESPONSE_MODE_FORM_POST = "form_post"
+
+// PKCE_S256 is the only supported code_challenge_method. RFC 7636 also defines
+// "plain", but that offers no protection if the challenge is intercepted.
+const PKCE_S256 = "S256"
+
+// pkceRE matches code_challenges and code_verifiers, as per RFC 7636 Section 4.1.
+var pkceRE = regexp.MustCompile(`^[-._~a-zA-Z0-9]{43,128}$`)
+
+// verifyCodeChallenge reports whether verifier hashes to an S256 challenge.
+func verifyCodeChallenge(challenge string, verifier string) bool {
+	if !pkceRE.MatchString(verifier) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return secretsEqual(expected, challenge)
+}
+
+// contains reports whether list includes s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// randomToken generates an unguessable, URL-safe string.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// secretsEqual reports whether a and b, which are secret tokens like CSRF
+// signatures or PKCE challenges, are equal, taking the same time wherever
+// they differ, so that a guess's running time doesn't reveal how close it is.
+func secretsEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// renderFormPost responds with a page that POSTs an id_token and state to the
+// client's redirect_uri. All values are HTML-escaped by the template.
+func renderFormPost(c *gin.Context, req AuthRequest, email string, idToken string) {
+	renderPage(c, 200, "form_post.html", struct {
+		Client      string
+		Email       string
+		RedirectURI string
+		IDToken     string
+		State       string
+	}{req.ClientID, email, req.RedirectURI, idToken, req.State})
+}
+
+// reject reports a problem with an authorization request. Once the client_id
+// and redirect_uri are known to be trustworthy, the error is sent back to the
+// client as per RFC 6749 Section 4.1.2.1. Otherwise it's shown to the user, as
+// redirecting to an unverified url would make us an open redirector.
+func reject(c *gin.Context, form *AuthRequest, errType string, err error) {
+	code, reason := "invalid_request", "invalid_request"
+	if reqErr, ok := err.(requestError); ok {
+		code, reason = reqErr.code, reqErr.reason
+	}
+
+	if !form.redirectable() {
+		fail(c, reason, errType, err.Error())
+		return
+	}
+
+	redirectError(c, form.RedirectURI, code, err.Error(), form.State)
+}
+
+// redirectError sends an OAuth 2.0 error response to the client's redirect_uri,
+// preserving any query values it already has.
+func redirectError(c *gin.Context, redirectURI string, code string, description string, state string) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		fail(c, "invalid_redirect_uri", "Bad Value", description)
+		return
+	}
+
+	params := u.Query()
+	params.Set("error", code)
+	params.Set("error_description", description)
+	if state != "" {
+		params.Set("state", state)
+	}
+	u.RawQuery = params.Encode()
+
+	c.Redirect(302, u.String())
 }
 
 // fail sets the status code and response body for handling bad requests.
-func fail(c *gin.Context, errType string, errMsg string) {
+// JSON bodies include code, a stable name for the problem like
+// invalid_redirect_uri, so that clients needn't parse errType or errMsg.
+func fail(c *gin.Context, code string, errType string, errMsg string) {
+	if wantsHTML(c) {
+		failPage(c, 400, errType, errMsg)
+		return
+	}
+
 	c.JSON(400, gin.H{
 		"error":   errType,
 		"message": errMsg,
+		"code":    code,
 	})
 }
+
+// oauthError responds to a request from a client, rather than a browser, with
+// an OAuth 2.0 error as per RFC 6749 Section 5.2, which RFC 6750, RFC 7009, and
+// RFC 7662 share. Its error member is oauthCode, like invalid_request, or is
+// left out if oauthCode is empty, for the few errors which have no OAuth code.
+// As with fail, code is our own more specific name for the problem.
+func oauthError(c *gin.Context, status int, oauthCode string, code string, errMsg string) {
+	body := gin.H{
+		"error_description": errMsg,
+		"code":              code,
+	}
+	if oauthCode != "" {
+		body["error"] = oauthCode
+	}
+	c.JSON(status, body)
+}
@@ -0,0 +1,1694 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/square/go-jose"
+)
+
+var (
+	formActionRE = regexp.MustCompile(`<form method="post" action="([^"]*)">`)
+	formInputRE  = regexp.MustCompile(`<input type="hidden" name="([^"]*)" value="([^"]*)">`)
+)
+
+// The signing key shared by tests which don't care which key they use, as
+// generating a new 2048-bit key for each would slow the suite down.
+var (
+	sharedKey     *rsa.PrivateKey
+	sharedKeyErr  error
+	sharedKeyOnce sync.Once
+)
+
+// testKey returns the shared signing key, generating it the first time.
+func testKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	sharedKeyOnce.Do(func() {
+		sharedKey, sharedKeyErr = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	if sharedKeyErr != nil {
+		t.Fatal(sharedKeyErr)
+	}
+	return sharedKey
+}
+
+// newTestProvider returns a router with OpenID Connect routes for auths,
+// configured by p, whose Origin, Key, and Lifetime default to issuer.example,
+// testKey, and TOKEN_LIFETIME. It also returns p with those defaults filled
+// in, for minting tokens.
+func newTestProvider(t *testing.T, p ProviderConfig, auths ...Authenticator) (*gin.Engine, ProviderConfig) {
+	t.Helper()
+	if p.Origin == "" {
+		p.Origin = "issuer.example"
+	}
+	if p.Key == nil && p.Keys == nil {
+		p.Key = testKey(t)
+	}
+	if p.Lifetime == 0 {
+		p.Lifetime = TOKEN_LIFETIME
+	}
+
+	router := gin.New()
+	oidcAddRoutes(router, p, auths...)
+	return router, p
+}
+
+// parseFormPost extracts the target and fields of a form_post response page.
+func parseFormPost(t *testing.T, body string) (string, url.Values) {
+	match := formActionRE.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("response is not a form_post page: %s", body)
+	}
+
+	fields := url.Values{}
+	for _, input := range formInputRE.FindAllStringSubmatch(body, -1) {
+		fields.Add(html.UnescapeString(input[1]), html.UnescapeString(input[2]))
+	}
+
+	return html.UnescapeString(match[1]), fields
+}
+
+func TestRenderFormPost(t *testing.T) {
+	tests := []struct {
+		redirectURI string
+		state       string
+		contains    []string
+		excludes    []string
+	}{
+		{
+			"https://client.example/callback",
+			"xyzzy",
+			[]string{
+				`action="https://client.example/callback"`,
+				`name="id_token" value="header.payload.signature"`,
+				`name="state" value="xyzzy"`,
+			},
+			nil,
+		},
+		{
+			"https://client.example/callback?a=1&b=2",
+			`"><script>alert(1)</script>`,
+			[]string{
+				`action="https://client.example/callback?a=1&amp;b=2"`,
+				`value="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;"`,
+			},
+			[]string{`"><script>alert(1)`},
+		},
+		{
+			`https://client.example/"><script>alert(1)</script>`,
+			"",
+			nil,
+			[]string{`"><script>alert(1)`, `name="state"`},
+		},
+		{
+			"javascript:alert(1)",
+			"",
+			nil,
+			[]string{`action="javascript:`},
+		},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		renderFormPost(c, AuthRequest{ClientID: "https://client.example", RedirectURI: test.redirectURI, State: test.state}, "foo@example.com", "header.payload.signature")
+		body := w.Body.String()
+
+		if w.Code != 200 {
+			t.Errorf("renderFormPost(%q) returned %d instead of 200", test.redirectURI, w.Code)
+		}
+
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("renderFormPost(%q) has Content-Type %q", test.redirectURI, ct)
+		}
+
+		if !strings.Contains(body, "document.forms[0].submit()") {
+			t.Errorf("renderFormPost(%q) did not include the auto-submit script", test.redirectURI)
+		}
+
+		for _, s := range test.contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("renderFormPost(%q, %q) does not contain %s:\n%s", test.redirectURI, test.state, s, body)
+			}
+		}
+
+		for _, s := range test.excludes {
+			if strings.Contains(body, s) {
+				t.Errorf("renderFormPost(%q, %q) unexpectedly contains %s:\n%s", test.redirectURI, test.state, s, body)
+			}
+		}
+	}
+}
+
+func TestAuthorizeMethods(t *testing.T) {
+	mailer := &fakeMailer{}
+	router, _ := newEmailTestRouter(t, mailer)
+
+	w := get(router, "/authorize?"+validAuthForm().Encode())
+	if w.Code != 200 {
+		t.Fatalf("GET /authorize returned %d: %s", w.Code, w.Body.String())
+	}
+
+	w = postForm(router, "/authorize", validAuthForm())
+	if w.Code != 200 {
+		t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+	}
+
+	if len(mailer.sent) != 2 {
+		t.Fatalf("expected 2 emails to be sent, got %d", len(mailer.sent))
+	}
+
+	// Validation applies the same way to query parameters
+	bad := validAuthForm()
+	bad.Set("client_id", "bogus")
+	if w = get(router, "/authorize?"+bad.Encode()); w.Code != 400 {
+		t.Errorf("GET /authorize with a bad client_id returned %d instead of 400", w.Code)
+	}
+
+	bad.Del("client_id")
+	if w = get(router, "/authorize?"+bad.Encode()); w.Code != 400 {
+		t.Errorf("GET /authorize without a client_id returned %d instead of 400", w.Code)
+	}
+}
+
+// postJSON posts fields to router at path as a JSON object.
+func postJSON(router http.Handler, path string, fields map[string]string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(fields)
+	req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthorizeJSON(t *testing.T) {
+	mailer := &fakeMailer{}
+	router, _ := newEmailTestRouter(t, mailer)
+
+	fields := map[string]string{}
+	for k := range validAuthForm() {
+		fields[k] = validAuthForm().Get(k)
+	}
+
+	w := postJSON(router, "/authorize", fields)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Check your email") {
+		t.Fatalf("POST /authorize with a JSON body returned %d: %s", w.Code, w.Body.String())
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].to != "foo@example.com" {
+		t.Errorf("POST /authorize with a JSON body did not email the login_hint")
+	}
+
+	// The fields are validated like any others
+	fields["response_type"] = "code"
+	w = postJSON(router, "/authorize", fields)
+	if location := w.Header().Get("Location"); w.Code != 302 || !strings.Contains(location, "error=unsupported_response_type") {
+		t.Errorf("POST /authorize with a bad JSON response_type returned %d, redirecting to %q", w.Code, location)
+	}
+
+	delete(fields, "client_id")
+	if w = postJSON(router, "/authorize", fields); w.Code != 400 {
+		t.Errorf("POST /authorize with a JSON body missing client_id returned %d instead of 400", w.Code)
+	}
+}
+
+func TestAuthorizeMalformedBody(t *testing.T) {
+	mailer := &fakeMailer{}
+	router, _ := newEmailTestRouter(t, mailer)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/authorize", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Binding fails, but it's our own error which is reported
+	w := post(`{"scope": "openid email", "response_type": `)
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != 400 || body["code"] != "missing_field" {
+		t.Errorf("POST /authorize with malformed JSON returned %d: %q", w.Code, w.Body.String())
+	}
+
+	// Validation errors take precedence over binding errors, and like them
+	// can still be redirected
+	w = post(`{"scope": "openid email", "response_type": "code", "client_id": "https://client.example",
+		"redirect_uri": "https://client.example/callback", "login_hint": "foo@example.com", "max_age": 60}`)
+	if location := w.Header().Get("Location"); w.Code != 302 || !strings.Contains(location, "error=unsupported_response_type") {
+		t.Errorf("POST /authorize with a bad response_type and a numeric max_age returned %d, redirecting to %q", w.Code, location)
+	}
+
+	// Until the binding error is all that's left
+	w = post(`{"scope": "openid email", "response_type": "id_token", "client_id": "https://client.example",
+		"redirect_uri": "https://client.example/callback", "login_hint": "foo@example.com", "max_age": 60}`)
+	body = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != 400 || body["code"] != "malformed_request" {
+		t.Errorf("POST /authorize with a numeric max_age returned %d: %q", w.Code, w.Body.String())
+	}
+
+	if len(mailer.sent) != 0 {
+		t.Errorf("sent %d emails for malformed requests", len(mailer.sent))
+	}
+}
+
+func TestAuthorizeResponseTypes(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		configured  []string
+		advertised  string
+		accepted    []string
+	}{
+		{"by default", nil, `"response_types_supported":["id_token"]`, []string{"id_token"}},
+		{"when configured", []string{"id_token", "id_token token"}, `"response_types_supported":["id_token","id_token token"]`, []string{"id_token", "id_token token", "token id_token"}},
+	}
+
+	for _, test := range tests {
+		router := gin.New()
+		p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, ResponseTypes: test.configured}
+		oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME)))
+
+		// Discovery advertises exactly what's accepted
+		if body := get(router, "/.well-known/openid-configuration").Body.String(); !strings.Contains(body, test.advertised) {
+			t.Errorf("%s, the discovery document is %s", test.description, body)
+		}
+
+		for _, responseType := range test.accepted {
+			form := validAuthForm()
+			form.Set("response_type", responseType)
+			if w := postForm(router, "/authorize", form); w.Code != 200 {
+				t.Errorf("%s, POST /authorize with response_type=%q returned %d: %s", test.description, responseType, w.Code, w.Body.String())
+			}
+		}
+
+		for _, responseType := range []string{"code", "id_token code", "token"} {
+			form := validAuthForm()
+			form.Set("response_type", responseType)
+			w := postForm(router, "/authorize", form)
+			if location := w.Header().Get("Location"); w.Code != 302 || !strings.Contains(location, "error=unsupported_response_type") {
+				t.Errorf("%s, POST /authorize with response_type=%q returned %d, redirecting to %q", test.description, responseType, w.Code, location)
+			}
+		}
+	}
+}
+
+func TestAuthorizeResponseMode(t *testing.T) {
+	router, _ := newEmailTestRouter(t, &fakeMailer{})
+
+	// form_post is what discovery advertises, and what we'd use anyway
+	form := validAuthForm()
+	form.Set("response_mode", "form_post")
+	if w := postForm(router, "/authorize", form); w.Code != 200 || !strings.Contains(w.Body.String(), "Check your email") {
+		t.Errorf("POST /authorize with response_mode=form_post returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthorizeErrors(t *testing.T) {
+	router, _ := newEmailTestRouter(t, &fakeMailer{})
+
+	// Problems with the request are reported to a trustworthy redirect_uri
+	redirected := []struct {
+		field string
+		value string
+		code  string
+	}{
+		{"scope", "email profile", "invalid_scope"},
+		{"response_type", "code", "unsupported_response_type"},
+		{"response_mode", "fragment", "invalid_request"},
+		{"response_mode", "query", "invalid_request"},
+		{"response_mode", "params_post", "invalid_request"},
+		{"login_hint", "not an email", "invalid_request"},
+		{"code_challenge", "too-short", "invalid_request"},
+		{"code_challenge_method", "S256", "invalid_request"},
+	}
+
+	for _, test := range redirected {
+		form := validAuthForm()
+		form.Set(test.field, test.value)
+		form.Set("redirect_uri", "https://client.example/callback?keep=me")
+
+		w := postForm(router, "/authorize", form)
+		if w.Code != 302 {
+			t.Errorf("POST /authorize with %s=%q returned %d instead of 302", test.field, test.value, w.Code)
+			continue
+		}
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if target := location.Scheme + "://" + location.Host + location.Path; target != "https://client.example/callback" {
+			t.Errorf("POST /authorize with %s=%q redirected to %q", test.field, test.value, target)
+		}
+
+		params := location.Query()
+		if params.Get("error") != test.code {
+			t.Errorf("POST /authorize with %s=%q returned error=%q instead of %q", test.field, test.value, params.Get("error"), test.code)
+		}
+
+		if params.Get("error_description") == "" {
+			t.Errorf("POST /authorize with %s=%q returned no error_description", test.field, test.value)
+		}
+
+		if params.Get("state") != "xyzzy" {
+			t.Errorf("POST /authorize with %s=%q returned state=%q instead of xyzzy", test.field, test.value, params.Get("state"))
+		}
+
+		if params.Get("keep") != "me" {
+			t.Errorf("POST /authorize with %s=%q dropped the redirect_uri's query", test.field, test.value)
+		}
+	}
+
+	// Without state, none is returned
+	form := validAuthForm()
+	form.Set("scope", "email")
+	form.Del("state")
+	w := postForm(router, "/authorize", form)
+	if location := w.Header().Get("Location"); w.Code != 302 || strings.Contains(location, "state=") {
+		t.Errorf("POST /authorize without state returned %d with Location %q", w.Code, location)
+	}
+
+	// Problems with the client_id or redirect_uri are reported locally
+	local := []struct {
+		field string
+		value string
+	}{
+		{"client_id", ""},
+		{"client_id", "not a url"},
+		{"client_id", "https://client.example/path"},
+		{"redirect_uri", ""},
+		{"redirect_uri", "javascript:alert(1)"},
+		{"redirect_uri", "https://evil.example/callback"},
+	}
+
+	for _, test := range local {
+		form := validAuthForm()
+		form.Set("scope", "bogus")
+		form.Set(test.field, test.value)
+
+		w := postForm(router, "/authorize", form)
+		if w.Code != 400 {
+			t.Errorf("POST /authorize with %s=%q returned %d instead of 400", test.field, test.value, w.Code)
+		}
+
+		if location := w.Header().Get("Location"); location != "" {
+			t.Errorf("POST /authorize with %s=%q redirected to %q", test.field, test.value, location)
+		}
+	}
+}
+
+func TestAuthorizeErrorCodes(t *testing.T) {
+	router, _ := newEmailTestRouter(t, &fakeMailer{})
+
+	// Problems reported locally name themselves in the JSON body. With a
+	// redirect_uri outside the client's origin, only those which valid()
+	// checks first are reported as themselves.
+	tests := []struct {
+		field string
+		value string
+		code  string
+	}{
+		{"scope", "", "missing_field"},
+		{"scope", "email", "invalid_scope"},
+		{"response_type", "code", "unsupported_response_type"},
+		{"client_id", "not a url", "invalid_client_id"},
+		{"client_id", "https://client.example/path", "invalid_client_id"},
+		{"redirect_uri", "javascript:alert(1)", "invalid_redirect_uri"},
+		{"login_hint", "not an email", "invalid_redirect_uri"},
+	}
+
+	for _, test := range tests {
+		form := validAuthForm()
+		form.Set("redirect_uri", "https://evil.example/callback")
+		form.Set(test.field, test.value)
+
+		w := postForm(router, "/authorize", form)
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != 400 || body["code"] != test.code {
+			t.Errorf("POST /authorize with %s=%q returned %d with %s instead of code %s", test.field, test.value, w.Code, w.Body.String(), test.code)
+		}
+	}
+
+	form := validAuthForm()
+	form.Add("client_id", "https://other.example")
+	w := postForm(router, "/authorize", form)
+	if !strings.Contains(w.Body.String(), `"code":"repeated_parameter"`) {
+		t.Errorf("POST /authorize with a repeated client_id returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestValidReasons(t *testing.T) {
+	// Each of valid()'s checks has its own code for fail to report
+	tests := []struct {
+		description string
+		change      func(*AuthRequest)
+		reason      string
+	}{
+		{"response_mode=fragment", func(r *AuthRequest) { r.ResponseMode = "fragment" }, "unsupported_response_mode"},
+		{"a bad login_hint", func(r *AuthRequest) { r.LoginHint = "not an email" }, "invalid_login_hint"},
+		{"a newline in the state", func(r *AuthRequest) { r.State = "xyzzy\nLocation: evil" }, "invalid_state"},
+		{"a NUL in the nonce", func(r *AuthRequest) { r.Nonce = "n-0S6\x00_WzA2Mj" }, "invalid_nonce"},
+		{"a long nonce", func(r *AuthRequest) { r.Nonce = strings.Repeat("n", MAX_NONCE_LENGTH+1) }, "nonce_too_long"},
+		{"an unknown prompt", func(r *AuthRequest) { r.Prompt = "bogus" }, "invalid_prompt"},
+		{"prompt=none with another", func(r *AuthRequest) { r.Prompt = "none login" }, "invalid_prompt"},
+		{"a negative max_age", func(r *AuthRequest) { r.MaxAge = "-1" }, "invalid_max_age"},
+		{"a short code_challenge", func(r *AuthRequest) { r.CodeChallenge = "too-short" }, "invalid_code_challenge"},
+		{"a lone code_challenge_method", func(r *AuthRequest) { r.CodeChallengeMethod = PKCE_S256 }, "invalid_code_challenge_method"},
+	}
+
+	for _, test := range tests {
+		req := AuthRequest{
+			Scope:        "openid email",
+			ResponseType: "id_token",
+			ClientID:     "https://client.example",
+			RedirectURI:  "https://client.example/callback",
+		}
+		test.change(&req)
+
+		err, _ := req.valid(supportedResponseTypes, MAX_NONCE_LENGTH).(requestError)
+		if err.reason != test.reason {
+			t.Errorf("valid() with %s returned reason %q instead of %q", test.description, err.reason, test.reason)
+		}
+	}
+}
+
+func TestAuthorizeLoginHint(t *testing.T) {
+	mailer := &fakeMailer{}
+	router, _ := newEmailTestRouter(t, mailer)
+
+	// With a login_hint, the flow proceeds directly
+	w := postForm(router, "/authorize", validAuthForm())
+	if w.Code != 200 || strings.Contains(w.Body.String(), `name="login_hint"`) {
+		t.Fatalf("POST /authorize with a login_hint returned %d: %s", w.Code, w.Body.String())
+	}
+
+	if len(mailer.sent) != 1 {
+		t.Fatalf("expected 1 email to be sent, got %d", len(mailer.sent))
+	}
+
+	// Without one, the user is asked for their email
+	form := validAuthForm()
+	form.Del("login_hint")
+	for _, w := range []*httptest.ResponseRecorder{
+		get(router, "/authorize?"+form.Encode()),
+		postForm(router, "/authorize", form),
+	} {
+		if w.Code != 200 {
+			t.Fatalf("/authorize without a login_hint returned %d: %s", w.Code, w.Body.String())
+		}
+
+		if !strings.Contains(w.Body.String(), `<input type="email" name="login_hint"`) {
+			t.Errorf("/authorize without a login_hint did not ask for an email: %s", w.Body.String())
+		}
+
+		action, fields := parseFormPost(t, w.Body.String())
+		if action != "/authorize" {
+			t.Errorf("email entry form posts to %q instead of /authorize", action)
+		}
+
+		for name := range form {
+			if fields.Get(name) != form.Get(name) {
+				t.Errorf("email entry form has %s=%q instead of %q", name, fields.Get(name), form.Get(name))
+			}
+		}
+	}
+
+	if len(mailer.sent) != 1 {
+		t.Fatalf("expected no more emails before an address is entered, got %d", len(mailer.sent))
+	}
+
+	// Submitting the form continues the flow
+	w = postForm(router, "/authorize", form)
+	_, fields := parseFormPost(t, w.Body.String())
+	fields.Set("login_hint", "bar@example.com")
+	if w = postForm(router, "/authorize", fields); w.Code != 200 {
+		t.Fatalf("submitting the email entry form returned %d: %s", w.Code, w.Body.String())
+	}
+
+	if len(mailer.sent) != 2 || mailer.sent[1].to != "bar@example.com" {
+		t.Errorf("submitting the email entry form did not email bar@example.com")
+	}
+}
+
+func TestAuthorizeNormalizesLoginHint(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lowercase := range []bool{false, true} {
+		mailer := &fakeMailer{}
+		router := gin.New()
+		store := newMemorySessionStore(SESSION_LIFETIME)
+		oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, LowercaseEmails: lowercase}, newEmailAuthenticator("https://issuer.example", mailer, store))
+
+		form := validAuthForm()
+		form.Set("login_hint", "  Foo@Example.COM ")
+		claims := emailLogin(t, router, mailer, &key.PublicKey, form)
+
+		expected := "Foo@example.com"
+		if lowercase {
+			expected = "foo@example.com"
+		}
+
+		if len(mailer.sent) != 1 || mailer.sent[0].to != expected {
+			t.Errorf("with LowercaseEmails %t, expected 1 email to %s, got %v", lowercase, expected, mailer.sent)
+		}
+
+		if claims.Subject != expected || claims.Email != expected {
+			t.Errorf("with LowercaseEmails %t, id_token has sub %q and email %q instead of %s", lowercase, claims.Subject, claims.Email, expected)
+		}
+	}
+}
+
+func TestAuthorizeScopes(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		scope   string
+		lenient string // The error code returned by default, if any
+		strict  string // The error code returned with StrictScopes
+	}{
+		{"openid email", "", ""},
+		{"email openid", "", ""},
+		{"  openid\temail  ", "", ""},
+		{"openid", "", ""},
+		{"openid email email", "", ""},
+		{"openid email profile", "", ""},
+		{"openid email phone", "", "invalid_scope"},
+		{"address openid", "", "invalid_scope"},
+		{"email", "invalid_scope", "invalid_scope"},
+		{"email profile", "invalid_scope", "invalid_scope"},
+		{"OpenID email", "invalid_scope", "invalid_scope"},
+		{"openidemail", "invalid_scope", "invalid_scope"},
+	}
+
+	for _, strict := range []bool{false, true} {
+		router := gin.New()
+		store := newMemorySessionStore(SESSION_LIFETIME)
+		oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, StrictScopes: strict}, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, store))
+
+		for i, test := range tests {
+			form := validAuthForm()
+			form.Set("scope", test.scope)
+			form.Set("nonce", fmt.Sprintf("nonce-%d", i))
+
+			expected := test.lenient
+			if strict {
+				expected = test.strict
+			}
+
+			w := postForm(router, "/authorize", form)
+			if expected == "" {
+				if w.Code != 200 {
+					t.Errorf("with StrictScopes %t, POST /authorize with scope %q returned %d: %s", strict, test.scope, w.Code, w.Body.String())
+				}
+				continue
+			}
+
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != 302 || location.Query().Get("error") != expected {
+				t.Errorf("with StrictScopes %t, POST /authorize with scope %q returned %d with Location %q, instead of %s", strict, test.scope, w.Code, location, expected)
+			}
+		}
+	}
+}
+
+func TestDomainAllowed(t *testing.T) {
+	tests := []struct {
+		description string
+		allowed     []string
+		blocked     []string
+		email       string
+		ok          bool
+	}{
+		{"any domain, by default", nil, nil, "foo@example.com", true},
+		{"an allowed domain", []string{"example.com", "example.org"}, nil, "foo@example.org", true},
+		{"an allowed domain in another case", []string{"Example.COM"}, nil, "foo@EXAMPLE.com", true},
+		{"a domain which isn't allowed", []string{"example.com"}, nil, "foo@example.net", false},
+		{"a subdomain of an allowed domain", []string{"example.com"}, nil, "foo@mail.example.com", false},
+		{"a blocked domain", nil, []string{"example.net"}, "foo@example.net", false},
+		{"a blocked domain in another case", nil, []string{"example.net"}, "foo@Example.Net", false},
+		{"a domain which isn't blocked", nil, []string{"example.net"}, "foo@example.com", true},
+		{"an allowed but blocked domain", []string{"example.com"}, []string{"EXAMPLE.com"}, "foo@example.com", false},
+	}
+
+	for _, test := range tests {
+		p := ProviderConfig{AllowedDomains: test.allowed, BlockedDomains: test.blocked}
+		if ok := p.domainAllowed(test.email); ok != test.ok {
+			t.Errorf("domainAllowed for %s returned %t instead of %t", test.description, ok, test.ok)
+		}
+	}
+}
+
+func TestAuthorizeDomains(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &fakeMailer{}
+	router := gin.New()
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, AllowedDomains: []string{"example.com", "xn--mnchen-3ya.de"}, BlockedDomains: []string{"blocked.example.com"}}
+	oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME)))
+
+	for _, email := range []string{"foo@example.net", "foo@blocked.example.com"} {
+		form := validAuthForm()
+		form.Set("login_hint", email)
+
+		w := postForm(router, "/authorize", form)
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w.Code != 302 || location.Query().Get("error") != "access_denied" {
+			t.Errorf("POST /authorize for %s returned %d with Location %q, instead of access_denied", email, w.Code, location)
+		}
+	}
+
+	if len(mailer.sent) != 0 {
+		t.Errorf("sent %d confirmation emails to domains which aren't allowed", len(mailer.sent))
+	}
+
+	form := validAuthForm()
+	form.Set("login_hint", "foo@EXAMPLE.COM")
+	if w := postForm(router, "/authorize", form); w.Code != 200 || len(mailer.sent) != 1 {
+		t.Errorf("POST /authorize for an allowed domain returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// International domains are matched in their punycode form
+	form.Set("login_hint", "user@münchen.de")
+	if w := postForm(router, "/authorize", form); w.Code != 200 || len(mailer.sent) != 2 {
+		t.Errorf("POST /authorize for an allowed international domain returned %d: %s", w.Code, w.Body.String())
+	} else if to := mailer.sent[1].to; to != "user@xn--mnchen-3ya.de" {
+		t.Errorf("POST /authorize for user@münchen.de sent the confirmation email to %s", to)
+	}
+}
+
+func TestAuthorizeIDTokenHint(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}
+	client := AuthRequest{ClientID: "https://client.example", Scope: "openid email"}
+	hint := func(key *rsa.PrivateKey, req AuthRequest, issued time.Time) string {
+		token, err := signToken(key, newIDToken(p, req, "bar@example.com", AMR_EMAIL, issued))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// Hints stand in for a login_hint, even once they've expired
+	for _, issued := range []time.Time{time.Now(), time.Now().Add(-time.Hour)} {
+		mailer := &fakeMailer{}
+		router := gin.New()
+		oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME)))
+
+		form := validAuthForm()
+		form.Del("login_hint")
+		form.Set("id_token_hint", hint(key, client, issued))
+		w := postForm(router, "/authorize", form)
+		if w.Code != 200 || len(mailer.sent) != 1 || mailer.sent[0].to != "bar@example.com" {
+			t.Errorf("POST /authorize with an id_token_hint issued at %s returned %d and sent %+v", issued, w.Code, mailer.sent)
+		}
+	}
+
+	tests := []struct {
+		description string
+		hint        string
+		loginHint   string
+	}{
+		{"a malformed hint", "bogus", ""},
+		{"a hint signed by someone else", hint(otherKey, client, time.Now()), ""},
+		{"a hint issued to another client", hint(key, AuthRequest{ClientID: "https://other.example"}, time.Now()), ""},
+		{"a hint for someone other than the login_hint", hint(key, client, time.Now()), "foo@example.com"},
+	}
+
+	for _, strict := range []bool{false, true} {
+		p.StrictIDTokenHints = strict
+		mailer := &fakeMailer{}
+		router := gin.New()
+		oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME)))
+
+		for i, test := range tests {
+			form := validAuthForm()
+			form.Set("nonce", fmt.Sprintf("nonce-%d", i))
+			form.Set("login_hint", test.loginHint)
+			form.Set("id_token_hint", test.hint)
+			w := postForm(router, "/authorize", form)
+
+			if strict {
+				location, err := url.Parse(w.Header().Get("Location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if w.Code != 302 || location.Query().Get("error") != "invalid_request" {
+					t.Errorf("with StrictIDTokenHints, POST /authorize with %s returned %d with Location %q", test.description, w.Code, location)
+				}
+				continue
+			}
+
+			// Otherwise the hint is ignored, leaving any login_hint to be used
+			if w.Code != 200 {
+				t.Errorf("POST /authorize with %s returned %d: %s", test.description, w.Code, w.Body.String())
+			}
+			for _, msg := range mailer.sent {
+				if msg.to == "bar@example.com" {
+					t.Errorf("POST /authorize with %s sent an email to the hint's address", test.description)
+				}
+			}
+		}
+	}
+}
+
+func TestAuthorizePrompt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field    string
+		value    string
+		expected string // The error code returned, if any
+	}{
+		{"prompt", "", ""},
+		{"prompt", "login", ""},
+		{"prompt", "consent", ""},
+		{"prompt", "select_account", ""},
+		{"prompt", "login consent", ""},
+		{"prompt", "none", "login_required"},
+		{"prompt", "none login", "invalid_request"},
+		{"prompt", "always", "invalid_request"},
+		{"prompt", "NONE", "invalid_request"},
+		{"max_age", "0", ""},
+		{"max_age", "3600", ""},
+		{"max_age", "-1", "invalid_request"},
+		{"max_age", "1.5", "invalid_request"},
+		{"max_age", "soon", "invalid_request"},
+	}
+
+	mailer := &fakeMailer{}
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME)))
+
+	for i, test := range tests {
+		form := validAuthForm()
+		form.Set(test.field, test.value)
+		form.Set("nonce", fmt.Sprintf("nonce-%d", i))
+
+		sent := len(mailer.sent)
+		w := postForm(router, "/authorize", form)
+		if test.expected == "" {
+			// Users are always verified afresh, whether or not prompt=login
+			if w.Code != 200 || len(mailer.sent) != sent+1 {
+				t.Errorf("POST /authorize with %s %q returned %d without sending a confirmation link: %s", test.field, test.value, w.Code, w.Body.String())
+			}
+			continue
+		}
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w.Code != 302 || location.Query().Get("error") != test.expected {
+			t.Errorf("POST /authorize with %s %q returned %d with Location %q, instead of %s", test.field, test.value, w.Code, location, test.expected)
+		}
+		if len(mailer.sent) != sent {
+			t.Errorf("POST /authorize with %s %q sent a confirmation link", test.field, test.value)
+		}
+	}
+}
+
+func TestAuthorizeRepeatedParams(t *testing.T) {
+	// This router has no MaxBodyBytes, yet bodies are still checked
+	router, _ := newEmailTestRouter(t, &fakeMailer{})
+
+	// Repeating the client_id or redirect_uri leaves nowhere safe to redirect
+	for _, name := range []string{"client_id", "redirect_uri"} {
+		form := validAuthForm()
+		form.Add(name, "https://evil.example")
+
+		w := postForm(router, "/authorize", form)
+		if w.Code != 400 || w.Header().Get("Location") != "" {
+			t.Errorf("POST /authorize with two %s values returned %d with Location %q, instead of 400", name, w.Code, w.Header().Get("Location"))
+		}
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("POST /authorize with two %s values didn't say which was repeated: %s", name, w.Body.String())
+		}
+	}
+
+	// Other repeated parameters are reported to the client
+	form := validAuthForm()
+	form.Add("state", "other")
+	w := postForm(router, "/authorize", form)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 302 || location.Query().Get("error") != "invalid_request" {
+		t.Errorf("POST /authorize with two state values returned %d with Location %q, instead of invalid_request", w.Code, location)
+	}
+
+	// Including the same parameter in the query and the body repeats it too
+	query := url.Values{"client_id": {"https://evil.example"}}
+	w = postForm(router, "/authorize?"+query.Encode(), validAuthForm())
+	if w.Code != 400 || w.Header().Get("Location") != "" {
+		t.Errorf("POST /authorize with client_id in both query and body returned %d with Location %q, instead of 400", w.Code, w.Header().Get("Location"))
+	}
+
+	// JSON bodies too, which json.Unmarshal would quietly take the last of
+	fields := map[string]string{}
+	for k := range validAuthForm() {
+		fields[k] = validAuthForm().Get(k)
+	}
+	encoded, _ := json.Marshal(fields)
+	body := `{"client_id":"https://evil.example",` + string(encoded[1:])
+	req := httptest.NewRequest("POST", "/authorize", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), `"code":"repeated_parameter"`) {
+		t.Errorf("POST /authorize with two client_id values in a JSON body returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// As is a JSON body's parameter which is also in the query
+	w = postJSON(router, "/authorize?"+query.Encode(), fields)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), `"code":"repeated_parameter"`) {
+		t.Errorf("POST /authorize with client_id in both query and JSON body returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// Unrecognized parameters may be repeated
+	form = validAuthForm()
+	form.Add("extra", "1")
+	form.Add("extra", "2")
+	if w := postForm(router, "/authorize", form); w.Code != 200 {
+		t.Errorf("POST /authorize with a repeated unknown parameter returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthorizeBodyLimit(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &fakeMailer{}
+	router := gin.New()
+	store := newMemorySessionStore(SESSION_LIFETIME)
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, MaxBodyBytes: 1024}, newEmailAuthenticator("https://issuer.example", mailer, store))
+
+	if w := postForm(router, "/authorize", validAuthForm()); w.Code != 200 {
+		t.Errorf("POST /authorize under the body limit returned %d: %s", w.Code, w.Body.String())
+	}
+
+	form := validAuthForm()
+	form.Set("state", strings.Repeat("x", 2048))
+	w := postForm(router, "/authorize", form)
+	if w.Code != 413 {
+		t.Errorf("POST /authorize over the body limit returned %d instead of 413: %s", w.Code, w.Body.String())
+	}
+
+	// JSON bodies too
+	if w := postJSON(router, "/authorize", map[string]string{"state": strings.Repeat("x", 2048)}); w.Code != 413 {
+		t.Errorf("POST /authorize with a JSON body over the limit returned %d instead of 413: %s", w.Code, w.Body.String())
+	}
+
+	if len(mailer.sent) != 1 {
+		t.Errorf("expected 1 email to be sent, got %d", len(mailer.sent))
+	}
+}
+
+func TestAuthorizeState(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &fakeMailer{}
+	router := gin.New()
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, MaxStateLength: 64}
+	oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME)))
+
+	// Markup in the state is inert in the form_post page, and comes back intact
+	state := `"><script>alert(1)</script>`
+	form := validAuthForm()
+	form.Set("state", state)
+	if w := postForm(router, "/authorize", form); w.Code != 200 {
+		t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+	}
+
+	w := get(router, linkRE.FindStringSubmatch(mailer.sent[0].textBody)[1])
+	if strings.Contains(w.Body.String(), "<script>alert") {
+		t.Errorf("form_post page includes the state's markup unescaped:\n%s", w.Body.String())
+	}
+	if _, fields := parseFormPost(t, w.Body.String()); fields.Get("state") != state {
+		t.Errorf("form_post page has state %q instead of %q", fields.Get("state"), state)
+	}
+
+	// Nor can it add parameters to redirected errors
+	form = validAuthForm()
+	form.Set("prompt", "none")
+	form.Set("state", "xyzzy&error=none#fragment")
+	w = postForm(router, "/authorize", form)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params := location.Query(); params.Get("state") != form.Get("state") || len(params["error"]) != 1 || location.Fragment != "" {
+		t.Errorf("redirected error has Location %q, which doesn't keep the state to itself", location)
+	}
+
+	// Too long a state isn't echoed back at all
+	for _, length := range []int{64, 65} {
+		form = validAuthForm()
+		form.Set("state", strings.Repeat("x", length))
+		w = postForm(router, "/authorize", form)
+
+		if length <= p.MaxStateLength {
+			if w.Code != 200 {
+				t.Errorf("POST /authorize with a %d byte state returned %d: %s", length, w.Code, w.Body.String())
+			}
+			continue
+		}
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 302 || location.Query().Get("error") != "invalid_request" || location.Query().Has("state") {
+			t.Errorf("POST /authorize with a %d byte state returned %d with Location %q", length, w.Code, location)
+		}
+	}
+}
+
+func TestAuthorizeNonce(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &fakeMailer{}
+	router := gin.New()
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, MaxNonceLength: 32}
+	oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME)))
+
+	tests := []struct {
+		description string
+		param       string
+		value       string
+		ok          bool
+	}{
+		{"a nonce of the longest length", "nonce", strings.Repeat("n", 32), true},
+		{"too long a nonce", "nonce", strings.Repeat("n", 33), false},
+		{"a nonce with a newline", "nonce", "n-0S6\r\n_WzA2Mj", false},
+		{"a nonce with a NUL", "nonce", "n-0S6\x00_WzA2Mj", false},
+		{"a state with a tab", "state", "xyzzy\tplugh", false},
+		{"a state with DEL", "state", "xyzzy\x7f", false},
+		{"a state with non-ASCII letters", "state", "état", true},
+	}
+
+	for _, test := range tests {
+		form := validAuthForm()
+		form.Set(test.param, test.value)
+		w := postForm(router, "/authorize", form)
+
+		if test.ok {
+			if w.Code != 200 {
+				t.Errorf("POST /authorize with %s returned %d: %s", test.description, w.Code, w.Body.String())
+			}
+			continue
+		}
+
+		// Bad states are left out of the error, like long ones
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 302 || location.Query().Get("error") != "invalid_request" || location.Query().Get("state") == test.value {
+			t.Errorf("POST /authorize with %s returned %d with Location %q", test.description, w.Code, location)
+		}
+	}
+
+	if len(mailer.sent) != 2 {
+		t.Errorf("sent %d confirmation emails instead of 2", len(mailer.sent))
+	}
+}
+
+func TestAuthorizeRateLimit(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &fakeMailer{}
+	router := gin.New()
+	store := newMemorySessionStore(SESSION_LIFETIME)
+	limiter := newRateLimiter(time.Minute, 2)
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Limiter: limiter}, newEmailAuthenticator("https://issuer.example", mailer, store))
+
+	// Each email address has its own limit
+	for i := 0; i < 2; i++ {
+		if w := postForm(router, "/authorize", validAuthForm()); w.Code != 200 {
+			t.Fatalf("POST /authorize %d returned %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+
+	w := postForm(router, "/authorize", validAuthForm())
+	if w.Code != 429 {
+		t.Fatalf("POST /authorize past the burst returned %d instead of 429", w.Code)
+	}
+
+	if retry := w.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("POST /authorize past the burst has Retry-After %q instead of 60", retry)
+	}
+
+	if len(mailer.sent) != 2 {
+		t.Errorf("expected 2 emails to be sent, got %d", len(mailer.sent))
+	}
+
+	// ...as does each client_id
+	other := validAuthForm()
+	other.Set("client_id", "https://other.example")
+	other.Set("redirect_uri", "https://other.example/callback")
+	for i, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		other.Set("login_hint", email)
+		w := postForm(router, "/authorize", other)
+		if expected := []int{200, 200, 429}[i]; w.Code != expected {
+			t.Errorf("POST /authorize for %s returned %d instead of %d", email, w.Code, expected)
+		}
+	}
+}
+
+func TestAuthorizeWithoutKey(t *testing.T) {
+	mailer := &fakeMailer{}
+	auths := []Authenticator{newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME))}
+
+	keys := map[string]crypto.Signer{
+		"no key":        nil,
+		"a nil RSA key": (*rsa.PrivateKey)(nil),
+		"an empty key":  &rsa.PrivateKey{},
+	}
+
+	for description, key := range keys {
+		p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}
+		router := gin.New()
+		router.POST("/authorize", authorize(p, "/authorize", auths))
+
+		w := postForm(router, "/authorize", validAuthForm())
+		if w.Code != 500 {
+			t.Errorf("POST /authorize with %s returned %d instead of 500", description, w.Code)
+		}
+
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" {
+			t.Errorf("POST /authorize with %s returned %q instead of a JSON error", description, w.Body.String())
+		}
+	}
+
+	if len(mailer.sent) != 0 {
+		t.Errorf("sent %d emails for logins which could never finish", len(mailer.sent))
+	}
+
+	// The other routes don't panic either, and have no keys to publish
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Lifetime: TOKEN_LIFETIME}, auths...)
+	if w := get(router, "/jwks.json"); w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"keys":[]}` {
+		t.Errorf("GET /jwks.json without a key returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthorizeOrigin(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routers := map[bool]*gin.Engine{}
+	for _, strict := range []bool{false, true} {
+		routers[strict] = gin.New()
+		store := newMemorySessionStore(SESSION_LIFETIME)
+		oidcAddRoutes(routers[strict], ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, RequireOrigin: strict}, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, store))
+	}
+
+	tests := []struct {
+		strict  bool
+		header  string
+		value   string
+		allowed bool
+	}{
+		{false, "Origin", "https://client.example", true},
+		{false, "Origin", "https://issuer.example", true},
+		{false, "Origin", "https://evil.example", false},
+		{false, "Origin", "http://client.example", false},
+		{false, "Origin", "https://client.example:8443", false},
+		{false, "Referer", "https://client.example/login", true},
+		{false, "Referer", "https://evil.example/client.example", false},
+		{false, "Origin", "null", true},
+		{false, "", "", true},
+
+		{true, "Origin", "https://client.example", true},
+		{true, "Referer", "https://client.example/login", true},
+		{true, "Origin", "https://evil.example", false},
+		{true, "Origin", "null", false},
+		{true, "", "", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/authorize", strings.NewReader(validAuthForm().Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		routers[test.strict].ServeHTTP(w, req)
+
+		expected := 400
+		if test.allowed {
+			expected = 200
+		}
+		if w.Code != expected {
+			t.Errorf("POST /authorize with %s %q (strict=%t) returned %d instead of %d", test.header, test.value, test.strict, w.Code, expected)
+		}
+	}
+
+	// The Origin header takes precedence over the Referer
+	req := httptest.NewRequest("POST", "/authorize", strings.NewReader(validAuthForm().Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://evil.example")
+	req.Header.Set("Referer", "https://client.example/login")
+	w := httptest.NewRecorder()
+	routers[false].ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Errorf("POST /authorize with a bad Origin and good Referer returned %d instead of 400", w.Code)
+	}
+}
+
+func TestDiscoveryMatchesRoutes(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Endpoints which are only used with other methods than GET
+	methods := map[string]string{"revocation_endpoint": "POST", "introspection_endpoint": "POST"}
+
+	clients, err := newClientRegistry(nil, nil, nil, []string{"https://rs.example=correct horse battery staple"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, optional := range []bool{false, true} {
+		p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}
+		expected := []string{"authorization_endpoint", "jwks_uri", "end_session_endpoint"}
+		if optional {
+			p.Revoked = newBlocklist()
+			p.Clients = clients
+			expected = append(expected, "revocation_endpoint", "introspection_endpoint")
+		}
+
+		router := gin.New()
+		oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME)))
+
+		w := get(router, "/.well-known/openid-configuration")
+		var document map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+			t.Fatalf("GET /.well-known/openid-configuration returned invalid JSON: %s", err)
+		}
+
+		registered := map[string]bool{}
+		for _, route := range router.Routes() {
+			registered[route.Method+" "+route.Path] = true
+		}
+
+		// Every endpoint URL advertised, whatever it's called, must be served
+		var advertised []string
+		for field, value := range document {
+			endpoint, ok := value.(string)
+			if !ok || field == "issuer" || !(strings.HasSuffix(field, "_endpoint") || strings.HasSuffix(field, "_uri")) {
+				continue
+			}
+			advertised = append(advertised, field)
+
+			if !strings.HasPrefix(endpoint, "https://issuer.example/") {
+				t.Errorf("discovery has %s %q outside the issuer", field, endpoint)
+				continue
+			}
+
+			method := methods[field]
+			if method == "" {
+				method = "GET"
+			}
+
+			path := strings.TrimPrefix(endpoint, "https://issuer.example")
+			if !registered[method+" "+path] {
+				t.Errorf("discovery has %s %q, but no route serves %s %s", field, endpoint, method, path)
+			}
+		}
+
+		for _, field := range expected {
+			if !contains(advertised, field) {
+				t.Errorf("with optional endpoints %t, discovery doesn't advertise %s", optional, field)
+			}
+		}
+		if len(advertised) != len(expected) {
+			t.Errorf("with optional endpoints %t, discovery advertised %v instead of %v", optional, advertised, expected)
+		}
+	}
+}
+
+func TestDiscoveryClaims(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		scopeClaims map[string][]string
+		expected    string
+	}{
+		{nil, `["acr","amr","aud","auth_time","email","email_verified","exp","iat","iss","jti","nbf","preferred_username","sub"]`},
+		{map[string][]string{"openid": {"sub"}, "email": {"email"}}, `["acr","amr","aud","auth_time","email","exp","iat","iss","jti","nbf","sub"]`},
+	}
+
+	for _, test := range tests {
+		router := gin.New()
+		p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, ScopeClaims: test.scopeClaims}
+		oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME)))
+
+		var document struct {
+			ClaimsSupported json.RawMessage `json:"claims_supported"`
+		}
+		if err := json.Unmarshal(get(router, "/.well-known/openid-configuration").Body.Bytes(), &document); err != nil {
+			t.Fatal(err)
+		}
+		if string(document.ClaimsSupported) != test.expected {
+			t.Errorf("with scope claims %v, claims_supported is %s instead of %s", test.scopeClaims, document.ClaimsSupported, test.expected)
+		}
+	}
+}
+
+func TestDiscoveryScheme(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, scheme := range []string{"", SCHEME_HTTPS, SCHEME_HTTP} {
+		p := ProviderConfig{Origin: "localhost:3333", Scheme: scheme, Key: key, Lifetime: TOKEN_LIFETIME, UserInfo: true}
+		issuer := p.scheme() + "://localhost:3333"
+		if scheme == "" && issuer != "https://localhost:3333" {
+			t.Errorf("without a scheme, the issuer is %s", issuer)
+		}
+
+		router := gin.New()
+		oidcAddRoutes(router, p, newEmailAuthenticator(issuer, &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME)))
+
+		var document map[string]interface{}
+		if err := json.Unmarshal(get(router, "/.well-known/openid-configuration").Body.Bytes(), &document); err != nil {
+			t.Fatal(err)
+		}
+
+		if document["issuer"] != issuer {
+			t.Errorf("with scheme %q, the issuer is %v instead of %s", scheme, document["issuer"], issuer)
+		}
+		for _, name := range []string{"authorization_endpoint", "jwks_uri", "end_session_endpoint", "userinfo_endpoint"} {
+			if endpoint, _ := document[name].(string); !strings.HasPrefix(endpoint, issuer+"/") {
+				t.Errorf("with scheme %q, %s is %q, which is not under %s", scheme, name, endpoint, issuer)
+			}
+		}
+
+		// Logins started from our own pages come from the issuer's origin
+		req := httptest.NewRequest("POST", "/authorize", strings.NewReader(validAuthForm().Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", issuer)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Errorf("with scheme %q, POST /authorize from %s returned %d: %s", scheme, issuer, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &fakeMailer{}
+	router := gin.New()
+	p := ProviderConfig{Origin: "issuer.example", BasePath: "/auth", Key: key, Lifetime: TOKEN_LIFETIME}
+	oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example/auth", mailer, newMemorySessionStore(SESSION_LIFETIME)))
+
+	w := get(router, "/auth/.well-known/openid-configuration")
+	if w.Code != 200 {
+		t.Fatalf("GET /auth/.well-known/openid-configuration returned %d", w.Code)
+	}
+
+	var document map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"issuer":                 "https://issuer.example/auth",
+		"authorization_endpoint": "https://issuer.example/auth/authorize",
+		"jwks_uri":               "https://issuer.example/auth/jwks.json",
+		"end_session_endpoint":   "https://issuer.example/auth/end_session",
+	}
+	for field, value := range expected {
+		if document[field] != value {
+			t.Errorf("discovery under /auth has %s %v instead of %q", field, document[field], value)
+		}
+	}
+
+	if w := get(router, "/auth/jwks.json"); w.Code != 200 || !strings.Contains(w.Body.String(), generateKid(key.Public())) {
+		t.Errorf("GET /auth/jwks.json returned %d: %s", w.Code, w.Body.String())
+	}
+	if w := get(router, "/jwks.json"); w.Code != 404 {
+		t.Errorf("GET /jwks.json returned %d, though routes are under /auth", w.Code)
+	}
+
+	// The email form resubmits under the base path too
+	form := validAuthForm()
+	form.Del("login_hint")
+	if w := postForm(router, "/auth/authorize", form); !strings.Contains(w.Body.String(), `action="/auth/authorize"`) {
+		t.Errorf("the email form doesn't submit to /auth/authorize: %s", w.Body.String())
+	}
+
+	w = postForm(router, "/auth/authorize", validAuthForm())
+	if w.Code != 200 {
+		t.Fatalf("POST /auth/authorize returned %d: %s", w.Code, w.Body.String())
+	}
+
+	match := regexp.MustCompile(`https://issuer\.example(/auth/confirm\?token=[-_.a-zA-Z0-9%]+)`).FindStringSubmatch(mailer.sent[0].textBody)
+	if match == nil {
+		t.Fatalf("email does not contain a confirmation link under /auth: %s", mailer.sent[0].textBody)
+	}
+
+	w = get(router, match[1])
+	_, params := parseFormPost(t, w.Body.String())
+	claims, err := parseIDToken(p, params.Get("id_token"))
+	if err != nil {
+		t.Fatalf("GET %s did not issue a valid id_token: %s", match[1], err)
+	}
+	if claims.Issuer != "https://issuer.example/auth" {
+		t.Errorf("id_token has iss %q instead of the prefixed issuer", claims.Issuer)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	router, _ := newEmailTestRouter(t, &fakeMailer{})
+
+	send := func(method string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Origin", "https://client.example")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{"/.well-known/openid-configuration", "/jwks.json"} {
+		if w := send("GET", path); w.Code != 200 || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("GET %s returned %d with Access-Control-Allow-Origin %q", path, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+
+		w := send("OPTIONS", path)
+		if w.Code != 204 || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("OPTIONS %s returned %d with Access-Control-Allow-Origin %q", path, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+
+		if methods := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, "GET") || !strings.Contains(methods, "HEAD") {
+			t.Errorf("OPTIONS %s allows methods %q, not including GET", path, methods)
+		}
+	}
+
+	for _, method := range []string{"GET", "POST", "OPTIONS"} {
+		w := send(method, "/authorize?"+validAuthForm().Encode())
+		if allowed := w.Header().Get("Access-Control-Allow-Origin"); allowed != "" {
+			t.Errorf("%s /authorize returned Access-Control-Allow-Origin %q", method, allowed)
+		}
+
+		if method == "OPTIONS" && w.Code == 204 {
+			t.Errorf("OPTIONS /authorize was answered as a CORS preflight")
+		}
+	}
+}
+
+func TestPublicHead(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, DiscoveryMaxAge: time.Hour})
+
+	for _, path := range []string{"/.well-known/openid-configuration", "/jwks.json"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("HEAD", path, nil))
+		if w.Code != 200 || w.Body.Len() != 0 {
+			t.Errorf("HEAD %s returned %d with a %d byte body", path, w.Code, w.Body.Len())
+		}
+
+		full := get(router, path)
+		for _, header := range []string{"Content-Type", "Cache-Control", "ETag", "Access-Control-Allow-Origin"} {
+			if w.Header().Get(header) == "" || w.Header().Get(header) != full.Header().Get(header) {
+				t.Errorf("HEAD %s has %s %q, while GET has %q", path, header, w.Header().Get(header), full.Header().Get(header))
+			}
+		}
+		if length := w.Header().Get("Content-Length"); length != strconv.Itoa(full.Body.Len()) {
+			t.Errorf("HEAD %s has Content-Length %q, while GET's body is %d bytes", path, length, full.Body.Len())
+		}
+	}
+}
+
+func TestDiscoveryCaching(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, DiscoveryMaxAge: time.Hour, KeysetMaxAge: 5 * time.Minute})
+
+	tests := []struct {
+		path         string
+		cacheControl string
+	}{
+		{"/.well-known/openid-configuration", "public, max-age=3600"},
+		{"/jwks.json", "public, max-age=300"},
+	}
+
+	for _, test := range tests {
+		w := get(router, test.path)
+		if cc := w.Header().Get("Cache-Control"); cc != test.cacheControl {
+			t.Errorf("GET %s has Cache-Control %q instead of %q", test.path, cc, test.cacheControl)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("GET %s has Content-Type %q", test.path, ct)
+		}
+
+		etag := w.Header().Get("ETag")
+		if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+			t.Fatalf("GET %s has ETag %q, which isn't a quoted string", test.path, etag)
+		}
+
+		conditional := func(ifNoneMatch string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", test.path, nil)
+			req.Header.Set("If-None-Match", ifNoneMatch)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+			if w := conditional(ifNoneMatch); w.Code != 304 || w.Body.Len() != 0 {
+				t.Errorf("GET %s with If-None-Match %s returned %d instead of 304", test.path, ifNoneMatch, w.Code)
+			}
+		}
+
+		w = conditional(`"other"`)
+		if w.Code != 200 || w.Body.Len() == 0 {
+			t.Errorf("GET %s with a stale ETag returned %d instead of the document", test.path, w.Code)
+		}
+	}
+
+	// The JWK Set's ETag changes with the key
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := gin.New()
+	oidcAddRoutes(rotated, ProviderConfig{Origin: "issuer.example", Key: other, Lifetime: TOKEN_LIFETIME})
+	if get(rotated, "/jwks.json").Header().Get("ETag") == get(router, "/jwks.json").Header().Get("ETag") {
+		t.Error("JWK Sets for different keys have the same ETag")
+	}
+
+	// Without a max age, clients must check for changes each time
+	if cc := get(rotated, "/jwks.json").Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("GET /jwks.json without a max age has Cache-Control %q instead of no-cache", cc)
+	}
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mJ92K9ZVqNhn0gtLVQTo2NKJpRjdV0"
+	challenge := "lJhBIgJzn9ty8k15Z3ssytxRJ7rUIpGYGJeNVq7mM08"
+
+	tests := []struct {
+		description string
+		challenge   string
+		verifier    string
+		expected    bool
+	}{
+		{"matching verifier", challenge, verifier, true},
+		{"different verifier", challenge, strings.Replace(verifier, "d", "e", 1), false},
+		{"verifier used as its own challenge", verifier, verifier, false},
+		{"empty verifier", challenge, "", false},
+		{"short verifier", "-bAHi131ltLqGQEMABu9AJ5lHeLFfo-341XzHrnT9zk", "short", false},
+		{"verifier with bad characters", challenge, verifier + "!", false},
+	}
+
+	for _, test := range tests {
+		if actual := verifyCodeChallenge(test.challenge, test.verifier); actual != test.expected {
+			t.Errorf("verifyCodeChallenge with a %s returned %t instead of %t", test.description, actual, test.expected)
+		}
+	}
+}
+
+func TestSecretsEqual(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"secret", "secret", true},
+		{"", "", true},
+		{"secret", "Secret", false},
+		{"secret", "secret2", false},
+		{"secret", "", false},
+	}
+
+	for _, test := range tests {
+		if actual := secretsEqual(test.a, test.b); actual != test.expected {
+			t.Errorf("secretsEqual(%q, %q) returned %t instead of %t", test.a, test.b, actual, test.expected)
+		}
+	}
+
+	// Its running time only depends on the lengths if it's subtle's
+	file, err := parser.ParseFile(token.NewFileSet(), "openid_provider.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var constantTime bool
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == "secretsEqual" {
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				if sel, ok := n.(*ast.SelectorExpr); ok && sel.Sel.Name == "ConstantTimeCompare" {
+					if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "subtle" {
+						constantTime = true
+					}
+				}
+				return true
+			})
+		}
+	}
+	if !constantTime {
+		t.Error("secretsEqual doesn't use subtle.ConstantTimeCompare")
+	}
+}
+
+func TestGenerateKid(t *testing.T) {
+	// The example key and thumbprint from RFC 7638, Section 3.1
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rfcKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+	if kid := generateKid(rfcKey); kid != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("generateKid of the RFC 7638 example key returned %q", kid)
+	}
+
+	// Relying parties can compute the same thumbprint from our published JWKs
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	required := map[string][]string{
+		"RSA": {"e", "kty", "n"},
+		"EC":  {"crv", "kty", "x", "y"},
+	}
+
+	for _, key := range []interface{}{&rsaKey.PublicKey, &ecKey.PublicKey} {
+		data, err := json.Marshal(jose.JsonWebKey{Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var jwk map[string]string
+		if err := json.Unmarshal(data, &jwk); err != nil {
+			t.Fatal(err)
+		}
+
+		var members []string
+		for _, name := range required[jwk["kty"]] {
+			members = append(members, fmt.Sprintf("%q:%q", name, jwk[name]))
+		}
+		sum := sha256.Sum256([]byte("{" + strings.Join(members, ",") + "}"))
+
+		if kid := generateKid(key); kid != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			t.Errorf("generateKid of a %s key does not match the thumbprint of its JWK %s", jwk["kty"], data)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readinessCheck is a dependency which must be working for the daemon to
+// serve requests.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// opsAddRoutes adds liveness and readiness probes, for container orchestrators
+// and load balancers, along with build information, to an existing gin.IRouter.
+func opsAddRoutes(router gin.IRouter, checks ...readinessCheck) {
+	router.GET("/healthz", healthz())
+	router.GET("/readyz", readyz(checks))
+	router.GET("/version", version())
+}
+
+// healthz creates a handler which reports that the process is up.
+func healthz() func(*gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"status":  "ok",
+			"version": VERSION,
+		})
+	}
+}
+
+// version creates a handler which reports which build is running.
+func version() func(*gin.Context) {
+	info := buildInfo()
+
+	return func(c *gin.Context) {
+		c.JSON(200, info)
+	}
+}
+
+// readyz creates a handler which runs every check, and responds with 503 if
+// any of them fail.
+func readyz(checks []readinessCheck) func(*gin.Context) {
+	return func(c *gin.Context) {
+		status, results := 200, gin.H{}
+		for _, v := range checks {
+			if err := v.check(); err != nil {
+				status = 503
+				results[v.name] = err.Error()
+			} else {
+				results[v.name] = "ok"
+			}
+		}
+
+		state := "ready"
+		if status != 200 {
+			state = "unavailable"
+		}
+
+		c.JSON(status, gin.H{
+			"status": state,
+			"checks": results,
+		})
+	}
+}
+
+// keyCheck verifies that a usable signing key has been loaded.
+func keyCheck(key crypto.Signer) readinessCheck {
+	return readinessCheck{"signing_key", func() error {
+		return checkKey(key)
+	}}
+}
+
+// pingCheck verifies that a dependency such as a Mailer or SessionStore is
+// reachable, if it has a way of checking. Dependencies without a Ping method,
+// like in-memory stores, are always considered reachable.
+func pingCheck(name string, dependency interface{}) readinessCheck {
+	return readinessCheck{name, func() error {
+		if pinger, ok := dependency.(interface{ Ping() error }); ok {
+			return pinger.Ping()
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakePinger is a dependency whose Ping returns err.
+type fakePinger struct {
+	err error
+}
+
+func (p *fakePinger) Ping() error {
+	return p.err
+}
+
+func TestHealthz(t *testing.T) {
+	router := gin.New()
+	opsAddRoutes(router)
+
+	w := get(router, "/healthz")
+	if w.Code != 200 {
+		t.Fatalf("GET /healthz returned %d", w.Code)
+	}
+
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("GET /healthz returned invalid JSON: %s", err)
+	}
+
+	if body["version"] != VERSION {
+		t.Errorf("GET /healthz has version %q instead of %q", body["version"], VERSION)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &fakePinger{}
+	router := gin.New()
+	opsAddRoutes(router,
+		keyCheck(key),
+		pingCheck("smtp", logMailer{}),
+		pingCheck("session_store", store),
+	)
+
+	if w := get(router, "/readyz"); w.Code != 200 {
+		t.Errorf("GET /readyz with healthy dependencies returned %d: %s", w.Code, w.Body.String())
+	}
+
+	store.err = errors.New("connection refused")
+	w := get(router, "/readyz")
+	if w.Code != 503 {
+		t.Errorf("GET /readyz with an unreachable store returned %d instead of 503", w.Code)
+	}
+
+	var body struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("GET /readyz returned invalid JSON: %s", err)
+	}
+
+	expected := map[string]string{
+		"signing_key":   "ok",
+		"smtp":          "ok",
+		"session_store": "connection refused",
+	}
+	for name, result := range expected {
+		if body.Checks[name] != result {
+			t.Errorf("GET /readyz reports %s=%q instead of %q", name, body.Checks[name], result)
+		}
+	}
+
+	// Without a signing key, we can't issue tokens
+	router = gin.New()
+	opsAddRoutes(router, keyCheck(nil))
+	if w := get(router, "/readyz"); w.Code != 503 {
+		t.Errorf("GET /readyz without a signing key returned %d instead of 503", w.Code)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// embeddedPages holds the built-in HTML templates, which operators can
+// override to brand the pages users see.
+//
+//go:embed templates/*.html
+var embeddedPages embed.FS
+
+// defaultPages is used by handlers on routers without usePages.
+var defaultPages = template.Must(parseDefaultPages())
+
+// pagesKey is where usePages puts the templates in the gin.Context.
+const pagesKey = "pages"
+
+// What the index route serves, if not a redirect to a URL
+const (
+	INDEX_PAGE = "page" // index.html; the default
+	INDEX_NONE = "none" // Nothing, so it's not found
+)
+
+// indexPage is shown at the index route.
+type indexPage struct {
+	Issuer string
+}
+
+// checkEmailPage is shown after sending a confirmation link.
+type checkEmailPage struct {
+	Client string // The client_id, which is the client's origin
+	Email  string
+}
+
+// errorPage is shown when a request can't be handled. Client and Email are
+// empty if they aren't known.
+type errorPage struct {
+	Client  string
+	Email   string
+	Error   string // A short title, like "Bad Token"
+	Message string
+}
+
+func parseDefaultPages() (*template.Template, error) {
+	return template.ParseFS(embeddedPages, "templates/*.html")
+}
+
+// loadPages parses the built-in templates, replacing any which have a file of
+// the same name in dir. Files in dir which don't replace a template are an
+// error, as they're probably misnamed.
+func loadPages(dir string) (*template.Template, error) {
+	pages, err := parseDefaultPages()
+	if err != nil || dir == "" {
+		return pages, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if pages.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown template %s%s", path, pages.DefinedTemplates())
+		}
+
+		// Parsing a file redefines the template named after it
+		if _, err := pages.ParseFiles(path); err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %s", path, err)
+		}
+	}
+
+	return pages, nil
+}
+
+// usePages creates a handler which makes renderPage use pages.
+func usePages(pages *template.Template) func(*gin.Context) {
+	return func(c *gin.Context) {
+		c.Set(pagesKey, pages)
+	}
+}
+
+// indexAddRoutes registers the index route, which serves whatever index says:
+// INDEX_PAGE, INDEX_NONE, or a URL to redirect to.
+func indexAddRoutes(router gin.IRouter, index string, issuer string) {
+	switch index {
+	case INDEX_NONE:
+	case INDEX_PAGE:
+		router.GET("/", func(c *gin.Context) {
+			renderPage(c, 200, "index.html", indexPage{issuer})
+		})
+	default:
+		router.GET("/", func(c *gin.Context) {
+			c.Redirect(302, index)
+		})
+	}
+}
+
+// renderPage writes the HTML template called name to the response.
+func renderPage(c *gin.Context, status int, name string, data interface{}) {
+	pages := defaultPages
+	if v, ok := c.Get(pagesKey); ok {
+		pages = v.(*template.Template)
+	}
+
+	// Errors are reported as JSON, as the error page itself may be broken
+	var body bytes.Buffer
+	if err := pages.ExecuteTemplate(&body, name, data); err != nil {
+		c.JSON(500, gin.H{"error": "Unknown Error", "message": err.Error()})
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", body.Bytes())
+}
+
+// respondError reports an error with the given status code, as an HTML page
+// for browsers or as JSON for other clients.
+func respondError(c *gin.Context, status int, errType string, errMsg string) {
+	if wantsHTML(c) {
+		failPage(c, status, errType, errMsg)
+		return
+	}
+
+	c.JSON(status, gin.H{
+		"error":   errType,
+		"message": errMsg,
+	})
+}
+
+// allowMethods makes router answer requests for paths it serves, but not with
+// their method, with a 405 and an Allow header listing the methods it does
+// serve them with, as per RFC 9110 Section 15.5.6, instead of a 404.
+func allowMethods(router *gin.Engine) {
+	router.HandleMethodNotAllowed = true
+	router.NoMethod(func(c *gin.Context) {
+		var allowed []string
+		for _, route := range router.Routes() {
+			if route.Path == c.Request.URL.Path {
+				allowed = append(allowed, route.Method)
+			}
+		}
+		sort.Strings(allowed)
+
+		c.Header("Allow", strings.Join(allowed, ", "))
+		respondError(c, 405, "Method Not Allowed", c.Request.Method+" requests are not supported here")
+	})
+}
+
+// wantsHTML reports whether the request prefers HTML to JSON, going by its
+// Accept header. If that doesn't ask for either, a response_mode in the query
+// means a client sent a browser here, as only they use one.
+func wantsHTML(c *gin.Context) bool {
+	var html, json float64
+	for _, accepted := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, q := parseMediaRange(accepted)
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			html = math.Max(html, q)
+		case "application/json":
+			json = math.Max(json, q)
+		}
+	}
+
+	if html > 0 || json > 0 {
+		return html >= json
+	}
+
+	return c.Query("response_mode") != ""
+}
+
+// parseMediaRange splits an entry of an Accept header into its lowercased
+// media type and its quality value, which is 1 unless given and valid.
+func parseMediaRange(accepted string) (string, float64) {
+	parts := strings.Split(accepted, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+
+	q := 1.0
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.ToLower(name) != "q" {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil && v >= 0 && v <= 1 {
+			q = v
+		}
+	}
+
+	return mediaType, q
+}
+
+// failPage is like respondError, but always shows an HTML error page, for
+// requests which only ever come from people rather than programs.
+func failPage(c *gin.Context, status int, errType string, errMsg string) {
+	renderPage(c, status, "error.html", errorPage{Error: errType, Message: errMsg})
+}
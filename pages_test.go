@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDefaultPages(t *testing.T) {
+	evil := `<script>alert(1)</script>`
+	escaped := `&lt;script&gt;alert(1)&lt;/script&gt;`
+
+	tests := []struct {
+		name     string
+		data     interface{}
+		contains []string
+	}{
+		{
+			"check_email.html",
+			checkEmailPage{Client: "https://client.example", Email: evil + "@example.com"},
+			[]string{"https://client.example", escaped + "@example.com"},
+		},
+		{
+			"error.html",
+			errorPage{Client: "https://client.example", Error: "Bad Token", Message: evil},
+			[]string{"Bad Token", escaped, `href="https://client.example"`},
+		},
+		{
+			"index.html",
+			indexPage{Issuer: evil},
+			[]string{"login service for " + escaped},
+		},
+		{
+			"logged_out.html",
+			loggedOutPage{Client: evil},
+			[]string{"Logged out", "logged out of " + escaped},
+		},
+		{
+			"enter_email.html",
+			struct {
+				Client string
+				Action string
+				Fields url.Values
+			}{evil, "/authorize", url.Values{"state": {evil}}},
+			[]string{`action="/authorize"`, `name="state" value="` + ("&lt;script&gt;alert(1)&lt;/script&gt;") + `"`, "Log in to " + escaped},
+		},
+		{
+			"form_post.html",
+			struct {
+				Client      string
+				Email       string
+				RedirectURI string
+				IDToken     string
+				State       string
+			}{"https://client.example", evil + "@example.com", "https://client.example/callback", "token", "xyzzy"},
+			[]string{"Logged in to https://client.example as " + escaped + "@example.com", `name="state" value="xyzzy"`},
+		},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		renderPage(c, 200, test.name, test.data)
+		body := w.Body.String()
+
+		if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("rendering %s returned %d with Content-Type %q: %s", test.name, w.Code, w.Header().Get("Content-Type"), body)
+		}
+
+		if strings.Contains(body, evil) {
+			t.Errorf("%s does not escape its data:\n%s", test.name, body)
+		}
+
+		for _, s := range test.contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s does not contain %s:\n%s", test.name, s, body)
+			}
+		}
+	}
+}
+
+func TestLoadPages(t *testing.T) {
+	dir := t.TempDir()
+	custom := `<p class="brand">Check {{.Email}} for a link to {{.Client}}</p>`
+	if err := ioutil.WriteFile(filepath.Join(dir, "check_email.html"), []byte(custom), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := loadPages(dir)
+	if err != nil {
+		t.Fatalf("loadPages returned an error: %s", err)
+	}
+
+	router := gin.New()
+	router.Use(usePages(pages))
+	router.GET("/check", func(c *gin.Context) {
+		renderPage(c, 200, "check_email.html", checkEmailPage{Client: "https://client.example", Email: "<foo@example.com>"})
+	})
+	router.GET("/error", func(c *gin.Context) {
+		failPage(c, 400, "Bad Token", "Nope")
+	})
+
+	if body := get(router, "/check").Body.String(); body != `<p class="brand">Check &lt;foo@example.com&gt; for a link to https://client.example</p>` {
+		t.Errorf("custom check_email.html rendered as %q", body)
+	}
+
+	// Pages without a replacement fall back to the built-in ones
+	if w := get(router, "/error"); w.Code != 400 || !strings.Contains(w.Body.String(), "<h1>Bad Token</h1>") {
+		t.Errorf("built-in error.html returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLoadPagesErrors(t *testing.T) {
+	tests := map[string]string{
+		"misnamed template": "check-email.html",
+		"bad syntax":        "error.html",
+	}
+
+	for description, name := range tests {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("{{.Oops"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := loadPages(dir); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("loadPages with a %s returned %v", description, err)
+		}
+	}
+
+	if _, err := loadPages(""); err != nil {
+		t.Errorf("loadPages without a directory returned %s", err)
+	}
+}
+
+func TestRespondError(t *testing.T) {
+	tests := []struct {
+		accept string
+		query  string
+		html   bool
+	}{
+		{"text/html", "", true},
+		{"application/json", "", false},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "", true},
+		{"application/json, text/html;q=0.5", "", false},
+		{"text/html;q=0.9, application/json;q=0.1", "", true},
+		{"TEXT/HTML", "", true},
+		{"*/*", "", false},
+		{"", "", false},
+		{"", "?response_mode=form_post", true},
+		{"application/json", "?response_mode=form_post", false},
+	}
+
+	for _, test := range tests {
+		router := gin.New()
+		router.GET("/", func(c *gin.Context) {
+			respondError(c, 400, "Bad Value", "<oops>")
+		})
+
+		req := httptest.NewRequest("GET", "/"+test.query, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != 400 {
+			t.Errorf("with Accept %q, respondError responded with %d instead of 400", test.accept, w.Code)
+		}
+
+		contentType := w.Header().Get("Content-Type")
+		if html := strings.HasPrefix(contentType, "text/html"); html != test.html {
+			t.Errorf("with Accept %q and query %q, respondError responded with %s", test.accept, test.query, contentType)
+			continue
+		}
+
+		if test.html && !strings.Contains(w.Body.String(), "&lt;oops&gt;") {
+			t.Errorf("with Accept %q, respondError's page doesn't include the escaped message: %s", test.accept, w.Body.String())
+		}
+		if !test.html && !strings.Contains(w.Body.String(), `"error":"Bad Value"`) {
+			t.Errorf("with Accept %q, respondError's JSON doesn't include the error: %s", test.accept, w.Body.String())
+		}
+	}
+}
+
+func TestAuthorizeErrorPage(t *testing.T) {
+	router, _ := newEmailTestRouter(t, &fakeMailer{})
+
+	for accept, contentType := range map[string]string{
+		"text/html":        "text/html",
+		"application/json": "application/json",
+	} {
+		form := validAuthForm()
+		form.Set("redirect_uri", "https://evil.example/callback")
+		req := httptest.NewRequest("GET", "/authorize?"+form.Encode(), nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != 400 || !strings.HasPrefix(w.Header().Get("Content-Type"), contentType) {
+			t.Errorf("GET /authorize with an untrusted redirect_uri and Accept %q returned %d with %s, instead of 400 with %s", accept, w.Code, w.Header().Get("Content-Type"), contentType)
+		}
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	allowMethods(router)
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME})
+
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{"DELETE", "/authorize", "GET, POST"},
+		{"PUT", "/authorize", "GET, POST"},
+		{"POST", "/.well-known/openid-configuration", "GET, HEAD, OPTIONS"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+
+		if w.Code != 405 {
+			t.Errorf("%s %s returned %d instead of 405", test.method, test.path, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != test.allow {
+			t.Errorf("%s %s returned Allow %q instead of %q", test.method, test.path, allow, test.allow)
+		}
+	}
+
+	// Paths which aren't served at all are still not found
+	if w := get(router, "/bogus"); w.Code != 404 {
+		t.Errorf("GET /bogus returned %d instead of 404", w.Code)
+	}
+}
+
+func TestIndexAddRoutes(t *testing.T) {
+	tests := []struct {
+		index    string
+		code     int
+		location string
+	}{
+		{INDEX_PAGE, 200, ""},
+		{"https://www.example.com/", 302, "https://www.example.com/"},
+		{INDEX_NONE, 404, ""},
+	}
+
+	for _, test := range tests {
+		router := gin.New()
+		indexAddRoutes(router, test.index, "https://issuer.example")
+
+		w := get(router, "/")
+		if w.Code != test.code || w.Header().Get("Location") != test.location {
+			t.Errorf("with index %q, GET / returned %d with Location %q instead of %d with %q", test.index, w.Code, w.Header().Get("Location"), test.code, test.location)
+		}
+	}
+
+	// The default page says whose it is, and can be replaced like any other
+	router := gin.New()
+	indexAddRoutes(router, INDEX_PAGE, "https://issuer.example")
+	if body := get(router, "/").Body.String(); !strings.Contains(body, "https://issuer.example") {
+		t.Errorf("GET / does not name the issuer:\n%s", body)
+	}
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(`Welcome to {{.Issuer}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pages, err := loadPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router = gin.New()
+	router.Use(usePages(pages))
+	indexAddRoutes(router, INDEX_PAGE, "https://issuer.example")
+	if body := get(router, "/").Body.String(); body != "Welcome to https://issuer.example" {
+		t.Errorf("GET / with a custom index.html returned %q", body)
+	}
+}
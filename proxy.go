@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// schemeKey is where forwardedProto stores the scheme the client used in the
+// gin.Context.
+const schemeKey = "scheme"
+
+// parseProxies parses trusted proxies given as IP addresses, like 10.0.0.1,
+// or CIDR ranges, like 10.0.0.0/8.
+func parseProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// trustProxies configures router to take the client's address from
+// X-Forwarded-For, and the scheme they used from X-Forwarded-Proto, but only
+// for requests which come from one of proxies. With none, both headers are
+// ignored, as anyone could forge them.
+func trustProxies(router *gin.Engine, proxies []string) error {
+	nets, err := parseProxies(proxies)
+	if err != nil {
+		return err
+	}
+
+	router.ForwardedByClientIP = true
+	router.RemoteIPHeaders = []string{"X-Forwarded-For"}
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		return err
+	}
+
+	router.Use(forwardedProto(nets))
+	return nil
+}
+
+// forwardedProto creates a middleware which records the scheme the client
+// used under schemeKey, believing X-Forwarded-Proto only from trusted.
+func forwardedProto(trusted []*net.IPNet) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+
+		proto := strings.ToLower(strings.TrimSpace(c.GetHeader("X-Forwarded-Proto")))
+		if (proto == "http" || proto == "https") && containsIP(trusted, net.ParseIP(c.RemoteIP())) {
+			scheme = proto
+		}
+
+		c.Set(schemeKey, scheme)
+		c.Next()
+	}
+}
+
+// containsIP reports whether any of nets contains ip.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client which made the request, as told
+// by a trusted proxy if it came through one.
+func clientIP(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// requestScheme returns the scheme the client used to make the request,
+// either "http" or "https", as told by a trusted proxy if it came through one.
+func requestScheme(c *gin.Context) string {
+	if scheme := c.GetString(schemeKey); scheme != "" {
+		return scheme
+	}
+
+	if c.Request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTrustProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	if err := trustProxies(router, []string{"10.0.0.0/8", "::1"}); err != nil {
+		t.Fatal(err)
+	}
+	router.GET("/whoami", func(c *gin.Context) {
+		c.String(200, "%s %s", requestScheme(c), clientIP(c))
+	})
+
+	tests := []struct {
+		description string
+		remoteAddr  string
+		forwarded   string // X-Forwarded-For
+		proto       string // X-Forwarded-Proto
+		expected    string
+	}{
+		{"a direct request", "198.51.100.7:1234", "", "", "http 198.51.100.7"},
+		{"forged headers from an untrusted address", "198.51.100.7:1234", "203.0.113.9", "https", "http 198.51.100.7"},
+		{"headers from a trusted proxy", "10.1.2.3:1234", "203.0.113.9", "https", "https 203.0.113.9"},
+		{"headers from a trusted IPv6 proxy", "[::1]:1234", "203.0.113.9", "HTTPS", "https 203.0.113.9"},
+		{"a proxied plain HTTP request", "10.1.2.3:1234", "203.0.113.9", "http", "http 203.0.113.9"},
+		{"a bogus scheme from a trusted proxy", "10.1.2.3:1234", "203.0.113.9", "gopher", "http 203.0.113.9"},
+
+		// Clients can prepend whatever they like, so only the address our proxy added counts
+		{"a forged address relayed by a trusted proxy", "10.1.2.3:1234", "192.0.2.66, 203.0.113.9", "https", "https 203.0.113.9"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/whoami", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Body.String() != test.expected {
+			t.Errorf("with %s, got %q instead of %q", test.description, w.Body.String(), test.expected)
+		}
+	}
+}
+
+func TestTrustNoProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	if err := trustProxies(router, nil); err != nil {
+		t.Fatal(err)
+	}
+	router.GET("/whoami", func(c *gin.Context) {
+		c.String(200, "%s %s", requestScheme(c), clientIP(c))
+	})
+
+	// Even loopback and private addresses aren't trusted by default
+	req := httptest.NewRequest("GET", "/whoami", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Body.String() != "http 127.0.0.1" {
+		t.Errorf("without trusted proxies, got %q instead of \"http 127.0.0.1\"", w.Body.String())
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	for _, proxies := range [][]string{{"proxy.example"}, {"10.0.0.0/33"}, {"10.0.0.1", ""}, {"fe80::/129"}} {
+		if _, err := parseProxies(proxies); err == nil {
+			t.Errorf("parseProxies(%q) accepted an invalid proxy", proxies)
+		}
+	}
+
+	nets, err := parseProxies([]string{"10.0.0.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 2 || nets[0].String() != "10.0.0.1/32" || nets[1].String() != "2001:db8::/32" {
+		t.Errorf("parseProxies returned %v", nets)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiter with a separate bucket for each key.
+// Every bucket holds up to burst tokens, and regains one token per interval.
+type RateLimiter struct {
+	interval time.Duration
+	burst    int
+	clock    Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// bucket is the number of tokens left for a key as of the last update.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a RateLimiter which allows burst requests at once per
+// key, and one more per interval after that.
+func newRateLimiter(interval time.Duration, burst int) *RateLimiter {
+	return &RateLimiter{
+		interval: interval,
+		burst:    burst,
+		clock:    realClock{},
+		buckets:  make(map[string]*bucket),
+	}
+}
+
+// Allow reports whether a request for key may proceed, and if so uses up one
+// of its tokens. A nil RateLimiter allows everything.
+func (l *RateLimiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{float64(l.burst), now}
+		l.buckets[key] = b
+	}
+	b.refill(now, l.interval, l.burst)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// RetryAfter is how long a rejected caller should wait before trying again.
+func (l *RateLimiter) RetryAfter() time.Duration {
+	return l.interval
+}
+
+// Len returns the number of keys being tracked.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.buckets)
+}
+
+// sweep forgets buckets which have refilled completely, as they're no
+// different from new ones. It runs at most once per the time it takes to
+// refill a bucket. The caller must hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.interval*time.Duration(l.burst) {
+		return
+	}
+
+	for key, b := range l.buckets {
+		b.refill(now, l.interval, l.burst)
+		if b.tokens >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+// refill adds the tokens earned since the bucket was last updated.
+func (b *bucket) refill(now time.Time, interval time.Duration, burst int) {
+	b.tokens += float64(now.Sub(b.last)) / float64(interval)
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	limiter := newRateLimiter(time.Minute, 3)
+	limiter.clock = clock
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("a") {
+			t.Fatalf("Allow denied request %d of a burst of 3", i+1)
+		}
+	}
+
+	if limiter.Allow("a") {
+		t.Error("Allow permitted a request past the burst")
+	}
+
+	// Other keys have their own buckets
+	if !limiter.Allow("b") {
+		t.Error("Allow denied a request for an independent key")
+	}
+
+	// Tokens come back one per interval
+	clock.Advance(59 * time.Second)
+	if limiter.Allow("a") {
+		t.Error("Allow permitted a request before a token was regained")
+	}
+
+	clock.Advance(time.Second)
+	if !limiter.Allow("a") {
+		t.Error("Allow denied a request after a token was regained")
+	}
+
+	if limiter.Allow("a") {
+		t.Error("Allow permitted a second request after only one token was regained")
+	}
+
+	// Full buckets are forgotten once enough time passes
+	clock.Advance(time.Hour)
+	limiter.Allow("c")
+	if n := limiter.Len(); n != 1 {
+		t.Errorf("limiter tracks %d keys after sweeping instead of 1", n)
+	}
+
+	if !limiter.Allow("a") {
+		t.Error("Allow denied a request after the bucket refilled")
+	}
+}
+
+func TestNilRateLimiter(t *testing.T) {
+	var limiter *RateLimiter
+	for i := 0; i < 100; i++ {
+		if !limiter.Allow("a") {
+			t.Fatal("a nil RateLimiter denied a request")
+		}
+	}
+}
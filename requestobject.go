@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/square/go-jose"
+)
+
+// requestObjectParams returns the names of the AuthRequest parameters which a
+// request object may set, which are all but request and request_uri, as per
+// http://openid.net/specs/openid-connect-core-1_0.html#RequestObject.
+func requestObjectParams() map[string]int {
+	params := map[string]int{}
+	structure := reflect.TypeOf(AuthRequest{})
+	for i := 0; i < structure.NumField(); i++ {
+		if name := structure.Field(i).Tag.Get("form"); name != "request" && name != "request_uri" {
+			params[name] = i
+		}
+	}
+	return params
+}
+
+// mergeRequestObject verifies req's request object, which must be a JWT
+// signed by one of the client's registered keys, and returns req with the
+// parameters it contains in place of those given alongside it.
+//
+// Unsigned objects, and those signed with a shared secret, are refused, as we
+// don't have one. Its iss, aud, and exp claims are optional, but must be the
+// client, us, and in the future if given, and its client_id and
+// response_type must match those outside it, as the spec requires.
+func mergeRequestObject(p ProviderConfig, req AuthRequest) (AuthRequest, error) {
+	if !p.Clients.hasKeys() {
+		return req, requestError{"request_not_supported", "Request objects are not supported", "request_not_supported"}
+	}
+
+	jws, err := jose.ParseSigned(req.Request)
+	if err != nil {
+		return req, requestError{"invalid_request_object", "Malformed request object", "invalid_request_object"}
+	}
+
+	alg := jws.Signatures[0].Header.Algorithm
+	if !contains(asymmetricAlgs, alg) {
+		return req, requestError{"invalid_request_object", fmt.Sprintf("Request object is signed with %q, which is not allowed", alg), "invalid_request_object"}
+	}
+
+	var payload []byte
+	for _, key := range p.Clients.Keys(req.ClientID, jws.Signatures[0].Header.KeyID) {
+		if key.Algorithm != "" && key.Algorithm != alg {
+			continue
+		}
+		if payload, err = jws.Verify(key.Key); err == nil {
+			break
+		}
+	}
+	if payload == nil {
+		return req, requestError{"invalid_request_object", "Request object is not signed by any of client_id " + req.ClientID + "'s keys", "invalid_request_object"}
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return req, requestError{"invalid_request_object", "Malformed request object claims", "invalid_request_object"}
+	}
+
+	exp, _ := claims["exp"].(float64)
+	tests := []struct {
+		description string
+		ok          bool
+	}{
+		{"Request object was issued by someone other than client_id", claims["iss"] == nil || claims["iss"] == req.ClientID},
+		{"Request object is intended for someone else", claims["aud"] == nil || audienceIncludes(claims["aud"], p.issuer())},
+		{"Request object has expired", claims["exp"] == nil || float64(p.now().Unix()) < exp},
+		{"Request object is for another client_id", claims["client_id"] == nil || claims["client_id"] == req.ClientID},
+		{"Request object has a different response_type", claims["response_type"] == nil || claims["response_type"] == req.ResponseType},
+		{"Request objects must not contain request or request_uri", claims["request"] == nil && claims["request_uri"] == nil},
+	}
+
+	for _, v := range tests {
+		if !v.ok {
+			return req, requestError{"invalid_request_object", v.description, "invalid_request_object"}
+		}
+	}
+
+	// The signed values take precedence
+	merged := req
+	fields := reflect.ValueOf(&merged).Elem()
+	for name, i := range requestObjectParams() {
+		switch value := claims[name].(type) {
+		case nil:
+		case string:
+			fields.Field(i).SetString(value)
+		case float64: // Like max_age, which is a number in JSON
+			fields.Field(i).SetString(strconv.FormatFloat(value, 'f', -1, 64))
+		default:
+			return req, requestError{"invalid_request_object", "Request object parameter " + name + " must be a string or number", "invalid_request_object"}
+		}
+	}
+	merged.Request = ""
+
+	return merged, nil
+}
+
+// audienceIncludes reports whether an aud claim, which may be a string or an
+// array of them, includes audience.
+func audienceIncludes(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, v := range aud {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// errRequestURI is reported for authorization requests with a request_uri,
+// as we don't fetch request objects by reference.
+var errRequestURI = requestError{"request_uri_not_supported", "request_uri is not supported, but the request parameter may be", "request_uri_not_supported"}
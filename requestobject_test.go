@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRequestObjectTestRouter returns a router whose only client,
+// https://client.example, has the returned key registered for signing request
+// objects.
+func newRequestObjectTestRouter(t *testing.T, mailer Mailer) (*gin.Engine, crypto.Signer) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(jwkSet(clientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "client.jwks")
+	if err := ioutil.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := newClientRegistry([]string{"https://client.example"}, nil, nil, nil, []string{"https://client.example=" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Clients: clients}
+	oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME)))
+
+	return router, clientKey
+}
+
+// validRequestObject returns the claims of a request object which
+// https://client.example could send.
+func validRequestObject() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":           "https://client.example",
+		"aud":           "https://issuer.example",
+		"exp":           time.Now().Add(time.Minute).Unix(),
+		"client_id":     "https://client.example",
+		"response_type": "id_token",
+		"scope":         "openid email",
+		"redirect_uri":  "https://client.example/callback",
+		"login_hint":    "signed@example.com",
+		"state":         "signed-state",
+		"nonce":         "signed-nonce",
+		"max_age":       3600,
+	}
+}
+
+func signRequestObject(t *testing.T, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+
+	token, err := signToken(key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthorizeRequestObject(t *testing.T) {
+	mailer := &fakeMailer{}
+	router, clientKey := newRequestObjectTestRouter(t, mailer)
+
+	// The signed parameters replace those alongside them
+	form := url.Values{
+		"scope":         {"openid"},
+		"response_type": {"id_token"},
+		"client_id":     {"https://client.example"},
+		"redirect_uri":  {"https://client.example/unsigned"},
+		"login_hint":    {"unsigned@example.com"},
+		"request":       {signRequestObject(t, clientKey, validRequestObject())},
+	}
+	w := postForm(router, "/authorize", form)
+	if w.Code != 200 || len(mailer.sent) != 1 {
+		t.Fatalf("POST /authorize with a valid request object returned %d: %s", w.Code, w.Body.String())
+	}
+	if to := mailer.sent[0].to; to != "signed@example.com" {
+		t.Errorf("POST /authorize with a request object sent the confirmation email to %s instead of its login_hint", to)
+	}
+
+	// And reach the client once the login is finished
+	match := linkRE.FindStringSubmatch(mailer.sent[0].textBody)
+	if match == nil {
+		t.Fatal("email does not contain a confirmation link")
+	}
+	body := get(router, match[1]).Body.String()
+	if !strings.Contains(body, `action="https://client.example/callback"`) || !strings.Contains(body, `value="signed-state"`) {
+		t.Errorf("the login didn't finish with the request object's redirect_uri and state:\n%s", body)
+	}
+
+	// Required parameters may be left to the request object
+	form.Del("redirect_uri")
+	if w := postForm(router, "/authorize", form); w.Code != 200 || len(mailer.sent) != 2 {
+		t.Errorf("POST /authorize with redirect_uri only in the request object returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthorizeRequestObjectRejects(t *testing.T) {
+	mailer := &fakeMailer{}
+	router, clientKey := newRequestObjectTestRouter(t, mailer)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := validRequestObject()
+		claims[name] = value
+		return claims
+	}
+
+	// Swap in another login_hint, keeping the original signature
+	valid := strings.Split(signRequestObject(t, clientKey, validRequestObject()), ".")
+	payload, err := json.Marshal(with("login_hint", "attacker@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := valid[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + valid[2]
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + valid[1] + "."
+
+	tests := []struct {
+		description string
+		param       string
+		value       string
+		code        string
+	}{
+		{"a tampered request object", "request", tampered, "invalid_request_object"},
+		{"an unsigned request object", "request", unsigned, "invalid_request_object"},
+		{"a request object signed by another key", "request", signRequestObject(t, otherKey, validRequestObject()), "invalid_request_object"},
+		{"an expired request object", "request", signRequestObject(t, clientKey, with("exp", time.Now().Add(-time.Minute).Unix())), "invalid_request_object"},
+		{"a request object for another issuer", "request", signRequestObject(t, clientKey, with("aud", "https://other.example")), "invalid_request_object"},
+		{"a request object for another client", "request", signRequestObject(t, clientKey, with("client_id", "https://other.example")), "invalid_request_object"},
+		{"a request object containing a request_uri", "request", signRequestObject(t, clientKey, with("request_uri", "https://client.example/request.jwt")), "invalid_request_object"},
+		{"a malformed request object", "request", "bogus", "invalid_request_object"},
+		{"a request_uri", "request_uri", "https://client.example/request.jwt", "request_uri_not_supported"},
+	}
+
+	for _, test := range tests {
+		form := validAuthForm()
+		form.Set(test.param, test.value)
+
+		w := postForm(router, "/authorize", form)
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 302 || location.Query().Get("error") != test.code {
+			t.Errorf("POST /authorize with %s returned %d with Location %q, instead of %s", test.description, w.Code, location, test.code)
+		}
+	}
+
+	if len(mailer.sent) != 0 {
+		t.Errorf("sent %d confirmation emails for rejected request objects", len(mailer.sent))
+	}
+}
+
+func TestRequestObjectDiscovery(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without any client keys, request objects are refused and not advertised
+	mailer := &fakeMailer{}
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, newEmailAuthenticator("https://issuer.example", mailer, newMemorySessionStore(SESSION_LIFETIME)))
+
+	body := get(router, "/.well-known/openid-configuration").Body.String()
+	if !strings.Contains(body, `"request_parameter_supported":false`) || !strings.Contains(body, `"request_uri_parameter_supported":false`) {
+		t.Errorf("without client keys, the discovery document is %s", body)
+	}
+
+	form := validAuthForm()
+	form.Set("request", "bogus")
+	w := postForm(router, "/authorize", form)
+	if location := w.Header().Get("Location"); w.Code != 302 || !strings.Contains(location, "error=request_not_supported") {
+		t.Errorf("POST /authorize with a request object and no client keys returned %d with Location %q", w.Code, location)
+	}
+
+	router, _ = newRequestObjectTestRouter(t, mailer)
+	body = get(router, "/.well-known/openid-configuration").Body.String()
+	if !strings.Contains(body, `"request_parameter_supported":true`) || !strings.Contains(body, `"request_object_signing_alg_values_supported":["RS256"`) {
+		t.Errorf("with client keys, the discovery document is %s", body)
+	}
+}
+
+func TestParseClientKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := parseClientKeys(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+	if err != nil || len(set.Keys) != 1 || set.Keys[0].KeyID != "" {
+		t.Errorf("parseClientKeys of a PEM public key returned (%+v, %v)", set, err)
+	}
+
+	private := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	for _, data := range []string{"", "bogus", `{"keys": []}`, string(private)} {
+		if _, err := parseClientKeys([]byte(data)); err == nil {
+			t.Errorf("parseClientKeys(%q) unexpectedly succeeded", data)
+		}
+	}
+}
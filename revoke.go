@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Blocklist records the jti claims of id_tokens which were revoked before they
+// expired. Entries are only kept until the token would have expired anyway.
+//
+// It's kept in memory, so revocations only apply to the instance which
+// received them.
+type Blocklist struct {
+	clock Clock
+
+	mu      sync.Mutex
+	entries map[string]time.Time // Expiry of each revoked jti
+}
+
+// newBlocklist creates an empty Blocklist.
+func newBlocklist() *Blocklist {
+	return &Blocklist{
+		clock:   realClock{},
+		entries: make(map[string]time.Time),
+	}
+}
+
+// Revoke blocks jti until expiry, and forgets any entries which have expired.
+func (b *Blocklist) Revoke(jti string, expiry time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	for k, v := range b.entries {
+		if !now.Before(v) {
+			delete(b.entries, k)
+		}
+	}
+
+	if now.Before(expiry) {
+		b.entries[jti] = expiry
+	}
+}
+
+// Revoked reports whether jti has been revoked. A nil Blocklist has no
+// entries.
+func (b *Blocklist) Revoked(jti string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	expiry, ok := b.entries[jti]
+	return ok && b.clock.Now().Before(expiry)
+}
+
+// revoke creates a handler for token revocation requests, as per RFC 7009.
+//
+// We don't authenticate clients, so anyone holding a token may revoke it.
+// Only valid, unexpired tokens that we issued are added to the Blocklist, so
+// it can't be filled with junk. As the RFC requires, the response is the same
+// either way.
+func revoke(p ProviderConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		token := c.PostForm("token")
+		if token == "" {
+			oauthError(c, 400, "invalid_request", "missing_token", "token is required")
+			return
+		}
+
+		if claims, err := parseIDToken(p, token); err == nil && claims.JWTID != "" {
+			p.Revoked.Revoke(claims.JWTID, time.Unix(claims.Expiry, 0))
+		}
+
+		c.Status(200)
+	}
+}
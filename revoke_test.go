@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBlocklist(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	b := newBlocklist()
+	b.clock = clock
+
+	b.Revoke("foo", clock.Now().Add(time.Minute))
+	b.Revoke("expired", clock.Now().Add(-time.Minute))
+
+	if !b.Revoked("foo") {
+		t.Error("Blocklist.Revoked returned false for a revoked jti")
+	}
+	if b.Revoked("bar") || b.Revoked("expired") {
+		t.Error("Blocklist.Revoked returned true for a jti which isn't blocked")
+	}
+
+	// Entries are forgotten once their tokens would have expired
+	clock.Advance(time.Minute)
+	b.Revoke("baz", clock.Now().Add(time.Minute))
+	if b.Revoked("foo") || len(b.entries) != 1 {
+		t.Errorf("Blocklist kept %d entries after foo expired, instead of 1", len(b.entries))
+	}
+
+	var unconfigured *Blocklist
+	if unconfigured.Revoked("foo") {
+		t.Error("a nil Blocklist returned true")
+	}
+}
+
+func TestMintIDTokenJTI(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}
+
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		token, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example"}, "foo@example.com", AMR_EMAIL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims, err := parseIDToken(p, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.JWTID == "" || seen[claims.JWTID] {
+			t.Errorf("minted an id_token with jti %q, which isn't unique", claims.JWTID)
+		}
+		seen[claims.JWTID] = true
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Revoked: newBlocklist()}
+
+	router := gin.New()
+	oidcAddRoutes(router, p)
+
+	token, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example"}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example"}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseIDToken(p, token); err != nil {
+		t.Fatalf("parseIDToken rejected a valid id_token: %s", err)
+	}
+
+	if w := postForm(router, "/revoke", url.Values{"token": {token}}); w.Code != 200 {
+		t.Fatalf("POST /revoke returned %d: %s", w.Code, w.Body.String())
+	}
+
+	if _, err := parseIDToken(p, token); err == nil {
+		t.Error("parseIDToken accepted a revoked id_token")
+	}
+	if _, err := parseIDToken(p, other); err != nil {
+		t.Errorf("revoking one id_token revoked another: %s", err)
+	}
+
+	// Revoking again, or revoking something else, looks the same
+	if w := postForm(router, "/revoke", url.Values{"token": {token}}); w.Code != 200 {
+		t.Errorf("POST /revoke for a revoked token returned %d", w.Code)
+	}
+	if w := postForm(router, "/revoke", url.Values{"token": {"bogus"}}); w.Code != 200 {
+		t.Errorf("POST /revoke for a bogus token returned %d", w.Code)
+	}
+
+	if w := postForm(router, "/revoke", url.Values{}); w.Code != 400 || !strings.Contains(w.Body.String(), `"error":"invalid_request"`) {
+		t.Errorf("POST /revoke without a token returned %d instead of 400: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRevokeForeignToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Revoked: newBlocklist()}
+	router := gin.New()
+	oidcAddRoutes(router, p)
+
+	// Tokens signed by someone else don't go on the Blocklist
+	forged := p
+	forged.Key = otherKey
+	token, err := mintIDToken(forged, AuthRequest{ClientID: "https://client.example"}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := postForm(router, "/revoke", url.Values{"token": {token}}); w.Code != 200 {
+		t.Errorf("POST /revoke for a forged token returned %d instead of 200", w.Code)
+	}
+	if len(p.Revoked.entries) != 0 {
+		t.Errorf("POST /revoke for a forged token added it to the Blocklist")
+	}
+}
+
+func TestRevokeDisabled(t *testing.T) {
+	router, _ := newEmailTestRouter(t, &fakeMailer{})
+
+	if w := postForm(router, "/revoke", url.Values{"token": {"anything"}}); w.Code != 404 {
+		t.Errorf("POST /revoke without a Blocklist returned %d instead of 404", w.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/square/go-jose"
+)
+
+// newTestServer serves the OpenID Connect routes over real HTTP, as main
+// does, with an EmailAuthenticator which doesn't send anything. It returns
+// the server and its signing key.
+func newTestServer(t *testing.T) (*httptest.Server, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(gin.Recovery(), accessLog(io.Discard, LOG_TEXT), usePages(defaultPages))
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME)))
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	return server, key
+}
+
+// localURL maps one of the issuer's urls onto server, which isn't really
+// at the issuer's origin.
+func localURL(t *testing.T, server *httptest.Server, uri string) string {
+	if !strings.HasPrefix(uri, "https://issuer.example/") {
+		t.Fatalf("%q is not under the issuer", uri)
+	}
+	return server.URL + strings.TrimPrefix(uri, "https://issuer.example")
+}
+
+func TestServerDiscovery(t *testing.T) {
+	server, key := newTestServer(t)
+
+	resp, err := http.Get(server.URL + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET /.well-known/openid-configuration returned %d", resp.StatusCode)
+	}
+
+	var document struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		JwksURI               string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		t.Fatalf("discovery document is not valid JSON: %s", err)
+	}
+
+	if document.Issuer != "https://issuer.example" {
+		t.Errorf("discovery document has issuer %q", document.Issuer)
+	}
+
+	// The advertised jwks_uri serves our key
+	resp, err = http.Get(localURL(t, server, document.JwksURI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET %s returned %d", document.JwksURI, resp.StatusCode)
+	}
+
+	var keys jose.JsonWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		t.Fatalf("%s is not a JWK Set: %s", document.JwksURI, err)
+	}
+	if len(keys.Key(generateKid(key.Public()))) != 1 {
+		t.Errorf("%s doesn't include the signing key", document.JwksURI)
+	}
+
+	// As does the advertised authorization_endpoint
+	resp, err = http.PostForm(localURL(t, server, document.AuthorizationEndpoint), url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		t.Errorf("POST %s returned 404", document.AuthorizationEndpoint)
+	}
+}
+
+func TestServerAuthorize(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, err := http.Get(server.URL + "/authorize?" + validAuthForm().Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 200 || !strings.Contains(string(body), "Check your email") {
+		t.Errorf("GET /authorize with a valid request returned %d: %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Request-ID") == "" {
+		t.Error("GET /authorize response has no X-Request-ID")
+	}
+
+	// And an invalid one doesn't get that far
+	form := validAuthForm()
+	form.Set("redirect_uri", "https://evil.example/callback")
+	resp, err = http.Get(server.URL + "/authorize?" + form.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 400 {
+		t.Errorf("GET /authorize with an untrusted redirect_uri returned %d instead of 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoSession is returned when loading a session that doesn't exist, or
+// which has expired.
+var ErrNoSession = errors.New("No such session, or it has expired")
+
+// ErrSessionUsed is returned when consuming a session which has already been
+// consumed, or whose nonce has already been used by the same client.
+var ErrSessionUsed = errors.New("This session has already been used")
+
+// SessionStore persists pending authorization requests between the initial
+// request to authorize and the step which completes authentication.
+type SessionStore interface {
+	Save(id string, req AuthRequest) error
+	Load(id string) (AuthRequest, error)
+	Delete(id string)
+
+	// Consume atomically loads a session and marks it as used, so that it
+	// can finish at most one login. Used sessions are remembered until they
+	// expire, along with their nonce, so that replays can be told apart
+	// from bad ids and a client's nonce can't complete two logins.
+	Consume(id string) (AuthRequest, error)
+}
+
+// MemorySessionStore is a SessionStore which keeps sessions in memory, so they
+// are lost on restart and not shared between instances.
+type MemorySessionStore struct {
+	ttl   time.Duration
+	clock Clock
+	max   int // The most sessions held at once, or zero for no limit
+
+	mu         sync.Mutex
+	sessions   map[string]memorySession
+	order      *list.List           // Of session ids, oldest first
+	usedNonces map[string]time.Time // By client_id and nonce, until they expire
+	lastSweep  time.Time
+	evictions  int
+}
+
+// memorySession is an AuthRequest, the time at which it expires, whether it
+// has been consumed, and its place in the order sessions were saved.
+type memorySession struct {
+	req     AuthRequest
+	expires time.Time
+	used    bool
+	elem    *list.Element
+}
+
+// newMemorySessionStore creates a MemorySessionStore where sessions expire
+// after ttl.
+func newMemorySessionStore(ttl time.Duration) *MemorySessionStore {
+	return &MemorySessionStore{
+		ttl:        ttl,
+		clock:      realClock{},
+		sessions:   make(map[string]memorySession),
+		order:      list.New(),
+		usedNonces: make(map[string]time.Time),
+	}
+}
+
+// limit caps the number of sessions held at max, so that a flood of logins
+// which are never finished can't exhaust memory. Once there are max sessions,
+// saving another evicts the oldest, whether it's pending or consumed.
+func (s *MemorySessionStore) limit(max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.max = max
+}
+
+// Save stores req as session id, replacing any existing session with that id,
+// and evicting the oldest sessions if the store is full.
+func (s *MemorySessionStore) Save(id string, req AuthRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	s.sweep(now)
+
+	if existing, ok := s.sessions[id]; ok {
+		s.remove(id, existing)
+	}
+	for s.max > 0 && len(s.sessions) >= s.max {
+		oldest := s.order.Front().Value.(string)
+		s.remove(oldest, s.sessions[oldest])
+		s.evictions++
+	}
+
+	s.sessions[id] = memorySession{req, now.Add(s.ttl), false, s.order.PushBack(id)}
+
+	return nil
+}
+
+// Load retrieves session id, if it exists, has not expired, and has not been
+// consumed.
+func (s *MemorySessionStore) Load(id string) (AuthRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || !s.clock.Now().Before(session.expires) {
+		return AuthRequest{}, ErrNoSession
+	}
+
+	if session.used {
+		return AuthRequest{}, ErrSessionUsed
+	}
+
+	return session.req, nil
+}
+
+// Consume retrieves session id like Load, and marks it and its nonce as used.
+func (s *MemorySessionStore) Consume(id string) (AuthRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	session, ok := s.sessions[id]
+	if !ok || !now.Before(session.expires) {
+		return AuthRequest{}, ErrNoSession
+	}
+
+	if session.used {
+		return AuthRequest{}, ErrSessionUsed
+	}
+
+	if session.req.Nonce != "" {
+		nonceKey := session.req.ClientID + " " + session.req.Nonce
+		if expires, ok := s.usedNonces[nonceKey]; ok && now.Before(expires) {
+			return AuthRequest{}, ErrSessionUsed
+		}
+		s.usedNonces[nonceKey] = session.expires
+	}
+
+	session.used = true
+	s.sessions[id] = session
+
+	return session.req, nil
+}
+
+// Delete removes session id.
+func (s *MemorySessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[id]; ok {
+		s.remove(id, session)
+	}
+}
+
+// remove forgets session id. The caller must hold s.mu.
+func (s *MemorySessionStore) remove(id string, session memorySession) {
+	s.order.Remove(session.elem)
+	delete(s.sessions, id)
+}
+
+// Len returns the number of sessions held, including any stale ones which
+// haven't been swept yet.
+func (s *MemorySessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sessions)
+}
+
+// Pending returns the number of sessions which have been neither consumed nor
+// expired.
+func (s *MemorySessionStore) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now, n := s.clock.Now(), 0
+	for _, session := range s.sessions {
+		if !session.used && now.Before(session.expires) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Evictions returns the number of sessions which have been evicted to make
+// room for newer ones.
+func (s *MemorySessionStore) Evictions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.evictions
+}
+
+// sweep discards expired sessions, at most once per ttl. The caller must hold s.mu.
+func (s *MemorySessionStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.ttl {
+		return
+	}
+
+	for id, session := range s.sessions {
+		if !now.Before(session.expires) {
+			s.remove(id, session)
+		}
+	}
+
+	for nonceKey, expires := range s.usedNonces {
+		if !now.Before(expires) {
+			delete(s.usedNonces, nonceKey)
+		}
+	}
+
+	s.lastSweep = now
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/callahad/authdaemon/internal/validation"
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisConfig describes how to connect to Redis for session storage. If
+// Address is empty, sessions are kept in memory instead.
+type RedisConfig struct {
+	Address  string `json:"address" env:"AUTHDAEMON_REDIS_ADDRESS"`
+	Password string `json:"password" env:"AUTHDAEMON_REDIS_PASSWORD"`
+	DB       int    `json:"db" env:"AUTHDAEMON_REDIS_DB"`
+}
+
+// RedisSessionStore is a SessionStore which keeps sessions in Redis, so that
+// several instances behind a load balancer can share them. Sessions are
+// stored as JSON, and expire through Redis key TTLs. It requires Redis 6.2 or
+// later, for SET's GET option.
+type RedisSessionStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// Key prefixes, to keep our keys apart from anything else in the database
+const (
+	redisSessionPrefix = "authdaemon:session:"
+	redisNoncePrefix   = "authdaemon:nonce:"
+)
+
+// redisUsed replaces the value of a consumed session. It isn't valid JSON, so
+// it can't be mistaken for an AuthRequest.
+const redisUsed = "used"
+
+// redisTimeout bounds each call to Redis, so a dead server fails requests
+// rather than hanging them.
+const redisTimeout = 5 * time.Second
+
+// newRedisSessionStore creates a RedisSessionStore where sessions expire after
+// ttl. It doesn't connect until the store is first used.
+func newRedisSessionStore(config RedisConfig, ttl time.Duration) *RedisSessionStore {
+	return &RedisSessionStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:         config.Address,
+			Password:     config.Password,
+			DB:           config.DB,
+			DialTimeout:  redisTimeout,
+			ReadTimeout:  redisTimeout,
+			WriteTimeout: redisTimeout,
+		}),
+		ttl: ttl,
+	}
+}
+
+// Save stores req as session id, replacing any existing session with that id.
+func (s *RedisSessionStore) Save(id string, req AuthRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	return s.client.Set(ctx, redisSessionPrefix+id, data, s.ttl).Err()
+}
+
+// Load retrieves session id, if it exists, has not expired, and has not been
+// consumed.
+func (s *RedisSessionStore) Load(id string) (AuthRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, redisSessionPrefix+id).Result()
+	if err == redis.Nil {
+		return AuthRequest{}, ErrNoSession
+	}
+	if err != nil {
+		return AuthRequest{}, err
+	}
+
+	return decodeRedisSession(data)
+}
+
+// Consume retrieves session id like Load, and marks it and its nonce as used.
+// Marking the session swaps out its value in a single command, so that only
+// one of several concurrent calls can succeed, even across instances.
+func (s *RedisSessionStore) Consume(id string) (AuthRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	// Only replace existing sessions, keeping their expiry
+	data, err := s.client.SetArgs(ctx, redisSessionPrefix+id, redisUsed, redis.SetArgs{
+		Mode:    "XX",
+		Get:     true,
+		KeepTTL: true,
+	}).Result()
+	if err == redis.Nil {
+		return AuthRequest{}, ErrNoSession
+	}
+	if err != nil {
+		return AuthRequest{}, err
+	}
+
+	req, err := decodeRedisSession(data)
+	if err != nil {
+		return AuthRequest{}, err
+	}
+
+	// The nonce needn't be remembered for longer than a session could last
+	if req.Nonce != "" {
+		fresh, err := s.client.SetNX(ctx, redisNoncePrefix+req.ClientID+" "+req.Nonce, 1, s.ttl).Result()
+		if err != nil {
+			return AuthRequest{}, err
+		}
+		if !fresh {
+			return AuthRequest{}, ErrSessionUsed
+		}
+	}
+
+	return req, nil
+}
+
+// Delete removes session id.
+func (s *RedisSessionStore) Delete(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	s.client.Del(ctx, redisSessionPrefix+id)
+}
+
+// Ping checks that Redis is reachable, for readiness checks.
+func (s *RedisSessionStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	return s.client.Ping(ctx).Err()
+}
+
+// Close disconnects from Redis.
+func (s *RedisSessionStore) Close() error {
+	return s.client.Close()
+}
+
+// validRedisAddress checks that address is a host and port.
+func validRedisAddress(address string) bool {
+	_, port, err := net.SplitHostPort(address)
+	return err == nil && port != "" && validation.ValidPort(port)
+}
+
+// decodeRedisSession parses a stored session, which may have been consumed.
+func decodeRedisSession(data string) (AuthRequest, error) {
+	if data == redisUsed {
+		return AuthRequest{}, ErrSessionUsed
+	}
+
+	var req AuthRequest
+	err := json.Unmarshal([]byte(data), &req)
+	return req, err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisStore returns a RedisSessionStore backed by an in-process Redis.
+func newTestRedisStore(t *testing.T) (*RedisSessionStore, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	store := newRedisSessionStore(RedisConfig{Address: server.Addr()}, time.Minute)
+	t.Cleanup(func() { store.Close() })
+	return store, server
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	req := AuthRequest{ClientID: "https://client.example", State: "xyzzy", Nonce: "n-0S6_WzA2Mj"}
+
+	if _, err := store.Load("missing"); err != ErrNoSession {
+		t.Errorf("Load of a missing session returned %v instead of ErrNoSession", err)
+	}
+
+	if err := store.Save("abc", req); err != nil {
+		t.Fatalf("Save returned an error: %s", err)
+	}
+
+	loaded, err := store.Load("abc")
+	if err != nil {
+		t.Fatalf("Load returned an error: %s", err)
+	}
+
+	if loaded != req {
+		t.Errorf("Load returned %+v instead of %+v", loaded, req)
+	}
+
+	// Sessions are stored as JSON, with a TTL matching their expiry
+	data, err := server.Get(redisSessionPrefix + "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored AuthRequest
+	if err := json.Unmarshal([]byte(data), &stored); err != nil || stored != req {
+		t.Errorf("session is stored as %q, not as JSON", data)
+	}
+
+	if ttl := server.TTL(redisSessionPrefix + "abc"); ttl != time.Minute {
+		t.Errorf("session has a TTL of %s instead of 1m", ttl)
+	}
+
+	store.Delete("abc")
+	if _, err := store.Load("abc"); err != ErrNoSession {
+		t.Errorf("Load of a deleted session returned %v instead of ErrNoSession", err)
+	}
+}
+
+func TestRedisSessionStoreExpiry(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	store.Save("old", AuthRequest{State: "old"})
+
+	server.FastForward(59 * time.Second)
+	if _, err := store.Load("old"); err != nil {
+		t.Errorf("Load of a session before its expiry returned %v", err)
+	}
+
+	server.FastForward(time.Second)
+	if _, err := store.Load("old"); err != ErrNoSession {
+		t.Errorf("Load of an expired session returned %v instead of ErrNoSession", err)
+	}
+
+	if _, err := store.Consume("old"); err != ErrNoSession {
+		t.Errorf("Consume of an expired session returned %v instead of ErrNoSession", err)
+	}
+}
+
+func TestRedisConsumeSession(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	store.Save("abc", AuthRequest{State: "xyzzy"})
+
+	req, err := store.Consume("abc")
+	if err != nil || req.State != "xyzzy" {
+		t.Errorf("Consume returned (%+v, %v)", req, err)
+	}
+
+	if _, err := store.Consume("abc"); err != ErrSessionUsed {
+		t.Errorf("second Consume returned %v instead of ErrSessionUsed", err)
+	}
+
+	if _, err := store.Load("abc"); err != ErrSessionUsed {
+		t.Errorf("Load of a consumed session returned %v instead of ErrSessionUsed", err)
+	}
+
+	if _, err := store.Consume("missing"); err != ErrNoSession {
+		t.Errorf("Consume of a missing session returned %v instead of ErrNoSession", err)
+	}
+
+	// Consuming a session doesn't extend its life, or create missing ones
+	server.FastForward(30 * time.Second)
+	if ttl := server.TTL(redisSessionPrefix + "abc"); ttl != 30*time.Second {
+		t.Errorf("consumed session has a TTL of %s instead of 30s", ttl)
+	}
+
+	if server.Exists(redisSessionPrefix + "missing") {
+		t.Error("Consume of a missing session created it")
+	}
+}
+
+func TestRedisConsumeSessionNonceReplay(t *testing.T) {
+	store, server := newTestRedisStore(t)
+
+	req := AuthRequest{ClientID: "https://client.example", Nonce: "n-0S6_WzA2Mj"}
+	store.Save("first", req)
+	store.Save("second", req)
+	store.Save("other", AuthRequest{ClientID: "https://other.example", Nonce: "n-0S6_WzA2Mj"})
+
+	if _, err := store.Consume("first"); err != nil {
+		t.Fatalf("Consume returned %v", err)
+	}
+
+	if _, err := store.Consume("second"); err != ErrSessionUsed {
+		t.Errorf("Consume of a session with a used nonce returned %v instead of ErrSessionUsed", err)
+	}
+
+	if _, err := store.Consume("other"); err != nil {
+		t.Errorf("Consume of another client's session with the same nonce returned %v", err)
+	}
+
+	// Used nonces expire along with their sessions
+	server.FastForward(time.Minute)
+	store.Save("third", req)
+	if _, err := store.Consume("third"); err != nil {
+		t.Errorf("Consume after the used nonce expired returned %v", err)
+	}
+}
+
+func TestRedisConsumeSessionConcurrently(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	store.Save("abc", AuthRequest{State: "xyzzy"})
+
+	results := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := store.Consume("abc")
+			results <- err
+		}()
+	}
+
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		if <-results == nil {
+			succeeded++
+		}
+	}
+
+	if succeeded != 1 {
+		t.Errorf("%d concurrent Consumes of one session succeeded instead of 1", succeeded)
+	}
+}
+
+func TestRedisSessionStorePing(t *testing.T) {
+	store, server := newTestRedisStore(t)
+
+	if err := store.Ping(); err != nil {
+		t.Errorf("Ping returned an error: %s", err)
+	}
+
+	server.Close()
+	store.Close()
+	if err := store.Ping(); err == nil {
+		t.Error("Ping of a stopped server unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	store := newMemorySessionStore(time.Minute)
+	req := AuthRequest{ClientID: "https://client.example", State: "xyzzy", Nonce: "n-0S6_WzA2Mj"}
+
+	if _, err := store.Load("missing"); err != ErrNoSession {
+		t.Errorf("Load of a missing session returned %v instead of ErrNoSession", err)
+	}
+
+	if err := store.Save("abc", req); err != nil {
+		t.Fatalf("Save returned an error: %s", err)
+	}
+
+	loaded, err := store.Load("abc")
+	if err != nil {
+		t.Fatalf("Load returned an error: %s", err)
+	}
+
+	if loaded != req {
+		t.Errorf("Load returned %+v instead of %+v", loaded, req)
+	}
+
+	store.Delete("abc")
+	if _, err := store.Load("abc"); err != ErrNoSession {
+		t.Errorf("Load of a deleted session returned %v instead of ErrNoSession", err)
+	}
+}
+
+func TestMemorySessionStoreExpiry(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	store := newMemorySessionStore(time.Minute)
+	store.clock = clock
+
+	store.Save("old", AuthRequest{State: "old"})
+
+	clock.Advance(59 * time.Second)
+	if _, err := store.Load("old"); err != nil {
+		t.Errorf("Load of a session before its expiry returned %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if _, err := store.Load("old"); err != ErrNoSession {
+		t.Errorf("Load of an expired session returned %v instead of ErrNoSession", err)
+	}
+
+	// Saving sweeps out stale sessions
+	store.Save("new", AuthRequest{State: "new"})
+	if n := store.Len(); n != 1 {
+		t.Errorf("store holds %d sessions after sweeping instead of 1", n)
+	}
+
+	if _, err := store.Load("new"); err != nil {
+		t.Errorf("Load of a fresh session returned %v", err)
+	}
+}
+
+func TestMemorySessionStoreLimit(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	store := newMemorySessionStore(time.Minute)
+	store.clock = clock
+	store.limit(3)
+
+	for _, id := range []string{"a", "b", "c"} {
+		store.Save(id, AuthRequest{State: id})
+		clock.Advance(time.Second)
+	}
+	store.Consume("a")
+
+	// Replacing a session doesn't count against the limit, but does make it the newest
+	store.Save("a", AuthRequest{State: "a again"})
+	if n := store.Evictions(); n != 0 {
+		t.Errorf("replacing a session evicted %d", n)
+	}
+
+	store.Save("d", AuthRequest{State: "d"})
+	store.Save("e", AuthRequest{State: "e"})
+
+	if n := store.Len(); n != 3 {
+		t.Errorf("store holds %d sessions instead of its limit of 3", n)
+	}
+	if n := store.Evictions(); n != 2 {
+		t.Errorf("store evicted %d sessions to save 2 past its limit", n)
+	}
+
+	for _, id := range []string{"b", "c"} {
+		if _, err := store.Load(id); err != ErrNoSession {
+			t.Errorf("Load of the evicted session %s returned %v instead of ErrNoSession", id, err)
+		}
+	}
+	for _, id := range []string{"a", "d", "e"} {
+		if _, err := store.Load(id); err != nil {
+			t.Errorf("Load of the newer session %s returned %v", id, err)
+		}
+	}
+
+	// Deleted and swept sessions free up room
+	store.Delete("d")
+	clock.Advance(time.Minute)
+	store.Save("f", AuthRequest{State: "f"})
+	if n := store.Evictions(); n != 2 {
+		t.Errorf("store evicted a session with room to spare, for %d in all", n)
+	}
+	if n := store.Len(); n != 1 {
+		t.Errorf("store holds %d sessions after sweeping instead of 1", n)
+	}
+}
+
+func TestConsumeSession(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	store := newMemorySessionStore(time.Minute)
+	store.clock = clock
+	store.Save("abc", AuthRequest{State: "xyzzy"})
+
+	if n := store.Pending(); n != 1 {
+		t.Errorf("store has %d pending sessions instead of 1", n)
+	}
+
+	req, err := store.Consume("abc")
+	if err != nil || req.State != "xyzzy" {
+		t.Errorf("Consume returned (%+v, %v)", req, err)
+	}
+
+	if n := store.Pending(); n != 0 {
+		t.Errorf("store has %d pending sessions after Consume instead of 0", n)
+	}
+
+	// A consumed session can't be used again, and is reported as such
+	if _, err := store.Consume("abc"); err != ErrSessionUsed {
+		t.Errorf("second Consume returned %v instead of ErrSessionUsed", err)
+	}
+
+	if _, err := store.Load("abc"); err != ErrSessionUsed {
+		t.Errorf("Load of a consumed session returned %v instead of ErrSessionUsed", err)
+	}
+
+	if _, err := store.Consume("missing"); err != ErrNoSession {
+		t.Errorf("Consume of a missing session returned %v instead of ErrNoSession", err)
+	}
+
+	// Once expired, it's forgotten like any other
+	clock.Advance(time.Minute)
+	if _, err := store.Consume("abc"); err != ErrNoSession {
+		t.Errorf("Consume of an expired session returned %v instead of ErrNoSession", err)
+	}
+}
+
+func TestConsumeSessionNonceReplay(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	store := newMemorySessionStore(time.Minute)
+	store.clock = clock
+
+	req := AuthRequest{ClientID: "https://client.example", Nonce: "n-0S6_WzA2Mj"}
+	store.Save("first", req)
+	store.Save("second", req)
+	store.Save("other", AuthRequest{ClientID: "https://other.example", Nonce: "n-0S6_WzA2Mj"})
+
+	if _, err := store.Consume("first"); err != nil {
+		t.Fatalf("Consume returned %v", err)
+	}
+
+	// The client's nonce has been used, even though this session hasn't
+	if _, err := store.Consume("second"); err != ErrSessionUsed {
+		t.Errorf("Consume of a session with a used nonce returned %v instead of ErrSessionUsed", err)
+	}
+
+	// Nonces are only unique per client
+	if _, err := store.Consume("other"); err != nil {
+		t.Errorf("Consume of another client's session with the same nonce returned %v", err)
+	}
+
+	// Used nonces are swept out along with their sessions
+	clock.Advance(time.Minute)
+	store.Save("third", req)
+	if _, err := store.Consume("third"); err != nil {
+		t.Errorf("Consume after the used nonce expired returned %v", err)
+	}
+}
+
+func TestConsumeSessionConcurrently(t *testing.T) {
+	store := newMemorySessionStore(time.Minute)
+	store.Save("abc", AuthRequest{State: "xyzzy"})
+
+	results := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := store.Consume("abc")
+			results <- err
+		}()
+	}
+
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		if <-results == nil {
+			succeeded++
+		}
+	}
+
+	if succeeded != 1 {
+		t.Errorf("%d concurrent Consumes of one session succeeded instead of 1", succeeded)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig describes how to serve HTTPS directly, for deployments without a
+// separate TLS terminator in front of the daemon.
+type TLSConfig struct {
+	// A PEM-encoded certificate chain and private key
+	CertPath string `json:"cert_path" env:"AUTHDAEMON_TLS_CERT_PATH"`
+	KeyPath  string `json:"key_path" env:"AUTHDAEMON_TLS_KEY_PATH"`
+
+	// Or, fetch certificates for the origin from Let's Encrypt, keeping them
+	// in CacheDir so they aren't requested anew on every start.
+	Autocert bool   `json:"autocert" env:"AUTHDAEMON_TLS_AUTOCERT"`
+	CacheDir string `json:"cache_dir" env:"AUTHDAEMON_TLS_CACHE_DIR"`
+}
+
+// enabled reports whether the daemon should serve HTTPS.
+func (t TLSConfig) enabled() bool {
+	return t.Autocert || t.CertPath != "" || t.KeyPath != ""
+}
+
+// serverTLS builds the tls.Config for serving origin, or returns nil if the
+// daemon should serve plain HTTP.
+//
+// Autocert answers ACME TLS-ALPN-01 challenges itself, so the daemon must be
+// reachable on port 443 for certificates to be issued.
+func serverTLS(origin string, t TLSConfig) (*tls.Config, error) {
+	if !t.enabled() {
+		return nil, nil
+	}
+
+	if t.Autocert {
+		host := origin
+		if h, _, err := net.SplitHostPort(origin); err == nil {
+			host = h
+		}
+
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(t.CacheDir),
+			HostPolicy: autocert.HostWhitelist(host),
+		}
+		return manager.TLSConfig(), nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertPath, t.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert creates a self-signed certificate for 127.0.0.1, and returns the
+// paths of its certificate and key files.
+func writeCert(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath
+}
+
+func TestServerTLS(t *testing.T) {
+	certPath, keyPath := writeCert(t)
+
+	// Without any TLS settings, serve plain HTTP
+	if config, err := serverTLS("issuer.example", TLSConfig{}); config != nil || err != nil {
+		t.Errorf("serverTLS without settings returned %v, %v instead of nil", config, err)
+	}
+
+	config, err := serverTLS("issuer.example", TLSConfig{CertPath: certPath, KeyPath: keyPath})
+	if err != nil {
+		t.Fatalf("serverTLS with a certificate returned an error: %s", err)
+	}
+	if len(config.Certificates) != 1 {
+		t.Errorf("serverTLS with a certificate has %d certificates instead of 1", len(config.Certificates))
+	}
+
+	if _, err := serverTLS("issuer.example", TLSConfig{CertPath: keyPath, KeyPath: certPath}); err == nil {
+		t.Error("serverTLS with swapped certificate and key unexpectedly succeeded")
+	}
+
+	config, err = serverTLS("issuer.example:8443", TLSConfig{Autocert: true, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("serverTLS with autocert returned an error: %s", err)
+	}
+	if config.GetCertificate == nil {
+		t.Error("serverTLS with autocert does not fetch certificates")
+	}
+
+	// Autocert must only request certificates for our own origin
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.example"}); err == nil {
+		t.Error("autocert unexpectedly accepted a certificate request for another host")
+	}
+}
+
+func TestRunTLS(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Address = "127.0.0.1"
+	cfg.Port = freePort(t)
+	cfg.TLS.CertPath, cfg.TLS.KeyPath = writeCert(t)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	startRun(t, cfg, client, "https")
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", cfg.Port))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("plain HTTP request to a TLS server returned %d", resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/square/go-jose"
+)
+
+// IDToken represents the claims of an OpenID Connect ID Token, as per
+// http://openid.net/specs/openid-connect-core-1_0.html#IDToken.
+type IDToken struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	IssuedAt      int64  `json:"iat"`
+	NotBefore     int64  `json:"nbf"`
+	Expiry        int64  `json:"exp"`
+	Nonce         string `json:"nonce,omitempty"`
+	JWTID         string `json:"jti"`
+
+	// How the user was verified, as per RFC 8176, and the authentication
+	// context they asked for with acr_values, if any
+	AuthMethods []string `json:"amr,omitempty"`
+	AuthContext string   `json:"acr,omitempty"`
+
+	// Only when the client sent a max_age, as the spec requires
+	AuthTime int64 `json:"auth_time,omitempty"`
+
+	// Only with the scopes which add them, as in ProviderConfig.ScopeClaims
+	PreferredUsername string `json:"preferred_username,omitempty"`
+
+	// Static claims configured by the operator, which are added alongside
+	// the others but never replace them
+	Extra map[string]interface{} `json:"-"`
+}
+
+// reservedClaims are the claims which IDToken sets itself, and which extra
+// claims therefore mustn't use.
+var reservedClaims = []string{
+	"iss", "aud", "sub", "email", "email_verified", "iat", "nbf", "exp", "nonce", "jti",
+	"amr", "acr", "auth_time", "preferred_username",
+}
+
+// validExtraClaims checks that none of claims are reservedClaims.
+func validExtraClaims(claims map[string]interface{}) bool {
+	for name := range claims {
+		if contains(reservedClaims, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultScopeClaims are the claims each scope adds to id_tokens, unless
+// configured otherwise. We have no name to give, so profile only adds the
+// preferred_username we take from the email address.
+var defaultScopeClaims = map[string][]string{
+	"openid":  {"sub"},
+	"email":   {"email", "email_verified"},
+	"profile": {"preferred_username"},
+}
+
+// scopedClaims are the claims which scopes may add. Every id_token has
+// the sub claim, which the spec requires, so openid must always add it.
+var scopedClaims = []string{"sub", "email", "email_verified", "preferred_username"}
+
+// protocolClaims are the claims which don't depend on scopes, and are in
+// every id_token that they apply to.
+var protocolClaims = []string{"iss", "aud", "iat", "nbf", "exp", "jti", "amr", "acr", "auth_time"}
+
+// validScopeClaims checks that scopeClaims only maps supportedScopes to
+// scopedClaims, and that openid adds sub. A nil map means the defaults.
+func validScopeClaims(scopeClaims map[string][]string) bool {
+	if scopeClaims == nil {
+		return true
+	}
+
+	for scope, claims := range scopeClaims {
+		if !contains(supportedScopes, scope) {
+			return false
+		}
+		for _, claim := range claims {
+			if !contains(scopedClaims, claim) {
+				return false
+			}
+		}
+	}
+	return contains(scopeClaims["openid"], "sub")
+}
+
+// supportedClaims returns the claims an id_token may have, given the claims
+// each scope adds, sorted for discovery's claims_supported.
+func supportedClaims(scopeClaims map[string][]string) []string {
+	claims := append([]string(nil), protocolClaims...)
+	for _, added := range scopeClaims {
+		for _, claim := range added {
+			if !contains(claims, claim) {
+				claims = append(claims, claim)
+			}
+		}
+	}
+	sort.Strings(claims)
+	return claims
+}
+
+// grantedClaims returns the claims which req's scopes add.
+func grantedClaims(scopeClaims map[string][]string, req AuthRequest) map[string]bool {
+	granted := map[string]bool{}
+	for scope := range req.scopes() {
+		for _, claim := range scopeClaims[scope] {
+			granted[claim] = true
+		}
+	}
+	return granted
+}
+
+// MarshalJSON encodes the claims, with t.Extra merged in.
+func (t IDToken) MarshalJSON() ([]byte, error) {
+	type claims IDToken // Without this method, so it doesn't recurse
+	encoded, err := json.Marshal(claims(t))
+	if err != nil || len(t.Extra) == 0 {
+		return encoded, err
+	}
+
+	merged := make(map[string]interface{}, len(t.Extra))
+	for name, value := range t.Extra {
+		merged[name] = value
+	}
+	if err := json.Unmarshal(encoded, &merged); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(merged)
+}
+
+// Subject identifier types, as per
+// http://openid.net/specs/openid-connect-core-1_0.html#SubjectIDTypes
+const (
+	SUBJECT_PUBLIC   = "public"   // The sub is the user's email address
+	SUBJECT_PAIRWISE = "pairwise" // The sub is different for each client
+)
+
+// Ways users can prove they control an address, for the amr claim. RFC 8176
+// doesn't register any of these, so they're our own.
+const (
+	AMR_EMAIL     = "email"     // Clicked a confirmation link
+	AMR_GOOGLE    = "google"    // Logged in to Google
+	AMR_DELEGATED = "delegated" // Logged in to their domain's own provider
+	AMR_BYPASS    = "bypass"    // Nothing, with AUTH_BYPASS
+)
+
+// pairwiseSubject derives an opaque sub for the user with the given normalized
+// email, which is stable for each client but can't be correlated across
+// clients without secret.
+func pairwiseSubject(secret string, email string, clientID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	// Neither value can contain a NUL, so this encoding is unambiguous
+	mac.Write([]byte(email + "\x00" + clientID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newIDToken builds the claims asserting that the user controls email, as
+// verified by method, for delivery to the client that made the given
+// authorization request.
+//
+// The iat and nbf claims are backdated by p.Leeway, so that clients whose
+// clocks are slightly behind ours don't reject the token as not yet valid. The
+// exp claim is always p.Lifetime from now.
+//
+// Which of email, email_verified, and preferred_username are included depends
+// on the scopes req asked for, as p.scopeClaims() maps them. All we know
+// about users is their email address, so preferred_username is its local
+// part. We have no name to give.
+//
+// We don't distinguish levels of assurance, so if the client asked for any
+// acr_values, the acr claim is just the first of them.
+//
+// Any p.ExtraClaims are added as they are, for every client.
+func newIDToken(p ProviderConfig, req AuthRequest, email string, method string, now time.Time) IDToken {
+	granted := grantedClaims(p.scopeClaims(), req)
+
+	var address string
+	if granted["email"] {
+		address = email
+	}
+
+	var username string
+	if granted["preferred_username"] {
+		username = email[:strings.LastIndex(email, "@")]
+	}
+
+	// Every login verifies the user afresh, so they authenticated just now
+	var authTime int64
+	if req.MaxAge != "" {
+		authTime = now.Unix()
+	}
+
+	var acr string
+	if values := strings.Fields(req.ACRValues); len(values) > 0 {
+		acr = values[0]
+	}
+
+	issued := now.Add(-p.Leeway).Unix()
+	return IDToken{
+		Issuer:        p.issuer(),
+		Audience:      req.ClientID,
+		Subject:       p.subject(email, req.ClientID),
+		Email:         address,
+		EmailVerified: granted["email_verified"],
+		IssuedAt:      issued,
+		NotBefore:     issued,
+		Expiry:        now.Add(p.Lifetime).Unix(),
+		Nonce:         req.Nonce,
+		AuthTime:      authTime,
+		AuthMethods:   []string{method},
+		AuthContext:   acr,
+
+		PreferredUsername: username,
+		Extra:             p.ExtraClaims,
+	}
+}
+
+// signToken signs claims with an RSA or ECDSA key, returning a compact JWS
+// whose `kid` header matches the key's entry in the published JWK Set.
+func signToken(key crypto.Signer, claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	alg := signingAlg(key)
+	jwk := jose.JsonWebKey{
+		Key:       key,
+		KeyID:     generateKid(key.Public()),
+		Algorithm: alg,
+	}
+
+	signer, err := jose.NewSigner(jose.SignatureAlgorithm(alg), &jwk)
+	if err != nil {
+		return "", err
+	}
+
+	// Identify the key by `kid` rather than embedding the whole JWK.
+	signer.SetEmbedJwk(false)
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return jws.CompactSerialize()
+}
+
+// mintIDToken creates a signed id_token for a user who has proven control of
+// email, by method, while completing the given authorization request. It's
+// recorded in p.Tokens, if that's set.
+func mintIDToken(p ProviderConfig, req AuthRequest, email string, method string) (string, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	claims := newIDToken(p, req, email, method, p.now())
+	claims.JWTID = jti
+	token, err := signToken(p.signingKey(), claims)
+	if err != nil {
+		return "", err
+	}
+
+	// Operators look records up by email, whether or not the client got it
+	if p.Tokens != nil {
+		record := claims
+		record.Email = email
+		p.Tokens.Record(record)
+	}
+	return token, nil
+}
+
+// parseIDToken verifies that token is an id_token which we issued and which
+// is still valid, and returns its claims.
+func parseIDToken(p ProviderConfig, token string) (IDToken, error) {
+	claims, err := verifyIDToken(p, token)
+	if err != nil {
+		return claims, err
+	}
+
+	now := p.now().Unix()
+	tests := []struct {
+		description string
+		ok          bool
+	}{
+		{"Token has expired", now < claims.Expiry},
+		{"Token is not valid yet", claims.NotBefore <= now},
+	}
+
+	for _, v := range tests {
+		if !v.ok {
+			return claims, errors.New(v.description)
+		}
+	}
+
+	return claims, nil
+}
+
+// verifyIDToken verifies that token is an id_token which we issued and which
+// hasn't been revoked, and returns its claims, whether or not it has expired.
+func verifyIDToken(p ProviderConfig, token string) (IDToken, error) {
+	var claims IDToken
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return claims, errors.New("Malformed token")
+	}
+
+	key := p.verificationKey(jws.Signatures[0].Header.KeyID)
+	if key == nil {
+		return claims, errors.New("No signing key loaded")
+	}
+
+	payload, err := jws.Verify(key.Public())
+	if err != nil {
+		return claims, errors.New("Token signature is invalid")
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("Malformed token claims")
+	}
+
+	tests := []struct {
+		description string
+		ok          bool
+	}{
+		{"Token was issued by someone else", claims.Issuer == p.issuer()},
+		{"Token has been revoked", !p.Revoked.Revoked(claims.JWTID)},
+	}
+
+	for _, v := range tests {
+		if !v.ok {
+			return claims, errors.New(v.description)
+		}
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/square/go-jose"
+)
+
+func TestMintIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := AuthRequest{
+		ClientID: "https://client.example",
+		Scope:    "openid email",
+		Nonce:    "n-0S6_WzA2Mj",
+	}
+
+	before := time.Now().Unix()
+	token, err := mintIDToken(ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: 5 * time.Minute}, req, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatalf("mintIDToken returned an error: %s", err)
+	}
+	after := time.Now().Unix()
+
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("jose.ParseSigned(%q) returned an error: %s", token, err)
+	}
+
+	if kid := jws.Signatures[0].Header.KeyID; kid != generateKid(&key.PublicKey) {
+		t.Errorf("token has kid %q instead of %q", kid, generateKid(&key.PublicKey))
+	}
+
+	if alg := jws.Signatures[0].Header.Algorithm; alg != "RS256" {
+		t.Errorf("token has alg %q instead of RS256", alg)
+	}
+
+	payload, err := jws.Verify(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("token signature did not verify: %s", err)
+	}
+
+	var claims IDToken
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("token payload is not valid JSON: %s", err)
+	}
+
+	tests := []struct {
+		claim    string
+		actual   string
+		expected string
+	}{
+		{"iss", claims.Issuer, "https://issuer.example"},
+		{"aud", claims.Audience, "https://client.example"},
+		{"sub", claims.Subject, "foo@example.com"},
+		{"email", claims.Email, "foo@example.com"},
+		{"nonce", claims.Nonce, "n-0S6_WzA2Mj"},
+	}
+
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("claim %s is %q instead of %q", test.claim, test.actual, test.expected)
+		}
+	}
+
+	if !claims.EmailVerified {
+		t.Error("claim email_verified is false instead of true")
+	}
+
+	if claims.IssuedAt < before || claims.IssuedAt > after {
+		t.Errorf("claim iat is %d, expected between %d and %d", claims.IssuedAt, before, after)
+	}
+
+	if lifetime := claims.Expiry - claims.IssuedAt; lifetime != 300 {
+		t.Errorf("claims exp - iat is %d instead of 300", lifetime)
+	}
+
+	if claims.NotBefore != claims.IssuedAt {
+		t.Errorf("claim nbf is %d instead of matching iat %d", claims.NotBefore, claims.IssuedAt)
+	}
+}
+
+func TestAuthorizeIssuesIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Clock: clock}, newBypassAuthenticator())
+
+	// Once the user is verified, the handler posts a signed id_token to the
+	// client, rather than failing
+	w := postForm(router, "/authorize", validAuthForm())
+	if w.Code != 200 {
+		t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+	}
+
+	action, params := parseFormPost(t, w.Body.String())
+	if action != "https://client.example/callback" || params.Get("state") != "xyzzy" {
+		t.Errorf("POST /authorize posts to %q with state %q", action, params.Get("state"))
+	}
+
+	jws, err := jose.ParseSigned(params.Get("id_token"))
+	if err != nil {
+		t.Fatalf("POST /authorize did not return an id_token: %s", err)
+	}
+	if header := jws.Signatures[0].Header; header.KeyID != generateKid(&key.PublicKey) || header.Algorithm != ALG_RS256 {
+		t.Errorf("id_token has kid %q and alg %q", header.KeyID, header.Algorithm)
+	}
+
+	claims := verifiedClaims(t, params.Get("id_token"), &key.PublicKey)
+	expected := IDToken{
+		Issuer:        "https://issuer.example",
+		Audience:      "https://client.example",
+		Subject:       "foo@example.com",
+		Email:         "foo@example.com",
+		EmailVerified: true,
+		IssuedAt:      1500000000,
+		NotBefore:     1500000000,
+		Expiry:        1500000000 + int64(TOKEN_LIFETIME/time.Second),
+		Nonce:         "n-0S6_WzA2Mj",
+		JWTID:         claims.JWTID,
+		AuthMethods:   []string{AMR_BYPASS},
+	}
+	if claims.JWTID == "" || !reflect.DeepEqual(claims, expected) {
+		t.Errorf("POST /authorize issued the claims %+v instead of %+v", claims, expected)
+	}
+}
+
+func TestNewIDTokenLeeway(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	req := AuthRequest{ClientID: "https://client.example"}
+
+	tests := []struct {
+		lifetime time.Duration
+		leeway   time.Duration
+	}{
+		{10 * time.Minute, 0},
+		{10 * time.Minute, 30 * time.Second},
+		{time.Hour, 2 * time.Minute},
+	}
+
+	for _, test := range tests {
+		p := ProviderConfig{Origin: "issuer.example", Lifetime: test.lifetime, Leeway: test.leeway}
+		claims := newIDToken(p, req, "foo@example.com", AMR_EMAIL, now)
+
+		if expected := now.Add(-test.leeway).Unix(); claims.IssuedAt != expected || claims.NotBefore != expected {
+			t.Errorf("with leeway %s, iat is %d and nbf is %d instead of %d", test.leeway, claims.IssuedAt, claims.NotBefore, expected)
+		}
+
+		if expected := now.Add(test.lifetime).Unix(); claims.Expiry != expected {
+			t.Errorf("with lifetime %s and leeway %s, exp is %d instead of %d", test.lifetime, test.leeway, claims.Expiry, expected)
+		}
+
+		if lifetime := time.Duration(claims.Expiry-claims.IssuedAt) * time.Second; lifetime != test.lifetime+test.leeway {
+			t.Errorf("with lifetime %s and leeway %s, exp - iat is %s", test.lifetime, test.leeway, lifetime)
+		}
+	}
+}
+
+func TestParseIDTokenExpiry(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Clock: clock}
+
+	token, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example"}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := verifiedClaims(t, token, &key.PublicKey)
+	if claims.IssuedAt != 1500000000 || claims.Expiry != 1500000000+int64(TOKEN_LIFETIME/time.Second) {
+		t.Errorf("id_token minted at 1500000000 has iat %d and exp %d", claims.IssuedAt, claims.Expiry)
+	}
+
+	// Tokens are valid up to, but not including, their exp
+	clock.Advance(TOKEN_LIFETIME - time.Second)
+	if _, err := parseIDToken(p, token); err != nil {
+		t.Errorf("parseIDToken rejected a token in the last second of its lifetime: %s", err)
+	}
+
+	clock.Advance(time.Second)
+	if _, err := parseIDToken(p, token); err == nil || err.Error() != "Token has expired" {
+		t.Errorf("parseIDToken returned %v for a token at its exp instead of an expiry error", err)
+	}
+}
+
+func TestMintIDTokenWithoutNonce(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := mintIDToken(ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, AuthRequest{}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatalf("mintIDToken returned an error: %s", err)
+	}
+
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := jws.Verify(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := claims["nonce"]; ok {
+		t.Errorf("token unexpectedly included a nonce claim: %v", claims["nonce"])
+	}
+}
+
+func TestMintIDTokenES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := AuthRequest{ClientID: "https://client.example"}
+	token, err := mintIDToken(ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME}, req, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatalf("mintIDToken returned an error: %s", err)
+	}
+
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if alg := jws.Signatures[0].Header.Algorithm; alg != "ES256" {
+		t.Errorf("token has alg %q instead of ES256", alg)
+	}
+
+	// Verify the token the way a client would, using our published keys
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/jwks.json", nil))
+
+	var jwks jose.JsonWebKeySet
+	if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("GET /jwks.json returned invalid JSON: %s", err)
+	}
+
+	keys := jwks.Key(jws.Signatures[0].Header.KeyID)
+	if len(keys) != 1 {
+		t.Fatalf("GET /jwks.json has %d keys matching the token's kid", len(keys))
+	}
+
+	if keys[0].Algorithm != "ES256" {
+		t.Errorf("published key has alg %q instead of ES256", keys[0].Algorithm)
+	}
+
+	if _, err := jws.Verify(keys[0].Key); err != nil {
+		t.Errorf("token did not verify with the published key: %s", err)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+
+	var config struct {
+		Algs []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Algs) != 1 || config.Algs[0] != "ES256" {
+		t.Errorf("discovery advertises %v instead of ES256", config.Algs)
+	}
+}
+
+func TestPairwiseSubject(t *testing.T) {
+	secret := "correct horse battery staple"
+	sub := pairwiseSubject(secret, "foo@example.com", "https://client.example")
+
+	if again := pairwiseSubject(secret, "foo@example.com", "https://client.example"); again != sub {
+		t.Errorf("pairwiseSubject is not stable: %q then %q", sub, again)
+	}
+
+	others := map[string]string{
+		"another client":       pairwiseSubject(secret, "foo@example.com", "https://other.example"),
+		"another user":         pairwiseSubject(secret, "bar@example.com", "https://client.example"),
+		"another secret":       pairwiseSubject("hunter2hunter2hunter2", "foo@example.com", "https://client.example"),
+		"shifted field bounds": pairwiseSubject(secret, "foo@example.comhttps://client.exampl", "e"),
+	}
+	for description, other := range others {
+		if other == sub {
+			t.Errorf("pairwiseSubject is the same for %s: %q", description, sub)
+		}
+	}
+
+	if strings.Contains(sub, "foo") {
+		t.Errorf("pairwiseSubject %q reveals the email address", sub)
+	}
+}
+
+func TestPairwiseLogin(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	mailer := &fakeMailer{}
+	router := gin.New()
+	store := newMemorySessionStore(SESSION_LIFETIME)
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, PairwiseSecret: "correct horse battery staple"}
+	oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", mailer, store))
+
+	login := func(clientID string, nonce string) IDToken {
+		form := validAuthForm()
+		form.Set("client_id", clientID)
+		form.Set("redirect_uri", clientID+"/callback")
+		form.Set("nonce", nonce)
+		return emailLogin(t, router, mailer, &key.PublicKey, form)
+	}
+
+	first := login("https://client.example", "1")
+	second := login("https://client.example", "2")
+	other := login("https://other.example", "3")
+
+	if first.Subject != second.Subject {
+		t.Errorf("the same client got different subs for the same user: %q and %q", first.Subject, second.Subject)
+	}
+
+	if first.Subject == other.Subject {
+		t.Errorf("different clients got the same sub for the same user: %q", first.Subject)
+	}
+
+	if first.Subject == "foo@example.com" || first.Email != "foo@example.com" {
+		t.Errorf("pairwise id_token has sub %q and email %q", first.Subject, first.Email)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+
+	var config struct {
+		SubjectTypes []string `json:"subject_types_supported"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.SubjectTypes) != 1 || config.SubjectTypes[0] != "pairwise" {
+		t.Errorf("discovery advertises subject types %v instead of pairwise", config.SubjectTypes)
+	}
+}
+
+// verifiedClaims checks that token is signed by key, and returns its claims.
+func verifiedClaims(t *testing.T, token string, key crypto.PublicKey) IDToken {
+	t.Helper()
+
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("response does not contain a valid id_token: %s", err)
+	}
+
+	payload, err := jws.Verify(key)
+	if err != nil {
+		t.Fatalf("id_token signature did not verify: %s", err)
+	}
+
+	var claims IDToken
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	return claims
+}
+
+func TestMintIDTokenExtraClaims(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, ExtraClaims: map[string]interface{}{
+		"tenant": "acme",
+		"env":    "staging",
+		"groups": []string{"admins"},
+	}}
+	token, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example", Scope: "openid email"}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatalf("mintIDToken returned an error: %s", err)
+	}
+
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := jws.Verify(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["tenant"] != "acme" || claims["env"] != "staging" || fmt.Sprint(claims["groups"]) != "[admins]" {
+		t.Errorf("id_token is missing the extra claims: %s", payload)
+	}
+	if claims["email"] != "foo@example.com" || claims["iss"] != "https://issuer.example" {
+		t.Errorf("id_token with extra claims is missing its own: %s", payload)
+	}
+
+	// Even unvalidated, extra claims can't replace ours
+	p.ExtraClaims = map[string]interface{}{"email": "admin@example.com"}
+	if token, err = mintIDToken(p, AuthRequest{ClientID: "https://client.example", Scope: "openid email"}, "foo@example.com", AMR_EMAIL); err != nil {
+		t.Fatal(err)
+	}
+	if parsed := verifiedClaims(t, token, &key.PublicKey); parsed.Email != "foo@example.com" {
+		t.Errorf("an extra email claim replaced the user's with %s", parsed.Email)
+	}
+
+	if validExtraClaims(p.ExtraClaims) {
+		t.Error("validExtraClaims accepted an email claim")
+	}
+	if !validExtraClaims(map[string]interface{}{"tenant": "acme"}) {
+		t.Error("validExtraClaims rejected a tenant claim")
+	}
+}
+
+func TestNewIDTokenAuthContext(t *testing.T) {
+	p := ProviderConfig{Origin: "issuer.example", Lifetime: TOKEN_LIFETIME}
+
+	claims := newIDToken(p, AuthRequest{}, "foo@example.com", AMR_EMAIL, time.Now())
+	if len(claims.AuthMethods) != 1 || claims.AuthMethods[0] != AMR_EMAIL {
+		t.Errorf("amr is %q instead of [%q]", claims.AuthMethods, AMR_EMAIL)
+	}
+	if claims.AuthContext != "" {
+		t.Errorf("without acr_values, acr is %q instead of omitted", claims.AuthContext)
+	}
+
+	// The first requested value is echoed
+	claims = newIDToken(p, AuthRequest{ACRValues: "urn:example:loa:2 urn:example:loa:1"}, "foo@example.com", AMR_EMAIL, time.Now())
+	if claims.AuthContext != "urn:example:loa:2" {
+		t.Errorf("with acr_values, acr is %q instead of urn:example:loa:2", claims.AuthContext)
+	}
+}
+
+func TestNewIDTokenAuthTime(t *testing.T) {
+	p := ProviderConfig{Origin: "issuer.example", Lifetime: TOKEN_LIFETIME, Leeway: time.Minute}
+	now := time.Unix(1500000000, 0)
+
+	if claims := newIDToken(p, AuthRequest{}, "foo@example.com", AMR_EMAIL, now); claims.AuthTime != 0 {
+		t.Errorf("without max_age, auth_time is %d instead of omitted", claims.AuthTime)
+	}
+
+	// auth_time is when the user was verified, which isn't backdated
+	for _, maxAge := range []string{"0", "3600"} {
+		if claims := newIDToken(p, AuthRequest{MaxAge: maxAge}, "foo@example.com", AMR_EMAIL, now); claims.AuthTime != now.Unix() {
+			t.Errorf("with max_age %s, auth_time is %d instead of %d", maxAge, claims.AuthTime, now.Unix())
+		}
+	}
+}
+
+func TestNewIDTokenProfile(t *testing.T) {
+	p := ProviderConfig{Origin: "issuer.example", Lifetime: TOKEN_LIFETIME}
+
+	tests := []struct {
+		scope    string
+		email    string
+		expected string // preferred_username, or empty if it must be omitted
+	}{
+		{"openid email", "foo@example.com", ""},
+		{"openid", "foo@example.com", ""},
+		{"openid email profile", "foo@example.com", "foo"},
+		{"profile openid", "Foo.Bar+baz@example.com", "Foo.Bar+baz"},
+		{"openid profile", `"foo@bar"@example.com`, `"foo@bar"`},
+	}
+
+	for _, test := range tests {
+		claims := newIDToken(p, AuthRequest{Scope: test.scope}, test.email, AMR_EMAIL, time.Now())
+		if claims.PreferredUsername != test.expected {
+			t.Errorf("with scope %q, preferred_username for %s is %q instead of %q", test.scope, test.email, claims.PreferredUsername, test.expected)
+		}
+
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var raw map[string]interface{}
+		if err := json.Unmarshal(payload, &raw); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, claim := range []string{"preferred_username", "name"} {
+			if _, ok := raw[claim]; ok != (claim == "preferred_username" && test.expected != "") {
+				t.Errorf("with scope %q, id_token has unexpected %s claim presence: %v", test.scope, claim, raw)
+			}
+		}
+	}
+}
+
+func TestNewIDTokenScopeClaims(t *testing.T) {
+	// Which claims would be in an id_token for scope, given scopeClaims
+	present := func(scopeClaims map[string][]string, scope string) map[string]bool {
+		p := ProviderConfig{Origin: "issuer.example", Lifetime: TOKEN_LIFETIME, ScopeClaims: scopeClaims}
+		payload, err := json.Marshal(newIDToken(p, AuthRequest{Scope: scope}, "foo@example.com", AMR_EMAIL, time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var raw map[string]interface{}
+		if err := json.Unmarshal(payload, &raw); err != nil {
+			t.Fatal(err)
+		}
+		claims := map[string]bool{}
+		for claim := range raw {
+			claims[claim] = true
+		}
+		return claims
+	}
+
+	tests := []struct {
+		description string
+		scopeClaims map[string][]string
+		scope       string
+		included    []string
+		omitted     []string
+	}{
+		{"only openid", nil, "openid", []string{"sub"}, []string{"email", "email_verified", "preferred_username"}},
+		{"openid and email", nil, "openid email", []string{"sub", "email", "email_verified"}, []string{"preferred_username"}},
+		{"openid and profile", nil, "openid profile", []string{"sub", "preferred_username"}, []string{"email", "email_verified"}},
+		{"email added to openid", map[string][]string{"openid": {"sub", "email"}}, "openid", []string{"sub", "email"}, []string{"email_verified"}},
+		{"email trimmed from email", map[string][]string{"openid": {"sub"}, "email": {"email_verified"}}, "openid email", []string{"sub", "email_verified"}, []string{"email"}},
+		{"profile removed", map[string][]string{"openid": {"sub"}}, "openid email profile", []string{"sub"}, []string{"email", "email_verified", "preferred_username"}},
+	}
+
+	for _, test := range tests {
+		claims := present(test.scopeClaims, test.scope)
+		for _, claim := range test.included {
+			if !claims[claim] {
+				t.Errorf("with %s, the id_token has no %s claim", test.description, claim)
+			}
+		}
+		for _, claim := range test.omitted {
+			if claims[claim] {
+				t.Errorf("with %s, the id_token unexpectedly has a %s claim", test.description, claim)
+			}
+		}
+	}
+}
+
+func TestValidScopeClaims(t *testing.T) {
+	tests := []struct {
+		scopeClaims map[string][]string
+		expected    bool
+	}{
+		{nil, true},
+		{defaultScopeClaims, true},
+		{map[string][]string{"openid": {"sub", "email", "email_verified"}}, true},
+		{map[string][]string{}, false},
+		{map[string][]string{"openid": {"email"}}, false},
+		{map[string][]string{"openid": {"sub"}, "phone": {"email"}}, false},
+		{map[string][]string{"openid": {"sub", "iss"}}, false},
+		{map[string][]string{"openid": {"sub"}, "profile": {"name"}}, false},
+	}
+
+	for _, test := range tests {
+		if actual := validScopeClaims(test.scopeClaims); actual != test.expected {
+			t.Errorf("validScopeClaims(%v) returned %t instead of %t", test.scopeClaims, actual, test.expected)
+		}
+	}
+}
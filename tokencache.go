@@ -0,0 +1,121 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"sync"
+)
+
+// TokenCache remembers the claims of id_tokens which have recently been
+// verified, so that a resource server introspecting the same token over and
+// over doesn't cost a signature check each time. Tokens are keyed by their
+// SHA-256 hash, and kept until they expire or, once the cache is full, until
+// they're the least recently used.
+//
+// Revocation is still checked on every lookup, but a cached token stays valid
+// even if the key which signed it is retired, just as it would for clients
+// which verified it themselves.
+type TokenCache struct {
+	max   int
+	clock Clock
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List // Of *tokenCacheEntry, most recently used first
+}
+
+// tokenCacheEntry is a cached token's hash and claims.
+type tokenCacheEntry struct {
+	key    [sha256.Size]byte
+	claims IDToken
+}
+
+// newTokenCache creates a TokenCache which holds at most max tokens.
+func newTokenCache(max int) *TokenCache {
+	return &TokenCache{
+		max:     max,
+		clock:   realClock{},
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the claims of token, if it's cached and hasn't expired. Expired
+// tokens are forgotten. A nil TokenCache has no entries.
+func (tc *TokenCache) Get(token string) (IDToken, bool) {
+	if tc == nil {
+		return IDToken{}, false
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	elem, ok := tc.entries[sha256.Sum256([]byte(token))]
+	if !ok {
+		return IDToken{}, false
+	}
+
+	entry := elem.Value.(*tokenCacheEntry)
+	if tc.clock.Now().Unix() >= entry.claims.Expiry {
+		tc.remove(elem)
+		return IDToken{}, false
+	}
+
+	tc.order.MoveToFront(elem)
+	return entry.claims, true
+}
+
+// Put caches the claims of token, which must already have been verified,
+// evicting the least recently used token if the cache is full. A nil
+// TokenCache does nothing.
+func (tc *TokenCache) Put(token string, claims IDToken) {
+	if tc == nil || tc.max <= 0 {
+		return
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	key := sha256.Sum256([]byte(token))
+	if elem, ok := tc.entries[key]; ok {
+		tc.remove(elem)
+	}
+	for len(tc.entries) >= tc.max {
+		tc.remove(tc.order.Back())
+	}
+
+	tc.entries[key] = tc.order.PushFront(&tokenCacheEntry{key, claims})
+}
+
+// remove forgets a cached token. The caller must hold tc.mu.
+func (tc *TokenCache) remove(elem *list.Element) {
+	tc.order.Remove(elem)
+	delete(tc.entries, elem.Value.(*tokenCacheEntry).key)
+}
+
+// Len returns the number of tokens cached, including any which have expired
+// but haven't been looked up since.
+func (tc *TokenCache) Len() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	return len(tc.entries)
+}
+
+// cachedIDToken is like parseIDToken, but looks token up in p.TokenCache
+// first, and caches it once it's verified.
+func cachedIDToken(p ProviderConfig, token string) (IDToken, error) {
+	if claims, ok := p.TokenCache.Get(token); ok {
+		if p.Revoked.Revoked(claims.JWTID) {
+			return claims, errors.New("Token has been revoked")
+		}
+		return claims, nil
+	}
+
+	claims, err := parseIDToken(p, token)
+	if err == nil {
+		p.TokenCache.Put(token, claims)
+	}
+	return claims, err
+}
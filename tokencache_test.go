@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenCacheLRU(t *testing.T) {
+	cache := newTokenCache(2)
+	expiry := time.Now().Add(time.Hour).Unix()
+
+	cache.Put("first", IDToken{JWTID: "1", Expiry: expiry})
+	cache.Put("second", IDToken{JWTID: "2", Expiry: expiry})
+
+	// Looking one up makes it the most recently used
+	if claims, ok := cache.Get("first"); !ok || claims.JWTID != "1" {
+		t.Fatalf("Get of a cached token returned (%+v, %t)", claims, ok)
+	}
+
+	cache.Put("third", IDToken{JWTID: "3", Expiry: expiry})
+	if cache.Len() != 2 {
+		t.Errorf("a cache of 2 holds %d tokens", cache.Len())
+	}
+	if _, ok := cache.Get("second"); ok {
+		t.Error("the least recently used token wasn't evicted")
+	}
+	for _, token := range []string{"first", "third"} {
+		if _, ok := cache.Get(token); !ok {
+			t.Errorf("token %s was evicted instead of the least recently used", token)
+		}
+	}
+
+	// Caching a token again replaces it, rather than taking more room
+	cache.Put("third", IDToken{JWTID: "3b", Expiry: expiry})
+	if claims, _ := cache.Get("third"); claims.JWTID != "3b" || cache.Len() != 2 {
+		t.Errorf("caching a token again left %+v, with %d tokens cached", claims, cache.Len())
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	cache := newTokenCache(10)
+	cache.clock = clock
+
+	cache.Put("token", IDToken{Expiry: clock.Now().Add(time.Minute).Unix()})
+	if _, ok := cache.Get("token"); !ok {
+		t.Fatal("Get of an unexpired token missed")
+	}
+
+	clock.Advance(time.Minute)
+	if _, ok := cache.Get("token"); ok {
+		t.Error("Get of an expired token hit")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("the expired token is still cached, with %d tokens", cache.Len())
+	}
+}
+
+func TestTokenCacheNil(t *testing.T) {
+	var cache *TokenCache
+	cache.Put("token", IDToken{Expiry: time.Now().Add(time.Hour).Unix()})
+	if _, ok := cache.Get("token"); ok {
+		t.Error("a nil TokenCache returned a token")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Where records of issued id_tokens may be kept
+const (
+	TOKEN_LOG_MEMORY = "memory" // Lost on restart, and only covers this instance
+	TOKEN_LOG_SQLITE = "sqlite" // In a SQLite database at token_log.path
+)
+
+// TOKEN_LOG_RETENTION is how long records of issued id_tokens are kept by
+// default.
+const TOKEN_LOG_RETENTION = 24 * time.Hour
+
+// TokenLogConfig describes where to keep records of issued id_tokens.
+type TokenLogConfig struct {
+	// Either "memory" or "sqlite". If empty, nothing is recorded.
+	Store string `json:"store" env:"AUTHDAEMON_TOKEN_LOG_STORE"`
+
+	// The SQLite database file, which is created if it doesn't exist
+	Path string `json:"path" env:"AUTHDAEMON_TOKEN_LOG_PATH"`
+
+	// How long after being issued records are deleted
+	Retention Duration `json:"retention" env:"AUTHDAEMON_TOKEN_LOG_RETENTION"`
+}
+
+// TokenRecord describes an issued id_token, without the token itself.
+type TokenRecord struct {
+	JWTID    string    `json:"jti"`
+	Email    string    `json:"email"`
+	Subject  string    `json:"sub"`
+	Audience string    `json:"aud"`
+	IssuedAt time.Time `json:"iat"`
+	Expiry   time.Time `json:"exp"`
+}
+
+// newTokenRecord takes the metadata worth keeping from claims.
+func newTokenRecord(claims IDToken) TokenRecord {
+	return TokenRecord{
+		JWTID:    claims.JWTID,
+		Email:    claims.Email,
+		Subject:  claims.Subject,
+		Audience: claims.Audience,
+		IssuedAt: time.Unix(claims.IssuedAt, 0).UTC(),
+		Expiry:   time.Unix(claims.Expiry, 0).UTC(),
+	}
+}
+
+// TokenLog keeps records of the id_tokens we issue, so that operators can
+// find out which were issued for a user.
+type TokenLog interface {
+	// Record notes that an id_token with claims was issued. Failures are
+	// logged rather than returned, as the user has already logged in.
+	Record(claims IDToken)
+
+	// Query returns the records of id_tokens issued for email since the
+	// given time, oldest first.
+	Query(email string, since time.Time) ([]TokenRecord, error)
+}
+
+// newTokenLog creates the TokenLog described by config, or returns nil if
+// config.Store is empty.
+func newTokenLog(config TokenLogConfig) (TokenLog, error) {
+	switch config.Store {
+	case TOKEN_LOG_MEMORY:
+		return newMemoryTokenLog(config.Retention.Duration), nil
+	case TOKEN_LOG_SQLITE:
+		l, err := newSQLiteTokenLog(config.Path, config.Retention.Duration)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	return nil, nil
+}
+
+// MemoryTokenLog is a TokenLog which keeps records in memory.
+type MemoryTokenLog struct {
+	retention time.Duration
+	clock     Clock
+
+	mu      sync.Mutex
+	records []TokenRecord // In the order they were recorded
+}
+
+// newMemoryTokenLog creates a MemoryTokenLog which forgets records once they
+// were issued longer than retention ago.
+func newMemoryTokenLog(retention time.Duration) *MemoryTokenLog {
+	return &MemoryTokenLog{retention: retention, clock: realClock{}}
+}
+
+// Record keeps a record of an id_token, and forgets any which have been kept
+// for long enough.
+func (l *MemoryTokenLog) Record(claims IDToken) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := l.clock.Now().Add(-l.retention)
+	kept := l.records[:0]
+	for _, record := range l.records {
+		if !record.IssuedAt.Before(cutoff) {
+			kept = append(kept, record)
+		}
+	}
+	l.records = append(kept, newTokenRecord(claims))
+}
+
+// Query returns the records for email issued since the given time.
+func (l *MemoryTokenLog) Query(email string, since time.Time) ([]TokenRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var matches []TokenRecord
+	for _, record := range l.records {
+		// Like SQLiteTokenLog, which only keeps whole seconds
+		if record.Email == email && record.IssuedAt.Unix() >= since.Unix() {
+			matches = append(matches, record)
+		}
+	}
+	return matches, nil
+}
+
+// SQLiteTokenLog is a TokenLog which keeps records in a SQLite database, so
+// that they survive restarts and can be queried with other tools.
+type SQLiteTokenLog struct {
+	db        *sql.DB
+	retention time.Duration
+	clock     Clock
+}
+
+// tokenLogSchema creates the table of records, if it doesn't exist.
+const tokenLogSchema = `
+CREATE TABLE IF NOT EXISTS issued_tokens (
+	jti TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	sub TEXT NOT NULL,
+	aud TEXT NOT NULL,
+	iat INTEGER NOT NULL,
+	exp INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS issued_tokens_by_email ON issued_tokens (email, iat);
+`
+
+// newSQLiteTokenLog opens the SQLite database at path, creating it and its
+// table if needed, and deletes records once they were issued longer than
+// retention ago.
+func newSQLiteTokenLog(path string, retention time.Duration) (*SQLiteTokenLog, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(tokenLogSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteTokenLog{db: db, retention: retention, clock: realClock{}}, nil
+}
+
+// Record inserts a record of an id_token, and deletes any which have been
+// kept for long enough.
+func (l *SQLiteTokenLog) Record(claims IDToken) {
+	record := newTokenRecord(claims)
+
+	_, err := l.db.Exec(`INSERT INTO issued_tokens (jti, email, sub, aud, iat, exp) VALUES (?, ?, ?, ?, ?, ?)`,
+		record.JWTID, record.Email, record.Subject, record.Audience, record.IssuedAt.Unix(), record.Expiry.Unix())
+	if err != nil {
+		log.Printf("[tokens] Could not record id_token %s: %s", record.JWTID, err)
+		return
+	}
+
+	if _, err := l.db.Exec(`DELETE FROM issued_tokens WHERE iat < ?`, l.clock.Now().Add(-l.retention).Unix()); err != nil {
+		log.Printf("[tokens] Could not delete old records: %s", err)
+	}
+}
+
+// Query returns the records for email issued since the given time.
+func (l *SQLiteTokenLog) Query(email string, since time.Time) ([]TokenRecord, error) {
+	rows, err := l.db.Query(`SELECT jti, email, sub, aud, iat, exp FROM issued_tokens WHERE email = ? AND iat >= ? ORDER BY iat, rowid`,
+		email, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []TokenRecord
+	for rows.Next() {
+		var record TokenRecord
+		var iat, exp int64
+		if err := rows.Scan(&record.JWTID, &record.Email, &record.Subject, &record.Audience, &iat, &exp); err != nil {
+			return nil, err
+		}
+		record.IssuedAt, record.Expiry = time.Unix(iat, 0).UTC(), time.Unix(exp, 0).UTC()
+		matches = append(matches, record)
+	}
+	return matches, rows.Err()
+}
+
+// Close closes the database.
+func (l *SQLiteTokenLog) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testTokenLog checks that l keeps records of id_tokens and finds them by
+// email and time, with its clock at now.
+func testTokenLog(t *testing.T, l TokenLog, now time.Time) {
+	issue := func(jti string, email string, issued time.Time) {
+		l.Record(IDToken{
+			JWTID:    jti,
+			Email:    email,
+			Subject:  email,
+			Audience: "https://client.example",
+			IssuedAt: issued.Unix(),
+			Expiry:   issued.Add(TOKEN_LIFETIME).Unix(),
+		})
+	}
+
+	issue("old", "foo@example.com", now.Add(-2*time.Hour))
+	issue("recent", "foo@example.com", now.Add(-30*time.Minute))
+	issue("other", "bar@example.com", now.Add(-20*time.Minute))
+	issue("latest", "foo@example.com", now)
+
+	records, err := l.Query("foo@example.com", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || records[0].JWTID != "recent" || records[1].JWTID != "latest" {
+		t.Fatalf("querying the last hour for foo@example.com returned %+v", records)
+	}
+
+	expected := TokenRecord{
+		JWTID:    "latest",
+		Email:    "foo@example.com",
+		Subject:  "foo@example.com",
+		Audience: "https://client.example",
+		IssuedAt: time.Unix(now.Unix(), 0).UTC(),
+		Expiry:   time.Unix(now.Add(TOKEN_LIFETIME).Unix(), 0).UTC(),
+	}
+	if records[1] != expected {
+		t.Errorf("record is %+v instead of %+v", records[1], expected)
+	}
+
+	if records, err := l.Query("baz@example.com", now.Add(-time.Hour)); err != nil || len(records) != 0 {
+		t.Errorf("querying for an address without tokens returned %+v, %v", records, err)
+	}
+
+	// Records past the retention period are forgotten
+	if records, err := l.Query("foo@example.com", now.Add(-3*time.Hour)); err != nil || len(records) != 2 {
+		t.Errorf("querying past the retention period returned %+v, %v", records, err)
+	}
+}
+
+func TestMemoryTokenLog(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	l := newMemoryTokenLog(time.Hour)
+	l.clock = clock
+
+	testTokenLog(t, l, clock.Now())
+}
+
+func TestSQLiteTokenLog(t *testing.T) {
+	l, err := newSQLiteTokenLog(filepath.Join(t.TempDir(), "tokens.db"), time.Hour)
+	if err != nil {
+		t.Skipf("SQLite is not available: %s", err)
+	}
+	defer l.Close()
+
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	l.clock = clock
+
+	testTokenLog(t, l, clock.Now())
+}
+
+func TestCompleteRecordsTokens(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := newMemoryTokenLog(time.Hour)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	oidcAddRoutes(router, ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, Tokens: tokens}, newBypassAuthenticator())
+
+	start := time.Now()
+	if w := postForm(router, "/authorize", validAuthForm()); w.Code != 200 {
+		t.Fatalf("POST /authorize returned %d: %s", w.Code, w.Body.String())
+	}
+
+	records, err := tokens.Query("foo@example.com", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].JWTID == "" || records[0].Audience != "https://client.example" {
+		t.Errorf("issuing an id_token recorded %+v", records)
+	}
+}
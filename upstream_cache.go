@@ -0,0 +1,372 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/square/go-jose"
+)
+
+// FAILED_FETCH_TTL is how long a failure to fetch an upstream document is
+// remembered, so that a provider which is down, or a domain without one,
+// doesn't slow down every login.
+const FAILED_FETCH_TTL = 1 * time.Minute
+
+// documentCache fetches upstream discovery documents and JWK Sets, keeping
+// each for as long as its Cache-Control max-age allows, up to maxAge, or ttl
+// if it has none. Concurrent requests for a document which isn't cached share
+// a single fetch.
+//
+// As the urls come from the domains of email addresses, which anyone can make
+// up, at most max documents are kept. Once that many are, expired ones are
+// dropped, and then the least recently used.
+type documentCache struct {
+	client *http.Client
+	ttl    time.Duration
+	maxAge time.Duration
+	max    int
+	clock  Clock
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Of *cachedDocument, most recently used first
+	calls   map[string]*fetchCall
+}
+
+// cachedDocument is the result of fetching uri, until expires.
+type cachedDocument struct {
+	uri     string
+	body    []byte
+	err     error
+	expires time.Time
+}
+
+// fetchCall is a fetch in progress, which others may wait for.
+type fetchCall struct {
+	done    chan struct{}
+	waiters int // How many requests besides the first are waiting
+	body    []byte
+	err     error
+}
+
+// discoveryDocument holds the parts of an OpenID Connect discovery document
+// which we use.
+type discoveryDocument struct {
+	Issuer                 string   `json:"issuer"`
+	AuthorizationEndpoint  string   `json:"authorization_endpoint"`
+	JwksURI                string   `json:"jwks_uri"`
+	ResponseTypesSupported []string `json:"response_types_supported"`
+	ResponseModesSupported []string `json:"response_modes_supported"`
+}
+
+// newDocumentCache creates a documentCache which keeps documents without a
+// max-age for ttl, and none for longer than maxAge, holding at most max of
+// them. It fetches them with an upstreamClient.
+func newDocumentCache(ttl time.Duration, maxAge time.Duration, max int) *documentCache {
+	return &documentCache{
+		client:  upstreamClient(DISCOVERY_TIMEOUT),
+		ttl:     ttl,
+		maxAge:  maxAge,
+		max:     max,
+		clock:   realClock{},
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		calls:   map[string]*fetchCall{},
+	}
+}
+
+// fetchDiscovery returns the discovery document for issuer, as per
+// http://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfig.
+// The document must say it's for the same issuer.
+func (dc *documentCache) fetchDiscovery(ctx context.Context, issuer string) (*discoveryDocument, error) {
+	uri := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	body, err := dc.get(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var document discoveryDocument
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, fmt.Errorf("Could not parse the discovery document at %s: %s", uri, err)
+	}
+
+	if document.Issuer != issuer {
+		return nil, fmt.Errorf("The discovery document at %s is for %q, not %q", uri, document.Issuer, issuer)
+	}
+
+	return &document, nil
+}
+
+// fetchJWKS returns the JWK Set at uri.
+func (dc *documentCache) fetchJWKS(ctx context.Context, uri string) (*jose.JsonWebKeySet, error) {
+	body, err := dc.get(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys jose.JsonWebKeySet
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return nil, fmt.Errorf("Could not parse the keys at %s: %s", uri, err)
+	}
+
+	return &keys, nil
+}
+
+// forget removes uri from the cache, so that it's fetched anew next time, as
+// when a provider may have rotated its keys.
+func (dc *documentCache) forget(uri string) {
+	dc.mu.Lock()
+	if elem, ok := dc.entries[uri]; ok {
+		dc.remove(elem)
+	}
+	dc.mu.Unlock()
+}
+
+// get returns the body of uri, fetching it unless it's cached, or waiting for
+// another request's fetch of it to finish, until ctx is done. Fetches which
+// fail because ctx is done aren't cached, as that's no fault of uri's.
+func (dc *documentCache) get(ctx context.Context, uri string) ([]byte, error) {
+	dc.mu.Lock()
+	if elem, ok := dc.entries[uri]; ok {
+		entry := elem.Value.(*cachedDocument)
+		if dc.clock.Now().Before(entry.expires) {
+			dc.order.MoveToFront(elem)
+			dc.mu.Unlock()
+			return entry.body, entry.err
+		}
+		dc.remove(elem)
+	}
+
+	if call, ok := dc.calls[uri]; ok {
+		call.waiters++
+		dc.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.body, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	call := &fetchCall{done: make(chan struct{})}
+	dc.calls[uri] = call
+	dc.mu.Unlock()
+
+	body, ttl, err := dc.fetch(ctx, uri)
+	if err != nil {
+		ttl = FAILED_FETCH_TTL
+		if ctx.Err() != nil {
+			ttl = 0
+		}
+	}
+	if ttl > dc.maxAge {
+		ttl = dc.maxAge
+	}
+
+	dc.mu.Lock()
+	call.body, call.err = body, err
+	if ttl > 0 {
+		dc.put(&cachedDocument{uri, body, err, dc.clock.Now().Add(ttl)})
+	}
+	delete(dc.calls, uri)
+	dc.mu.Unlock()
+	close(call.done)
+
+	return body, err
+}
+
+// put caches entry, making room for it if the cache is full. The caller must
+// hold dc.mu.
+func (dc *documentCache) put(entry *cachedDocument) {
+	if dc.max <= 0 {
+		return
+	}
+
+	if elem, ok := dc.entries[entry.uri]; ok {
+		dc.remove(elem)
+	}
+	if len(dc.entries) >= dc.max {
+		dc.sweep(dc.clock.Now())
+	}
+	for len(dc.entries) >= dc.max {
+		dc.remove(dc.order.Back())
+	}
+
+	dc.entries[entry.uri] = dc.order.PushFront(entry)
+}
+
+// sweep forgets every document which has expired by now. The caller must hold
+// dc.mu.
+func (dc *documentCache) sweep(now time.Time) {
+	for elem := dc.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		if !now.Before(elem.Value.(*cachedDocument).expires) {
+			dc.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+// remove forgets a cached document. The caller must hold dc.mu.
+func (dc *documentCache) remove(elem *list.Element) {
+	dc.order.Remove(elem)
+	delete(dc.entries, elem.Value.(*cachedDocument).uri)
+}
+
+// Len returns the number of documents cached, including any which have
+// expired but haven't been swept.
+func (dc *documentCache) Len() int {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	return len(dc.entries)
+}
+
+// fetch requests uri, returning its body and how long it may be cached for.
+func (dc *documentCache) fetch(ctx context.Context, uri string) ([]byte, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not fetch %s: %s", uri, err)
+	}
+
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not fetch %s: %s", uri, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("Could not fetch %s: HTTP %d", uri, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDiscoveryBytes))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not fetch %s: %s", uri, err)
+	}
+
+	return body, cacheLifetime(resp.Header.Get("Cache-Control"), dc.ttl), nil
+}
+
+// cacheLifetime returns how long a response may be cached for, going by its
+// Cache-Control header, or fallback if that doesn't say.
+func cacheLifetime(cacheControl string, fallback time.Duration) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return fallback
+}
+
+// upstreamClient creates an http.Client for fetching upstream documents, whose
+// urls may come from the domains of email addresses anyone can make up. So
+// that nobody can have us probe our own network, it only connects to public
+// addresses, bypassing any proxy, and doesn't follow redirects to other hosts.
+func upstreamClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: dialPublicOnly}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     transport,
+		CheckRedirect: sameHostRedirects,
+	}
+}
+
+// dialPublicOnly is a net.Dialer Control function which refuses connections
+// to any address publicIP doesn't allow. It's called with the address a
+// hostname resolved to, so names which point inwards are caught too.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !publicIP(ip) {
+		return fmt.Errorf("Refusing to connect to %s, which is not a public address", host)
+	}
+	return nil
+}
+
+// nonPublicPrefixes are the address ranges which publicIP refuses: those the
+// IANA special-purpose address registries don't list as globally reachable,
+// and those which embed an IPv4 address, which might be any of the others.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // This network
+	netip.MustParsePrefix("10.0.0.0/8"),      // Private
+	netip.MustParsePrefix("100.64.0.0/10"),   // Carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // Loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // Link-local
+	netip.MustParsePrefix("172.16.0.0/12"),   // Private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // Documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // Private
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // Documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // Documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // Multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved, and broadcast
+	netip.MustParsePrefix("::/96"),           // Unspecified, loopback, and IPv4-compatible
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // Local NAT64
+	netip.MustParsePrefix("100::/64"),        // Discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, including Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // Unique local
+	netip.MustParsePrefix("fe80::/10"),       // Link-local
+	netip.MustParsePrefix("fec0::/10"),       // Site-local
+	netip.MustParsePrefix("ff00::/8"),        // Multicast
+}
+
+// publicIP reports whether ip is reachable across the internet, rather than
+// only on this host or its network, or not at all. IPv4-mapped addresses are
+// judged by the IPv4 address they map, and zones are ignored, as prefixes
+// never contain addresses with one.
+func publicIP(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return ip.IsValid()
+}
+
+// sameHostRedirects is an http.Client CheckRedirect function which only
+// follows redirects within the scheme and host first requested.
+func sameHostRedirects(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("Stopped after 10 redirects")
+	}
+
+	first := via[0].URL
+	if req.URL.Scheme != first.Scheme || !strings.EqualFold(req.URL.Host, first.Host) {
+		return fmt.Errorf("Refusing to follow a redirect from %s to %s", first.Host, req.URL.Host)
+	}
+	return nil
+}
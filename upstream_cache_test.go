@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDocumentCache creates a documentCache whose clock only moves when
+// the returned function is called, along with a server whose handler counts
+// each request it serves.
+func newTestDocumentCache(t *testing.T, handler http.HandlerFunc) (*documentCache, *httptest.Server, *int32, func(time.Duration)) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	docs := newDocumentCache(time.Hour, UPSTREAM_MAX_AGE, DISCOVERY_CACHE_SIZE)
+	docs.client = server.Client()
+	docs.clock = clock
+
+	return docs, server, &hits, clock.Advance
+}
+
+func TestDocumentCacheTTL(t *testing.T) {
+	docs, server, hits, advance := newTestDocumentCache(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys": []}`))
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := docs.fetchJWKS(context.Background(), server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(hits); n != 1 {
+		t.Errorf("fetched a cached document %d times instead of once", n)
+	}
+
+	advance(time.Hour + time.Second)
+	if _, err := docs.fetchJWKS(context.Background(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(hits); n != 2 {
+		t.Errorf("fetched an expired document %d times instead of twice", n)
+	}
+}
+
+func TestDocumentCacheControl(t *testing.T) {
+	tests := []struct {
+		header  string
+		after   time.Duration // How long until checking again
+		fetches int32         // How many times the document is then fetched
+	}{
+		{"max-age=60", 59 * time.Second, 1},
+		{"max-age=60", 61 * time.Second, 2},
+		{"public, max-age=7200", 90 * time.Minute, 1},
+		{"no-store", 0, 2},
+		{"no-cache", 0, 2},
+		{"max-age=0", 0, 2},
+		{"max-age=bogus", 59 * time.Minute, 1},
+		{"", 61 * time.Minute, 2},
+		{"max-age=31536000", UPSTREAM_MAX_AGE + time.Second, 2},
+	}
+
+	for _, test := range tests {
+		docs, server, hits, advance := newTestDocumentCache(t, func(w http.ResponseWriter, r *http.Request) {
+			if test.header != "" {
+				w.Header().Set("Cache-Control", test.header)
+			}
+			w.Write([]byte(`{"keys": []}`))
+		})
+
+		docs.fetchJWKS(context.Background(), server.URL)
+		advance(test.after)
+		docs.fetchJWKS(context.Background(), server.URL)
+
+		if n := atomic.LoadInt32(hits); n != test.fetches {
+			t.Errorf("with Cache-Control %q, fetched the document %d times in %s instead of %d", test.header, n, test.after, test.fetches)
+		}
+	}
+}
+
+func TestDocumentCacheSize(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/short" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte(`{"keys": []}`))
+	}
+	docs, server, hits, advance := newTestDocumentCache(t, handler)
+	docs.max = 2
+
+	fetch := func(path string) {
+		if _, err := docs.fetchJWKS(context.Background(), server.URL+path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The least recently used document makes way for a new one
+	fetch("/a")
+	fetch("/b")
+	fetch("/a")
+	fetch("/c")
+	if n := docs.Len(); n != 2 {
+		t.Errorf("a cache of 2 documents holds %d", n)
+	}
+	fetch("/a")
+	if n := atomic.LoadInt32(hits); n != 3 {
+		t.Errorf("fetched documents %d times instead of 3, as /a should have stayed cached", n)
+	}
+	fetch("/b")
+	if n := atomic.LoadInt32(hits); n != 4 {
+		t.Errorf("fetched documents %d times instead of 4, as /b should have been evicted", n)
+	}
+
+	// Unless there are expired ones, which go first, however recently used
+	docs, server, hits, advance = newTestDocumentCache(t, handler)
+	docs.max = 2
+	fetch("/a")
+	fetch("/short")
+	advance(time.Minute)
+	fetch("/c")
+	fetch("/a")
+	if n := atomic.LoadInt32(hits); n != 3 {
+		t.Errorf("fetched documents %d times instead of 3, as /a should have outlasted /short", n)
+	}
+}
+
+func TestDocumentCacheCoalesces(t *testing.T) {
+	release := make(chan struct{})
+	docs, server, hits, _ := newTestDocumentCache(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"keys": []}`))
+	})
+
+	const concurrency = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := docs.fetchJWKS(context.Background(), server.URL)
+			errs <- err
+		}()
+	}
+
+	// Wait for every request to join the first one's fetch
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		docs.mu.Lock()
+		call := docs.calls[server.URL]
+		joined := call != nil && call.waiters == concurrency-1
+		docs.mu.Unlock()
+
+		if joined {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("concurrent requests did not wait for the same fetch")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := atomic.LoadInt32(hits); n != 1 {
+		t.Errorf("%d concurrent requests fetched the document %d times instead of once", concurrency, n)
+	}
+}
+
+func TestDocumentCacheFailures(t *testing.T) {
+	docs, server, hits, advance := newTestDocumentCache(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := docs.fetchJWKS(context.Background(), server.URL); err == nil || !strings.Contains(err.Error(), "503") {
+			t.Errorf("fetching a broken document returned error %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(hits); n != 1 {
+		t.Errorf("fetched a broken document %d times instead of once", n)
+	}
+
+	// But not for as long as documents
+	advance(FAILED_FETCH_TTL + time.Second)
+	docs.fetchJWKS(context.Background(), server.URL)
+	if n := atomic.LoadInt32(hits); n != 2 {
+		t.Errorf("fetched a broken document %d times after FAILED_FETCH_TTL instead of twice", n)
+	}
+}
+
+func TestFetchDiscovery(t *testing.T) {
+	var issuer string
+	docs, server, _, _ := newTestDocumentCache(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"issuer": "` + issuer + `", "jwks_uri": "https://upstream.example/certs"}`))
+	})
+
+	issuer = server.URL
+	document, err := docs.fetchDiscovery(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.JwksURI != "https://upstream.example/certs" {
+		t.Errorf("fetchDiscovery returned jwks_uri %q", document.JwksURI)
+	}
+
+	// The document must be for the issuer it's fetched for
+	docs = newDocumentCache(time.Hour, UPSTREAM_MAX_AGE, DISCOVERY_CACHE_SIZE)
+	docs.client = server.Client()
+	issuer = "https://evil.example"
+	if _, err := docs.fetchDiscovery(context.Background(), server.URL); err == nil {
+		t.Error("fetchDiscovery accepted a document for another issuer")
+	}
+}
+
+func TestUpstreamClientPublicOnly(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(`{"keys": []}`))
+	}))
+	t.Cleanup(server.Close)
+
+	// The test server is on loopback, like anything else on this host
+	docs := newDocumentCache(time.Hour, UPSTREAM_MAX_AGE, DISCOVERY_CACHE_SIZE)
+	if _, err := docs.fetchJWKS(context.Background(), server.URL); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("fetching from a loopback address returned error %v", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("fetching from a loopback address reached the server %d times", n)
+	}
+
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:443", false},
+		{"[::1]:443", false},
+		{"10.0.0.1:443", false},
+		{"172.16.0.1:443", false},
+		{"192.168.1.1:443", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:443", false},
+		{"[fd00::1]:443", false},
+		{"0.0.0.0:443", false},
+		{"[::ffff:127.0.0.1]:443", false},
+		{"[fe80::1%eth0]:443", false},
+		{"100.64.0.1:443", false},
+		{"100.127.255.254:443", false},
+		{"100.128.0.1:443", true},
+		{"0.1.2.3:443", false},
+		{"192.0.0.8:443", false},
+		{"192.0.2.1:443", false},
+		{"198.18.0.1:443", false},
+		{"198.19.255.254:443", false},
+		{"198.20.0.1:443", true},
+		{"240.0.0.1:443", false},
+		{"255.255.255.255:443", false},
+		{"[64:ff9b::7f00:1]:443", false},
+		{"[64:ff9b::5db8:d822]:443", false},
+		{"[2002:7f00:1::1]:443", false},
+		{"[2001:0:4136:e378:8000:63bf:3fff:fdd2]:443", false},
+		{"[::127.0.0.1]:443", false},
+		{"[ff02::1]:443", false},
+		{"bogus:443", false},
+	}
+
+	for _, test := range tests {
+		if err := dialPublicOnly("tcp", test.address, nil); (err == nil) != test.public {
+			t.Errorf("dialPublicOnly(%q) returned %v", test.address, err)
+		}
+	}
+}
+
+func TestSameHostRedirects(t *testing.T) {
+	first := httptest.NewRequest("GET", "https://upstream.example/.well-known/openid-configuration", nil)
+
+	tests := []struct {
+		target string
+		ok     bool
+	}{
+		{"https://upstream.example/other", true},
+		{"https://UPSTREAM.example/other", true},
+		{"https://evil.example/other", false},
+		{"http://upstream.example/other", false},
+		{"https://upstream.example:8443/other", false},
+		{"https://127.0.0.1/other", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.target, nil)
+		if err := sameHostRedirects(req, []*http.Request{first}); (err == nil) != test.ok {
+			t.Errorf("sameHostRedirects to %s returned %v", test.target, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userInfo is the response to a UserInfo request, as per
+// http://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse.
+type userInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+}
+
+// userinfo creates a handler for UserInfo requests. As we only issue
+// id_tokens, they serve as the access token, sent as a Bearer token as per
+// RFC 6750, and the claims returned are the ones the id_token already has.
+//
+// Tokens which are malformed, forged, expired, or revoked are all rejected
+// with a 401 and the invalid_token error, as RFC 6750 Section 3.1 says.
+// Requests without a token get a 401 with no error code at all, as they may
+// just not have known authentication was needed.
+func userinfo(p ProviderConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c.Request)
+		if !ok {
+			c.Header("WWW-Authenticate", `Bearer realm="`+p.Origin+`"`)
+			oauthError(c, 401, "", "missing_token", "A Bearer token is required")
+			return
+		}
+
+		claims, err := parseIDToken(p, token)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="`+p.Origin+`", error="invalid_token"`)
+			oauthError(c, 401, "invalid_token", "invalid_token", err.Error())
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(200, userInfo{
+			Subject:       claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: claims.EmailVerified,
+		})
+	}
+}
+
+// bearerToken returns the token from a request's Authorization header, if it
+// uses the Bearer scheme, which is case-insensitive.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
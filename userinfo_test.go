@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newUserInfoTestRouter(t *testing.T) (*gin.Engine, ProviderConfig) {
+	return newTestProvider(t, ProviderConfig{UserInfo: true})
+}
+
+// requestUserInfo asks router for the claims of token with method, sending it
+// as a Bearer token unless it's empty.
+func requestUserInfo(router *gin.Engine, method string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/userinfo", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestUserInfo(t *testing.T) {
+	router, p := newUserInfoTestRouter(t)
+
+	token, err := mintIDToken(p, AuthRequest{ClientID: "https://client.example", Scope: "openid email"}, "foo@example.com", AMR_EMAIL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{"GET", "POST"} {
+		w := requestUserInfo(router, method, token)
+		if w.Code != 200 {
+			t.Fatalf("%s /userinfo returned %d: %s", method, w.Code, w.Body.String())
+		}
+
+		var response userInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		if response != (userInfo{Subject: "foo@example.com", Email: "foo@example.com", EmailVerified: true}) {
+			t.Errorf("%s /userinfo for a valid token returned %+v", method, response)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("%s /userinfo returned Cache-Control %q instead of no-store", method, cc)
+		}
+	}
+}
+
+func TestUserInfoRejects(t *testing.T) {
+	router, p := newUserInfoTestRouter(t)
+
+	expired, err := signToken(p.Key, newIDToken(p, AuthRequest{ClientID: "https://client.example"}, "foo@example.com", AMR_EMAIL, time.Now().Add(-time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		token       string
+		challenge   string // The WWW-Authenticate header expected
+		error       string // The error member expected, if any
+	}{
+		{"no token", "", `Bearer realm="issuer.example"`, ""},
+		{"an expired token", expired, `Bearer realm="issuer.example", error="invalid_token"`, "invalid_token"},
+		{"a malformed token", "bogus", `Bearer realm="issuer.example", error="invalid_token"`, "invalid_token"},
+	}
+
+	for _, test := range tests {
+		w := requestUserInfo(router, "GET", test.token)
+		if w.Code != 401 {
+			t.Errorf("GET /userinfo with %s returned %d instead of 401", test.description, w.Code)
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); challenge != test.challenge {
+			t.Errorf("GET /userinfo with %s returned WWW-Authenticate %q instead of %q", test.description, challenge, test.challenge)
+		}
+
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] != test.error || body["error_description"] == "" {
+			t.Errorf("GET /userinfo with %s returned %s instead of the error %q", test.description, w.Body.String(), test.error)
+		}
+	}
+
+	// Browsers get the same JSON as other clients
+	req := httptest.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("GET /userinfo from a browser returned Content-Type %q instead of JSON", w.Header().Get("Content-Type"))
+	}
+
+	// Only the Bearer scheme is accepted
+	req = httptest.NewRequest("GET", "/userinfo", nil)
+	req.SetBasicAuth("foo", "bar")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Errorf("GET /userinfo with Basic credentials returned %d instead of 401", w.Code)
+	}
+}
+
+func TestUserInfoDiscovery(t *testing.T) {
+	_, p := newUserInfoTestRouter(t)
+
+	for _, enabled := range []bool{false, true} {
+		p.UserInfo = enabled
+		router, _ := newTestProvider(t, p)
+
+		w := get(router, "/.well-known/openid-configuration")
+		advertised := strings.Contains(w.Body.String(), `"userinfo_endpoint":"https://issuer.example/userinfo"`)
+		if advertised != enabled {
+			t.Errorf("with UserInfo %t, the discovery document is %s", enabled, w.Body.String())
+		}
+
+		if served := get(router, "/userinfo").Code != 404; served != enabled {
+			t.Errorf("with UserInfo %t, GET /userinfo was served: %t", enabled, served)
+		}
+	}
+}
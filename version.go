@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Set at build time, like:
+//
+//	go build -ldflags "-X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	gitCommit string
+	buildDate string
+)
+
+// BuildInfo describes which version of the daemon is running.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Repo      string `json:"repo"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// buildInfo returns the version and build details. Without ldflags, the
+// commit and date come from the VCS information Go embeds in binaries, if
+// any, and are otherwise "unknown".
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   VERSION,
+		Repo:      REPO,
+		Commit:    gitCommit,
+		BuildDate: buildDate,
+	}
+
+	if embedded, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range embedded.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+
+	return info
+}
+
+// String formats the BuildInfo for the -version flag.
+func (info BuildInfo) String() string {
+	return fmt.Sprintf("authdaemon %s (commit %s, built %s)\n%s", info.Version, info.Commit, info.BuildDate, info.Repo)
+}
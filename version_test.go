@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBuildInfo(t *testing.T) {
+	info := buildInfo()
+
+	if info.Version != VERSION || info.Repo != REPO {
+		t.Errorf("buildInfo returned version %q and repo %q", info.Version, info.Repo)
+	}
+
+	// Tests are built without ldflags, but the fields are never empty
+	if info.Commit == "" || info.BuildDate == "" {
+		t.Errorf("buildInfo has empty fields: %+v", info)
+	}
+
+	if s := info.String(); !strings.Contains(s, VERSION) || !strings.Contains(s, REPO) {
+		t.Errorf("BuildInfo.String() returned %q", s)
+	}
+}
+
+func TestBuildInfoLdflags(t *testing.T) {
+	defer func(commit, date string) { gitCommit, buildDate = commit, date }(gitCommit, buildDate)
+	gitCommit, buildDate = "abc123", "2017-01-01T00:00:00Z"
+
+	if info := buildInfo(); info.Commit != "abc123" || info.BuildDate != "2017-01-01T00:00:00Z" {
+		t.Errorf("buildInfo ignores values set by ldflags: %+v", info)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	router := gin.New()
+	opsAddRoutes(router)
+
+	w := get(router, "/version")
+	if w.Code != 200 {
+		t.Fatalf("GET /version returned %d", w.Code)
+	}
+
+	var body BuildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("GET /version returned invalid JSON: %s", err)
+	}
+
+	if body != buildInfo() {
+		t.Errorf("GET /version returned %+v instead of %+v", body, buildInfo())
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/callahad/authdaemon/internal/validation"
+	"github.com/gin-gonic/gin"
+)
+
+// webfingerPath is where WebFinger requests are answered. Unlike our other
+// endpoints, it's at the root of the host, as RFC 7033 requires.
+const webfingerPath = "/.well-known/webfinger"
+
+// issuerRel is the WebFinger link relation for a user's OpenID Connect
+// issuer, as per
+// http://openid.net/specs/openid-connect-discovery-1_0.html#IssuerDiscovery.
+const issuerRel = "http://openid.net/specs/connect/1.0/issuer"
+
+// ErrNoIssuer is returned by resolveIssuer for email addresses which can't
+// log in here at all.
+var ErrNoIssuer = errors.New("No issuer handles this email address")
+
+// resolveIssuer returns the issuer which would verify the user with email:
+// ours, unless the first of auths to accept them delegates to another
+// provider, whose issuer it is instead. Like authorize, it gives up once ctx
+// is done, as delegates may have to fetch discovery documents.
+func resolveIssuer(ctx context.Context, p ProviderConfig, auths []Authenticator, email string) (string, error) {
+	if !validation.ValidEmail(email) || !p.domainAllowed(email) {
+		return "", ErrNoIssuer
+	}
+
+	for _, auth := range auths {
+		if !auth.Accepts(ctx, email) {
+			continue
+		}
+		if delegate, ok := auth.(interface {
+			IssuerFor(ctx context.Context, email string) (string, error)
+		}); ok {
+			return delegate.IssuerFor(ctx, email)
+		}
+		return p.issuer(), nil
+	}
+
+	return "", ErrNoIssuer
+}
+
+// webfingerLink is a link in a WebFinger response.
+type webfingerLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+// webfingerResponse is a JSON Resource Descriptor, as per
+// https://tools.ietf.org/html/rfc7033#section-4.4.
+type webfingerResponse struct {
+	Subject string          `json:"subject"`
+	Links   []webfingerLink `json:"links"`
+}
+
+// webfinger creates a handler for WebFinger requests, as per RFC 7033, which
+// tell clients the issuer of a resource like acct:foo@example.com, so that
+// they know where to send the user to log in.
+//
+// Resources may also be bare email addresses, which are normalized like
+// login_hints. Those which can't log in here are not found. If the request
+// asks only for other rels, the response has no links, as the RFC requires.
+//
+// Each client address may only look up issuers as often as p.Limiter allows.
+func webfinger(p ProviderConfig, auths []Authenticator) func(*gin.Context) {
+	return func(c *gin.Context) {
+		resource := c.Query("resource")
+		if resource == "" {
+			webfingerError(c, 400, "invalid_request", "resource is required")
+			return
+		}
+
+		email, err := validation.NormalizeEmail(strings.TrimPrefix(resource, "acct:"))
+		if err != nil {
+			webfingerError(c, 404, "not_found", ErrNoIssuer.Error())
+			return
+		}
+		if p.LowercaseEmails {
+			email = strings.ToLower(email)
+		}
+
+		// Resolving may fetch the discovery document of any domain the
+		// request names, so it's rate limited, and given no longer than
+		// starting a login would be
+		if !p.Limiter.Allow("webfinger:" + clientIP(c)) {
+			c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(p.Limiter.RetryAfter().Seconds()))))
+			webfingerError(c, 429, "rate_limited", "Too many lookups, please try again later")
+			return
+		}
+
+		ctx := c.Request.Context()
+		if p.LoginTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.LoginTimeout)
+			defer cancel()
+		}
+
+		issuer, err := resolveIssuer(ctx, p, auths, email)
+		if err != nil {
+			webfingerError(c, 404, "not_found", err.Error())
+			return
+		}
+
+		response := webfingerResponse{Subject: resource, Links: []webfingerLink{}}
+		if rels := c.QueryArray("rel"); len(rels) == 0 || contains(rels, issuerRel) {
+			response.Links = append(response.Links, webfingerLink{issuerRel, issuer})
+		}
+
+		body, err := json.Marshal(response)
+		if err != nil {
+			webfingerError(c, 500, "server_error", err.Error())
+			return
+		}
+		c.Data(200, "application/jrd+json", body)
+	}
+}
+
+// webfingerError responds with a JSON error whatever the request accepts, as
+// WebFinger is for programs rather than browsers. RFC 7033 doesn't say what
+// errors look like, so they take OAuth's shape, with an error code like
+// not_found and an error_description.
+func webfingerError(c *gin.Context, status int, code string, errMsg string) {
+	c.JSON(status, gin.H{"error": code, "error_description": errMsg})
+}
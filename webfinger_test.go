@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResolveIssuer(t *testing.T) {
+	u := newFakeUpstream(t)
+	g := newGoogleDelegate("https://issuer.example", "our-client-id", newMemorySessionStore(SESSION_LIFETIME), newDocumentCache(DISCOVERY_TTL, UPSTREAM_MAX_AGE, DISCOVERY_CACHE_SIZE), []string{ALG_RS256})
+	auths := []Authenticator{g, u.Delegate, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME))}
+	p := ProviderConfig{Origin: "issuer.example", BlockedDomains: []string{"blocked.example"}}
+
+	tests := []struct {
+		email    string
+		expected string // Or empty if there's no issuer
+	}{
+		{"foo@example.com", "https://issuer.example"},
+		{"foo@gmail.com", "https://accounts.google.com"},
+		{"foo@upstream.example", u.server.URL + "/upstream.example"},
+		{"foo@blocked.example", ""},
+		{"not an email", ""},
+	}
+
+	for _, test := range tests {
+		issuer, err := resolveIssuer(context.Background(), p, auths, test.email)
+		if test.expected == "" {
+			if err != ErrNoIssuer {
+				t.Errorf("resolveIssuer(%q) returned (%q, %v) instead of ErrNoIssuer", test.email, issuer, err)
+			}
+		} else if err != nil || issuer != test.expected {
+			t.Errorf("resolveIssuer(%q) returned (%q, %v) instead of %s", test.email, issuer, err, test.expected)
+		}
+	}
+}
+
+func TestWebFinger(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGoogleDelegate("https://issuer.example/oidc", "our-client-id", newMemorySessionStore(SESSION_LIFETIME), newDocumentCache(DISCOVERY_TTL, UPSTREAM_MAX_AGE, DISCOVERY_CACHE_SIZE), []string{ALG_RS256})
+	email := newEmailAuthenticator("https://issuer.example/oidc", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME))
+	p := ProviderConfig{Origin: "issuer.example", BasePath: "/oidc", Key: key, Lifetime: TOKEN_LIFETIME, WebFinger: true, BlockedDomains: []string{"blocked.example"}}
+	router := gin.New()
+	oidcAddRoutes(router, p, g, email)
+
+	query := func(params url.Values) (int, webfingerResponse) {
+		w := get(router, "/.well-known/webfinger?"+params.Encode())
+		var response webfingerResponse
+		if w.Code == 200 {
+			if ct := w.Header().Get("Content-Type"); ct != "application/jrd+json" {
+				t.Errorf("WebFinger response has Content-Type %q", ct)
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, response
+	}
+
+	tests := []struct {
+		resource string
+		issuer   string
+	}{
+		{"acct:foo@example.com", "https://issuer.example/oidc"},
+		{"foo@EXAMPLE.com", "https://issuer.example/oidc"},
+		{"acct:foo@gmail.com", "https://accounts.google.com"},
+	}
+	for _, test := range tests {
+		code, response := query(url.Values{"resource": {test.resource}})
+		if code != 200 || response.Subject != test.resource || len(response.Links) != 1 || response.Links[0] != (webfingerLink{issuerRel, test.issuer}) {
+			t.Errorf("WebFinger for %s returned %d: %+v", test.resource, code, response)
+		}
+	}
+
+	// Asking for the issuer rel gets it, and asking only for others doesn't
+	if _, response := query(url.Values{"resource": {"acct:foo@example.com"}, "rel": {"http://webfinger.net/rel/avatar", issuerRel}}); len(response.Links) != 1 {
+		t.Errorf("WebFinger for the issuer rel returned links %+v", response.Links)
+	}
+	if code, response := query(url.Values{"resource": {"acct:foo@example.com"}, "rel": {"http://webfinger.net/rel/avatar"}}); code != 200 || len(response.Links) != 0 {
+		t.Errorf("WebFinger for another rel returned %d with links %+v", code, response.Links)
+	}
+
+	// Errors are JSON, even for browsers
+	failed := func(params url.Values) (int, map[string]string) {
+		req := httptest.NewRequest("GET", "/.well-known/webfinger?"+params.Encode(), nil)
+		req.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("WebFinger for %s returned %d with a body which isn't JSON: %s", params.Encode(), w.Code, w.Body.String())
+		}
+		return w.Code, body
+	}
+
+	for _, resource := range []string{"acct:foo@blocked.example", "acct:bogus", "https://example.com/"} {
+		if code, body := failed(url.Values{"resource": {resource}}); code != 404 || body["error"] != "not_found" {
+			t.Errorf("WebFinger for %s returned %d with %v instead of 404 not_found", resource, code, body)
+		}
+	}
+	if code, body := failed(url.Values{}); code != 400 || body["error"] != "invalid_request" {
+		t.Errorf("WebFinger without a resource returned %d with %v instead of 400 invalid_request", code, body)
+	}
+
+	// It's only served if enabled
+	p.WebFinger = false
+	disabled := gin.New()
+	oidcAddRoutes(disabled, p, email)
+	if w := get(disabled, "/.well-known/webfinger?resource=acct:foo@example.com"); w.Code != 404 {
+		t.Errorf("WebFinger returned %d while disabled", w.Code)
+	}
+}
+
+func TestWebFingerRateLimit(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ProviderConfig{Origin: "issuer.example", Key: key, Lifetime: TOKEN_LIFETIME, WebFinger: true, Limiter: newRateLimiter(time.Hour, 1)}
+	router := gin.New()
+	oidcAddRoutes(router, p, newEmailAuthenticator("https://issuer.example", &fakeMailer{}, newMemorySessionStore(SESSION_LIFETIME)))
+
+	// Lookups are limited per client, whichever domains they're for
+	if w := get(router, "/.well-known/webfinger?resource=acct:foo@example.com"); w.Code != 200 {
+		t.Fatalf("the first WebFinger lookup returned %d: %s", w.Code, w.Body.String())
+	}
+	w := get(router, "/.well-known/webfinger?resource=acct:foo@other.example")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "3600" || !strings.Contains(w.Body.String(), `"error":"rate_limited"`) {
+		t.Errorf("a WebFinger lookup over the limit returned %d with Retry-After %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+}